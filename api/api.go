@@ -0,0 +1,126 @@
+// Package api is the versioned JSON API for machine clients, served under /api/v1. Every route is described once,
+// in routes, which both registers it and generates the OpenAPI document, so the two can't drift apart.
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+)
+
+// Config is what the API needs from the app
+type Config struct {
+	ExternalURL string
+	// Auth is middleware that aborts with an Error unless the request's API key has scope
+	Auth func(scope string) gin.HandlerFunc
+}
+
+var config Config
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          "invalid_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusTooManyRequests:     "rate_limited",
+	http.StatusInternalServerError: "internal_error",
+}
+
+// Abort ends the request with an error object
+func Abort(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, ErrorResponse{Error: Error{
+		Status:  status,
+		Code:    errorCodes[status],
+		Message: message,
+	}})
+}
+
+// serverError logs err and ends the request without showing it to the client
+func serverError(c *gin.Context, err error) {
+	log.Errorf("api %v: %+v", c.Request.URL.Path, err)
+	Abort(c, http.StatusInternalServerError, "Something went wrong on our end")
+}
+
+// Page is one page of a list. Pass next_cursor back as cursor for the next page, there isn't one after the last.
+type Page struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// Single wraps a single resource, so every response has its data in the same place
+type Single struct {
+	Data interface{} `json:"data"`
+}
+
+// page is which part of a list the request asks for
+type page struct {
+	start int
+	limit int
+}
+
+// pageParams reads limit and cursor, before anything's fetched
+func pageParams(c *gin.Context) (page, bool) {
+	p := page{limit: defaultLimit}
+	if v := c.Query("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxLimit {
+			Abort(c, http.StatusBadRequest, "limit must be a number from 1 to "+strconv.Itoa(maxLimit))
+			return p, false
+		}
+		p.limit = l
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err == nil {
+			p.start, err = strconv.Atoi(strings.TrimPrefix(string(b), "o:"))
+		}
+		if err != nil || p.start < 0 {
+			Abort(c, http.StatusBadRequest, "cursor isn't one we gave out")
+			return p, false
+		}
+	}
+	return p, true
+}
+
+// slice is where the page starts and ends in a list of n, and the cursor for the page after if there is one
+func (p page) slice(n int) (start, end int, next string) {
+	start = p.start
+	if start > n {
+		start = n
+	}
+	end = start + p.limit
+	if end >= n {
+		end = n
+	} else {
+		next = base64.RawURLEncoding.EncodeToString([]byte("o:" + strconv.Itoa(end)))
+	}
+	return start, end, next
+}
+
+// Register adds the API's routes to g, and the OpenAPI document at openapi.json
+func Register(g *gin.RouterGroup, cfg Config) {
+	config = cfg
+
+	for _, r := range routes {
+		handlers := []gin.HandlerFunc{}
+		if r.Scope != "" {
+			handlers = append(handlers, cfg.Auth(r.Scope))
+		}
+		g.Handle(r.Method, r.Path, append(handlers, r.Handler)...)
+	}
+
+	doc := OpenAPI(cfg.ExternalURL + g.BasePath())
+	g.GET("/openapi.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, doc)
+	})
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testContext(url string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, url, nil)
+	return c, w
+}
+
+func TestPageParams(t *testing.T) {
+	cursor := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		query string
+		start int
+		limit int
+		ok    bool
+	}{
+		{"", 0, defaultLimit, true},
+		{"limit=10", 0, 10, true},
+		{"limit=200", 0, 200, true},
+		{"limit=201", 0, 0, false},
+		{"limit=0", 0, 0, false},
+		{"limit=ten", 0, 0, false},
+		{"cursor=" + cursor("o:100"), 100, defaultLimit, true},
+		{"cursor=" + cursor("o:-1"), 0, 0, false},
+		{"cursor=" + cursor("100"), 100, defaultLimit, true},
+		{"cursor=" + cursor("o:x"), 0, 0, false},
+		{"cursor=not!base64", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			c, w := testContext("/attendees?" + tt.query)
+			p, ok := pageParams(c)
+			if ok != tt.ok {
+				t.Fatalf("pageParams() ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want 400", w.Code)
+				}
+				return
+			}
+			if p.start != tt.start || p.limit != tt.limit {
+				t.Errorf("pageParams() = %+v, want start %d limit %d", p, tt.start, tt.limit)
+			}
+		})
+	}
+}
+
+func TestSlice(t *testing.T) {
+	tests := []struct {
+		name       string
+		p          page
+		n          int
+		start, end int
+		more       bool
+	}{
+		{"first page", page{0, 2}, 5, 0, 2, true},
+		{"middle page", page{2, 2}, 5, 2, 4, true},
+		{"last page", page{4, 2}, 5, 4, 5, false},
+		{"exactly the rest", page{3, 2}, 5, 3, 5, false},
+		{"past the end", page{9, 2}, 5, 5, 5, false},
+		{"empty list", page{0, 50}, 0, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, next := tt.p.slice(tt.n)
+			if start != tt.start || end != tt.end || (next != "") != tt.more {
+				t.Fatalf("slice() = %d, %d, %q, want %d, %d, more %v", start, end, next, tt.start, tt.end, tt.more)
+			}
+			if next == "" {
+				return
+			}
+
+			// the cursor picks up where this page ended
+			c, _ := testContext("/attendees?cursor=" + next)
+			p, ok := pageParams(c)
+			if !ok || p.start != end {
+				t.Errorf("next page starts at %d, want %d", p.start, end)
+			}
+		})
+	}
+}
+
+func TestAbort(t *testing.T) {
+	for status, code := range errorCodes {
+		c, w := testContext("/")
+		Abort(c, status, "message")
+		if w.Code != status {
+			t.Errorf("status = %d, want %d", w.Code, status)
+		}
+		want := `{"error":{"status":` + strconv.Itoa(status) + `,"code":"` + code + `","message":"message"}}`
+		if w.Body.String() != want {
+			t.Errorf("body = %s, want %s", w.Body, want)
+		}
+	}
+
+	if errorCodes[http.StatusTooManyRequests] != "rate_limited" {
+		t.Errorf("429 has code %q", errorCodes[http.StatusTooManyRequests])
+	}
+}
+
+// every route's documented errors have codes, and the 429 says when to retry
+func TestOpenAPIErrors(t *testing.T) {
+	doc := OpenAPI("https://my.vibe.camp/api/v1")
+	for path, ops := range doc["paths"].(object) {
+		for method, op := range ops.(object) {
+			responses := op.(object)["responses"].(object)
+			rateLimited, ok := responses["429"].(object)
+			if !ok {
+				t.Errorf("%s %s doesn't document 429", method, path)
+				continue
+			}
+			if _, ok := rateLimited["headers"].(object)["Retry-After"]; !ok {
+				t.Errorf("%s %s 429 doesn't document Retry-After", method, path)
+			}
+
+			for status := range responses {
+				if status == "200" {
+					continue
+				}
+				n, _ := strconv.Atoi(status)
+				if errorCodes[n] == "" {
+					t.Errorf("%s %s documents %s, which has no error code", method, path, status)
+				}
+			}
+		}
+	}
+}
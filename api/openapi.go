@@ -0,0 +1,189 @@
+package api
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+type object = map[string]interface{}
+
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+// OpenAPI generates the OpenAPI 3 document for the routes, served from serverURL
+func OpenAPI(serverURL string) object {
+	schemas := object{}
+	schemaRef(reflect.TypeOf(ErrorResponse{}), schemas)
+
+	errorResponse := func(description string) object {
+		return object{
+			"description": description,
+			"content": object{"application/json": object{
+				"schema": object{"$ref": "#/components/schemas/ErrorResponse"},
+			}},
+		}
+	}
+
+	rateLimited := errorResponse("The API key has made too many requests, try again in Retry-After seconds")
+	rateLimited["headers"] = object{"Retry-After": object{
+		"description": "seconds until the key can make requests again",
+		"schema":      object{"type": "integer"},
+	}}
+
+	paths := object{}
+	for _, r := range routes {
+		var params []object
+		for _, p := range r.Params {
+			params = append(params, parameter(p))
+		}
+
+		data := schemaRef(reflect.TypeOf(r.Resource), schemas)
+		body := object{
+			"type":     "object",
+			"required": []string{"data"},
+			"properties": object{
+				"data": data,
+			},
+		}
+		if r.List {
+			body["properties"] = object{
+				"data":        object{"type": "array", "items": data},
+				"next_cursor": object{"type": "string", "description": "where the next page starts, missing on the last page"},
+			}
+			params = append(params,
+				parameter(param{Name: "limit", In: "query", Doc: "how many to return, 50 by default and at most 200"}),
+				parameter(param{Name: "cursor", In: "query", Doc: "next_cursor from the page before"}),
+			)
+		}
+
+		op := object{
+			"summary":     r.Summary,
+			"operationId": operationID(r),
+			"parameters":  params,
+			"responses": object{
+				"200": object{
+					"description": "OK",
+					"content":     object{"application/json": object{"schema": body}},
+				},
+				"400": errorResponse("The request was malformed"),
+				"401": errorResponse("The API key was missing, invalid, expired or revoked"),
+				"403": errorResponse("The API key doesn't have the " + r.Scope + " scope"),
+				"404": errorResponse("Not found"),
+				"429": rateLimited,
+				"500": errorResponse("Something went wrong on our end"),
+			},
+		}
+		if r.Scope != "" {
+			op["description"] = "Needs an API key with the `" + r.Scope + "` scope."
+			op["security"] = []object{{"apiKey": []string{}}}
+		}
+
+		path := pathParam.ReplaceAllString(r.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = object{}
+		}
+		paths[path].(object)[strings.ToLower(r.Method)] = op
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "my.vibecamp API",
+			"version":     "1",
+			"description": "Read access to attendees, tickets, orders and cabins for vibecamp's integrations. Every response has its result in data, or an error object in error.",
+		},
+		"servers": []object{{"url": serverURL}},
+		"paths":   paths,
+		"components": object{
+			"schemas": schemas,
+			"securitySchemes": object{
+				"apiKey": object{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An API key from /admin/api-keys",
+				},
+			},
+		},
+	}
+}
+
+// operationID names a route for code generators, like getAttendees or getOrdersById
+func operationID(r route) string {
+	id := strings.ToLower(r.Method)
+	for _, part := range strings.Split(strings.Trim(r.Path, "/"), "/") {
+		if strings.HasPrefix(part, ":") {
+			part = "by_" + part[1:]
+		}
+		for _, word := range strings.FieldsFunc(part, func(c rune) bool { return c == '_' || c == '-' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+func parameter(p param) object {
+	o := object{
+		"name":     p.Name,
+		"in":       p.In,
+		"required": p.Required || p.In == "path",
+		"schema":   object{"type": "string"},
+	}
+	if p.In == "query" && p.Name == "limit" {
+		o["schema"] = object{"type": "integer", "minimum": 1, "maximum": maxLimit}
+	}
+	if p.Doc != "" {
+		o["description"] = p.Doc
+	}
+	return o
+}
+
+// schemaRef describes t, adding structs to schemas and referring to them by name
+func schemaRef(t reflect.Type, schemas object) object {
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := schemaRef(t.Elem(), schemas)
+		return object{"allOf": []object{s}, "nullable": true}
+	case reflect.Slice:
+		return object{"type": "array", "items": schemaRef(t.Elem(), schemas)}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return object{"type": "integer"}
+	case reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = object{} // stops recursive types looping
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return object{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return object{}
+}
+
+func structSchema(t reflect.Type, schemas object) object {
+	properties := object{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "" || tag[0] == "-" {
+			continue
+		}
+
+		s := schemaRef(f.Type, schemas)
+		if doc := f.Tag.Get("doc"); doc != "" {
+			s["description"] = doc
+		}
+		properties[tag[0]] = s
+		if len(tag) == 1 || tag[1] != "omitempty" {
+			required = append(required, tag[0])
+		}
+	}
+
+	return object{
+		"type":       "object",
+		"required":   required,
+		"properties": properties,
+	}
+}
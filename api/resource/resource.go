@@ -0,0 +1,83 @@
+// Package resource is the shapes /api/v1 sends, in their own package so clients can use them without pulling in the
+// server.
+package resource
+
+// Attendee is someone on the guest list
+type Attendee struct {
+	UserName       string  `json:"username" doc:"their lowercased twitter handle, or the name they were added under"`
+	Name           string  `json:"name"`
+	TwitterName    string  `json:"twitter_name,omitempty"`
+	DiscordName    string  `json:"discord_name,omitempty"`
+	AdmissionLevel string  `json:"admission_level" doc:"Cabin, Tent, Sat or Staff"`
+	Cabin          string  `json:"cabin,omitempty"`
+	CabinNickname  string  `json:"cabin_nickname,omitempty"`
+	TentVillage    string  `json:"tent_village,omitempty"`
+	CreatedAt      string  `json:"created_at" doc:"RFC 3339"`
+	Ticket         *Ticket `json:"ticket" doc:"null until they have a ticket"`
+}
+
+// Ticket is an attendee's ticket
+type Ticket struct {
+	ID             string `json:"id"`
+	Attendee       string `json:"attendee" doc:"the attendee's username"`
+	Status         string `json:"status" doc:"active, or suspended while a payment is disputed"`
+	Type           string `json:"type"`
+	AdmissionLevel string `json:"admission_level"`
+	CheckedIn      bool   `json:"checked_in"`
+	CheckinURL     string `json:"checkin_url" doc:"the page staff scan at the gate"`
+	OrderID        string `json:"order_id,omitempty"`
+}
+
+// Order is a purchase. Amounts are in cents.
+type Order struct {
+	ID            string      `json:"id"`
+	Attendee      string      `json:"attendee" doc:"the buyer's username"`
+	Status        string      `json:"status" doc:"the payment status"`
+	CreatedAt     string      `json:"created_at" doc:"RFC 3339"`
+	Items         []OrderItem `json:"items"`
+	PromoCode     string      `json:"promo_code,omitempty"`
+	DiscountCents int64       `json:"discount_cents"`
+	FeeCents      int64       `json:"fee_cents" doc:"the processing fee charged to the buyer"`
+	DonationCents int64       `json:"donation_cents"`
+	TotalCents    int64       `json:"total_cents"`
+	PaidCents     int64       `json:"paid_cents"`
+	Installments  int         `json:"installments" doc:"the number of payments on a payment plan, 0 or 1 for paying in full"`
+	TicketsIssued bool        `json:"tickets_issued"`
+}
+
+// OrderItem is one thing bought on an order
+type OrderItem struct {
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+	UnitCents   int64  `json:"unit_cents"`
+	AmountCents int64  `json:"amount_cents"`
+}
+
+// Logistics is what an attendee has told us about their stay
+type Logistics struct {
+	Attendee          string `json:"attendee" doc:"the attendee's username"`
+	Badge             bool   `json:"badge" doc:"whether they want a badge"`
+	Vegetarian        bool   `json:"vegetarian"`
+	GlutenFree        bool   `json:"gluten_free"`
+	LactoseIntolerant bool   `json:"lactose_intolerant"`
+	FoodComments      string `json:"food_comments,omitempty"`
+	DiscordName       string `json:"discord_name,omitempty"`
+}
+
+// Cabin is a cabin and who's staying in it
+type Cabin struct {
+	Name      string   `json:"name"`
+	Nickname  string   `json:"nickname,omitempty"`
+	Attendees []string `json:"attendees" doc:"usernames"`
+}
+
+// Error is what every failed request gets back, inside ErrorResponse
+type Error struct {
+	Status  int    `json:"status" doc:"the HTTP status code"`
+	Code    string `json:"code" doc:"a stable code for the kind of error: invalid_request, unauthorized, forbidden, not_found, rate_limited or internal_error"`
+	Message string `json:"message" doc:"what went wrong, for people"`
+}
+
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/api/resource"
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/receipt"
+)
+
+// the resources live in their own package so the client can share them
+type (
+	Attendee      = resource.Attendee
+	Ticket        = resource.Ticket
+	Order         = resource.Order
+	OrderItem     = resource.OrderItem
+	Logistics     = resource.Logistics
+	Cabin         = resource.Cabin
+	Error         = resource.Error
+	ErrorResponse = resource.ErrorResponse
+)
+
+// NewAttendee is the attendee resource for u
+func NewAttendee(u *db.User) *Attendee {
+	return &Attendee{
+		UserName:       u.UserName,
+		Name:           u.Name,
+		TwitterName:    u.TwitterName,
+		DiscordName:    u.DiscordName,
+		AdmissionLevel: u.AdmissionLevel,
+		Cabin:          u.Cabin2023,
+		CabinNickname:  u.CabinNickname2023,
+		TentVillage:    u.TentVillage,
+		CreatedAt:      u.Created,
+		Ticket:         ticketFrom(u),
+	}
+}
+
+func ticketFrom(u *db.User) *Ticket {
+	if u.TicketID == "" {
+		return nil
+	}
+
+	return &Ticket{
+		ID:             u.TicketID,
+		Attendee:       u.UserName,
+		Status:         strings.ToLower(u.TicketStatus()),
+		Type:           u.TicketType,
+		AdmissionLevel: u.AdmissionLevel,
+		CheckedIn:      u.CheckedIn,
+		CheckinURL:     fmt.Sprintf("%s/checkin/%s", config.ExternalURL, u.TicketID),
+		OrderID:        u.OrderID,
+	}
+}
+
+// NewLogistics is the logistics resource for u
+func NewLogistics(u *db.User) *Logistics {
+	return &Logistics{
+		Attendee:          u.UserName,
+		Badge:             u.Badge,
+		Vegetarian:        u.Vegetarian,
+		GlutenFree:        u.GlutenFree,
+		LactoseIntolerant: u.LactoseIntolerant,
+		FoodComments:      u.FoodComments,
+		DiscordName:       u.DiscordName,
+	}
+}
+
+func cents(c *db.Currency) int64 {
+	if c == nil {
+		return 0
+	}
+	return c.InCents()
+}
+
+// NewOrder is the order resource for o
+func NewOrder(o *db.Order) *Order {
+	order := &Order{
+		ID:            o.OrderID,
+		Attendee:      o.UserName,
+		Status:        o.PaymentStatus,
+		Items:         []OrderItem{},
+		PromoCode:     o.PromoCode,
+		DiscountCents: cents(o.Discount),
+		FeeCents:      cents(o.ProcessingFee),
+		DonationCents: int64(o.Donation) * 100,
+		TotalCents:    cents(o.Total),
+		Installments:  o.InstallmentPlan,
+		TicketsIssued: o.TicketIssued(),
+	}
+
+	if date, err := time.Parse("2006-01-02 15:04", o.Date); err == nil {
+		order.CreatedAt = date.UTC().Format(time.RFC3339)
+	}
+
+	switch {
+	case o.InstallmentPlan > 1:
+		order.PaidCents = cents(o.AmountPaid)
+	case o.TicketIssued():
+		order.PaidCents = order.TotalCents
+	}
+
+	for _, l := range receipt.Lines(o) {
+		order.Items = append(order.Items, OrderItem{
+			Description: l.Description,
+			Quantity:    l.Quantity,
+			UnitCents:   l.Unit.InCents(),
+			AmountCents: l.Amount.InCents(),
+		})
+	}
+	return order
+}
+
+// cabinsFrom groups attendees by the cabin they're in, ordered by cabin name
+func cabinsFrom(users []*db.User) []*Cabin {
+	byName := map[string]*Cabin{}
+	cabins := []*Cabin{}
+	for _, u := range users {
+		if u.Cabin2023 == "" {
+			continue
+		}
+
+		cabin, ok := byName[u.Cabin2023]
+		if !ok {
+			cabin = &Cabin{Name: u.Cabin2023, Attendees: []string{}}
+			byName[u.Cabin2023] = cabin
+			cabins = append(cabins, cabin)
+		}
+		if cabin.Nickname == "" {
+			cabin.Nickname = u.CabinNickname2023
+		}
+		cabin.Attendees = append(cabin.Attendees, u.UserName)
+	}
+
+	sort.Slice(cabins, func(i, j int) bool {
+		return cabins[i].Name < cabins[j].Name
+	})
+	return cabins
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+)
+
+// param is a path or query parameter, for the OpenAPI document
+type param struct {
+	Name     string
+	In       string
+	Doc      string
+	Required bool
+}
+
+// route is one endpoint. Resource is an example of what it returns, a page of them if List is set.
+type route struct {
+	Method   string
+	Path     string
+	Summary  string
+	Scope    string
+	Params   []param
+	Resource interface{}
+	List     bool
+	Handler  gin.HandlerFunc
+}
+
+var routes = []route{
+	{
+		Method:   http.MethodGet,
+		Path:     "/attendees",
+		Summary:  "List attendees, ordered by username",
+		Scope:    fields.ScopeAttendeesRead,
+		Resource: Attendee{},
+		List:     true,
+		Handler:  listAttendees,
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/attendees/:username",
+		Summary:  "Get an attendee",
+		Scope:    fields.ScopeAttendeeRead,
+		Params:   []param{{Name: "username", In: "path", Required: true}},
+		Resource: Attendee{},
+		Handler:  getAttendee,
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/discord/:discord_name",
+		Summary:  "Get the attendee with a discord account",
+		Scope:    fields.ScopeDiscordLookup,
+		Params:   []param{{Name: "discord_name", In: "path", Doc: "their discord username", Required: true}},
+		Resource: Attendee{},
+		Handler:  getDiscordAttendee,
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/tickets/:id",
+		Summary:  "Get a ticket",
+		Scope:    fields.ScopeAttendeeRead,
+		Params:   []param{{Name: "id", In: "path", Required: true}},
+		Resource: Ticket{},
+		Handler:  getTicket,
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/orders",
+		Summary:  "List orders, oldest first",
+		Scope:    fields.ScopeOrdersRead,
+		Params:   []param{{Name: "attendee", In: "query", Doc: "only this username's orders"}},
+		Resource: Order{},
+		List:     true,
+		Handler:  listOrders,
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/orders/:id",
+		Summary:  "Get an order",
+		Scope:    fields.ScopeOrdersRead,
+		Params:   []param{{Name: "id", In: "path", Required: true}},
+		Resource: Order{},
+		Handler:  getOrder,
+	},
+	{
+		Method:   http.MethodGet,
+		Path:     "/cabins",
+		Summary:  "List cabins and who's in them, ordered by name",
+		Scope:    fields.ScopeCabinsRead,
+		Resource: Cabin{},
+		List:     true,
+		Handler:  listCabins,
+	},
+}
+
+// lookupError answers a failed lookup, with a 404 if there was nothing to find
+func lookupError(c *gin.Context, err error, what string) {
+	if errors.Is(err, db.ErrNoRecords) {
+		Abort(c, http.StatusNotFound, what+" not found")
+		return
+	}
+	serverError(c, err)
+}
+
+func listAttendees(c *gin.Context) {
+	p, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	users, err := db.GetAllUsers()
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+
+	start, end, next := p.slice(len(users))
+	attendees := make([]*Attendee, 0, end-start)
+	for _, u := range users[start:end] {
+		attendees = append(attendees, NewAttendee(u))
+	}
+	c.JSON(http.StatusOK, Page{Data: attendees, NextCursor: next})
+}
+
+func getAttendee(c *gin.Context) {
+	user, err := db.GetUser(c.Param("username"))
+	if err != nil {
+		lookupError(c, err, "attendee")
+		return
+	}
+	c.JSON(http.StatusOK, Single{Data: NewAttendee(user)})
+}
+
+func getDiscordAttendee(c *gin.Context) {
+	user, err := db.GetUserByField(fields.DiscordName, c.Param("discord_name"))
+	if err != nil {
+		lookupError(c, err, "attendee")
+		return
+	}
+	c.JSON(http.StatusOK, Single{Data: NewAttendee(user)})
+}
+
+func getTicket(c *gin.Context) {
+	user, err := db.GetUserFromTicketId(c.Param("id"))
+	if err != nil {
+		lookupError(c, err, "ticket")
+		return
+	}
+	c.JSON(http.StatusOK, Single{Data: ticketFrom(user)})
+}
+
+func listOrders(c *gin.Context) {
+	p, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	all, err := db.GetOrders()
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+
+	attendee := strings.ToLower(c.Query("attendee"))
+	orders := make([]*db.Order, 0, len(all))
+	for _, o := range all {
+		if attendee == "" || strings.ToLower(o.UserName) == attendee {
+			orders = append(orders, o)
+		}
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		if orders[i].Date != orders[j].Date {
+			return orders[i].Date < orders[j].Date
+		}
+		return orders[i].OrderID < orders[j].OrderID
+	})
+
+	start, end, next := p.slice(len(orders))
+	data := make([]*Order, 0, end-start)
+	for _, o := range orders[start:end] {
+		data = append(data, NewOrder(o))
+	}
+	c.JSON(http.StatusOK, Page{Data: data, NextCursor: next})
+}
+
+func getOrder(c *gin.Context) {
+	order, err := db.GetOrder(c.Param("id"))
+	if err != nil {
+		lookupError(c, err, "order")
+		return
+	}
+	c.JSON(http.StatusOK, Single{Data: NewOrder(order)})
+}
+
+func listCabins(c *gin.Context) {
+	p, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	users, err := db.GetAllUsers()
+	if err != nil {
+		serverError(c, err)
+		return
+	}
+
+	cabins := cabinsFrom(users)
+	start, end, next := p.slice(len(cabins))
+	c.JSON(http.StatusOK, Page{Data: cabins[start:end], NextCursor: next})
+}
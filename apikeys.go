@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/api"
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/sales"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// keys look like vc_<key id>_<secret>
+	apiKeyPrefix = "vc_"
+	// how often a key's last used time is written back, so busy clients don't write on every request
+	apiKeyLastUsedInterval = 15 * time.Minute
+	// how long the old key keeps working after a rotation, so the client can switch over
+	apiKeyRotationGrace = 24 * time.Hour
+
+	apiKeyContextKey = "apiKey"
+
+	// how many /api/v1 requests one key can make a minute
+	apiKeyRequestsPerMinute = 300
+)
+
+// requests made by each key this minute
+var apiKeyRequests = cache.New(time.Minute, 10*time.Minute)
+
+// allowAPIRequest counts a request against the key's limit, and says how long until it can make more if it's over
+func allowAPIRequest(keyID string) (bool, time.Duration) {
+	if apiKeyRequests.Add(keyID, 1, time.Minute) == nil {
+		return true, 0
+	}
+
+	count, err := apiKeyRequests.IncrementInt(keyID, 1)
+	if err != nil {
+		// expired between the two calls
+		apiKeyRequests.Set(keyID, 1, time.Minute)
+		return true, 0
+	}
+	if count <= apiKeyRequestsPerMinute {
+		return true, 0
+	}
+
+	_, resets, _ := apiKeyRequests.GetWithExpiration(keyID)
+	return false, time.Until(resets)
+}
+
+// newAPIKey makes a key and its id
+func newAPIKey() (key, keyID string, err error) {
+	b := make([]byte, 28)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", errors.Wrap(err, "generating api key")
+	}
+
+	keyID = hex.EncodeToString(b[:4])
+	return apiKeyPrefix + keyID + "_" + hex.EncodeToString(b[4:]), keyID, nil
+}
+
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// requestAPIKey is the key the client sent, as a bearer token or in the auth_token header or query param the
+// older integrations use
+func requestAPIKey(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if token := c.GetHeader("auth_token"); token != "" {
+		return token
+	}
+	return c.Query("auth_token")
+}
+
+// legacyAPIToken says whether token is the old shared token, which only works while ALLOW_LEGACY_API_TOKEN is on
+func legacyAPIToken(token string) bool {
+	hmacSecret := os.Getenv("HMAC_SECRET")
+	if os.Getenv("ALLOW_LEGACY_API_TOKEN") == "" || hmacSecret == "" {
+		return false
+	}
+
+	h := sha256.Sum256([]byte(hmacSecret))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(token)) == 1
+}
+
+// checkAPIKey makes sure the request has a live key with scope, saying what's wrong and the status to give if not
+func checkAPIKey(c *gin.Context, scope string) (int, error) {
+	token := requestAPIKey(c)
+	if token == "" {
+		return http.StatusUnauthorized, errors.New("API key required")
+	}
+
+	if legacyAPIToken(token) {
+		log.Warnf("%v called with the legacy shared token, give its client an API key", c.Request.URL.Path)
+		return 0, nil
+	}
+
+	invalid := errors.New("invalid API key")
+	parts := strings.Split(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	if !strings.HasPrefix(token, apiKeyPrefix) || len(parts) != 2 {
+		return http.StatusUnauthorized, invalid
+	}
+
+	key, err := db.GetAPIKey(parts[0])
+	if err != nil {
+		if !errors.Is(err, db.ErrNoRecords) {
+			log.Errorf("error looking up api key %v: %v", parts[0], err)
+		}
+		return http.StatusUnauthorized, invalid
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(token)), []byte(key.Hash)) != 1 {
+		return http.StatusUnauthorized, invalid
+	}
+	if !key.Active() {
+		return http.StatusUnauthorized, errors.New("API key expired or revoked")
+	}
+	if !key.HasScope(scope) {
+		return http.StatusForbidden, errors.Newf("API key doesn't have the %s scope", scope)
+	}
+
+	if time.Since(key.LastUsed) > apiKeyLastUsedInterval {
+		go func() {
+			if err := key.SetLastUsed(time.Now()); err != nil {
+				log.Errorf("error recording api key %v use: %v", key.KeyID, err)
+			}
+		}()
+	}
+
+	c.Set(apiKeyContextKey, key)
+	return 0, nil
+}
+
+// requireScope is middleware for the older machine endpoints, aborting unless the request has a live key with scope
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if status, err := checkAPIKey(c, scope); err != nil {
+			c.AbortWithError(status, err)
+		}
+	}
+}
+
+// requireAPIScope is requireScope for /api/v1, which answers with JSON error objects and limits how often each
+// key can call it
+func requireAPIScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if status, err := checkAPIKey(c, scope); err != nil {
+			api.Abort(c, status, err.Error())
+			return
+		}
+
+		keyID := "legacy"
+		if key, ok := c.Get(apiKeyContextKey); ok {
+			keyID = key.(*db.APIKey).KeyID
+		}
+		if ok, wait := allowAPIRequest(keyID); !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			api.Abort(c, http.StatusTooManyRequests, "Too many requests, try again in a minute")
+		}
+	}
+}
+
+// createAPIKey makes and stores a key, returning it so it can be shown the one time
+func createAPIKey(name string, scopes []string, expires time.Time, createdBy string) (string, *db.APIKey, error) {
+	token, keyID, err := newAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := &db.APIKey{
+		KeyID:     keyID,
+		Name:      name,
+		Hash:      hashAPIKey(token),
+		Scopes:    scopes,
+		CreatedBy: createdBy,
+		Expires:   expires,
+	}
+	err = db.CreateAPIKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, key, nil
+}
+
+// APIKeysAdminHandler lists API keys, and makes, rotates and revokes them. A new key is shown once, on the page
+// that made it.
+func APIKeysAdminHandler(c *gin.Context) {
+	staff := staffUser(c)
+	var newKey, newKeyName string
+
+	if c.Request.Method == http.MethodPost {
+		switch c.PostForm("action") {
+		case "create":
+			name := strings.TrimSpace(c.PostForm("name"))
+			if name == "" {
+				c.AbortWithError(http.StatusBadRequest, errors.New("Give the key a name saying who uses it"))
+				return
+			}
+
+			scopes := c.PostFormArray("scope")
+			for _, s := range scopes {
+				if !contains(db.APIKeyScopes, s) {
+					c.AbortWithError(http.StatusBadRequest, errors.Newf("Unknown scope %s", s))
+					return
+				}
+			}
+			if len(scopes) == 0 {
+				c.AbortWithError(http.StatusBadRequest, errors.New("Give the key at least one scope"))
+				return
+			}
+
+			var expires time.Time
+			if days := c.PostForm("expires-days"); days != "" {
+				n, err := strconv.Atoi(days)
+				if err != nil || n <= 0 {
+					c.AbortWithError(http.StatusBadRequest, errors.New("Expiry must be a number of days"))
+					return
+				}
+				expires = time.Now().AddDate(0, 0, n)
+			}
+
+			token, key, err := createAPIKey(name, scopes, expires, staff.UserName)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			staffDetails(c, "created key %s for %s with %s", key.KeyID, name, strings.Join(scopes, ", "))
+			newKey, newKeyName = token, name
+		case "rotate", "revoke":
+			key, err := db.GetAPIKey(c.PostForm("id"))
+			if err != nil {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			if c.PostForm("action") == "revoke" {
+				err = key.Revoke()
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				SuccessFlash(c, "Revoked "+key.Name)
+				c.Redirect(http.StatusFound, "/admin/api-keys")
+				return
+			}
+
+			if !key.Active() {
+				c.AbortWithError(http.StatusBadRequest, errors.New("Only live keys can be rotated, make a new one instead"))
+				return
+			}
+			token, rotated, err := createAPIKey(key.Name, key.Scopes, key.Expires, staff.UserName)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			grace := time.Now().Add(apiKeyRotationGrace)
+			if key.Expires.IsZero() || key.Expires.After(grace) {
+				err = key.SetExpires(grace)
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+			}
+			staffDetails(c, "replaced with key %s", rotated.KeyID)
+			newKey, newKeyName = token, key.Name
+		default:
+			c.AbortWithError(http.StatusBadRequest, errors.New("Unknown action"))
+			return
+		}
+	}
+
+	keys, err := db.GetAPIKeys()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	for _, k := range keys {
+		k.Created = k.Created.In(sales.Eastern)
+		k.Expires = k.Expires.In(sales.Eastern)
+		k.LastUsed = k.LastUsed.In(sales.Eastern)
+	}
+
+	c.HTML(http.StatusOK, "apiKeysAdmin.html.tmpl", gin.H{
+		"flashes":    GetFlashes(c),
+		"Keys":       keys,
+		"Scopes":     db.APIKeyScopes,
+		"NewKey":     newKey,
+		"NewKeyName": newKeyName,
+		"GraceHours": int(apiKeyRotationGrace.Hours()),
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckAPIKey(t *testing.T) {
+	dbtest.New(t)
+	t.Setenv("HMAC_SECRET", "secret")
+	t.Setenv("ALLOW_LEGACY_API_TOKEN", "")
+	h := sha256.Sum256([]byte("secret"))
+	legacy := hex.EncodeToString(h[:])
+
+	newKey := func(scopes []string, expires time.Time, revoked bool) string {
+		token, key, err := createAPIKey("test", scopes, expires, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revoked {
+			if err := key.Revoke(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return token
+	}
+	reader := []string{fields.ScopeAttendeesRead}
+	live := newKey(reader, time.Time{}, false)
+	expiring := newKey(reader, time.Now().Add(time.Hour), false)
+	expired := newKey(reader, time.Now().Add(-time.Hour), false)
+	revoked := newKey(reader, time.Time{}, true)
+	orders := newKey([]string{fields.ScopeOrdersRead}, time.Time{}, false)
+	// the right key id with someone else's secret
+	wrongSecret := live[:strings.LastIndex(live, "_")+1] + strings.Repeat("0", 48)
+
+	tests := []struct {
+		name   string
+		header string
+		token  string
+		legacy bool
+		status int
+	}{
+		{"no key", "", "", false, http.StatusUnauthorized},
+		{"live key", "Authorization", live, false, 0},
+		{"key that expires later", "Authorization", expiring, false, 0},
+		{"auth_token header", "auth_token", live, false, 0},
+		{"auth_token query", "query", live, false, 0},
+		{"expired key", "Authorization", expired, false, http.StatusUnauthorized},
+		{"revoked key", "Authorization", revoked, false, http.StatusUnauthorized},
+		{"key without the scope", "Authorization", orders, false, http.StatusForbidden},
+		{"wrong secret", "Authorization", wrongSecret, false, http.StatusUnauthorized},
+		{"unknown key id", "Authorization", "vc_00000000_" + strings.Repeat("0", 48), false, http.StatusUnauthorized},
+		{"not a key", "Authorization", "hunter2", false, http.StatusUnauthorized},
+		{"legacy token while it's allowed", "auth_token", legacy, true, 0},
+		{"legacy token once it's turned off", "auth_token", legacy, false, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow := ""
+			if tt.legacy {
+				allow = "true"
+			}
+			t.Setenv("ALLOW_LEGACY_API_TOKEN", allow)
+
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/attendees", nil)
+			switch tt.header {
+			case "Authorization":
+				c.Request.Header.Set("Authorization", "Bearer "+tt.token)
+			case "query":
+				c.Request.URL.RawQuery = "auth_token=" + tt.token
+			case "auth_token":
+				c.Request.Header.Set("auth_token", tt.token)
+			}
+
+			status, err := checkAPIKey(c, fields.ScopeAttendeesRead)
+			if status != tt.status || (err == nil) != (tt.status == 0) {
+				t.Errorf("checkAPIKey() = %d, %v, want %d", status, err, tt.status)
+			}
+		})
+	}
+}
+
+func TestRequireAPIScopeRateLimit(t *testing.T) {
+	t.Setenv("HMAC_SECRET", "secret")
+	t.Setenv("ALLOW_LEGACY_API_TOKEN", "true")
+	h := sha256.Sum256([]byte("secret"))
+	token := hex.EncodeToString(h[:])
+	apiKeyRequests.Flush()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/attendees", requireAPIScope("attendees:read"), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	get := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/attendees", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no key got %d", w.Code)
+	}
+
+	for i := 0; i < apiKeyRequestsPerMinute; i++ {
+		if w := get(token); w.Code != http.StatusOK {
+			t.Fatalf("request %d got %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+
+	w := get(token)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the limit got %d", w.Code)
+	}
+	if s, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || s < 1 || s > 60 {
+		t.Errorf("Retry-After = %q, want 1 to 60 seconds", w.Header().Get("Retry-After"))
+	}
+	if want := `"code":"rate_limited"`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("body = %s, want %s", w.Body, want)
+	}
+}
+
+func TestWebhookReplayEndpoint(t *testing.T) {
+	dbtest.New(t)
+	t.Setenv("HMAC_SECRET", "secret")
+	t.Setenv("ALLOW_LEGACY_API_TOKEN", "true")
+	h := sha256.Sum256([]byte("secret"))
+	legacy := hex.EncodeToString(h[:])
+
+	if _, err := db.RecordWebhookEvent("evt_1", "customer.created", `{"id": "evt_1", "object": "event", "type": "customer.created"}`); err != nil {
+		t.Fatal(err)
+	}
+	replayer, _, err := createAPIKey("cli", []string{fields.ScopeWebhooksReplay}, time.Time{}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, _, err := createAPIKey("app", []string{fields.ScopeAttendeesRead}, time.Time{}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/webhook-replay", requireScope(fields.ScopeWebhooksReplay), WebhookReplayEndpoint)
+
+	tests := []struct {
+		name   string
+		token  string
+		ids    []string
+		status int
+	}{
+		{"no key", "", []string{"evt_1"}, http.StatusUnauthorized},
+		{"legacy token", legacy, []string{"evt_1"}, http.StatusForbidden},
+		{"key without the scope", reader, []string{"evt_1"}, http.StatusForbidden},
+		{"no events", replayer, nil, http.StatusBadRequest},
+		{"replay key", replayer, []string{"evt_1"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/webhook-replay", strings.NewReader(url.Values{"id": tt.ids}.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("got %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	e, err := db.GetWebhookEvent("evt_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Status != fields.EventIgnored {
+		t.Errorf("event status = %s after the replay, want %s", e.Status, fields.EventIgnored)
+	}
+}
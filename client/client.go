@@ -0,0 +1,261 @@
+// Package client calls /api/v1 for integrations like the discord bot and the app, so they don't each hand-write
+// requests. It sends the API key, retries requests that fail for reasons worth retrying, and follows next_cursor
+// for the list calls.
+//
+//	c := client.New("https://my.vibecamp.xyz", os.Getenv("VIBECAMP_API_KEY"))
+//	attendee, err := c.AttendeeByDiscord(ctx, "someone")
+//	if client.IsNotFound(err) {
+//		// not on the guest list
+//	}
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/api/resource"
+
+	"github.com/cockroachdb/errors"
+)
+
+// the resources the API returns, documented at /api/v1/openapi.json
+type (
+	Attendee  = resource.Attendee
+	Ticket    = resource.Ticket
+	Order     = resource.Order
+	OrderItem = resource.OrderItem
+	Cabin     = resource.Cabin
+)
+
+const (
+	// the biggest page the API gives out, list calls use it so they make as few requests as they can
+	pageSize = 200
+	// how long to wait before the first retry, it doubles after each one
+	retryWait = 250 * time.Millisecond
+)
+
+// Client calls the API. Its fields can be changed after New, before it's used.
+type Client struct {
+	// BaseURL is the site, without /api/v1
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+	// MaxRetries is how many times a request that failed with a network error, a 429 or a 5xx is tried again
+	MaxRetries int
+}
+
+// New makes a client for the site at baseURL, like https://my.vibecamp.xyz, using apiKey
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 3,
+	}
+}
+
+// Error is an error object the API answered with. Code is one of the codes in the OpenAPI document.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("vibecamp api: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// IsNotFound says whether err is the API saying there's no such thing
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusNotFound
+}
+
+// envelope is every successful response, with the data left to decode into whatever's expected
+type envelope struct {
+	Data       json.RawMessage `json:"data"`
+	NextCursor string          `json:"next_cursor"`
+}
+
+// get fetches path, decoding its data into out, and returns the cursor for the next page if there is one
+func (c *Client) get(ctx context.Context, path string, query url.Values, out interface{}) (string, error) {
+	u := c.BaseURL + "/api/v1" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	wait := retryWait
+	for attempt := 0; ; attempt++ {
+		body, retryAfter, err := c.do(ctx, u)
+		if err == nil {
+			var env envelope
+			if err := json.Unmarshal(body, &env); err != nil {
+				return "", errors.Wrapf(err, "vibecamp api: parsing %s", path)
+			}
+			if err := json.Unmarshal(env.Data, out); err != nil {
+				return "", errors.Wrapf(err, "vibecamp api: parsing %s", path)
+			}
+			return env.NextCursor, nil
+		}
+
+		if !retryable(err) || attempt >= c.MaxRetries {
+			return "", err
+		}
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// do makes one request, returning the body of a 2xx and how long the API asked to wait if it's busy
+func (c *Client) do(ctx context.Context, u string) ([]byte, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "vibecamp api: making request")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "vibecamp api")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "vibecamp api: reading response")
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return body, 0, nil
+	}
+
+	var retryAfter time.Duration
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		retryAfter = time.Duration(s) * time.Second
+	}
+
+	var errResp resource.ErrorResponse
+	if json.Unmarshal(body, &errResp) != nil || errResp.Error.Status == 0 {
+		// not one of ours, like a proxy's error page
+		errResp.Error = resource.Error{Status: resp.StatusCode, Code: "http_error", Message: resp.Status}
+	}
+	return nil, retryAfter, &Error{Status: errResp.Error.Status, Code: errResp.Error.Code, Message: errResp.Error.Message}
+}
+
+// retryable says whether a failed request might work if it's tried again
+func retryable(err error) bool {
+	var e *Error
+	if !errors.As(err, &e) {
+		// couldn't reach the API, unless the caller gave up
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// Attendee looks someone up by their username, their lowercased twitter handle
+func (c *Client) Attendee(ctx context.Context, username string) (*Attendee, error) {
+	var a Attendee
+	_, err := c.get(ctx, "/attendees/"+url.PathEscape(username), nil, &a)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// AttendeeByDiscord looks up the attendee with a discord username
+func (c *Client) AttendeeByDiscord(ctx context.Context, discordName string) (*Attendee, error) {
+	var a Attendee
+	_, err := c.get(ctx, "/discord/"+url.PathEscape(discordName), nil, &a)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Ticket looks a ticket up by its id
+func (c *Client) Ticket(ctx context.Context, id string) (*Ticket, error) {
+	var t Ticket
+	_, err := c.get(ctx, "/tickets/"+url.PathEscape(id), nil, &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Order looks an order up by its id
+func (c *Client) Order(ctx context.Context, id string) (*Order, error) {
+	var o Order
+	_, err := c.get(ctx, "/orders/"+url.PathEscape(id), nil, &o)
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// list fetches every page of path, calling add with each page's data
+func (c *Client) list(ctx context.Context, path string, query url.Values, page func() interface{}, add func(interface{})) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("limit", strconv.Itoa(pageSize))
+
+	for {
+		data := page()
+		next, err := c.get(ctx, path, query, data)
+		if err != nil {
+			return err
+		}
+		add(data)
+
+		if next == "" {
+			return nil
+		}
+		query.Set("cursor", next)
+	}
+}
+
+// Attendees is everyone on the guest list, ordered by username
+func (c *Client) Attendees(ctx context.Context) ([]*Attendee, error) {
+	attendees := []*Attendee{}
+	err := c.list(ctx, "/attendees", nil,
+		func() interface{} { return &[]*Attendee{} },
+		func(page interface{}) { attendees = append(attendees, *page.(*[]*Attendee)...) })
+	return attendees, err
+}
+
+// Cabins is every cabin and who's in it, ordered by name
+func (c *Client) Cabins(ctx context.Context) ([]*Cabin, error) {
+	cabins := []*Cabin{}
+	err := c.list(ctx, "/cabins", nil,
+		func() interface{} { return &[]*Cabin{} },
+		func(page interface{}) { cabins = append(cabins, *page.(*[]*Cabin)...) })
+	return cabins, err
+}
+
+// Orders is every order, oldest first, or only one attendee's if attendee isn't blank
+func (c *Client) Orders(ctx context.Context, attendee string) ([]*Order, error) {
+	query := url.Values{}
+	if attendee != "" {
+		query.Set("attendee", attendee)
+	}
+
+	orders := []*Order{}
+	err := c.list(ctx, "/orders", query,
+		func() interface{} { return &[]*Order{} },
+		func(page interface{}) { orders = append(orders, *page.(*[]*Order)...) })
+	return orders, err
+}
@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/api"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+)
+
+// fakeKeys stands in for the site's API keys, and can be told to rate limit the next few requests
+type fakeKeys struct {
+	mutex    sync.Mutex
+	scopes   map[string][]string
+	limited  int
+	requests []string
+}
+
+func (k *fakeKeys) auth(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k.mutex.Lock()
+		defer k.mutex.Unlock()
+		k.requests = append(k.requests, c.Request.URL.RequestURI())
+
+		if k.limited > 0 {
+			k.limited--
+			c.Header("Retry-After", "1")
+			api.Abort(c, http.StatusTooManyRequests, "Slow down")
+			return
+		}
+		scopes, ok := k.scopes[strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")]
+		if !ok {
+			api.Abort(c, http.StatusUnauthorized, "Missing or unknown API key")
+			return
+		}
+		for _, s := range scopes {
+			if s == scope {
+				return
+			}
+		}
+		api.Abort(c, http.StatusForbidden, "This API key can't "+scope)
+	}
+}
+
+// testAPI serves the real API from a fake airtable with n attendees, and returns a client for it with a key that
+// can read them
+func testAPI(t *testing.T, n int) (*Client, *fakeKeys) {
+	s := dbtest.New(t)
+	for i := 0; i < n; i++ {
+		s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: fmt.Sprintf("user%04d", i), fields.AdmissionLevel: "Basic"})
+	}
+
+	keys := &fakeKeys{scopes: map[string][]string{
+		"vc_reader": {fields.ScopeAttendeesRead, fields.ScopeAttendeeRead},
+		"vc_other":  {fields.ScopeDiscordLookup},
+	}}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	api.Register(r.Group("/api/v1"), api.Config{ExternalURL: "https://my.vibe.camp", Auth: keys.auth})
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return New(server.URL+"/", "vc_reader"), keys
+}
+
+func TestAttendeesWalksEveryPage(t *testing.T) {
+	tests := []struct {
+		attendees int
+		requests  int
+	}{
+		{0, 1},
+		{1, 1},
+		{pageSize, 1},
+		{pageSize + 1, 2},
+		{2*pageSize + 50, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attendees), func(t *testing.T) {
+			c, keys := testAPI(t, tt.attendees)
+			attendees, err := c.Attendees(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(attendees) != tt.attendees {
+				t.Fatalf("got %d attendees, want %d", len(attendees), tt.attendees)
+			}
+			for i, a := range attendees {
+				if want := fmt.Sprintf("user%04d", i); a.UserName != want {
+					t.Fatalf("attendee %d is %s, want %s", i, a.UserName, want)
+				}
+			}
+			if len(keys.requests) != tt.requests {
+				t.Errorf("made %d requests, want %d: %v", len(keys.requests), tt.requests, keys.requests)
+			}
+			for i, r := range keys.requests {
+				if !strings.Contains(r, fmt.Sprintf("limit=%d", pageSize)) || strings.Contains(r, "cursor=") != (i > 0) {
+					t.Errorf("request %d was %s", i, r)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		status int
+		code   string
+	}{
+		{"no key", "", http.StatusUnauthorized, "unauthorized"},
+		{"unknown key", "vc_made_up", http.StatusUnauthorized, "unauthorized"},
+		{"key without the scope", "vc_other", http.StatusForbidden, "forbidden"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, keys := testAPI(t, 3)
+			c.APIKey = tt.key
+
+			_, err := c.Attendees(context.Background())
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("Attendees() error = %v, want an *Error", err)
+			}
+			if e.Status != tt.status || e.Code != tt.code || e.Message == "" {
+				t.Errorf("error = %+v, want %d %s", e, tt.status, tt.code)
+			}
+			if IsNotFound(err) {
+				t.Error("IsNotFound() for an auth failure")
+			}
+			if len(keys.requests) != 1 {
+				t.Errorf("made %d requests, auth failures shouldn't be retried", len(keys.requests))
+			}
+		})
+	}
+}
+
+func TestRetriesRateLimited(t *testing.T) {
+	c, keys := testAPI(t, 3)
+	keys.limited = 1
+
+	start := time.Now()
+	a, err := c.Attendee(context.Background(), "user0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.UserName != "user0001" {
+		t.Errorf("got %s", a.UserName)
+	}
+	if len(keys.requests) != 2 {
+		t.Errorf("made %d requests, want 2", len(keys.requests))
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("retried after %v, the API said to wait a second", waited)
+	}
+
+	// it gives up once it's out of retries, with the API's error
+	keys.limited = 1
+	keys.requests = nil
+	c.MaxRetries = 0
+	_, err = c.Attendee(context.Background(), "user0001")
+	var e *Error
+	if !errors.As(err, &e) || e.Status != http.StatusTooManyRequests || e.Code != "rate_limited" {
+		t.Errorf("Attendee() error = %v, want rate_limited", err)
+	}
+	if len(keys.requests) != 1 {
+		t.Errorf("made %d requests, want 1", len(keys.requests))
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	c, _ := testAPI(t, 3)
+	_, err := c.Attendee(context.Background(), "nobody")
+	if !IsNotFound(err) {
+		t.Errorf("Attendee() error = %v, want not found", err)
+	}
+}
+
+// a request the caller has given up on isn't retried
+func TestCancelled(t *testing.T) {
+	c, keys := testAPI(t, 3)
+	keys.limited = 5
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.Attendees(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Attendees() error = %v, want the deadline", err)
+	}
+	if len(keys.requests) != 1 {
+		t.Errorf("made %d requests, want 1", len(keys.requests))
+	}
+}
@@ -0,0 +1,57 @@
+// Command discordsync prints the discord role changes the site's sync would make, and makes them with -apply.
+// Run it before turning the sync on, to check the Discord Roles table does what you meant.
+//
+//	discordsync [-apply]
+//
+// It reads the same env file as the site, run it from the repo root. It needs DISCORD_BOT_TOKEN and DISCORD_GUILD_ID.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/discord"
+
+	"github.com/cockroachdb/errors/oserror"
+	"github.com/joho/godotenv"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	// load env file if exists
+	_, err := os.Open("env")
+	if !oserror.IsNotExist(err) {
+		err := godotenv.Load("env")
+		if err != nil {
+			log.Fatalf("loading env: %s", err)
+		}
+	}
+
+	apply := flag.Bool("apply", false, "make the changes instead of only printing them")
+	flag.Parse()
+
+	token, guild := os.Getenv("DISCORD_BOT_TOKEN"), os.Getenv("DISCORD_GUILD_ID")
+	if token == "" || guild == "" {
+		log.Fatal("need DISCORD_BOT_TOKEN and DISCORD_GUILD_ID set")
+	}
+
+	db.Init(os.Getenv("AIRTABLE_API_KEY"), os.Getenv("AIRTABLE_BASE_ID"), cache.New(1*time.Second, 1*time.Minute))
+
+	result, err := discord.Sync(&discord.Bot{Token: token, GuildID: guild, APIBase: os.Getenv("DISCORD_API_BASE")}, !*apply)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%d server members, %d linked discord accounts, %d changes\n", result.Members, result.Linked, len(result.Changes))
+	for _, c := range result.Changes {
+		fmt.Println(c)
+	}
+	if result.Failed > 0 {
+		fmt.Printf("%d changes failed\n", result.Failed)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+// Command fakeoauth is a local stand in for twitter's, discord's or google's OAuth 2.0 endpoints, for trying sign
+// in without setting up an app with them. It approves every authorization as one made up account, and checks the
+// PKCE verifier like the real ones do.
+//
+//	fakeoauth [-provider twitter] [-addr localhost:12112] [-id 1234] [-username grintesting] [-email you@example.com]
+//
+// Point the site at it with TWITTER_API_BASE=http://localhost:12112 and any TWITTER_CLIENT_ID, or the same with
+// DISCORD_ or GOOGLE_.
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/vibecamp/myvibecamp/signin/fakeoauth"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	provider = flag.String("provider", "twitter", "which provider to pretend to be: twitter, discord or google")
+	addr     = flag.String("addr", "localhost:12112", "address to listen on")
+	id       = flag.String("id", "1234", "stable id of the account that signs in")
+	username = flag.String("username", "grintesting", "handle of the account that signs in")
+	name     = flag.String("name", "Grin Testing", "display name of the account that signs in")
+	email    = flag.String("email", "", "verified email of the account that signs in, for discord and google")
+	deny     = flag.Bool("deny", false, "turn down every authorization instead")
+)
+
+func main() {
+	flag.Parse()
+
+	server, err := fakeoauth.New(*provider, fakeoauth.Account{ID: *id, UserName: *username, Name: *name, Email: *email})
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Deny = *deny
+
+	log.Printf("Fake %s listening on http://%s, signing everyone in as %s (%s)", *provider, *addr, *username, *id)
+	log.Fatal(http.ListenAndServe(*addr, server.Handler()))
+}
@@ -0,0 +1,71 @@
+// Command reconcile checks stripe's succeeded payment intents against the orders table and prints any mismatches.
+// It exits 1 if there are any, so it can run from cron.
+//
+//	reconcile [-since 2023-02-01]
+//
+// It reads the same env file as the site, run it from the repo root. Set STRIPE_API_BASE to run it against stripe-mock.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/reconcile"
+	"github.com/vibecamp/myvibecamp/sales"
+	"github.com/vibecamp/myvibecamp/stripe"
+
+	"github.com/cockroachdb/errors/oserror"
+	"github.com/joho/godotenv"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	// load env file if exists
+	_, err := os.Open("env")
+	if !oserror.IsNotExist(err) {
+		err := godotenv.Load("env")
+		if err != nil {
+			log.Fatalf("loading env: %s", err)
+		}
+	}
+
+	since := flag.String("since", os.Getenv("RECONCILE_SINCE"), "only check intents created on or after this date, defaults to RECONCILE_SINCE")
+	flag.Parse()
+
+	var sinceTime time.Time
+	if *since != "" {
+		sinceTime, err = time.ParseInLocation("2006-01-02", *since, sales.Eastern)
+		if err != nil {
+			log.Fatalf("can't read -since %q, use 2006-01-02", *since)
+		}
+	}
+
+	db.Init(os.Getenv("AIRTABLE_API_KEY"), os.Getenv("AIRTABLE_BASE_ID"), cache.New(1*time.Second, 1*time.Minute))
+	stripeApiKey := os.Getenv("STRIPE_API_KEY")
+	if os.Getenv("DEV") == "true" {
+		stripeApiKey = "sk_test_4eC39HqLyjWDarjtT1zdp7dc"
+	}
+	stripe.Init(stripeApiKey, "", "", "", "")
+	if apiBase := os.Getenv("STRIPE_API_BASE"); apiBase != "" {
+		stripe.UseAPIBase(apiBase)
+	}
+
+	report, err := reconcile.Run(sinceTime)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Checked %d succeeded payment intents against %d orders, %d mismatches\n", report.Intents, report.Orders, len(report.Mismatches))
+	fmt.Println(report.Fees())
+	for _, m := range report.Mismatches {
+		fmt.Printf("%-22s %-30s %-36s @%-20s %s\n", m.Kind, m.PaymentID, m.OrderID, m.UserName, m.Detail)
+	}
+
+	if len(report.Mismatches) > 0 {
+		os.Exit(1)
+	}
+}
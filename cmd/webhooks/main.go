@@ -0,0 +1,202 @@
+// Command webhooks lists, inspects and replays the stripe webhook events the site has stored.
+//
+//	webhooks list [-status Failed] [-since 2023-03-01] [-until 2023-03-02T12:00]
+//	webhooks show <event id>
+//	webhooks replay [-dry-run] <event id>
+//	webhooks replay [-dry-run] [-status Failed] -since 2023-03-01 [-until 2023-03-02]
+//
+// Times are Eastern. It reads the same env file as the site, run it from the repo root. Replays are run by the site at
+// EXTERNAL_URL, so its listeners send what the events promise, using the API key with the webhooks:replay scope in
+// WEBHOOKS_API_KEY.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/sales"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/oserror"
+	"github.com/joho/godotenv"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	// load env file if exists
+	_, err := os.Open("env")
+	if !oserror.IsNotExist(err) {
+		err := godotenv.Load("env")
+		if err != nil {
+			log.Fatalf("loading env: %s", err)
+		}
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	status := flags.String("status", "", "only events with this status (Received, Processed, Failed, Ignored)")
+	since := flags.String("since", "", "only events received at or after this time")
+	until := flags.String("until", "", "only events received before this time")
+	dryRun := flags.Bool("dry-run", false, "print what replaying would change without changing anything")
+	flags.Parse(os.Args[2:])
+
+	db.Init(os.Getenv("AIRTABLE_API_KEY"), os.Getenv("AIRTABLE_BASE_ID"), cache.New(1*time.Second, 1*time.Minute))
+
+	switch os.Args[1] {
+	case "list":
+		events, err := db.GetWebhookEvents(*status, parseTime(*since), parseTime(*until))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, e := range events {
+			fmt.Printf("%s  %-30s %-28s %-9s %d  %s\n", e.ReceivedAt.In(sales.Eastern).Format("2006-01-02 15:04"), e.EventID, e.Type, e.Status, e.Attempts, e.LastError)
+		}
+	case "show":
+		if flags.NArg() != 1 {
+			usage()
+		}
+		e, err := db.GetWebhookEvent(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Event:     %s\nType:      %s\nStatus:    %s\nAttempts:  %d\nSteps:     %s\nError:     %s\nReceived:  %s\n",
+			e.EventID, e.Type, e.Status, e.Attempts, strings.Join(e.Steps, ", "), e.LastError, e.ReceivedAt.In(sales.Eastern).Format(time.RFC1123))
+		if !e.ProcessedAt.IsZero() {
+			fmt.Printf("Processed: %s\n", e.ProcessedAt.In(sales.Eastern).Format(time.RFC1123))
+		}
+		var payload bytes.Buffer
+		if json.Indent(&payload, []byte(e.Payload), "", "  ") != nil {
+			payload.WriteString(e.Payload)
+		}
+		fmt.Printf("\n%s\n", payload.String())
+	case "replay":
+		var ids []string
+		if flags.NArg() == 1 {
+			ids = append(ids, flags.Arg(0))
+		} else if *since != "" {
+			events, err := db.GetWebhookEvents(*status, parseTime(*since), parseTime(*until))
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, e := range events {
+				ids = append(ids, e.EventID)
+			}
+		} else {
+			usage()
+		}
+
+		failed := false
+		for _, id := range ids {
+			result, err := replay(id, *dryRun)
+			if err != nil {
+				log.Fatalf("replaying %s: %v", id, err)
+			}
+			fmt.Println(id)
+			for _, change := range result.Changes {
+				if *dryRun {
+					fmt.Printf("  would %s\n", change)
+				} else {
+					fmt.Printf("  %s\n", change)
+				}
+			}
+			if len(result.Changes) == 0 {
+				fmt.Println("  nothing to do")
+			}
+			if result.Error != "" {
+				fmt.Printf("  error: %s\n", result.Error)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
+
+// replayed is what the site says replaying an event did
+type replayed struct {
+	EventID string   `json:"event_id"`
+	Changes []string `json:"changes"`
+	Error   string   `json:"error"`
+}
+
+// replay has the site replay the event, one at a time so a long run shows how far it's got
+func replay(id string, dryRun bool) (*replayed, error) {
+	siteURL, key := os.Getenv("EXTERNAL_URL"), os.Getenv("WEBHOOKS_API_KEY")
+	if siteURL == "" || key == "" {
+		return nil, errors.New("EXTERNAL_URL and WEBHOOKS_API_KEY need to be set to replay events")
+	}
+
+	form := url.Values{"id": {id}}
+	if dryRun {
+		form.Set("dry-run", "on")
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(siteURL, "/")+"/webhook-replay", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	resp, err := (&http.Client{Timeout: 5 * time.Minute}).Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Newf("site answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var results []replayed
+	if err := json.Unmarshal(body, &results); err != nil {
+		return nil, errors.Wrap(err, "reading the site's answer")
+	}
+	if len(results) != 1 {
+		return nil, errors.Newf("site answered with %d results", len(results))
+	}
+	return &results[0], nil
+}
+
+func parseTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		t, err := time.ParseInLocation(layout, value, sales.Eastern)
+		if err == nil {
+			return t
+		}
+	}
+
+	log.Fatalf("can't read time %q, use 2006-01-02 or 2006-01-02T15:04", value)
+	return time.Time{}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  webhooks list [-status Failed] [-since 2023-03-01] [-until 2023-03-02T12:00]
+  webhooks show <event id>
+  webhooks replay [-dry-run] <event id>
+  webhooks replay [-dry-run] [-status Failed] -since 2023-03-01 [-until 2023-03-02]`)
+	os.Exit(2)
+}
@@ -14,9 +14,20 @@ import (
 	"github.com/vibecamp/myvibecamp/fields"
 )
 
-var stripeFee float64 = 0.03
 var aggregationMutex sync.Mutex
 
+// capacityListeners are called after a cap constant is raised
+var capacityListeners []func()
+
+// OnCapacityIncrease registers fn to run whenever a cap in the constants table goes up
+func OnCapacityIncrease(fn func()) {
+	capacityListeners = append(capacityListeners, fn)
+}
+
+func isCapConstant(name string) bool {
+	return name == fields.SalesCap || name == fields.CabinCap || name == fields.SoftCabinCap || name == fields.SatCap
+}
+
 type Constant struct {
 	Name  string
 	Value int
@@ -38,6 +49,9 @@ type Currency struct {
 }
 
 func CurrencyFromAirtableString(str string) *Currency {
+	if str == "" {
+		return &Currency{}
+	}
 	revenueStr := strings.Replace(str[1:], ",", "", -1)
 	currencyInts, _ := strconv.Atoi(revenueStr[:len(revenueStr)-3])
 	currencyCents, _ := strconv.Atoi(revenueStr[len(revenueStr)-2:])
@@ -78,6 +92,18 @@ func CurrencyFromFloat(curr float64) *Currency {
 	return c
 }
 
+// InCents is exact, unlike ToCurrencyInt which goes through a float
+func (c *Currency) InCents() int64 {
+	return int64(c.Dollars)*100 + int64(c.Cents)
+}
+
+func CurrencyFromCents(cents int64) *Currency {
+	return &Currency{
+		Dollars: int(cents / 100),
+		Cents:   int(cents % 100),
+	}
+}
+
 func (c *Currency) ToFloat() float64 {
 	var curr float64 = float64(c.Dollars)
 	curr += (float64(c.Cents) / 100)
@@ -151,6 +177,7 @@ func getConstantByField(field, value string) (*Constant, error) {
 }
 
 func (c *Constant) UpdateConstantValue(value int) error {
+	raised := value > c.Value
 	c.Value = value
 
 	r := &airtable.Records{
@@ -171,6 +198,12 @@ func (c *Constant) UpdateConstantValue(value int) error {
 		defaultCache.Delete(c.cacheKey())
 	}
 
+	if raised && isCapConstant(c.Name) {
+		for _, fn := range capacityListeners {
+			fn()
+		}
+	}
+
 	return nil
 }
 
@@ -273,40 +306,48 @@ func (a *Aggregation) UpdateAggregation(quantity int, revenue int) error {
 }
 
 func (a *Aggregation) MakeUpdatedRecord(order *Order) *airtable.Record {
+	return a.makeRecord(order, 1)
+}
+
+// makeRecord adds the order to the aggregation, or removes it when sign is -1
+func (a *Aggregation) makeRecord(order *Order, sign int) *airtable.Record {
 	ticketTotal := int((order.Total.ToFloat()-order.ProcessingFee.ToFloat()-float64(order.Donation))*100 + 0.5)
-	donationFee := int(float64(order.Donation)*stripeFee*100 + 0.5)
 	if a.Name == fields.TotalTicketsSold || a.Name == fields.SoftLaunchSold {
-		a.Quantity += order.TotalTickets
-		a.Revenue += ticketTotal
+		a.Quantity += sign * order.TotalTickets
+		a.Revenue += sign * ticketTotal
 	} else if a.Name == fields.CabinSold {
-		a.Quantity += order.AdultCabin + order.ChildCabin + order.ToddlerCabin
-		a.Revenue += ((order.AdultCabin * 590) + (order.ChildCabin * 380)) * 100
+		a.Quantity += sign * (order.AdultCabin + order.ChildCabin + order.ToddlerCabin)
+		a.Revenue += sign * ((order.AdultCabin * 590) + (order.ChildCabin * 380)) * 100
 	} else if a.Name == fields.TentSold {
-		a.Quantity += order.AdultTent + order.ChildTent + order.ToddlerTent
-		a.Revenue += (order.AdultTent * 42069) + (order.ChildTent*210)*100
+		a.Quantity += sign * (order.AdultTent + order.ChildTent + order.ToddlerTent)
+		a.Revenue += sign * ((order.AdultTent * 42069) + (order.ChildTent*210)*100)
 	} else if a.Name == fields.SatSold {
-		a.Quantity += order.AdultSat + order.ChildSat + order.ToddlerSat
-		a.Revenue += ((order.AdultSat * 140) + (order.ChildSat * 70)) * 100
+		a.Quantity += sign * (order.AdultSat + order.ChildSat + order.ToddlerSat)
+		a.Revenue += sign * ((order.AdultSat * 140) + (order.ChildSat * 70)) * 100
 	} else if a.Name == fields.AdultSold {
-		a.Quantity += order.AdultCabin + order.AdultTent + order.AdultSat
-		a.Revenue += ((order.AdultCabin*590)+(order.AdultSat*140))*100 + (order.AdultTent * 42069)
+		a.Quantity += sign * (order.AdultCabin + order.AdultTent + order.AdultSat)
+		a.Revenue += sign * (((order.AdultCabin*590)+(order.AdultSat*140))*100 + (order.AdultTent * 42069))
 	} else if a.Name == fields.ChildSold {
-		a.Quantity += order.ChildCabin + order.ChildTent + order.ChildSat
-		a.Revenue += ((order.ChildCabin * 380) + (order.ChildTent * 210) + (order.ChildSat * 70)) * 100
+		a.Quantity += sign * (order.ChildCabin + order.ChildTent + order.ChildSat)
+		a.Revenue += sign * ((order.ChildCabin * 380) + (order.ChildTent * 210) + (order.ChildSat * 70)) * 100
 	} else if a.Name == fields.ToddlerSold {
-		a.Quantity += order.ToddlerCabin + order.ToddlerTent + order.ToddlerSat
+		a.Quantity += sign * (order.ToddlerCabin + order.ToddlerTent + order.ToddlerSat)
 	} else if a.Name == fields.DonationsRecv {
 		if order.Donation > 0 {
-			a.Quantity += 1
-			newRev := (order.Donation*100 - donationFee)
-			a.Revenue += newRev
+			a.Quantity += sign
+			// any fee on the donation is in the processing fee, so the whole donation comes to us
+			a.Revenue += sign * order.Donation * 100
 		}
 	} else if a.Name == fields.FullSold {
-		a.Quantity += order.AdultCabin + order.AdultTent + order.ChildCabin + order.ChildTent + order.ToddlerCabin + order.ToddlerTent
-		a.Revenue += order.AdultTent*42069 + (order.AdultCabin*590+order.ChildCabin*380+order.ChildTent*210)*100
+		a.Quantity += sign * (order.AdultCabin + order.AdultTent + order.ChildCabin + order.ChildTent + order.ToddlerCabin + order.ToddlerTent)
+		a.Revenue += sign * (order.AdultTent*42069 + (order.AdultCabin*590+order.ChildCabin*380+order.ChildTent*210)*100)
 	} else if a.Name == fields.Sponsorships {
-		a.Quantity += order.TotalTickets
-		a.Revenue += (int(order.Total.ToCurrencyInt() - order.ProcessingFee.ToCurrencyInt()))
+		a.Quantity += sign * order.TotalTickets
+		a.Revenue += sign * int(order.Total.ToCurrencyInt()-order.ProcessingFee.ToCurrencyInt())
+	} else if a.Name == fields.PromoDiscounts {
+		// revenue here is what the codes took off, not what came in
+		a.Quantity += sign
+		a.Revenue += sign * int(order.discount().ToCurrencyInt())
 	}
 
 	cents := a.Revenue % 100
@@ -335,6 +376,15 @@ func (a *Aggregation) MakeUpdatedRecord(order *Order) *airtable.Record {
 }
 
 func UpdateAggregations(order *Order, ticketPath string) error {
+	return updateAggregations(order, ticketPath, 1)
+}
+
+// ReverseAggregations takes a refunded order back out of the aggregations
+func ReverseAggregations(order *Order, ticketPath string) error {
+	return updateAggregations(order, ticketPath, -1)
+}
+
+func updateAggregations(order *Order, ticketPath string, sign int) error {
 	aggregationMutex.Lock()
 	defer aggregationMutex.Unlock()
 	aggregations, err := GetAggregations()
@@ -346,18 +396,22 @@ func UpdateAggregations(order *Order, ticketPath string) error {
 
 	for _, element := range aggregations {
 		if order.Donation > 0 && element.Name == fields.DonationsRecv {
-			records = append(records, element.MakeUpdatedRecord(order))
+			records = append(records, element.makeRecord(order, sign))
 		} else if order.TotalTickets > 0 {
 			if element.Name == fields.SoftLaunchSold {
 				if ticketPath == "2022 Attendee" {
-					records = append(records, element.MakeUpdatedRecord(order))
+					records = append(records, element.makeRecord(order, sign))
 				}
 			} else if element.Name == fields.Sponsorships {
 				if ticketPath == "Sponsorship" {
-					records = append(records, element.MakeUpdatedRecord(order))
+					records = append(records, element.makeRecord(order, sign))
+				}
+			} else if element.Name == fields.PromoDiscounts {
+				if order.PromoCode != "" {
+					records = append(records, element.makeRecord(order, sign))
 				}
 			} else {
-				records = append(records, element.MakeUpdatedRecord(order))
+				records = append(records, element.makeRecord(order, sign))
 			}
 		}
 	}
@@ -371,6 +425,13 @@ func UpdateAggregations(order *Order, ticketPath string) error {
 		return errors.Wrap(err, "updating aggregations")
 	}
 
+	if order.TotalTickets > 0 {
+		err = addPhaseSold(ticketPath, sign*order.TotalTickets)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+// APIKeyScopes are the scopes a key can be given, in the order they're shown
+var APIKeyScopes = []string{
+	fields.ScopeAttendeeRead,
+	fields.ScopeAttendeesRead,
+	fields.ScopeCabinsRead,
+	fields.ScopeDiscordLookup,
+	fields.ScopeOrdersRead,
+	fields.ScopeWebhooksReplay,
+}
+
+// how long a looked up key is trusted before it's looked up again, so revoking one on another instance takes effect
+const apiKeyCacheTime = time.Minute
+
+// APIKey is a machine client's key. Only the hash of the key is kept, the key itself is shown once when it's made.
+type APIKey struct {
+	KeyID     string
+	Name      string
+	Hash      string
+	Scopes    []string
+	CreatedBy string
+	Created   time.Time
+	Expires   time.Time
+	LastUsed  time.Time
+	Revoked   bool
+
+	AirtableID string
+}
+
+func apiKeyFromRecord(rec *airtable.Record) *APIKey {
+	created, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.CreatedAt]))
+	expires, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.Expires]))
+	lastUsed, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.LastUsed]))
+	return &APIKey{
+		KeyID:      toStr(rec.Fields[fields.KeyID]),
+		Name:       toStr(rec.Fields[fields.Name]),
+		Hash:       toStr(rec.Fields[fields.KeyHash]),
+		Scopes:     splitList(toStr(rec.Fields[fields.Scopes])),
+		CreatedBy:  toStr(rec.Fields[fields.CreatedBy]),
+		Created:    created,
+		Expires:    expires,
+		LastUsed:   lastUsed,
+		Revoked:    rec.Fields[fields.Revoked] == checked,
+		AirtableID: rec.ID,
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Active says whether the key can be used
+func (k *APIKey) Active() bool {
+	return !k.Revoked && (k.Expires.IsZero() || time.Now().Before(k.Expires))
+}
+
+// HasScope says whether the key was given scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIKey stores a new key
+func CreateAPIKey(k *APIKey) error {
+	k.Created = time.Now()
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.KeyID:     k.KeyID,
+					fields.Name:      k.Name,
+					fields.KeyHash:   k.Hash,
+					fields.Scopes:    strings.Join(k.Scopes, ", "),
+					fields.CreatedBy: k.CreatedBy,
+					fields.CreatedAt: formatTime(k.Created),
+					fields.Expires:   formatTime(k.Expires),
+				},
+			},
+		},
+	}
+
+	recvRecords, err := apiKeysTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "creating api key")
+	}
+	if recvRecords == nil || len(recvRecords.Records) != 1 {
+		return errors.New("creating api key: no record returned")
+	}
+
+	k.AirtableID = recvRecords.Records[0].ID
+	return nil
+}
+
+// GetAPIKey looks a key up by its id
+func GetAPIKey(keyID string) (*APIKey, error) {
+	cacheKey := "apikey-" + keyID
+	if defaultCache != nil {
+		if k, found := defaultCache.Get(cacheKey); found {
+			key := k.(APIKey)
+			return &key, nil
+		}
+	}
+
+	records, err := query(apiKeysTable, fields.KeyID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if records == nil || len(records.Records) == 0 {
+		return nil, errors.Wrap(ErrNoRecords, "")
+	} else if len(records.Records) != 1 {
+		return nil, errors.Wrap(ErrManyRecords, "")
+	}
+
+	key := apiKeyFromRecord(records.Records[0])
+	if defaultCache != nil {
+		defaultCache.Set(cacheKey, *key, apiKeyCacheTime)
+	}
+	return key, nil
+}
+
+// GetAPIKeys returns every key, newest first
+func GetAPIKeys() ([]*APIKey, error) {
+	records, err := queryAll(apiKeysTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*APIKey, 0, len(records))
+	for _, rec := range records {
+		keys = append(keys, apiKeyFromRecord(rec))
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.After(keys[j].Created)
+	})
+	return keys, nil
+}
+
+func (k *APIKey) update(f map[string]interface{}) error {
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID:     k.AirtableID,
+			Fields: f,
+		}},
+	}
+
+	_, err := apiKeysTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating api key")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete("apikey-" + k.KeyID)
+	}
+	return nil
+}
+
+// Revoke stops the key working
+func (k *APIKey) Revoke() error {
+	k.Revoked = true
+	return k.update(map[string]interface{}{fields.Revoked: true})
+}
+
+// SetExpires changes when the key stops working
+func (k *APIKey) SetExpires(t time.Time) error {
+	k.Expires = t
+	return k.update(map[string]interface{}{fields.Expires: formatTime(t)})
+}
+
+// SetLastUsed records when the key was last used
+func (k *APIKey) SetLastUsed(t time.Time) error {
+	k.LastUsed = t
+	return k.update(map[string]interface{}{fields.LastUsed: formatTime(t)})
+}
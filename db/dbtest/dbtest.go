@@ -0,0 +1,332 @@
+// Package dbtest is an in-memory airtable for tests of code that goes through db. New points db at it, and tests
+// fill in the records they need with Add. It understands the filter formulas db uses, and fails the request for any
+// it doesn't, so a test can't pass by matching everything.
+package dbtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// the tables whose names come from the environment
+const (
+	Attendees    = "Attendees 2023"
+	Orders       = "Orders 2023"
+	Constants    = "Constants"
+	Aggregations = "Aggregations"
+	SoftLaunch   = "Soft Launch"
+)
+
+// how many records airtable gives out a page
+const pageSize = 100
+
+type record struct {
+	ID          string
+	Fields      map[string]interface{}
+	CreatedTime string
+}
+
+// Server is the fake airtable. Tables are made as they're used.
+type Server struct {
+	mutex  sync.Mutex
+	tables map[string][]*record
+	nextID int
+	server *httptest.Server
+	// how many more writes to each table fail
+	failing map[string]int
+	// fields written as numbers that come back as dollar amounts
+	currency map[string]bool
+}
+
+// New starts a server and points db at it until the test ends
+func New(t testing.TB) *Server {
+	s := &Server{tables: map[string][]*record{}, failing: map[string]int{}, currency: map[string]bool{}}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.server.Close)
+
+	t.Setenv("AIRTABLE_API_BASE", s.server.URL+"/v0")
+	t.Setenv("AIRTABLE_2023_BASE", "app2023")
+	t.Setenv("AIRTABLE_ATTENDEE_TABLE", Attendees)
+	t.Setenv("AIRTABLE_ORDER_TABLE", Orders)
+	t.Setenv("AIRTABLE_CONSTANTS_TABLE", Constants)
+	t.Setenv("AIRTABLE_AGG_TABLE", Aggregations)
+	t.Setenv("AIRTABLE_SL_TABLE", SoftLaunch)
+	db.Init("keyTest", "app2022", cache.New(time.Minute, time.Minute))
+	return s
+}
+
+// Add puts a record in table, returning its id
+func (s *Server) Add(table string, fields map[string]interface{}) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.add(table, fields)
+}
+
+func (s *Server) add(table string, fields map[string]interface{}) string {
+	s.nextID++
+	r := &record{
+		ID:          fmt.Sprintf("rec%014d", s.nextID),
+		Fields:      map[string]interface{}{},
+		CreatedTime: time.Now().UTC().Format(time.RFC3339),
+	}
+	for k, v := range fields {
+		r.Fields[k] = v
+	}
+	s.tables[table] = append(s.tables[table], r)
+	return r.ID
+}
+
+// FailWrites makes the next n writes to table fail, like airtable having an outage part way through a change
+func (s *Server) FailWrites(table string, n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing[table] = n
+}
+
+// Currency makes the fields come back as dollar amounts once they're written, like airtable's currency fields
+func (s *Server) Currency(fields ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, f := range fields {
+		s.currency[f] = true
+	}
+}
+
+// Records is every record in table, as the strings airtable would give back
+func (s *Server) Records(table string) []map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var records []map[string]string
+	for _, r := range s.tables[table] {
+		records = append(records, stringFields(r.Fields))
+	}
+	return records
+}
+
+// Get is the record in table with id, as the strings airtable would give back
+func (s *Server) Get(table, id string) map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, r := range s.tables[table] {
+		if r.ID == id {
+			return stringFields(r.Fields)
+		}
+	}
+	return nil
+}
+
+type recordJSON struct {
+	ID          string                 `json:"id,omitempty"`
+	Fields      map[string]interface{} `json:"fields"`
+	CreatedTime string                 `json:"createdTime,omitempty"`
+}
+
+type recordsJSON struct {
+	Records []*recordJSON `json:"records"`
+	Offset  string        `json:"offset,omitempty"`
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	// /v0/<base>/<table>[/<record id>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v0/"), "/", 3)
+	if len(parts) < 2 {
+		http.Error(w, "no table", http.StatusNotFound)
+		return
+	}
+	table := parts[1]
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		if len(parts) == 3 {
+			for _, rec := range s.tables[table] {
+				if rec.ID == parts[2] {
+					writeJSON(w, toJSON(rec, nil))
+					return
+				}
+			}
+			http.Error(w, `{"error":"NOT_FOUND"}`, http.StatusNotFound)
+			return
+		}
+		s.list(w, r, table)
+	case http.MethodPost, http.MethodPatch:
+		if s.failing[table] > 0 {
+			s.failing[table]--
+			http.Error(w, `{"error":"SERVICE_UNAVAILABLE"}`, http.StatusServiceUnavailable)
+			return
+		}
+
+		var body recordsJSON
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		out := recordsJSON{Records: []*recordJSON{}}
+		for _, in := range body.Records {
+			for k, v := range in.Fields {
+				if amount, ok := v.(float64); ok && s.currency[k] {
+					in.Fields[k] = fmt.Sprintf("$%.2f", amount)
+				}
+			}
+
+			var rec *record
+			if in.ID == "" {
+				s.add(table, in.Fields)
+				rec = s.tables[table][len(s.tables[table])-1]
+			} else {
+				for _, existing := range s.tables[table] {
+					if existing.ID == in.ID {
+						rec = existing
+					}
+				}
+				if rec == nil {
+					http.Error(w, `{"error":"ROW_DOES_NOT_EXIST"}`, http.StatusNotFound)
+					return
+				}
+				for k, v := range in.Fields {
+					rec.Fields[k] = v
+				}
+			}
+			out.Records = append(out.Records, toJSON(rec, nil))
+		}
+		writeJSON(w, out)
+	case http.MethodDelete:
+		out := recordsJSON{Records: []*recordJSON{}}
+		ids := r.URL.Query()["records[]"]
+		kept := s.tables[table][:0]
+		for _, rec := range s.tables[table] {
+			deleted := false
+			for _, id := range ids {
+				if rec.ID == id {
+					deleted = true
+				}
+			}
+			if deleted {
+				out.Records = append(out.Records, &recordJSON{ID: rec.ID})
+			} else {
+				kept = append(kept, rec)
+			}
+		}
+		s.tables[table] = kept
+		writeJSON(w, out)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, table string) {
+	q := r.URL.Query()
+
+	var match []*record
+	for _, rec := range s.tables[table] {
+		if formula := q.Get("filterByFormula"); formula != "" {
+			ok, err := eval(formula, stringFields(rec.Fields))
+			if err != nil {
+				http.Error(w, fmt.Sprintf(`{"error":"INVALID_FILTER_BY_FORMULA: %v"}`, err), http.StatusUnprocessableEntity)
+				return
+			}
+			if !ok {
+				continue
+			}
+		}
+		match = append(match, rec)
+	}
+
+	start, _ := strconv.Atoi(q.Get("offset"))
+	if start > len(match) {
+		start = len(match)
+	}
+	end := start + pageSize
+	out := recordsJSON{Records: []*recordJSON{}}
+	if end < len(match) {
+		out.Offset = strconv.Itoa(end)
+	} else {
+		end = len(match)
+	}
+	for _, rec := range match[start:end] {
+		out.Records = append(out.Records, toJSON(rec, q["fields[]"]))
+	}
+	writeJSON(w, out)
+}
+
+// toJSON is rec the way airtable sends it with cellFormat=string, with only the fields in only if there are any
+func toJSON(rec *record, only []string) *recordJSON {
+	out := &recordJSON{ID: rec.ID, CreatedTime: rec.CreatedTime, Fields: map[string]interface{}{}}
+	for k, v := range stringFields(rec.Fields) {
+		if len(only) > 0 && !contains(only, k) {
+			continue
+		}
+		out.Fields[k] = v
+	}
+	return out
+}
+
+// stringFields leaves out empty fields and unticked checkboxes, like airtable does
+func stringFields(fields map[string]interface{}) map[string]string {
+	out := map[string]string{}
+	for k, v := range fields {
+		if s := cellString(v); s != "" {
+			out[k] = s
+		}
+	}
+	return out
+}
+
+func cellString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		if v {
+			return "checked"
+		}
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	case []string:
+		return strings.Join(v, ", ")
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, cellString(item))
+		}
+		return strings.Join(items, ", ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
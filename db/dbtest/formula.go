@@ -0,0 +1,178 @@
+package dbtest
+
+import (
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// eval works out whether a record matches a filter formula. It knows field references, strings, = and !=, and
+// AND, OR, NOT and BLANK, which is everything db filters with apart from dates.
+func eval(formula string, fields map[string]string) (bool, error) {
+	p := &parser{src: formula, fields: fields}
+	v, err := p.expr()
+	if err != nil {
+		return false, err
+	}
+	p.space()
+	if p.pos != len(p.src) {
+		return false, errors.Newf("unexpected %q", p.src[p.pos:])
+	}
+	return truthy(v), nil
+}
+
+// values are strings or bools
+type parser struct {
+	src    string
+	pos    int
+	fields map[string]string
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	return false
+}
+
+func str(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case string:
+		return v
+	}
+	return ""
+}
+
+func (p *parser) space() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *parser) peek(s string) bool {
+	p.space()
+	return strings.HasPrefix(p.src[p.pos:], s)
+}
+
+func (p *parser) expect(s string) error {
+	if !p.peek(s) {
+		return errors.Newf("expected %q at %d in %s", s, p.pos, p.src)
+	}
+	p.pos += len(s)
+	return nil
+}
+
+// expr is an operand, compared to another one if there's an = or != after it
+func (p *parser) expr() (interface{}, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	var not bool
+	switch {
+	case p.peek("!="):
+		not = true
+		p.pos += 2
+	case p.peek("="):
+		p.pos++
+	default:
+		return left, nil
+	}
+
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return (str(left) == str(right)) != not, nil
+}
+
+func (p *parser) operand() (interface{}, error) {
+	p.space()
+	if p.pos >= len(p.src) {
+		return nil, errors.Newf("unexpected end of %s", p.src)
+	}
+
+	switch p.src[p.pos] {
+	case '{':
+		end := strings.IndexByte(p.src[p.pos:], '}')
+		if end < 0 {
+			return nil, errors.Newf("unclosed field in %s", p.src)
+		}
+		name := p.src[p.pos+1 : p.pos+end]
+		p.pos += end + 1
+		return p.fields[name], nil
+	case '"':
+		var b strings.Builder
+		for p.pos++; p.pos < len(p.src); p.pos++ {
+			switch c := p.src[p.pos]; c {
+			case '\\':
+				p.pos++
+				if p.pos < len(p.src) {
+					b.WriteByte(p.src[p.pos])
+				}
+			case '"':
+				p.pos++
+				return b.String(), nil
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return nil, errors.Newf("unclosed string in %s", p.src)
+	}
+
+	open := strings.IndexByte(p.src[p.pos:], '(')
+	if open < 0 {
+		return nil, errors.Newf("unexpected %q", p.src[p.pos:])
+	}
+	name := p.src[p.pos : p.pos+open]
+	p.pos += open + 1
+
+	var args []interface{}
+	for !p.peek(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.pos++
+
+	switch name {
+	case "AND":
+		for _, a := range args {
+			if !truthy(a) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "OR":
+		for _, a := range args {
+			if truthy(a) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "NOT":
+		if len(args) != 1 {
+			return nil, errors.New("NOT takes one argument")
+		}
+		return !truthy(args[0]), nil
+	case "BLANK":
+		return "", nil
+	}
+	return nil, errors.Newf("%s isn't supported", name)
+}
@@ -0,0 +1,39 @@
+package dbtest
+
+import "testing"
+
+func TestEval(t *testing.T) {
+	fields := map[string]string{"Status": "queued", "Name": `say "hi"`, "Ticket ID": "t1"}
+
+	tests := []struct {
+		formula string
+		want    bool
+		err     bool
+	}{
+		{`{Status}="queued"`, true, false},
+		{`{Status}="sent"`, false, false},
+		{`{Status}!="sent"`, true, false},
+		{`{Name}="say \"hi\""`, true, false},
+		{`{Missing}=""`, true, false},
+		{`{Missing}=BLANK()`, true, false},
+		{`AND({Status}="queued",NOT({Ticket ID}=BLANK()))`, true, false},
+		{`AND({Status}="queued",{Ticket ID}="")`, false, false},
+		{`OR({Status}="sent", {Ticket ID}!="")`, true, false},
+		{`OR({Status}="sent",{Status}="failed")`, false, false},
+		{`IS_AFTER({Date}, NOW())`, false, true},
+		{`{Status}="queued`, false, true},
+		{`{Status}="queued")`, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.formula, func(t *testing.T) {
+			got, err := eval(tt.formula, fields)
+			if (err != nil) != tt.err {
+				t.Fatalf("eval() error = %v, want error %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
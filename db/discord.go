@@ -0,0 +1,39 @@
+package db
+
+import (
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+// DiscordRole is a discord role we hand out, and who to
+type DiscordRole struct {
+	RoleID string
+	Name   string
+	Kind   string
+	Value  string
+}
+
+func discordRoleFromRecord(rec *airtable.Record) *DiscordRole {
+	return &DiscordRole{
+		RoleID: toStr(rec.Fields[fields.RoleID]),
+		Name:   toStr(rec.Fields[fields.Name]),
+		Kind:   toStr(rec.Fields[fields.Kind]),
+		Value:  toStr(rec.Fields[fields.Value]),
+	}
+}
+
+// GetDiscordRoles returns every role we manage. Records without a role id are skipped.
+func GetDiscordRoles() ([]*DiscordRole, error) {
+	records, err := queryAll(discordRolesTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make([]*DiscordRole, 0, len(records))
+	for _, rec := range records {
+		if r := discordRoleFromRecord(rec); r.RoleID != "" {
+			roles = append(roles, r)
+		}
+	}
+	return roles, nil
+}
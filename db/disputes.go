@@ -0,0 +1,136 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+// Dispute is a chargeback on one of our payments
+type Dispute struct {
+	DisputeID string
+	OrderID   string
+	PaymentID string
+	UserName  string
+	Amount    *Currency
+	Reason    string
+	Status    string
+	Opened    time.Time
+	Closed    time.Time
+
+	AirtableID string
+}
+
+func (d *Dispute) CreateDispute() error {
+	if d.AirtableID != "" {
+		return errors.New("Dispute already exists")
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.DisputeID: d.DisputeID,
+					fields.OrderID:   d.OrderID,
+					fields.PaymentID: d.PaymentID,
+					fields.UserName:  d.UserName,
+					fields.Amount:    d.Amount.ToFloat(),
+					fields.Reason:    d.Reason,
+					fields.Status:    d.Status,
+					fields.Opened:    d.Opened.UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+
+	recvRecords, err := disputesTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "creating dispute")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return errors.Wrap(ErrManyRecords, "")
+	}
+
+	d.AirtableID = recvRecords.Records[0].ID
+	return nil
+}
+
+func GetDispute(disputeID string) (*Dispute, error) {
+	records, err := query(disputesTable, fields.DisputeID, disputeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records.Records) == 0 {
+		return nil, errors.Wrap(ErrNoRecords, "")
+	} else if len(records.Records) > 1 {
+		return nil, errors.Wrap(ErrManyRecords, "")
+	}
+
+	return disputeFromRecord(records.Records[0]), nil
+}
+
+// GetDisputes returns every dispute, newest first
+func GetDisputes() ([]*Dispute, error) {
+	records, err := queryAll(disputesTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	disputes := make([]*Dispute, 0, len(records))
+	for _, rec := range records {
+		disputes = append(disputes, disputeFromRecord(rec))
+	}
+
+	sort.SliceStable(disputes, func(i, j int) bool {
+		return disputes[i].Opened.After(disputes[j].Opened)
+	})
+
+	return disputes, nil
+}
+
+func disputeFromRecord(rec *airtable.Record) *Dispute {
+	opened, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.Opened]))
+	closed, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.Closed]))
+	return &Dispute{
+		AirtableID: rec.ID,
+		DisputeID:  toStr(rec.Fields[fields.DisputeID]),
+		OrderID:    toStr(rec.Fields[fields.OrderID]),
+		PaymentID:  toStr(rec.Fields[fields.PaymentID]),
+		UserName:   toStr(rec.Fields[fields.UserName]),
+		Amount:     CurrencyFromAirtableString(toStr(rec.Fields[fields.Amount])),
+		Reason:     toStr(rec.Fields[fields.Reason]),
+		Status:     toStr(rec.Fields[fields.Status]),
+		Opened:     opened,
+		Closed:     closed,
+	}
+}
+
+// Close records how the dispute ended
+func (d *Dispute) Close(status string, closed time.Time) error {
+	d.Status = status
+	d.Closed = closed
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: d.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Status: d.Status,
+				fields.Closed: d.Closed.UTC().Format(time.RFC3339),
+			},
+		}},
+	}
+
+	_, err := disputesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "closing dispute")
+	}
+
+	return nil
+}
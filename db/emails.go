@@ -0,0 +1,187 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+// EmailAttachment is a file sent along with an email. The outbox only keeps its Source, what it's rendered from
+// when the email is sent, so files don't end up in airtable. Data is the rendered file.
+type EmailAttachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Source      string `json:"source"`
+	// emails queued before attachments had sources kept the file itself
+	Data []byte `json:"data,omitempty"`
+}
+
+// OutboxEmail is an email waiting to go out, or one that's been sent
+type OutboxEmail struct {
+	Key         string
+	To          string
+	Subject     string
+	Body        string
+	Attachments []EmailAttachment
+	Status      string
+	Attempts    int
+	LastError   string
+	QueuedAt    time.Time
+	SentAt      time.Time
+
+	AirtableID string
+}
+
+var outboxMutex sync.Mutex
+
+// QueueEmail adds the email to the outbox. If it has a key and an email with that key was already queued,
+// the earlier one is returned instead and queued is false.
+func QueueEmail(e *OutboxEmail) (stored *OutboxEmail, queued bool, err error) {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+
+	if e.Key != "" {
+		records, err := query(emailOutboxTable, fields.EmailKey, e.Key)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(records.Records) > 0 {
+			return outboxEmailFromRecord(records.Records[0]), false, nil
+		}
+	}
+
+	refs := make([]EmailAttachment, 0, len(e.Attachments))
+	for _, a := range e.Attachments {
+		if a.Source == "" {
+			return nil, false, errors.Newf("attachment %s has nothing to render it from", a.Name)
+		}
+		refs = append(refs, EmailAttachment{Name: a.Name, ContentType: a.ContentType, Source: a.Source})
+	}
+
+	attachments, err := json.Marshal(refs)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "encoding attachments")
+	}
+
+	e.Status = fields.EmailQueued
+	e.QueuedAt = time.Now()
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.EmailKey:    e.Key,
+					fields.To:          e.To,
+					fields.Subject:     e.Subject,
+					fields.Body:        e.Body,
+					fields.Attachments: string(attachments),
+					fields.Status:      e.Status,
+					fields.QueuedAt:    e.QueuedAt.UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+
+	recvRecords, err := emailOutboxTable.AddRecords(r)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "queueing email")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return nil, false, errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return nil, false, errors.Wrap(ErrManyRecords, "")
+	}
+
+	e.AirtableID = recvRecords.Records[0].ID
+	return e, true, nil
+}
+
+// GetQueuedEmails returns emails that haven't gone out yet, oldest first
+func GetQueuedEmails() ([]*OutboxEmail, error) {
+	return getOutboxEmails(fmt.Sprintf(`{%s}="%s"`, fields.Status, fields.EmailQueued))
+}
+
+// GetOutboxEmails returns every email in the outbox with the status, or all of them if it's blank, oldest first
+func GetOutboxEmails(status string) ([]*OutboxEmail, error) {
+	filterFormula := ""
+	if status != "" {
+		filterFormula = fmt.Sprintf(`{%s}="%s"`, fields.Status, status)
+	}
+	return getOutboxEmails(filterFormula)
+}
+
+func getOutboxEmails(filterFormula string) ([]*OutboxEmail, error) {
+	records, err := queryAll(emailOutboxTable, filterFormula)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := make([]*OutboxEmail, 0, len(records))
+	for _, rec := range records {
+		emails = append(emails, outboxEmailFromRecord(rec))
+	}
+
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].QueuedAt.Before(emails[j].QueuedAt)
+	})
+
+	return emails, nil
+}
+
+func outboxEmailFromRecord(rec *airtable.Record) *OutboxEmail {
+	queued, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.QueuedAt]))
+	sent, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.SentAt]))
+
+	var attachments []EmailAttachment
+	if a := toStr(rec.Fields[fields.Attachments]); a != "" {
+		_ = json.Unmarshal([]byte(a), &attachments)
+	}
+
+	return &OutboxEmail{
+		AirtableID:  rec.ID,
+		Key:         toStr(rec.Fields[fields.EmailKey]),
+		To:          toStr(rec.Fields[fields.To]),
+		Subject:     toStr(rec.Fields[fields.Subject]),
+		Body:        toStr(rec.Fields[fields.Body]),
+		Attachments: attachments,
+		Status:      toStr(rec.Fields[fields.Status]),
+		Attempts:    toInt(rec.Fields[fields.Attempts]),
+		LastError:   toStr(rec.Fields[fields.LastError]),
+		QueuedAt:    queued,
+		SentAt:      sent,
+	}
+}
+
+// Update saves the email's status, attempts, last error and when it was sent
+func (e *OutboxEmail) Update() error {
+	sent := ""
+	if !e.SentAt.IsZero() {
+		sent = e.SentAt.UTC().Format(time.RFC3339)
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: e.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Status:    e.Status,
+				fields.Attempts:  e.Attempts,
+				fields.LastError: e.LastError,
+				fields.SentAt:    sent,
+			},
+		}},
+	}
+
+	_, err := emailOutboxTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating email")
+	}
+
+	return nil
+}
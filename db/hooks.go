@@ -0,0 +1,339 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+// HookEvents are the events an endpoint can subscribe to, in the order they're shown
+var HookEvents = []string{
+	fields.HookTicketIssued,
+	fields.HookOrderRefunded,
+	fields.HookCheckedIn,
+	fields.HookLogisticsUpdated,
+}
+
+// HookEndpoint is a URL we send events to
+type HookEndpoint struct {
+	EndpointID string
+	Name       string
+	URL        string
+	Secret     string
+	Events     []string
+	Disabled   bool
+	CreatedBy  string
+	Created    time.Time
+
+	AirtableID string
+}
+
+// Wants says whether the endpoint should get the event. One with no events listed gets all of them.
+func (e *HookEndpoint) Wants(event string) bool {
+	if e.Disabled {
+		return false
+	}
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, ev := range e.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+func hookEndpointFromRecord(rec *airtable.Record) *HookEndpoint {
+	created, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.CreatedAt]))
+	return &HookEndpoint{
+		EndpointID: toStr(rec.Fields[fields.EndpointID]),
+		Name:       toStr(rec.Fields[fields.Name]),
+		URL:        toStr(rec.Fields[fields.URL]),
+		Secret:     toStr(rec.Fields[fields.Secret]),
+		Events:     splitList(toStr(rec.Fields[fields.Events])),
+		Disabled:   rec.Fields[fields.Disabled] == checked,
+		CreatedBy:  toStr(rec.Fields[fields.CreatedBy]),
+		Created:    created,
+		AirtableID: rec.ID,
+	}
+}
+
+// CreateHookEndpoint stores a new endpoint
+func CreateHookEndpoint(e *HookEndpoint) error {
+	e.Created = time.Now()
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.EndpointID: e.EndpointID,
+					fields.Name:       e.Name,
+					fields.URL:        e.URL,
+					fields.Secret:     e.Secret,
+					fields.Events:     strings.Join(e.Events, ", "),
+					fields.CreatedBy:  e.CreatedBy,
+					fields.CreatedAt:  formatTime(e.Created),
+				},
+			},
+		},
+	}
+
+	recvRecords, err := hookEndpointsTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "creating webhook endpoint")
+	}
+	if recvRecords == nil || len(recvRecords.Records) != 1 {
+		return errors.New("creating webhook endpoint: no record returned")
+	}
+
+	e.AirtableID = recvRecords.Records[0].ID
+	if defaultCache != nil {
+		defaultCache.Delete("hook-endpoints")
+	}
+	return nil
+}
+
+// GetHookEndpoints returns every endpoint, oldest first. They're cached for a minute, events look them up a lot.
+func GetHookEndpoints() ([]*HookEndpoint, error) {
+	if defaultCache != nil {
+		if e, found := defaultCache.Get("hook-endpoints"); found {
+			return e.([]*HookEndpoint), nil
+		}
+	}
+
+	records, err := queryAll(hookEndpointsTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]*HookEndpoint, 0, len(records))
+	for _, rec := range records {
+		endpoints = append(endpoints, hookEndpointFromRecord(rec))
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].Created.Before(endpoints[j].Created)
+	})
+
+	if defaultCache != nil {
+		defaultCache.Set("hook-endpoints", endpoints, time.Minute)
+	}
+	return endpoints, nil
+}
+
+// GetHookEndpoint looks an endpoint up by its id
+func GetHookEndpoint(endpointID string) (*HookEndpoint, error) {
+	endpoints, err := GetHookEndpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range endpoints {
+		if e.EndpointID == endpointID {
+			return e, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrNoRecords, "webhook endpoint %s", endpointID)
+}
+
+// SetDisabled stops or starts events going to the endpoint
+func (e *HookEndpoint) SetDisabled(disabled bool) error {
+	e.Disabled = disabled
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: e.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Disabled: disabled,
+			},
+		}},
+	}
+
+	_, err := hookEndpointsTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating webhook endpoint")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete("hook-endpoints")
+	}
+	return nil
+}
+
+// HookDelivery is one event going to one endpoint, and how it went
+type HookDelivery struct {
+	DeliveryID     string
+	Key            string
+	EndpointID     string
+	Event          string
+	Payload        string
+	Status         string
+	Attempts       int
+	ResponseStatus int
+	LastError      string
+	QueuedAt       time.Time
+	NextAttempt    time.Time
+	DeliveredAt    time.Time
+
+	AirtableID string
+}
+
+var hookDeliveryMutex sync.Mutex
+
+// QueueHookDelivery stores a delivery. If it has a key and a delivery with that key was already queued,
+// the earlier one is returned instead and queued is false.
+func QueueHookDelivery(d *HookDelivery) (stored *HookDelivery, queued bool, err error) {
+	hookDeliveryMutex.Lock()
+	defer hookDeliveryMutex.Unlock()
+
+	if d.Key != "" {
+		records, err := query(hookDeliveriesTable, fields.EmailKey, d.Key)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(records.Records) > 0 {
+			return hookDeliveryFromRecord(records.Records[0]), false, nil
+		}
+	}
+
+	d.Status = fields.DeliveryPending
+	d.QueuedAt = time.Now()
+	d.NextAttempt = d.QueuedAt
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.DeliveryID:  d.DeliveryID,
+					fields.EmailKey:    d.Key,
+					fields.EndpointID:  d.EndpointID,
+					fields.EventType:   d.Event,
+					fields.Payload:     d.Payload,
+					fields.Status:      d.Status,
+					fields.QueuedAt:    formatTime(d.QueuedAt),
+					fields.NextAttempt: formatTime(d.NextAttempt),
+				},
+			},
+		},
+	}
+
+	recvRecords, err := hookDeliveriesTable.AddRecords(r)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "queueing webhook delivery")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return nil, false, errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return nil, false, errors.Wrap(ErrManyRecords, "")
+	}
+
+	d.AirtableID = recvRecords.Records[0].ID
+	return d, true, nil
+}
+
+// GetHookDelivery looks a delivery up by its id
+func GetHookDelivery(deliveryID string) (*HookDelivery, error) {
+	records, err := query(hookDeliveriesTable, fields.DeliveryID, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records.Records) == 0 {
+		return nil, errors.Wrap(ErrNoRecords, "")
+	} else if len(records.Records) > 1 {
+		return nil, errors.Wrap(ErrManyRecords, "")
+	}
+
+	return hookDeliveryFromRecord(records.Records[0]), nil
+}
+
+// GetPendingHookDeliveries returns deliveries that haven't gone through yet, oldest first
+func GetPendingHookDeliveries() ([]*HookDelivery, error) {
+	return getHookDeliveries(fmt.Sprintf(`{%s}="%s"`, fields.Status, fields.DeliveryPending))
+}
+
+// GetHookDeliveries returns deliveries queued since, newest first
+func GetHookDeliveries(since time.Time) ([]*HookDelivery, error) {
+	deliveries, err := getHookDeliveries("")
+	if err != nil {
+		return nil, err
+	}
+
+	recent := make([]*HookDelivery, 0, len(deliveries))
+	for i := len(deliveries) - 1; i >= 0; i-- {
+		if !deliveries[i].QueuedAt.Before(since) {
+			recent = append(recent, deliveries[i])
+		}
+	}
+	return recent, nil
+}
+
+func getHookDeliveries(filterFormula string) ([]*HookDelivery, error) {
+	records, err := queryAll(hookDeliveriesTable, filterFormula)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]*HookDelivery, 0, len(records))
+	for _, rec := range records {
+		deliveries = append(deliveries, hookDeliveryFromRecord(rec))
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].QueuedAt.Before(deliveries[j].QueuedAt)
+	})
+
+	return deliveries, nil
+}
+
+func hookDeliveryFromRecord(rec *airtable.Record) *HookDelivery {
+	queued, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.QueuedAt]))
+	next, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.NextAttempt]))
+	delivered, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.DeliveredAt]))
+	return &HookDelivery{
+		AirtableID:     rec.ID,
+		DeliveryID:     toStr(rec.Fields[fields.DeliveryID]),
+		Key:            toStr(rec.Fields[fields.EmailKey]),
+		EndpointID:     toStr(rec.Fields[fields.EndpointID]),
+		Event:          toStr(rec.Fields[fields.EventType]),
+		Payload:        toStr(rec.Fields[fields.Payload]),
+		Status:         toStr(rec.Fields[fields.Status]),
+		Attempts:       toInt(rec.Fields[fields.Attempts]),
+		ResponseStatus: toInt(rec.Fields[fields.ResponseStatus]),
+		LastError:      toStr(rec.Fields[fields.LastError]),
+		QueuedAt:       queued,
+		NextAttempt:    next,
+		DeliveredAt:    delivered,
+	}
+}
+
+// Update saves the delivery's status, attempts, response and when it's next tried
+func (d *HookDelivery) Update() error {
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: d.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Status:         d.Status,
+				fields.Attempts:       d.Attempts,
+				fields.ResponseStatus: d.ResponseStatus,
+				fields.LastError:      d.LastError,
+				fields.NextAttempt:    formatTime(d.NextAttempt),
+				fields.DeliveredAt:    formatTime(d.DeliveredAt),
+			},
+		}},
+	}
+
+	_, err := hookDeliveriesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating webhook delivery")
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+// Installment is one scheduled payment on an order's payment plan. Number 1 is the deposit.
+type Installment struct {
+	OrderID   string
+	Number    int
+	Amount    *Currency
+	Due       time.Time
+	Status    string
+	PaymentID string
+	Attempts  int
+
+	AirtableID string
+}
+
+func (i *Installment) CreateInstallment() error {
+	if i.AirtableID != "" {
+		return errors.New("Installment already exists")
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.OrderID:           i.OrderID,
+					fields.InstallmentNumber: i.Number,
+					fields.Amount:            i.Amount.ToFloat(),
+					fields.Due:               i.Due.UTC().Format(time.RFC3339),
+					fields.Status:            i.Status,
+					fields.PaymentID:         i.PaymentID,
+					fields.Attempts:          i.Attempts,
+				},
+			},
+		},
+	}
+
+	recvRecords, err := installmentsTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "creating installment")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return errors.Wrap(ErrManyRecords, "")
+	}
+
+	i.AirtableID = recvRecords.Records[0].ID
+	return nil
+}
+
+// GetInstallments returns an order's installments in order
+func GetInstallments(orderID string) ([]*Installment, error) {
+	return getInstallmentsByField(fields.OrderID, orderID)
+}
+
+// GetInstallmentsByStatus returns every installment with the status, soonest due first
+func GetInstallmentsByStatus(status string) ([]*Installment, error) {
+	installments, err := getInstallmentsByField(fields.Status, status)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(installments, func(i, j int) bool {
+		return installments[i].Due.Before(installments[j].Due)
+	})
+
+	return installments, nil
+}
+
+// GetAllInstallments returns every installment on every plan
+func GetAllInstallments() ([]*Installment, error) {
+	return getInstallments("")
+}
+
+func getInstallmentsByField(field, value string) ([]*Installment, error) {
+	return getInstallments(fmt.Sprintf(`{%s}="%s"`, field, value))
+}
+
+func getInstallments(filterFormula string) ([]*Installment, error) {
+	records, err := queryAll(installmentsTable, filterFormula)
+	if err != nil {
+		return nil, err
+	}
+
+	installments := make([]*Installment, 0, len(records))
+	for _, rec := range records {
+		due, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.Due]))
+		installments = append(installments, &Installment{
+			AirtableID: rec.ID,
+			OrderID:    toStr(rec.Fields[fields.OrderID]),
+			Number:     toInt(rec.Fields[fields.InstallmentNumber]),
+			Amount:     CurrencyFromAirtableString(toStr(rec.Fields[fields.Amount])),
+			Due:        due,
+			Status:     toStr(rec.Fields[fields.Status]),
+			PaymentID:  toStr(rec.Fields[fields.PaymentID]),
+			Attempts:   toInt(rec.Fields[fields.Attempts]),
+		})
+	}
+
+	sort.SliceStable(installments, func(i, j int) bool {
+		return installments[i].Number < installments[j].Number
+	})
+
+	return installments, nil
+}
+
+// Update saves the installment's status, payment, attempts and due date
+func (i *Installment) Update() error {
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: i.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Status:    i.Status,
+				fields.PaymentID: i.PaymentID,
+				fields.Attempts:  i.Attempts,
+				fields.Due:       i.Due.UTC().Format(time.RFC3339),
+			},
+		}},
+	}
+
+	_, err := installmentsTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating installment")
+	}
+
+	return nil
+}
@@ -0,0 +1,313 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+type LotteryEntry struct {
+	UserName       string
+	Name           string
+	Email          string
+	AdmissionLevel string
+	Quantity       int
+	Returning      bool
+	Applied        bool
+	Status         string
+	Round          string
+	Weight         int
+	DrawPosition   int
+
+	AirtableID string
+}
+
+// LotteryDraw is one round of the lottery. It's committed before it's drawn, and the secret stays unpublished until
+// then.
+type LotteryDraw struct {
+	Round          string
+	Status         string
+	Entries        int
+	Winners        int
+	EntriesHash    string
+	SeedCommitment string
+	SeedSource     string
+	Secret         string
+	Beacon         string
+	Seed           string
+	ResultHash     string
+	Date           string
+	// the weights the round was committed with
+	ReturningWeight   int
+	ApplicationWeight int
+
+	AirtableID string
+}
+
+func (e *LotteryEntry) CreateLotteryEntry() error {
+	if e.AirtableID != "" {
+		return errors.New("Lottery entry already exists")
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.UserName:         e.UserName,
+					fields.Name:             e.Name,
+					fields.Email:            e.Email,
+					fields.AdmissionLevel:   e.AdmissionLevel,
+					fields.TicketsRequested: e.Quantity,
+					fields.Returning:        e.Returning,
+					fields.Applied:          e.Applied,
+					fields.LotteryStatus:    e.Status,
+				},
+			},
+		},
+	}
+
+	recvRecords, err := lotteryEntriesTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "creating lottery entry")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return errors.Wrap(ErrManyRecords, "")
+	}
+
+	e.AirtableID = recvRecords.Records[0].ID
+	return nil
+}
+
+// GetLotteryEntry returns a user's entry, or ErrNoRecords if they haven't entered
+func GetLotteryEntry(userName string) (*LotteryEntry, error) {
+	entries, err := getLotteryEntriesByField(fields.UserName, strings.ToLower(userName))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.Wrap(ErrNoRecords, "")
+	} else if len(entries) != 1 {
+		return nil, errors.Wrap(ErrManyRecords, "")
+	}
+
+	return entries[0], nil
+}
+
+// GetLotteryEntriesByStatus returns every entry with the given status, sorted by username
+func GetLotteryEntriesByStatus(status string) ([]*LotteryEntry, error) {
+	return getLotteryEntriesByField(fields.LotteryStatus, status)
+}
+
+// GetLotteryEntriesByRound returns every entry committed to the round, sorted by username
+func GetLotteryEntriesByRound(round string) ([]*LotteryEntry, error) {
+	return getLotteryEntriesByField(fields.Round, round)
+}
+
+func getLotteryEntriesByField(field, value string) ([]*LotteryEntry, error) {
+	filterFormula := fmt.Sprintf(`{%s}="%s"`, field, strings.ReplaceAll(value, `"`, `\"`))
+	records, err := queryAll(lotteryEntriesTable, filterFormula)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*LotteryEntry, 0, len(records))
+	for _, rec := range records {
+		entries = append(entries, &LotteryEntry{
+			AirtableID:     rec.ID,
+			UserName:       toStr(rec.Fields[fields.UserName]),
+			Name:           toStr(rec.Fields[fields.Name]),
+			Email:          toStr(rec.Fields[fields.Email]),
+			AdmissionLevel: toStr(rec.Fields[fields.AdmissionLevel]),
+			Quantity:       toInt(rec.Fields[fields.TicketsRequested]),
+			Returning:      rec.Fields[fields.Returning] == checked,
+			Applied:        rec.Fields[fields.Applied] == checked,
+			Status:         toStr(rec.Fields[fields.LotteryStatus]),
+			Round:          toStr(rec.Fields[fields.Round]),
+			Weight:         toInt(rec.Fields[fields.Weight]),
+			DrawPosition:   toInt(rec.Fields[fields.DrawPosition]),
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].UserName < entries[j].UserName
+	})
+
+	return entries, nil
+}
+
+func (e *LotteryEntry) SetLotteryResult(status string, weight, position int) error {
+	e.Status = status
+	e.Weight = weight
+	e.DrawPosition = position
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: e.AirtableID,
+			Fields: map[string]interface{}{
+				fields.LotteryStatus: e.Status,
+				fields.Weight:        e.Weight,
+				fields.DrawPosition:  e.DrawPosition,
+			},
+		}},
+	}
+
+	_, err := lotteryEntriesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "setting lottery result")
+	}
+
+	return nil
+}
+
+// SetLotteryRound commits entries to round, ten at a time since that's as many as airtable takes
+func SetLotteryRound(entries []*LotteryEntry, round string) error {
+	for start := 0; start < len(entries); start += 10 {
+		end := start + 10
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		r := &airtable.Records{}
+		for _, e := range entries[start:end] {
+			r.Records = append(r.Records, &airtable.Record{
+				ID:     e.AirtableID,
+				Fields: map[string]interface{}{fields.Round: round},
+			})
+		}
+
+		_, err := lotteryEntriesTable.UpdateRecordsPartial(r)
+		if err != nil {
+			return errors.Wrap(err, "setting lottery round")
+		}
+		for _, e := range entries[start:end] {
+			e.Round = round
+		}
+	}
+	return nil
+}
+
+func (d *LotteryDraw) CreateLotteryDraw() error {
+	if d.AirtableID != "" {
+		return errors.New("Lottery draw already exists")
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.Round:             d.Round,
+					fields.DrawStatus:        d.Status,
+					fields.Entries:           d.Entries,
+					fields.Winners:           d.Winners,
+					fields.EntriesHash:       d.EntriesHash,
+					fields.SeedCommitment:    d.SeedCommitment,
+					fields.SeedSource:        d.SeedSource,
+					fields.Secret:            d.Secret,
+					fields.Date:              d.Date,
+					fields.ReturningWeight:   d.ReturningWeight,
+					fields.ApplicationWeight: d.ApplicationWeight,
+				},
+			},
+		},
+	}
+
+	recvRecords, err := lotteryDrawsTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "creating lottery draw")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return errors.Wrap(ErrManyRecords, "")
+	}
+
+	d.AirtableID = recvRecords.Records[0].ID
+	return nil
+}
+
+// GetLotteryDraws returns every published draw, newest first
+func GetLotteryDraws() ([]*LotteryDraw, error) {
+	records, err := queryAll(lotteryDrawsTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	draws := make([]*LotteryDraw, 0, len(records))
+	for _, rec := range records {
+		draws = append(draws, &LotteryDraw{
+			AirtableID:        rec.ID,
+			Round:             toStr(rec.Fields[fields.Round]),
+			Status:            toStr(rec.Fields[fields.DrawStatus]),
+			Entries:           toInt(rec.Fields[fields.Entries]),
+			Winners:           toInt(rec.Fields[fields.Winners]),
+			EntriesHash:       toStr(rec.Fields[fields.EntriesHash]),
+			SeedCommitment:    toStr(rec.Fields[fields.SeedCommitment]),
+			SeedSource:        toStr(rec.Fields[fields.SeedSource]),
+			Secret:            toStr(rec.Fields[fields.Secret]),
+			Beacon:            toStr(rec.Fields[fields.Beacon]),
+			Seed:              toStr(rec.Fields[fields.Seed]),
+			ResultHash:        toStr(rec.Fields[fields.ResultHash]),
+			Date:              toStr(rec.Fields[fields.Date]),
+			ReturningWeight:   toInt(rec.Fields[fields.ReturningWeight]),
+			ApplicationWeight: toInt(rec.Fields[fields.ApplicationWeight]),
+		})
+	}
+
+	sort.SliceStable(draws, func(i, j int) bool {
+		return draws[i].Date > draws[j].Date
+	})
+
+	return draws, nil
+}
+
+// SetDrawn publishes the seed and result of a committed draw
+func (d *LotteryDraw) SetDrawn(beacon, seed, resultHash string) error {
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: d.AirtableID,
+			Fields: map[string]interface{}{
+				fields.DrawStatus: fields.DrawDrawn,
+				fields.Beacon:     beacon,
+				fields.Seed:       seed,
+				fields.ResultHash: resultHash,
+			},
+		}},
+	}
+
+	_, err := lotteryDrawsTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "publishing lottery draw")
+	}
+
+	d.Status, d.Beacon, d.Seed, d.ResultHash = fields.DrawDrawn, beacon, seed, resultHash
+	return nil
+}
+
+// SetAborted gives up on a committed draw without drawing it, so another round can be committed
+func (d *LotteryDraw) SetAborted() error {
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: d.AirtableID,
+			Fields: map[string]interface{}{
+				fields.DrawStatus: fields.DrawAborted,
+			},
+		}},
+	}
+
+	_, err := lotteryDrawsTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "aborting lottery draw")
+	}
+
+	d.Status = fields.DrawAborted
+	return nil
+}
@@ -24,6 +24,8 @@ type Order struct {
 	UserName        string
 	Total           *Currency
 	ProcessingFee   *Currency
+	FeePolicy       string
+	StripeFee       *Currency
 	TotalTickets    int
 	AdultCabin      int
 	AdultTent       int
@@ -42,9 +44,18 @@ type Order struct {
 	SleepingBags    int
 	SheetSets       int
 	Pillows         int
+	PromoCode       string
+	Discount        *Currency
+	InstallmentPlan int
+	AmountPaid      *Currency
+	StripeCustomer  string
+	PaymentMethod   string
+	DisputeStatus   string
 	StripeID        string
 	PaymentStatus   string
 	Date            string
+	// steps done to the order outside a webhook event, so a retry can pick up where it stopped
+	Steps []string
 
 	AirtableID string
 }
@@ -76,6 +87,7 @@ func (o *Order) CreateOrder() error {
 					fields.OrderID:         o.OrderID,
 					fields.Total:           o.Total.ToFloat(),
 					fields.ProcessingFee:   o.ProcessingFee.ToFloat(),
+					fields.FeePolicy:       o.FeePolicy,
 					fields.TotalTickets:    o.TotalTickets,
 					fields.AdultCabin:      o.AdultCabin,
 					fields.AdultTent:       o.AdultTent,
@@ -94,6 +106,10 @@ func (o *Order) CreateOrder() error {
 					fields.SheetSets:       o.SheetSets,
 					fields.Pillows:         o.Pillows,
 					fields.Donation:        o.Donation,
+					fields.PromoCode:       o.PromoCode,
+					fields.Discount:        o.discount().ToFloat(),
+					fields.InstallmentPlan: o.InstallmentPlan,
+					fields.StripeCustomer:  o.StripeCustomer,
 					fields.PaymentID:       o.StripeID,
 					fields.PaymentStatus:   o.PaymentStatus,
 					fields.Date:            o.Date,
@@ -133,7 +149,7 @@ func GetOrder(orderId string) (*Order, error) {
 	order, err := getOrderByField(fields.OrderID, orderId)
 	if err != nil {
 		if errors.Is(err, ErrNoRecords) {
-			err = errors.New("No order found! There may have been a mistake")
+			err = errors.Mark(errors.New("No order found! There may have been a mistake"), ErrNoRecords)
 		} else if errors.Is(err, ErrManyRecords) {
 			err = errors.New("Multiple orders found, looks like we may have had an issue")
 		}
@@ -173,14 +189,72 @@ func getOrderByField(field, value string) (*Order, error) {
 		return nil, errors.Wrap(ErrManyRecords, "")
 	}
 
-	rec := response.Records[0]
+	o := orderFromRecord(response.Records[0])
+
+	if defaultCache != nil {
+		var b bytes.Buffer
+		err := gob.NewEncoder(&b).Encode(*o)
+		if err != nil {
+			return nil, errors.Wrap(err, "cache save")
+		}
+		defaultCache.Set(o.cacheKey(), b.Bytes(), 0)
+	}
 
-	o := &Order{
+	return o, nil
+}
+
+// GetOrders returns every order
+func GetOrders() ([]*Order, error) {
+	records, err := queryAll(ordersTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]*Order, 0, len(records))
+	for _, rec := range records {
+		orders = append(orders, orderFromRecord(rec))
+	}
+	return orders, nil
+}
+
+// GetOrdersByUser returns every order userName has made
+func GetOrdersByUser(userName string) ([]*Order, error) {
+	records, err := queryAll(ordersTable, fmt.Sprintf(`{%s}="%s"`, fields.UserName, strings.ReplaceAll(userName, `"`, `\"`)))
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]*Order, 0, len(records))
+	for _, rec := range records {
+		orders = append(orders, orderFromRecord(rec))
+	}
+	return orders, nil
+}
+
+// GetUnpaidOrders returns orders with a payment intent that hasn't gone through, new or failed
+func GetUnpaidOrders() ([]*Order, error) {
+	records, err := queryAll(ordersTable, fmt.Sprintf(`AND({%s}!="",OR({%s}="",{%s}="failed"))`,
+		fields.PaymentID, fields.PaymentStatus, fields.PaymentStatus))
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]*Order, 0, len(records))
+	for _, rec := range records {
+		orders = append(orders, orderFromRecord(rec))
+	}
+	return orders, nil
+}
+
+func orderFromRecord(rec *airtable.Record) *Order {
+	return &Order{
 		AirtableID:      rec.ID,
 		UserName:        toStr(rec.Fields[fields.UserName]),
 		OrderID:         toStr(rec.Fields[fields.OrderID]),
 		Total:           CurrencyFromAirtableString(toStr(rec.Fields[fields.Total])),
 		ProcessingFee:   CurrencyFromAirtableString(toStr(rec.Fields[fields.ProcessingFee])),
+		FeePolicy:       toStr(rec.Fields[fields.FeePolicy]),
+		StripeFee:       CurrencyFromAirtableString(toStr(rec.Fields[fields.StripeFee])),
 		Donation:        CurrencyFromAirtableString(toStr(rec.Fields[fields.Donation])).Dollars,
 		TotalTickets:    toInt(rec.Fields[fields.TotalTickets]),
 		AdultCabin:      toInt(rec.Fields[fields.AdultCabin]),
@@ -198,38 +272,98 @@ func getOrderByField(field, value string) (*Order, error) {
 		SleepingBags:    toInt(rec.Fields[fields.SleepingBags]),
 		SheetSets:       toInt(rec.Fields[fields.SheetSets]),
 		Pillows:         toInt(rec.Fields[fields.Pillows]),
+		PromoCode:       toStr(rec.Fields[fields.PromoCode]),
+		Discount:        CurrencyFromAirtableString(toStr(rec.Fields[fields.Discount])),
+		InstallmentPlan: toInt(rec.Fields[fields.InstallmentPlan]),
+		AmountPaid:      CurrencyFromAirtableString(toStr(rec.Fields[fields.AmountPaid])),
+		StripeCustomer:  toStr(rec.Fields[fields.StripeCustomer]),
+		PaymentMethod:   toStr(rec.Fields[fields.PaymentMethod]),
+		DisputeStatus:   toStr(rec.Fields[fields.DisputeStatus]),
 		StripeID:        toStr(rec.Fields[fields.PaymentID]),
 		PaymentStatus:   toStr(rec.Fields[fields.PaymentStatus]),
 		Date:            toStr(rec.Fields[fields.Date]),
+		Steps:           splitList(toStr(rec.Fields[fields.Steps])),
+	}
+}
+
+func (o *Order) UpdateOrderStatus(paymentStatus string) error {
+	o.PaymentStatus = paymentStatus
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: o.AirtableID,
+			Fields: map[string]interface{}{
+				fields.PaymentStatus: o.PaymentStatus,
+			},
+		}},
+	}
+
+	_, err := ordersTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating payment status")
 	}
 
 	if defaultCache != nil {
-		var b bytes.Buffer
-		err := gob.NewEncoder(&b).Encode(*o)
-		if err != nil {
-			return nil, errors.Wrap(err, "cache save")
+		defaultCache.Delete(o.cacheKey())
+	}
+
+	return nil
+}
+
+// StepDone is whether an earlier try already finished the step
+func (o *Order) StepDone(step string) bool {
+	for _, s := range o.Steps {
+		if s == step {
+			return true
 		}
-		defaultCache.Set(o.cacheKey(), b.Bytes(), 0)
 	}
+	return false
+}
+
+// FinishStep records the step so retries skip it
+func (o *Order) FinishStep(step string) error {
+	if o.StepDone(step) {
+		return nil
+	}
+	o.Steps = append(o.Steps, step)
 
-	return o, nil
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: o.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Steps: strings.Join(o.Steps, ","),
+			},
+		}},
+	}
+
+	_, err := ordersTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating order steps")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(o.cacheKey())
+	}
+
+	return nil
 }
 
-func (o *Order) UpdateOrderStatus(paymentStatus string) error {
-	o.PaymentStatus = paymentStatus
+// UpdateDisputeStatus flags the order as disputed, or records how the dispute ended
+func (o *Order) UpdateDisputeStatus(status string) error {
+	o.DisputeStatus = status
 
 	r := &airtable.Records{
 		Records: []*airtable.Record{{
 			ID: o.AirtableID,
 			Fields: map[string]interface{}{
-				fields.PaymentStatus: o.PaymentStatus,
+				fields.DisputeStatus: o.DisputeStatus,
 			},
 		}},
 	}
 
 	_, err := ordersTable.UpdateRecordsPartial(r)
 	if err != nil {
-		return errors.Wrap(err, "updating payment status")
+		return errors.Wrap(err, "updating dispute status")
 	}
 
 	if defaultCache != nil {
@@ -244,24 +378,32 @@ func (o *Order) ReplaceCart(a *Order) error {
 	a.StripeID = o.StripeID
 	a.OrderID = o.OrderID
 	a.UserName = o.UserName
+	if a.StripeCustomer == "" {
+		a.StripeCustomer = o.StripeCustomer
+	}
 	r := &airtable.Records{
 		Records: []*airtable.Record{
 			{
 				ID: a.AirtableID,
 				Fields: map[string]interface{}{
-					fields.Total:         a.Total.ToFloat(),
-					fields.ProcessingFee: a.ProcessingFee.ToFloat(),
-					fields.TotalTickets:  a.TotalTickets,
-					fields.AdultCabin:    a.AdultCabin,
-					fields.AdultTent:     a.AdultTent,
-					fields.AdultSat:      a.AdultSat,
-					fields.ChildCabin:    a.ChildCabin,
-					fields.ChildTent:     a.ChildTent,
-					fields.ChildSat:      a.ChildSat,
-					fields.ToddlerCabin:  a.ToddlerCabin,
-					fields.ToddlerTent:   a.ToddlerTent,
-					fields.ToddlerSat:    a.ToddlerSat,
-					fields.Donation:      a.Donation,
+					fields.Total:           a.Total.ToFloat(),
+					fields.ProcessingFee:   a.ProcessingFee.ToFloat(),
+					fields.FeePolicy:       a.FeePolicy,
+					fields.TotalTickets:    a.TotalTickets,
+					fields.AdultCabin:      a.AdultCabin,
+					fields.AdultTent:       a.AdultTent,
+					fields.AdultSat:        a.AdultSat,
+					fields.ChildCabin:      a.ChildCabin,
+					fields.ChildTent:       a.ChildTent,
+					fields.ChildSat:        a.ChildSat,
+					fields.ToddlerCabin:    a.ToddlerCabin,
+					fields.ToddlerTent:     a.ToddlerTent,
+					fields.ToddlerSat:      a.ToddlerSat,
+					fields.Donation:        a.Donation,
+					fields.PromoCode:       a.PromoCode,
+					fields.Discount:        a.discount().ToFloat(),
+					fields.InstallmentPlan: a.InstallmentPlan,
+					fields.StripeCustomer:  a.StripeCustomer,
 				},
 			},
 		},
@@ -283,6 +425,10 @@ func (o *Order) IsEqual(a *Order) bool {
 		return false
 	}
 
+	if o.PromoCode != a.PromoCode || o.InstallmentPlan != a.InstallmentPlan {
+		return false
+	}
+
 	oCart := o.toCart()
 	aCart := a.toCart()
 
@@ -295,6 +441,80 @@ func (o *Order) IsEqual(a *Order) bool {
 	return true
 }
 
+// UpdatePayments records how much has been paid so far and the card saved for future installments
+func (o *Order) UpdatePayments(amountPaid *Currency, paymentMethod string) error {
+	o.AmountPaid = amountPaid
+	o.PaymentMethod = paymentMethod
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: o.AirtableID,
+			Fields: map[string]interface{}{
+				fields.AmountPaid:    o.AmountPaid.ToFloat(),
+				fields.PaymentMethod: o.PaymentMethod,
+			},
+		}},
+	}
+
+	_, err := ordersTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating order payments")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(o.cacheKey())
+	}
+
+	return nil
+}
+
+// UpdateStripeFee records the fee stripe's balance transaction says it took
+func (o *Order) UpdateStripeFee(fee *Currency) error {
+	o.StripeFee = fee
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: o.AirtableID,
+			Fields: map[string]interface{}{
+				fields.StripeFee: o.StripeFee.ToFloat(),
+			},
+		}},
+	}
+
+	_, err := ordersTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating stripe fee")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(o.cacheKey())
+	}
+
+	return nil
+}
+
+// Remaining is what's still owed on a payment plan
+func (o *Order) Remaining() *Currency {
+	paid := int64(0)
+	if o.AmountPaid != nil {
+		paid = o.AmountPaid.InCents()
+	}
+	return CurrencyFromCents(o.Total.InCents() - paid)
+}
+
+// TicketIssued is whether the order has paid enough to get its tickets
+func (o *Order) TicketIssued() bool {
+	return o.PaymentStatus == "success" || o.PaymentStatus == "partially_paid"
+}
+
+// discount is never nil, orders without a promo code have a zero discount
+func (o *Order) discount() *Currency {
+	if o.Discount == nil {
+		return &Currency{}
+	}
+	return o.Discount
+}
+
 func (o *Order) toCart() map[string]int {
 	return map[string]int{
 		"adult-cabin":   o.AdultCabin,
@@ -318,6 +538,15 @@ func toInt(i interface{}) int {
 	return num
 }
 
+// toFloat reads a number field, ignoring any currency or percent formatting
+func toFloat(i interface{}) float64 {
+	if i == nil {
+		return 0
+	}
+	num, _ := strconv.ParseFloat(strings.Trim(strings.ReplaceAll(i.(string), ",", ""), "$% "), 64)
+	return num
+}
+
 func (o *Order) cacheKey() string { return o.OrderID }
 
 type ItemType int64
@@ -399,7 +628,7 @@ func StringCartToItem(cart string) []Item {
 		numVal, err := strconv.Atoi(splitItem[1])
 
 		if err != nil {
-			log.Error("Atoi error: %v", err)
+			log.Errorf("Atoi error: %v", err)
 		}
 
 		newItem := Item{
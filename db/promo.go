@@ -0,0 +1,150 @@
+package db
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+var redemptionMutex sync.Mutex
+
+// PromoCode takes Amount dollars (Fixed) or Amount percent (Percent) off each eligible ticket.
+// Empty SKUs, TicketPaths or Users mean the code isn't restricted that way, and a zero
+// MaxRedemptions or Expires means no limit.
+type PromoCode struct {
+	Code           string
+	DiscountType   string
+	Amount         float64
+	SKUs           []string
+	MaxRedemptions int
+	Redemptions    int
+	Reserved       int
+	Expires        time.Time
+	TicketPaths    []string
+	Users          []string
+
+	AirtableID string
+}
+
+// GetPromoCode looks up a code, ignoring case
+func GetPromoCode(code string) (*PromoCode, error) {
+	response, err := query(promoCodesTable, fields.Code, strings.ToUpper(strings.TrimSpace(code)))
+	if err != nil {
+		return nil, err
+	}
+
+	if response == nil || len(response.Records) == 0 {
+		return nil, errors.Wrap(ErrNoRecords, "")
+	} else if len(response.Records) != 1 {
+		return nil, errors.Wrap(ErrManyRecords, "")
+	}
+
+	rec := response.Records[0]
+	expires, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.Expires]))
+
+	return &PromoCode{
+		AirtableID:     rec.ID,
+		Code:           toStr(rec.Fields[fields.Code]),
+		DiscountType:   toStr(rec.Fields[fields.DiscountType]),
+		Amount:         toFloat(rec.Fields[fields.Amount]),
+		SKUs:           splitList(toStr(rec.Fields[fields.SKUs])),
+		MaxRedemptions: toInt(rec.Fields[fields.MaxRedemptions]),
+		Redemptions:    toInt(rec.Fields[fields.Redemptions]),
+		Reserved:       toInt(rec.Fields[fields.Reserved]),
+		Expires:        expires,
+		TicketPaths:    splitList(toStr(rec.Fields[fields.TicketPaths])),
+		Users:          splitList(strings.ToLower(toStr(rec.Fields[fields.Users]))),
+	}, nil
+}
+
+// ErrUsedUp is a code whose redemptions are all used or held for checkouts
+var ErrUsedUp = errors.New("promo code used up")
+
+// AddRedemptions counts uses of a code, or gives them back when quantity is negative
+func AddRedemptions(code string, quantity int) error {
+	return updateRedemptions(code, func(p *PromoCode) error {
+		p.Redemptions += quantity
+		return nil
+	})
+}
+
+// ReserveRedemption holds one of a code's redemptions for a checkout until it's paid for or given up on, failing
+// with ErrUsedUp if the ones already used and held leave none
+func ReserveRedemption(code string) error {
+	return updateRedemptions(code, func(p *PromoCode) error {
+		if p.MaxRedemptions > 0 && p.Redemptions+p.Reserved >= p.MaxRedemptions {
+			return errors.Wrapf(ErrUsedUp, "%s", p.Code)
+		}
+		p.Reserved++
+		return nil
+	})
+}
+
+// ReleaseRedemption gives back a redemption held for a checkout that wasn't paid for
+func ReleaseRedemption(code string) error {
+	return updateRedemptions(code, func(p *PromoCode) error {
+		if p.Reserved > 0 {
+			p.Reserved--
+		}
+		return nil
+	})
+}
+
+// RedeemReservation counts a use of a code by a paid checkout, turning its held redemption into a used one
+func RedeemReservation(code string) error {
+	return updateRedemptions(code, func(p *PromoCode) error {
+		if p.Reserved > 0 {
+			p.Reserved--
+		}
+		p.Redemptions++
+		return nil
+	})
+}
+
+// updateRedemptions changes a code's counts with fn, one change at a time so none are lost
+func updateRedemptions(code string, fn func(p *PromoCode) error) error {
+	redemptionMutex.Lock()
+	defer redemptionMutex.Unlock()
+
+	p, err := GetPromoCode(code)
+	if err != nil {
+		return err
+	}
+
+	err = fn(p)
+	if err != nil {
+		return err
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: p.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Redemptions: p.Redemptions,
+				fields.Reserved:    p.Reserved,
+			},
+		}},
+	}
+
+	_, err = promoCodesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating promo code redemptions")
+	}
+
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
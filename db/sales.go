@@ -0,0 +1,223 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	log "github.com/sirupsen/logrus"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+var phaseSoldMutex sync.Mutex
+
+// SalesPhase is the sales window for one ticket path. A zero Opens or Closes means no limit on that side,
+// and a zero Cap means the phase is only limited by the overall caps.
+type SalesPhase struct {
+	Name   string
+	Opens  time.Time
+	Closes time.Time
+	Cap    int
+	Sold   int
+
+	AirtableID string
+}
+
+type SalesPhaseEvent struct {
+	Name  string
+	Event string
+	Date  time.Time
+}
+
+// GetSalesPhases returns every scheduled phase, in the order they open
+func GetSalesPhases() ([]*SalesPhase, error) {
+	records, err := queryAll(salesPhasesTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	phases := make([]*SalesPhase, 0, len(records))
+	for _, rec := range records {
+		phases = append(phases, salesPhaseFromRecord(rec))
+	}
+
+	sort.SliceStable(phases, func(i, j int) bool {
+		return phases[i].Opens.Before(phases[j].Opens)
+	})
+
+	return phases, nil
+}
+
+// GetSalesPhase returns the phase for a ticket path, or ErrNoRecords if it isn't scheduled
+func GetSalesPhase(name string) (*SalesPhase, error) {
+	response, err := query(salesPhasesTable, fields.Name, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if response == nil || len(response.Records) == 0 {
+		return nil, errors.Wrap(ErrNoRecords, "")
+	} else if len(response.Records) != 1 {
+		return nil, errors.Wrap(ErrManyRecords, "")
+	}
+
+	return salesPhaseFromRecord(response.Records[0]), nil
+}
+
+func salesPhaseFromRecord(rec *airtable.Record) *SalesPhase {
+	opens, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.Opens]))
+	closes, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.Closes]))
+	return &SalesPhase{
+		AirtableID: rec.ID,
+		Name:       toStr(rec.Fields[fields.Name]),
+		Opens:      opens,
+		Closes:     closes,
+		Cap:        toInt(rec.Fields[fields.Cap]),
+		Sold:       toInt(rec.Fields[fields.Sold]),
+	}
+}
+
+func formatPhaseTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (p *SalesPhase) CreateSalesPhase() error {
+	if p.AirtableID != "" {
+		return errors.New("Sales phase already exists")
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.Name:   p.Name,
+					fields.Opens:  formatPhaseTime(p.Opens),
+					fields.Closes: formatPhaseTime(p.Closes),
+					fields.Cap:    p.Cap,
+					fields.Sold:   p.Sold,
+				},
+			},
+		},
+	}
+
+	recvRecords, err := salesPhasesTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "creating sales phase")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return errors.Wrap(ErrManyRecords, "")
+	}
+
+	p.AirtableID = recvRecords.Records[0].ID
+	return nil
+}
+
+// UpdateSchedule saves new open and close times and cap for the phase
+func (p *SalesPhase) UpdateSchedule(opens, closes time.Time, capacity int) error {
+	p.Opens = opens
+	p.Closes = closes
+	p.Cap = capacity
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: p.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Opens:  formatPhaseTime(p.Opens),
+				fields.Closes: formatPhaseTime(p.Closes),
+				fields.Cap:    p.Cap,
+			},
+		}},
+	}
+
+	_, err := salesPhasesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating sales phase")
+	}
+
+	return nil
+}
+
+// addPhaseSold counts tickets against a phase's cap. Paths without a phase aren't counted.
+func addPhaseSold(name string, quantity int) error {
+	phaseSoldMutex.Lock()
+	defer phaseSoldMutex.Unlock()
+
+	p, err := GetSalesPhase(name)
+	if errors.Is(err, ErrNoRecords) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	p.Sold += quantity
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: p.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Sold: p.Sold,
+			},
+		}},
+	}
+
+	_, err = salesPhasesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating sales phase sold")
+	}
+
+	return nil
+}
+
+func LogSalesPhaseEvent(name, event string) error {
+	log.Infof("sales phase %s: %s", name, event)
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.Name:  name,
+					fields.Event: event,
+					fields.Date:  time.Now().UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+
+	_, err := salesPhaseLogTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "logging sales phase event")
+	}
+
+	return nil
+}
+
+// GetSalesPhaseEvents returns the phase change log, newest first
+func GetSalesPhaseEvents() ([]*SalesPhaseEvent, error) {
+	records, err := queryAll(salesPhaseLogTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*SalesPhaseEvent, 0, len(records))
+	for _, rec := range records {
+		date, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.Date]))
+		events = append(events, &SalesPhaseEvent{
+			Name:  toStr(rec.Fields[fields.Name]),
+			Event: toStr(rec.Fields[fields.Event]),
+			Date:  date,
+		})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Date.After(events[j].Date)
+	})
+
+	return events, nil
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	log "github.com/sirupsen/logrus"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+// StaffRoles are the roles that can be given out, in the order they're shown
+var StaffRoles = []string{
+	fields.RoleAdmin,
+	fields.RoleFinance,
+	fields.RoleCheckin,
+	fields.RoleLogistics,
+	fields.RoleVolunteerCoordinator,
+}
+
+// StaffAction is one thing someone did with a staff role
+type StaffAction struct {
+	Actor   string
+	Role    string
+	Action  string
+	Target  string
+	Details string
+	Date    time.Time
+}
+
+// SetRoles replaces the attendee's staff roles
+func (u *User) SetRoles(roles []string) error {
+	u.Roles = roles
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: u.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Roles: u.Roles,
+			},
+		}},
+	}
+
+	_, err := attendeesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "setting roles")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(u.cacheKey())
+	}
+
+	return nil
+}
+
+// GetStaff returns everyone with a role or a staff ticket, by username
+func GetStaff() ([]*User, error) {
+	formula := fmt.Sprintf(`OR({%s}!="", {%s}="%s")`, fields.Roles, fields.AdmissionLevel, fields.Staff)
+	records, err := queryAll(attendeesTable, formula, fields.UserName, fields.Name, fields.AdmissionLevel, fields.Roles)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0, len(records))
+	for _, rec := range records {
+		users = append(users, &User{
+			AirtableID:     rec.ID,
+			UserName:       toStr(rec.Fields[fields.UserName]),
+			Name:           toStr(rec.Fields[fields.Name]),
+			AdmissionLevel: toStr(rec.Fields[fields.AdmissionLevel]),
+			Roles:          splitList(toStr(rec.Fields[fields.Roles])),
+		})
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserName < users[j].UserName
+	})
+	return users, nil
+}
+
+// LogStaffAction records something staff did, along with the role that let them
+func LogStaffAction(a *StaffAction) error {
+	log.Infof("staff action: @%s (%s) %s %s %s", a.Actor, a.Role, a.Action, a.Target, a.Details)
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.Actor:   a.Actor,
+					fields.Role:    a.Role,
+					fields.Action:  a.Action,
+					fields.Target:  a.Target,
+					fields.Details: a.Details,
+					fields.Date:    time.Now().UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+
+	_, err := staffActionsTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "logging staff action")
+	}
+
+	return nil
+}
+
+// GetStaffActions returns what staff have done in the last few days, newest first
+func GetStaffActions(days int) ([]*StaffAction, error) {
+	formula := fmt.Sprintf(`IS_AFTER(DATETIME_PARSE({%s}), DATEADD(NOW(), -%d, 'days'))`, fields.Date, days)
+	records, err := queryAll(staffActionsTable, formula)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := make([]*StaffAction, 0, len(records))
+	for _, rec := range records {
+		date, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.Date]))
+		actions = append(actions, &StaffAction{
+			Actor:   toStr(rec.Fields[fields.Actor]),
+			Role:    toStr(rec.Fields[fields.Role]),
+			Action:  toStr(rec.Fields[fields.Action]),
+			Target:  toStr(rec.Fields[fields.Target]),
+			Details: toStr(rec.Fields[fields.Details]),
+			Date:    date,
+		})
+	}
+
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].Date.After(actions[j].Date)
+	})
+	return actions, nil
+}
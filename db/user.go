@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -30,6 +31,21 @@ var aggregationsTable *airtable.Table
 var chaosModeTable *airtable.Table
 var sponsorshipTable *airtable.Table
 var bus2023Table *airtable.Table
+var waitlistTable *airtable.Table
+var lotteryEntriesTable *airtable.Table
+var lotteryDrawsTable *airtable.Table
+var salesPhasesTable *airtable.Table
+var salesPhaseLogTable *airtable.Table
+var promoCodesTable *airtable.Table
+var installmentsTable *airtable.Table
+var webhookEventsTable *airtable.Table
+var disputesTable *airtable.Table
+var emailOutboxTable *airtable.Table
+var staffActionsTable *airtable.Table
+var apiKeysTable *airtable.Table
+var hookEndpointsTable *airtable.Table
+var hookDeliveriesTable *airtable.Table
+var discordRolesTable *airtable.Table
 
 // var cabinTable *airtable.Table
 // var ticketTable *airtable.Table
@@ -44,6 +60,14 @@ func Init(apiKey, baseID string, cache *cache.Cache) {
 		orderTable    = os.Getenv("AIRTABLE_ORDER_TABLE")
 	)
 	client = airtable.NewClient(apiKey)
+	// for pointing at a fake airtable in tests
+	if base := os.Getenv("AIRTABLE_API_BASE"); base != "" {
+		err := client.SetBaseURL(base)
+		if err != nil {
+			log.Fatalf("bad AIRTABLE_API_BASE: %v", err)
+		}
+		client.SetRateLimit(1000)
+	}
 	defaultTable = client.GetTable(baseID, "Attendees")
 	softLaunchTable = client.GetTable(baseTwo, slTable)
 	attendeesTable = client.GetTable(baseTwo, attendeeTable)
@@ -53,6 +77,21 @@ func Init(apiKey, baseID string, cache *cache.Cache) {
 	chaosModeTable = client.GetTable(baseTwo, "ChaosMode")
 	sponsorshipTable = client.GetTable(baseTwo, "Sponsorships")
 	bus2023Table = client.GetTable(baseTwo, "Bus 2023")
+	waitlistTable = client.GetTable(baseTwo, "Waitlist")
+	lotteryEntriesTable = client.GetTable(baseTwo, "Lottery Entries")
+	lotteryDrawsTable = client.GetTable(baseTwo, "Lottery Draws")
+	salesPhasesTable = client.GetTable(baseTwo, "Sales Phases")
+	salesPhaseLogTable = client.GetTable(baseTwo, "Sales Phase Log")
+	promoCodesTable = client.GetTable(baseTwo, "Promo Codes")
+	installmentsTable = client.GetTable(baseTwo, "Installments")
+	webhookEventsTable = client.GetTable(baseTwo, "Webhook Events")
+	disputesTable = client.GetTable(baseTwo, "Disputes")
+	emailOutboxTable = client.GetTable(baseTwo, "Email Outbox")
+	staffActionsTable = client.GetTable(baseTwo, "Staff Actions")
+	apiKeysTable = client.GetTable(baseTwo, "API Keys")
+	hookEndpointsTable = client.GetTable(baseTwo, "Webhook Endpoints")
+	hookDeliveriesTable = client.GetTable(baseTwo, "Webhook Deliveries")
+	discordRolesTable = client.GetTable(baseTwo, "Discord Roles")
 	// cabinTable = client.GetTable(baseTwo, "Cabins")
 	// ticketTable = client.GetTable(baseTwo, "Tickets")
 	defaultCache = cache
@@ -81,6 +120,10 @@ type SoftLaunchUser struct {
 type User struct {
 	UserName           string
 	TwitterName        string
+	TwitterID          string
+	DiscordID          string
+	GoogleID           string
+	Roles              []string
 	Name               string
 	Email              string
 	AdmissionLevel     string
@@ -89,6 +132,7 @@ type User struct {
 	OrderNotes         string
 	OrderID            string
 	CheckedIn          bool
+	TicketSuspended    bool
 	Badge              bool
 	Vegetarian         bool
 	GlutenFree         bool
@@ -151,18 +195,23 @@ type ChaosModeUser struct {
 	Email       string
 	TicketLimit int
 	Phase       string
+	// the only admission level they can buy, blank for any
+	AdmissionLevel string
 
 	AirtableID string
 }
 
 type SponsorshipUser struct {
-	UserName       string
-	Name           string
-	TwitterName    string
-	Email          string
-	AdmissionLevel string
-	TicketLimit    int
-	Discount       *Currency
+	UserName        string
+	Name            string
+	TwitterName     string
+	Email           string
+	AdmissionLevel  string
+	TicketLimit     int
+	Discount        *Currency
+	DiscountType    string
+	DiscountPercent int
+	AwardStatus     string
 
 	AirtableID string
 }
@@ -204,6 +253,10 @@ func (u *User) UpdateUser() error {
 			},
 		}},
 	}
+	// a linked discord account is only ever replaced by linking another one
+	if u.DiscordID != "" {
+		r.Records[0].Fields[fields.DiscordID] = u.DiscordID
+	}
 
 	recvRecords, err := attendeesTable.UpdateRecordsPartial(r)
 	if err != nil {
@@ -255,6 +308,7 @@ func (u *User) CreateUser() error {
 					fields.TicketPath:              u.TicketPath,
 					fields.Cabin2022:               u.Cabin2022,
 					fields.SponsorshipConfirmation: u.SponsorshipConfirm,
+					fields.DiscordID:               u.DiscordID,
 				},
 			},
 		},
@@ -296,7 +350,7 @@ func GetUser(userName string) (*User, error) {
 	user, err := GetUserByField(fields.UserName, cleanName)
 	if err != nil {
 		if errors.Is(err, ErrNoRecords) {
-			err = errors.New("You're not on the guest list! Most likely we spelled your Twitter handle wrong.")
+			err = errors.Mark(errors.New("You're not on the guest list! Most likely we spelled your Twitter handle wrong."), ErrNoRecords)
 		} else if errors.Is(err, ErrManyRecords) {
 			err = errors.New("You're on the list multiple times. We probably screwed something up 😰")
 		}
@@ -320,22 +374,72 @@ func GetUserByField(field, value string) (*User, error) {
 		return nil, errors.Wrap(ErrManyRecords, "")
 	}
 
-	rec := response.Records[0]
+	u := userFromRecord(response.Records[0])
+
+	if defaultCache != nil {
+		var b bytes.Buffer
+		err := gob.NewEncoder(&b).Encode(*u)
+		if err != nil {
+			return nil, errors.Wrap(err, "cache save")
+		}
+		defaultCache.Set(u.cacheKey(), b.Bytes(), 0)
+	}
+
+	return u, nil
+}
+
+// GetAllUsers returns everyone in the attendees table, ordered by username. The list is cached for a minute.
+func GetAllUsers() ([]*User, error) {
+	if defaultCache != nil {
+		if users, found := defaultCache.Get("all-users"); found {
+			return users.([]*User), nil
+		}
+	}
+	return ReloadAllUsers()
+}
+
+// ReloadAllUsers is GetAllUsers straight from the table, for when a list up to a minute old won't do
+func ReloadAllUsers() ([]*User, error) {
+	records, err := queryAll(attendeesTable, "")
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0, len(records))
+	for _, rec := range records {
+		users = append(users, userFromRecord(rec))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserName < users[j].UserName
+	})
+
+	if defaultCache != nil {
+		defaultCache.Set("all-users", users, time.Minute)
+	}
+	return users, nil
+}
+
+func userFromRecord(rec *airtable.Record) *User {
 	t, err := time.Parse("1/2/2006 15:04", toStr(rec.Fields[fields.Created]))
 	if err != nil {
 		t = time.Now()
 	}
 	created := t.UTC().Format("2006-01-02T15:04:05Z")
 
-	u := &User{
+	return &User{
 		AirtableID:         rec.ID,
 		UserName:           toStr(rec.Fields[fields.UserName]),
 		TwitterName:        toStr(rec.Fields[fields.TwitterName]),
+		TwitterID:          toStr(rec.Fields[fields.TwitterID]),
+		DiscordID:          toStr(rec.Fields[fields.DiscordID]),
+		GoogleID:           toStr(rec.Fields[fields.GoogleID]),
+		Roles:              splitList(toStr(rec.Fields[fields.Roles])),
 		Name:               toStr(rec.Fields[fields.Name]),
 		Email:              toStr(rec.Fields[fields.Email]),
 		TicketType:         toStr(rec.Fields[fields.TicketType]),
 		AdmissionLevel:     toStr(rec.Fields[fields.AdmissionLevel]),
 		CheckedIn:          rec.Fields[fields.CheckedIn] == checked,
+		TicketSuspended:    rec.Fields[fields.TicketSuspended] == checked,
 		Barcode:            toStr(rec.Fields[fields.Barcode]),
 		OrderNotes:         toStr(rec.Fields[fields.OrderNotes]),
 		Badge:              rec.Fields[fields.Badge] == checked,
@@ -388,17 +492,6 @@ func GetUserByField(field, value string) (*User, error) {
 
 		MealGroup: toStr(rec.Fields[fields.MealGroup]),
 	}
-
-	if defaultCache != nil {
-		var b bytes.Buffer
-		err := gob.NewEncoder(&b).Encode(*u)
-		if err != nil {
-			return nil, errors.Wrap(err, "cache save")
-		}
-		defaultCache.Set(u.cacheKey(), b.Bytes(), 0)
-	}
-
-	return u, nil
 }
 
 func (u *User) AddTransportAndBeddingOrder(busSpots, sleepingBags, sheetSets, pillows int, busToVibecamp, busFromVibecamp string) error {
@@ -474,6 +567,40 @@ func GetAttendees() ([]string, error) {
 	return attendees, nil
 }
 
+// GetTicketIDs maps every attendee's username to their ticket id, blank if they don't have one
+func GetTicketIDs() (map[string]string, error) {
+	records, err := queryAll(attendeesTable, "", fields.UserName, fields.TicketID)
+	if err != nil {
+		return nil, err
+	}
+
+	ticketIDs := make(map[string]string, len(records))
+	for _, rec := range records {
+		ticketIDs[strings.ToLower(toStr(rec.Fields[fields.UserName]))] = toStr(rec.Fields[fields.TicketID])
+	}
+	return ticketIDs, nil
+}
+
+// GetTicketHolders returns everyone with a ticket, with just their name, email and ticket id filled in
+func GetTicketHolders() ([]*User, error) {
+	records, err := queryAll(attendeesTable, fmt.Sprintf(`{%s}!=""`, fields.TicketID), fields.UserName, fields.Name, fields.Email, fields.TicketID)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*User, 0, len(records))
+	for _, rec := range records {
+		users = append(users, &User{
+			AirtableID: rec.ID,
+			UserName:   toStr(rec.Fields[fields.UserName]),
+			Name:       toStr(rec.Fields[fields.Name]),
+			Email:      toStr(rec.Fields[fields.Email]),
+			TicketID:   toStr(rec.Fields[fields.TicketID]),
+		})
+	}
+	return users, nil
+}
+
 func GetSoftLaunchUser(userName string) (*SoftLaunchUser, error) {
 	cleanName := strings.ToLower(userName)
 	if defaultCache != nil {
@@ -592,13 +719,14 @@ func getChaosUserByField(field, value string) (*ChaosModeUser, error) {
 	ticketLimit, _ := strconv.Atoi(rec.Fields[fields.TicketLimit].(string))
 
 	u := &ChaosModeUser{
-		AirtableID:  rec.ID,
-		UserName:    toStr(rec.Fields[fields.UserName]),
-		TwitterName: toStr(rec.Fields[fields.TwitterName]),
-		Name:        toStr(rec.Fields[fields.Name]),
-		Email:       toStr(rec.Fields[fields.Email]),
-		Phase:       toStr(rec.Fields[fields.Phase]),
-		TicketLimit: ticketLimit,
+		AirtableID:     rec.ID,
+		UserName:       toStr(rec.Fields[fields.UserName]),
+		TwitterName:    toStr(rec.Fields[fields.TwitterName]),
+		Name:           toStr(rec.Fields[fields.Name]),
+		Email:          toStr(rec.Fields[fields.Email]),
+		Phase:          toStr(rec.Fields[fields.Phase]),
+		TicketLimit:    ticketLimit,
+		AdmissionLevel: toStr(rec.Fields[fields.AdmissionLevel]),
 	}
 
 	if defaultCache != nil {
@@ -613,6 +741,71 @@ func getChaosUserByField(field, value string) (*ChaosModeUser, error) {
 	return u, nil
 }
 
+func (u *ChaosModeUser) CreateChaosUser() error {
+	if u.AirtableID != "" {
+		return errors.New("Chaos mode user already exists")
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.UserName:       u.UserName,
+					fields.TwitterName:    u.TwitterName,
+					fields.Name:           u.Name,
+					fields.Email:          u.Email,
+					fields.Phase:          u.Phase,
+					fields.TicketLimit:    u.TicketLimit,
+					fields.AdmissionLevel: u.AdmissionLevel,
+				},
+			},
+		},
+	}
+
+	recvRecords, err := chaosModeTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "creating chaos mode record")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return errors.Wrap(ErrManyRecords, "")
+	}
+
+	u.AirtableID = recvRecords.Records[0].ID
+	return nil
+}
+
+// UpdatePhase moves them to phase, with how many tickets and which admission level they can now buy
+func (u *ChaosModeUser) UpdatePhase(phase string, ticketLimit int, admissionLevel string) error {
+	u.Phase = phase
+	u.TicketLimit = ticketLimit
+	u.AdmissionLevel = admissionLevel
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: u.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Phase:          u.Phase,
+				fields.TicketLimit:    u.TicketLimit,
+				fields.AdmissionLevel: u.AdmissionLevel,
+			},
+		}},
+	}
+
+	_, err := chaosModeTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating chaos mode phase")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(u.cacheKey())
+	}
+
+	return nil
+}
+
 func GetSponsorshipUser(userName string) (*SponsorshipUser, error) {
 	cleanName := strings.ToLower(userName)
 	if defaultCache != nil {
@@ -658,14 +851,24 @@ func getSponsorshipUserByField(field, value string) (*SponsorshipUser, error) {
 	ticketLimit, _ := strconv.Atoi(rec.Fields[fields.TicketLimit].(string))
 
 	u := &SponsorshipUser{
-		AirtableID:     rec.ID,
-		UserName:       toStr(rec.Fields[fields.UserName]),
-		TwitterName:    toStr(rec.Fields[fields.TwitterName]),
-		Name:           toStr(rec.Fields[fields.Name]),
-		Email:          toStr(rec.Fields[fields.Email]),
-		AdmissionLevel: toStr(rec.Fields[fields.AdmissionLevel]),
-		Discount:       CurrencyFromAirtableString(toStr(rec.Fields[fields.Discount])),
-		TicketLimit:    ticketLimit,
+		AirtableID:      rec.ID,
+		UserName:        toStr(rec.Fields[fields.UserName]),
+		TwitterName:     toStr(rec.Fields[fields.TwitterName]),
+		Name:            toStr(rec.Fields[fields.Name]),
+		Email:           toStr(rec.Fields[fields.Email]),
+		AdmissionLevel:  toStr(rec.Fields[fields.AdmissionLevel]),
+		Discount:        CurrencyFromAirtableString(toStr(rec.Fields[fields.Discount])),
+		DiscountType:    toStr(rec.Fields[fields.DiscountType]),
+		DiscountPercent: toInt(rec.Fields[fields.DiscountPercent]),
+		AwardStatus:     toStr(rec.Fields[fields.AwardStatus]),
+		TicketLimit:     ticketLimit,
+	}
+
+	if u.DiscountType == "" {
+		u.DiscountType = fields.FixedDiscount
+	}
+	if u.AwardStatus == "" {
+		u.AwardStatus = fields.AwardOffered
 	}
 
 	if defaultCache != nil {
@@ -680,6 +883,50 @@ func getSponsorshipUserByField(field, value string) (*SponsorshipUser, error) {
 	return u, nil
 }
 
+// TicketDiscount is how much the sponsorship takes off one ticket at price
+func (u *SponsorshipUser) TicketDiscount(price float64) float64 {
+	off := u.Discount.ToFloat()
+	if u.DiscountType == fields.PercentDiscount {
+		off = price * float64(u.DiscountPercent) / 100
+	}
+
+	if off > price {
+		return price
+	} else if off < 0 {
+		return 0
+	}
+	return off
+}
+
+// AwardOpen is whether the sponsorship can still be used to buy tickets
+func (u *SponsorshipUser) AwardOpen() bool {
+	return u.AwardStatus == fields.AwardOffered || u.AwardStatus == fields.AwardAccepted
+}
+
+func (u *SponsorshipUser) UpdateAwardStatus(status string) error {
+	u.AwardStatus = status
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: u.AirtableID,
+			Fields: map[string]interface{}{
+				fields.AwardStatus: u.AwardStatus,
+			},
+		}},
+	}
+
+	_, err := sponsorshipTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating sponsorship award status")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(u.cacheKey())
+	}
+
+	return nil
+}
+
 func query(table *airtable.Table, field, value string, returnFields ...string) (*airtable.Records, error) {
 	filterFormula := fmt.Sprintf(`{%s}="%s"`, field, strings.ReplaceAll(value, `"`, `\"`))
 	log.Debugf(`airtable query: %s `, filterFormula)
@@ -693,6 +940,37 @@ func query(table *airtable.Table, field, value string, returnFields ...string) (
 	return records, errors.Wrap(err, "")
 }
 
+// queryAll pages through every record matching filterFormula, or the whole table if it's empty
+func queryAll(table *airtable.Table, filterFormula string, returnFields ...string) ([]*airtable.Record, error) {
+	log.Debugf(`airtable query: %s `, filterFormula)
+	offset := ""
+	var records []*airtable.Record
+
+	for {
+		req := table.GetRecords().
+			WithOffset(offset).
+			ReturnFields(returnFields...).
+			InStringFormat("US/Eastern", "en")
+		if filterFormula != "" {
+			req = req.WithFilterFormula(filterFormula)
+		}
+
+		response, err := req.Do()
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+
+		records = append(records, response.Records...)
+
+		if response.Offset == "" {
+			break
+		}
+		offset = response.Offset
+	}
+
+	return records, nil
+}
+
 func (u *User) SetBadge(badgeChoice string) error {
 	if badgeChoice != "yes" && badgeChoice != "no" {
 		return errors.Newf("invalid badge choice: '%s'", badgeChoice)
@@ -864,6 +1142,107 @@ func (u *User) UpdateTicketId(ticketId string) error {
 	return nil
 }
 
+// SetTwitterID records the twitter account's stable id, so they can still sign in after changing their handle
+func (u *User) SetTwitterID(id string) error {
+	u.TwitterID = id
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: u.AirtableID,
+			Fields: map[string]interface{}{
+				fields.TwitterID: u.TwitterID,
+			},
+		}},
+	}
+
+	_, err := attendeesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "setting twitter id")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(u.cacheKey())
+	}
+
+	return nil
+}
+
+// SetDiscord links a verified discord account, whose name replaces whatever they typed in
+func (u *User) SetDiscord(id, name string) error {
+	u.DiscordID = id
+	u.DiscordName = name
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: u.AirtableID,
+			Fields: map[string]interface{}{
+				fields.DiscordID:   u.DiscordID,
+				fields.DiscordName: u.DiscordName,
+			},
+		}},
+	}
+
+	_, err := attendeesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "setting discord account")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(u.cacheKey())
+	}
+
+	return nil
+}
+
+// SetGoogleID links a google account
+func (u *User) SetGoogleID(id string) error {
+	u.GoogleID = id
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: u.AirtableID,
+			Fields: map[string]interface{}{
+				fields.GoogleID: u.GoogleID,
+			},
+		}},
+	}
+
+	_, err := attendeesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "setting google id")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(u.cacheKey())
+	}
+
+	return nil
+}
+
+func (u *User) SetSponsorshipConfirm(confirmed bool) error {
+	u.SponsorshipConfirm = confirmed
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: u.AirtableID,
+			Fields: map[string]interface{}{
+				fields.SponsorshipConfirmation: u.SponsorshipConfirm,
+			},
+		}},
+	}
+
+	_, err := attendeesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating sponsorship confirmation")
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(u.cacheKey())
+	}
+
+	return nil
+}
+
 func (u *User) SetCheckedIn() error {
 	u.CheckedIn = true
 
@@ -888,6 +1267,39 @@ func (u *User) SetCheckedIn() error {
 	return nil
 }
 
+// TicketStatus is how the app should show the ticket
+func (u *User) TicketStatus() string {
+	if u.TicketSuspended {
+		return "Suspended"
+	}
+	return "Active"
+}
+
+// SetTicketSuspended marks the ticket as under dispute, check-in warns about suspended tickets
+func (u *User) SetTicketSuspended(suspended bool) error {
+	u.TicketSuspended = suspended
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: u.AirtableID,
+			Fields: map[string]interface{}{
+				fields.TicketSuspended: u.TicketSuspended,
+			},
+		}},
+	}
+
+	_, err := attendeesTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "suspending ticket for "+u.UserName)
+	}
+
+	if defaultCache != nil {
+		defaultCache.Delete(u.cacheKey())
+	}
+
+	return nil
+}
+
 func GetUserByDiscord(discordName string) (*User, error) {
 	user, err := GetUserByField(fields.DiscordName, discordName)
 	if err != nil {
@@ -960,22 +1372,28 @@ func (u *SoftLaunchUser) cacheKey() string  { return "sl-" + u.UserName }
 func (u *ChaosModeUser) cacheKey() string   { return "cm-" + u.UserName }
 func (u *SponsorshipUser) cacheKey() string { return "sp-" + u.UserName }
 
-func (u *User) HasCheckinPermission() bool {
-	if u.AdmissionLevel == "Staff" {
-		return true
-	}
+// HasRole says whether they can do what role allows. Admins have every role, and a staff ticket gets them through check-in.
+func (u *User) HasRole(role string) bool {
+	_, ok := u.RoleFor(role)
+	return ok
+}
 
-	helping := []string{
-		"konstell2", "thermestor", "dancinghorse16",
+// RoleFor is the role that lets them do what role allows: role itself, admin, or their staff ticket for check-in
+func (u *User) RoleFor(role string) (string, bool) {
+	for _, r := range u.Roles {
+		if r == role {
+			return r, true
+		}
 	}
-
-	for _, h := range helping {
-		if h == u.UserName {
-			return true
+	for _, r := range u.Roles {
+		if r == fields.RoleAdmin {
+			return r, true
 		}
 	}
-
-	return false
+	if role == fields.RoleCheckin && u.AdmissionLevel == fields.Staff {
+		return fields.Staff, true
+	}
+	return "", false
 }
 
 func toStr(i interface{}) string {
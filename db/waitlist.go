@@ -0,0 +1,172 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+type WaitlistEntry struct {
+	UserName       string
+	Name           string
+	Email          string
+	AdmissionLevel string
+	Quantity       int
+	Status         string
+	OfferToken     string
+	OfferExpires   time.Time
+	Created        string
+
+	AirtableID string
+}
+
+// OfferActive is true while the entry holds capacity for its user
+func (e *WaitlistEntry) OfferActive() bool {
+	return e.Status == fields.WaitlistOffered && time.Now().Before(e.OfferExpires)
+}
+
+func (e *WaitlistEntry) CreateWaitlistEntry() error {
+	if e.AirtableID != "" {
+		return errors.New("Waitlist entry already exists")
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.UserName:         e.UserName,
+					fields.Name:             e.Name,
+					fields.Email:            e.Email,
+					fields.AdmissionLevel:   e.AdmissionLevel,
+					fields.TicketsRequested: e.Quantity,
+					fields.WaitlistStatus:   e.Status,
+				},
+			},
+		},
+	}
+
+	recvRecords, err := waitlistTable.AddRecords(r)
+	if err != nil {
+		return errors.Wrap(err, "creating waitlist record")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return errors.Wrap(ErrManyRecords, "")
+	}
+
+	e.AirtableID = recvRecords.Records[0].ID
+	e.Created = recvRecords.Records[0].CreatedTime
+	return nil
+}
+
+// GetWaitlistEntries returns every waitlist entry for a user, oldest first
+func GetWaitlistEntries(userName string) ([]*WaitlistEntry, error) {
+	return getWaitlistEntriesByField(fields.UserName, strings.ToLower(userName))
+}
+
+// GetWaitlistEntriesByStatus returns every entry with the given status, oldest first
+func GetWaitlistEntriesByStatus(status string) ([]*WaitlistEntry, error) {
+	return getWaitlistEntriesByField(fields.WaitlistStatus, status)
+}
+
+func GetWaitlistOffer(token string) (*WaitlistEntry, error) {
+	if token == "" {
+		return nil, errors.New("No waitlist offer found")
+	}
+
+	entries, err := getWaitlistEntriesByField(fields.OfferToken, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("No waitlist offer found")
+	} else if len(entries) != 1 {
+		return nil, errors.Wrap(ErrManyRecords, "")
+	}
+
+	return entries[0], nil
+}
+
+func getWaitlistEntriesByField(field, value string) ([]*WaitlistEntry, error) {
+	filterFormula := fmt.Sprintf(`{%s}="%s"`, field, strings.ReplaceAll(value, `"`, `\"`))
+	records, err := queryAll(waitlistTable, filterFormula)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*WaitlistEntry, 0, len(records))
+	for _, rec := range records {
+		expires, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.OfferExpires]))
+		entries = append(entries, &WaitlistEntry{
+			AirtableID:     rec.ID,
+			UserName:       toStr(rec.Fields[fields.UserName]),
+			Name:           toStr(rec.Fields[fields.Name]),
+			Email:          toStr(rec.Fields[fields.Email]),
+			AdmissionLevel: toStr(rec.Fields[fields.AdmissionLevel]),
+			Quantity:       toInt(rec.Fields[fields.TicketsRequested]),
+			Status:         toStr(rec.Fields[fields.WaitlistStatus]),
+			OfferToken:     toStr(rec.Fields[fields.OfferToken]),
+			OfferExpires:   expires,
+			Created:        rec.CreatedTime,
+		})
+	}
+
+	// createdTime is RFC3339 so it sorts lexically
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created < entries[j].Created
+	})
+
+	return entries, nil
+}
+
+func (e *WaitlistEntry) MakeOffer(token string, expires time.Time) error {
+	e.Status = fields.WaitlistOffered
+	e.OfferToken = token
+	e.OfferExpires = expires
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: e.AirtableID,
+			Fields: map[string]interface{}{
+				fields.WaitlistStatus: e.Status,
+				fields.OfferToken:     e.OfferToken,
+				fields.OfferExpires:   e.OfferExpires.UTC().Format(time.RFC3339),
+			},
+		}},
+	}
+
+	_, err := waitlistTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "making waitlist offer")
+	}
+
+	return nil
+}
+
+func (e *WaitlistEntry) UpdateWaitlistStatus(status string) error {
+	e.Status = status
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: e.AirtableID,
+			Fields: map[string]interface{}{
+				fields.WaitlistStatus: e.Status,
+			},
+		}},
+	}
+
+	_, err := waitlistTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating waitlist status")
+	}
+
+	return nil
+}
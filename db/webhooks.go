@@ -0,0 +1,210 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/mehanizm/airtable"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+// WebhookEvent is a verified stripe event and how far we've got processing it
+type WebhookEvent struct {
+	EventID     string
+	Type        string
+	Payload     string
+	Status      string
+	Steps       []string
+	Attempts    int
+	LastError   string
+	ReceivedAt  time.Time
+	ProcessedAt time.Time
+
+	AirtableID string
+}
+
+var webhookEventMutex sync.Mutex
+
+// RecordWebhookEvent stores an event the first time it's seen, and returns the stored copy after that
+func RecordWebhookEvent(eventID, eventType, payload string) (*WebhookEvent, error) {
+	webhookEventMutex.Lock()
+	defer webhookEventMutex.Unlock()
+
+	existing, err := GetWebhookEvent(eventID)
+	if err == nil {
+		return existing, nil
+	} else if !errors.Is(err, ErrNoRecords) {
+		return nil, err
+	}
+
+	e := &WebhookEvent{
+		EventID:    eventID,
+		Type:       eventType,
+		Payload:    payload,
+		Status:     fields.EventReceived,
+		ReceivedAt: time.Now(),
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{
+			{
+				Fields: map[string]interface{}{
+					fields.EventID:    e.EventID,
+					fields.EventType:  e.Type,
+					fields.Payload:    e.Payload,
+					fields.Status:     e.Status,
+					fields.ReceivedAt: e.ReceivedAt.UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+
+	recvRecords, err := webhookEventsTable.AddRecords(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "recording webhook event")
+	}
+
+	if recvRecords == nil || len(recvRecords.Records) == 0 {
+		return nil, errors.Wrap(ErrNoRecords, "")
+	} else if len(recvRecords.Records) != 1 {
+		return nil, errors.Wrap(ErrManyRecords, "")
+	}
+
+	e.AirtableID = recvRecords.Records[0].ID
+	return e, nil
+}
+
+func GetWebhookEvent(eventID string) (*WebhookEvent, error) {
+	records, err := query(webhookEventsTable, fields.EventID, eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records.Records) == 0 {
+		return nil, errors.Wrap(ErrNoRecords, "")
+	} else if len(records.Records) > 1 {
+		return nil, errors.Wrap(ErrManyRecords, "")
+	}
+
+	return webhookEventFromRecord(records.Records[0]), nil
+}
+
+// GetUnfinishedWebhookEvents returns events that still need processing, oldest first
+func GetUnfinishedWebhookEvents() ([]*WebhookEvent, error) {
+	return getWebhookEvents(fmt.Sprintf(`OR({%s}="%s",{%s}="%s")`,
+		fields.Status, fields.EventReceived, fields.Status, fields.EventFailed))
+}
+
+// GetWebhookEvents returns events received in [since, until), oldest first. A blank status or zero time matches anything.
+func GetWebhookEvents(status string, since, until time.Time) ([]*WebhookEvent, error) {
+	filterFormula := ""
+	if status != "" {
+		filterFormula = fmt.Sprintf(`{%s}="%s"`, fields.Status, status)
+	}
+
+	events, err := getWebhookEvents(filterFormula)
+	if err != nil {
+		return nil, err
+	}
+
+	inRange := make([]*WebhookEvent, 0, len(events))
+	for _, e := range events {
+		if (since.IsZero() || !e.ReceivedAt.Before(since)) && (until.IsZero() || e.ReceivedAt.Before(until)) {
+			inRange = append(inRange, e)
+		}
+	}
+
+	return inRange, nil
+}
+
+func getWebhookEvents(filterFormula string) ([]*WebhookEvent, error) {
+	records, err := queryAll(webhookEventsTable, filterFormula)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*WebhookEvent, 0, len(records))
+	for _, rec := range records {
+		events = append(events, webhookEventFromRecord(rec))
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].ReceivedAt.Before(events[j].ReceivedAt)
+	})
+
+	return events, nil
+}
+
+func webhookEventFromRecord(rec *airtable.Record) *WebhookEvent {
+	received, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.ReceivedAt]))
+	processed, _ := time.Parse(time.RFC3339, toStr(rec.Fields[fields.ProcessedAt]))
+	return &WebhookEvent{
+		AirtableID:  rec.ID,
+		EventID:     toStr(rec.Fields[fields.EventID]),
+		Type:        toStr(rec.Fields[fields.EventType]),
+		Payload:     toStr(rec.Fields[fields.Payload]),
+		Status:      toStr(rec.Fields[fields.Status]),
+		Steps:       splitList(toStr(rec.Fields[fields.Steps])),
+		Attempts:    toInt(rec.Fields[fields.Attempts]),
+		LastError:   toStr(rec.Fields[fields.LastError]),
+		ReceivedAt:  received,
+		ProcessedAt: processed,
+	}
+}
+
+// String names the event in the logs
+func (e *WebhookEvent) String() string {
+	return "Event " + e.EventID
+}
+
+// StepDone is whether an earlier attempt already finished the step
+func (e *WebhookEvent) StepDone(step string) bool {
+	for _, s := range e.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// FinishStep records the step so retries skip it
+func (e *WebhookEvent) FinishStep(step string) error {
+	if e.StepDone(step) {
+		return nil
+	}
+
+	e.Steps = append(e.Steps, step)
+	return e.Update()
+}
+
+// Update saves the event's status, steps, attempts and last error
+func (e *WebhookEvent) Update() error {
+	processed := ""
+	if !e.ProcessedAt.IsZero() {
+		processed = e.ProcessedAt.UTC().Format(time.RFC3339)
+	}
+
+	r := &airtable.Records{
+		Records: []*airtable.Record{{
+			ID: e.AirtableID,
+			Fields: map[string]interface{}{
+				fields.Status:      e.Status,
+				fields.Steps:       strings.Join(e.Steps, ","),
+				fields.Attempts:    e.Attempts,
+				fields.LastError:   e.LastError,
+				fields.ProcessedAt: processed,
+			},
+		}},
+	}
+
+	_, err := webhookEventsTable.UpdateRecordsPartial(r)
+	if err != nil {
+		return errors.Wrap(err, "updating webhook event")
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+// Package discord keeps attendees' roles in the vibecamp discord server in step with their tickets. It only ever
+// adds or removes the roles listed in the Discord Roles table, anything else members have is left alone.
+package discord
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Member is someone in the server and the roles they have
+type Member struct {
+	UserID string
+	Roles  []string
+}
+
+// Guild is the discord server roles are synced in. Bot is the real one, Fake keeps members in memory.
+type Guild interface {
+	// Members is everyone in the server
+	Members() ([]Member, error)
+	AddRole(userID, roleID string) error
+	RemoveRole(userID, roleID string) error
+}
+
+// how many times a rate limited request is tried again before giving up on it
+const maxRateLimitRetries = 3
+
+var client = &http.Client{Timeout: 15 * time.Second}
+
+// Bot talks to discord's API as a bot in the server. It needs the Manage Roles permission and the server members
+// intent, and its own role has to be above the ones it hands out. APIBase points it somewhere other than discord,
+// and is blank for the real thing.
+type Bot struct {
+	Token   string
+	GuildID string
+	APIBase string
+}
+
+func (b *Bot) do(method, path string, out interface{}) error {
+	base := "https://discord.com"
+	if b.APIBase != "" {
+		base = strings.TrimRight(b.APIBase, "/")
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, base+"/api/v10"+path, nil)
+		if err != nil {
+			return errors.Wrap(err, "making request")
+		}
+		req.Header.Set("Authorization", "Bot "+b.Token)
+		req.Header.Set("User-Agent", "DiscordBot (https://github.com/vibecamp/myvibecamp, 1)")
+		req.Header.Set("X-Audit-Log-Reason", "ticket role sync")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return errors.Wrapf(err, "%s %s", method, path)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrapf(err, "reading %s %s", method, path)
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < maxRateLimitRetries {
+			var limit struct {
+				RetryAfter float64 `json:"retry_after"`
+			}
+			_ = json.Unmarshal(body, &limit)
+			time.Sleep(time.Duration(limit.RetryAfter*float64(time.Second)) + 100*time.Millisecond)
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			if len(body) > 200 {
+				body = body[:200]
+			}
+			return errors.Newf("%s %s: %s: %s", method, path, resp.Status, body)
+		}
+
+		if out == nil {
+			return nil
+		}
+		return errors.Wrapf(json.Unmarshal(body, out), "parsing %s %s", method, path)
+	}
+}
+
+// Members pages through everyone in the server
+func (b *Bot) Members() ([]Member, error) {
+	const pageSize = 1000
+
+	var members []Member
+	after := "0"
+	for {
+		var page []struct {
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+			Roles []string `json:"roles"`
+		}
+		q := url.Values{"limit": {"1000"}, "after": {after}}
+		err := b.do(http.MethodGet, "/guilds/"+b.GuildID+"/members?"+q.Encode(), &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range page {
+			members = append(members, Member{UserID: m.User.ID, Roles: m.Roles})
+		}
+		if len(page) < pageSize {
+			return members, nil
+		}
+		after = page[len(page)-1].User.ID
+	}
+}
+
+func (b *Bot) AddRole(userID, roleID string) error {
+	return b.do(http.MethodPut, "/guilds/"+b.GuildID+"/members/"+userID+"/roles/"+roleID, nil)
+}
+
+func (b *Bot) RemoveRole(userID, roleID string) error {
+	return b.do(http.MethodDelete, "/guilds/"+b.GuildID+"/members/"+userID+"/roles/"+roleID, nil)
+}
+
+// Fake is a server that only exists in memory, for trying the sync without discord
+type Fake struct {
+	mutex   sync.Mutex
+	members map[string][]string
+}
+
+// NewFake makes an empty server. Members only get roles once they've joined.
+func NewFake() *Fake {
+	return &Fake{members: map[string][]string{}}
+}
+
+// Join adds someone to the server with roles
+func (f *Fake) Join(userID string, roles ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.members[userID] = append([]string{}, roles...)
+}
+
+// Roles is the roles someone has, and whether they're in the server
+func (f *Fake) Roles(userID string) ([]string, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	roles, ok := f.members[userID]
+	return append([]string{}, roles...), ok
+}
+
+func (f *Fake) Members() ([]Member, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	members := make([]Member, 0, len(f.members))
+	for id, roles := range f.members {
+		members = append(members, Member{UserID: id, Roles: append([]string{}, roles...)})
+	}
+	return members, nil
+}
+
+func (f *Fake) AddRole(userID, roleID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	roles, ok := f.members[userID]
+	if !ok {
+		return errors.Newf("%s isn't in the server", userID)
+	}
+	for _, r := range roles {
+		if r == roleID {
+			return nil
+		}
+	}
+	f.members[userID] = append(roles, roleID)
+	return nil
+}
+
+func (f *Fake) RemoveRole(userID, roleID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	roles, ok := f.members[userID]
+	if !ok {
+		return errors.Newf("%s isn't in the server", userID)
+	}
+	kept := roles[:0]
+	for _, r := range roles {
+		if r != roleID {
+			kept = append(kept, r)
+		}
+	}
+	f.members[userID] = kept
+	return nil
+}
@@ -0,0 +1,221 @@
+package discord
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testToken = "bot-token"
+	testGuild = "guild1"
+)
+
+// fakeAPI is the bits of discord's API the bot uses, for one server
+type fakeAPI struct {
+	mutex   sync.Mutex
+	members map[string][]string
+	// limited is how many more times a request to each path is answered with a 429 before it goes through
+	limited    map[string]int
+	retryAfter float64
+	// when each path was last asked for, to check the bot waited as long as it was told to
+	lastTried map[string]time.Time
+	waited    map[string]time.Duration
+	requests  int
+}
+
+func newFakeAPI(t *testing.T) (*fakeAPI, *Bot) {
+	f := &fakeAPI{
+		members:   map[string][]string{},
+		limited:   map[string]int{},
+		lastTried: map[string]time.Time{},
+		waited:    map[string]time.Duration{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, &Bot{Token: testToken, GuildID: testGuild, APIBase: server.URL}
+}
+
+func (f *fakeAPI) join(userID string, roles ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.members[userID] = append([]string{}, roles...)
+}
+
+func (f *fakeAPI) roles(userID string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	roles := append([]string{}, f.members[userID]...)
+	sort.Strings(roles)
+	return roles
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests++
+
+	if last, ok := f.lastTried[r.URL.Path]; ok {
+		f.waited[r.URL.Path] = time.Since(last)
+	}
+	f.lastTried[r.URL.Path] = time.Now()
+
+	if r.Header.Get("Authorization") != "Bot "+testToken {
+		http.Error(w, `{"message": "401: Unauthorized", "code": 0}`, http.StatusUnauthorized)
+		return
+	}
+	if f.limited[r.URL.Path] > 0 {
+		f.limited[r.URL.Path]--
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, `{"message": "You are being rate limited.", "retry_after": %g, "global": false}`, f.retryAfter)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v10/guilds/"+testGuild), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "members":
+		f.listMembers(w, r)
+	case (r.Method == http.MethodPut || r.Method == http.MethodDelete) && len(parts) == 5 && parts[1] == "members" && parts[3] == "roles":
+		userID, roleID := parts[2], parts[4]
+		roles, ok := f.members[userID]
+		if !ok {
+			http.Error(w, `{"message": "Unknown Member", "code": 10007}`, http.StatusNotFound)
+			return
+		}
+		kept := []string{}
+		for _, id := range roles {
+			if id != roleID {
+				kept = append(kept, id)
+			}
+		}
+		if r.Method == http.MethodPut {
+			kept = append(kept, roleID)
+		}
+		f.members[userID] = kept
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listMembers pages through members in id order, like discord does
+func (f *fakeAPI) listMembers(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 || limit > 1000 {
+		http.Error(w, `{"message": "Invalid Form Body", "code": 50035}`, http.StatusBadRequest)
+		return
+	}
+	after, _ := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+
+	var ids []uint64
+	for id := range f.members {
+		n, _ := strconv.ParseUint(id, 10, 64)
+		if n > after {
+			ids = append(ids, n)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	type user struct {
+		ID string `json:"id"`
+	}
+	type member struct {
+		User  user     `json:"user"`
+		Roles []string `json:"roles"`
+	}
+	page := []member{}
+	for _, n := range ids {
+		id := strconv.FormatUint(n, 10)
+		page = append(page, member{User: user{ID: id}, Roles: f.members[id]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+func TestBotMembersPages(t *testing.T) {
+	f, bot := newFakeAPI(t)
+	const n = 2345
+	for i := 1; i <= n; i++ {
+		f.join(strconv.Itoa(1000000+i), "role")
+	}
+
+	members, err := bot.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != n {
+		t.Fatalf("got %d members, want %d", len(members), n)
+	}
+	seen := map[string]bool{}
+	for _, m := range members {
+		if seen[m.UserID] {
+			t.Fatalf("%s came back twice", m.UserID)
+		}
+		seen[m.UserID] = true
+	}
+	if f.requests != 3 {
+		t.Errorf("took %d requests, want 3", f.requests)
+	}
+}
+
+func TestBotRateLimits(t *testing.T) {
+	const path = "/api/v10/guilds/" + testGuild + "/members/100/roles/r1"
+	tests := []struct {
+		name       string
+		limited    int
+		retryAfter float64
+		ok         bool
+	}{
+		{"not limited", 0, 0, true},
+		{"limited once", 1, 0.25, true},
+		{"limited as many times as it retries", maxRateLimitRetries, 0, true},
+		{"limited more times than it retries", maxRateLimitRetries + 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, bot := newFakeAPI(t)
+			f.join("100")
+			f.limited[path] = tt.limited
+			f.retryAfter = tt.retryAfter
+
+			err := bot.AddRole("100", "r1")
+			if (err == nil) != tt.ok {
+				t.Fatalf("AddRole() error = %v, want ok %v", err, tt.ok)
+			}
+			if want := tt.limited + 1; tt.ok && f.requests != want {
+				t.Errorf("took %d requests, want %d", f.requests, want)
+			}
+			if wait := time.Duration(tt.retryAfter * float64(time.Second)); f.waited[path] < wait {
+				t.Errorf("tried again after %v, told to wait %v", f.waited[path], wait)
+			}
+			if got := strings.Join(f.roles("100"), ","); tt.ok && got != "r1" {
+				t.Errorf("roles = %s, want r1", got)
+			}
+		})
+	}
+}
+
+func TestBotErrors(t *testing.T) {
+	f, bot := newFakeAPI(t)
+	if err := bot.AddRole("100", "r1"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("adding a role to someone who isn't in the server: %v", err)
+	}
+
+	f.join("100")
+	bot.Token = "wrong"
+	if _, err := bot.Members(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("listing members with the wrong token: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package discord
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Change is a role added to or removed from someone
+type Change struct {
+	UserID   string
+	UserName string
+	RoleID   string
+	Role     string
+	Added    bool
+}
+
+func (c Change) String() string {
+	verb, dir := "add", "to"
+	if !c.Added {
+		verb, dir = "remove", "from"
+	}
+	who := c.UserID
+	if c.UserName != "" {
+		who = "@" + c.UserName + " (" + c.UserID + ")"
+	}
+	return fmt.Sprintf("%s %s %s %s", verb, c.Role, dir, who)
+}
+
+// Result is what a sync did, or for a dry run what it would do
+type Result struct {
+	Members int
+	Linked  int
+	Changes []Change
+	Failed  int
+}
+
+// Wants is the role ids the attendee should have. Ticket holders get the attendee role and the ones for their admission
+// level, cabin and ticket path, staff get the staff role, and a refunded, transferred or disputed ticket gets nothing.
+func Wants(u *db.User, roles []*db.DiscordRole) []string {
+	ticket := u.TicketID != "" && !u.TicketSuspended
+	staff := u.AdmissionLevel == "Staff" || len(u.Roles) > 0
+
+	var want []string
+	for _, r := range roles {
+		var match bool
+		switch r.Kind {
+		case fields.DiscordRoleAttendee:
+			match = ticket
+		case fields.DiscordRoleStaff:
+			match = staff
+		case fields.DiscordRoleAdmission:
+			match = ticket && u.AdmissionLevel == r.Value
+		case fields.DiscordRoleCabin:
+			match = ticket && u.Cabin2023 != "" && u.Cabin2023 == r.Value
+		case fields.DiscordRoleTicketPath:
+			match = ticket && u.TicketPath == r.Value
+		}
+		if match {
+			want = append(want, r.RoleID)
+		}
+	}
+	return want
+}
+
+var syncMutex sync.Mutex
+
+// Sync gives everyone in the server with a verified discord account on the guest list the roles they should have,
+// and takes managed roles off everyone else. A dry run only works out the changes.
+func Sync(g Guild, dryRun bool) (*Result, error) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	roles, err := db.GetDiscordRoles()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting discord roles")
+	}
+	managed := map[string]string{}
+	for _, r := range roles {
+		managed[r.RoleID] = r.Name
+	}
+
+	users, err := db.ReloadAllUsers()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting attendees")
+	}
+	if len(users) == 0 {
+		// better to do nothing than take everyone's roles away over a bad read
+		return nil, errors.New("no attendees, not syncing")
+	}
+	want := map[string]map[string]bool{}
+	names := map[string]string{}
+	for _, u := range users {
+		if u.DiscordID == "" {
+			continue
+		}
+		if want[u.DiscordID] == nil {
+			want[u.DiscordID] = map[string]bool{}
+		}
+		for _, id := range Wants(u, roles) {
+			want[u.DiscordID][id] = true
+		}
+		names[u.DiscordID] = u.UserName
+	}
+
+	members, err := g.Members()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting server members")
+	}
+
+	result := &Result{Members: len(members), Linked: len(want)}
+	for _, m := range members {
+		has := map[string]bool{}
+		for _, id := range m.Roles {
+			if _, ok := managed[id]; ok {
+				has[id] = true
+			}
+		}
+
+		var changes []Change
+		for id := range want[m.UserID] {
+			if !has[id] {
+				changes = append(changes, Change{UserID: m.UserID, UserName: names[m.UserID], RoleID: id, Role: roleName(id, managed), Added: true})
+			}
+		}
+		for id := range has {
+			if !want[m.UserID][id] {
+				changes = append(changes, Change{UserID: m.UserID, UserName: names[m.UserID], RoleID: id, Role: roleName(id, managed)})
+			}
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Role < changes[j].Role })
+
+		for _, c := range changes {
+			if !dryRun {
+				if c.Added {
+					err = g.AddRole(c.UserID, c.RoleID)
+				} else {
+					err = g.RemoveRole(c.UserID, c.RoleID)
+				}
+				if err != nil {
+					log.Errorf("discord sync couldn't %v: %v", c, err)
+					result.Failed++
+					continue
+				}
+			}
+			result.Changes = append(result.Changes, c)
+		}
+	}
+
+	return result, nil
+}
+
+// roleName is what the role's called in the roles table, or its id if it hasn't got a name
+func roleName(id string, managed map[string]string) string {
+	if name := managed[id]; name != "" {
+		return name
+	}
+	return id
+}
+
+var trigger = make(chan struct{}, 1)
+
+// Trigger asks the worker to sync soon, instead of waiting for its next run
+func Trigger() {
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs every interval, and whenever it's triggered, until the process exits
+func Run(g Guild, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-trigger:
+		}
+
+		result, err := Sync(g, false)
+		if err != nil {
+			log.Errorf("error syncing discord roles: %v", err)
+			continue
+		}
+		if len(result.Changes) > 0 || result.Failed > 0 {
+			log.Infof("Discord sync: %d changes, %d failed", len(result.Changes), result.Failed)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package discord
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+var testRoles = []*db.DiscordRole{
+	{RoleID: "r-attendee", Name: "attendee", Kind: fields.DiscordRoleAttendee},
+	{RoleID: "r-staff", Name: "staff", Kind: fields.DiscordRoleStaff},
+	{RoleID: "r-sponsor", Name: "sponsor", Kind: fields.DiscordRoleAdmission, Value: "Sponsor"},
+	{RoleID: "r-cabin", Name: "cabin 1", Kind: fields.DiscordRoleCabin, Value: "Cabin 1"},
+	{RoleID: "r-volunteer", Name: "volunteer", Kind: fields.DiscordRoleTicketPath, Value: "Volunteer"},
+}
+
+func TestWants(t *testing.T) {
+	tests := []struct {
+		name string
+		user db.User
+		want string
+	}{
+		{"no ticket", db.User{}, ""},
+		{"ticket", db.User{TicketID: "t1", AdmissionLevel: "Basic"}, "r-attendee"},
+		{"sponsor in a cabin", db.User{TicketID: "t1", AdmissionLevel: "Sponsor", Cabin2023: "Cabin 1"}, "r-attendee,r-sponsor,r-cabin"},
+		{"volunteer", db.User{TicketID: "t1", TicketPath: "Volunteer"}, "r-attendee,r-volunteer"},
+		{"suspended ticket", db.User{TicketID: "t1", AdmissionLevel: "Sponsor", TicketSuspended: true}, ""},
+		{"sponsor level without a ticket", db.User{AdmissionLevel: "Sponsor", Cabin2023: "Cabin 1"}, ""},
+		{"staff level", db.User{TicketID: "t1", AdmissionLevel: "Staff"}, "r-attendee,r-staff"},
+		{"staff role without a ticket", db.User{Roles: []string{fields.RoleAdmin}}, "r-staff"},
+		{"staff with a suspended ticket", db.User{TicketID: "t1", AdmissionLevel: "Staff", TicketSuspended: true}, "r-staff"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(Wants(&tt.user, testRoles), ","); got != tt.want {
+				t.Errorf("Wants() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// syncs against the fake API, checking members' roles end up matching their tickets
+func TestSync(t *testing.T) {
+	s := dbtest.New(t)
+	for _, r := range testRoles {
+		s.Add("Discord Roles", map[string]interface{}{fields.RoleID: r.RoleID, fields.Name: r.Name, fields.Kind: r.Kind, fields.Value: r.Value})
+	}
+	attendee := func(userName, discordID string, f map[string]interface{}) {
+		f[fields.UserName] = userName
+		f[fields.DiscordID] = discordID
+		s.Add(dbtest.Attendees, f)
+	}
+	attendee("alice", "100", map[string]interface{}{fields.TicketID: "t1", fields.AdmissionLevel: "Sponsor", fields.Cabin: "Cabin 1"})
+	attendee("bob", "101", map[string]interface{}{fields.TicketID: "t2", fields.AdmissionLevel: "Basic", fields.TicketSuspended: "checked"})
+	attendee("carol", "102", map[string]interface{}{fields.Roles: fields.RoleAdmin})
+	attendee("dave", "103", map[string]interface{}{fields.TicketID: "t3", fields.AdmissionLevel: "Basic", fields.TicketPath: "Volunteer"})
+	attendee("erin", "", map[string]interface{}{fields.TicketID: "t4", fields.AdmissionLevel: "Basic"})
+	attendee("frank", "105", map[string]interface{}{fields.TicketID: "t5", fields.AdmissionLevel: "Basic"})
+
+	f, bot := newFakeAPI(t)
+	f.join("100", "r-other")
+	f.join("101", "r-attendee", "r-other")
+	f.join("102")
+	f.join("103", "r-attendee")
+	// someone who never linked their account, holding a role they shouldn't
+	f.join("199", "r-attendee", "r-sponsor")
+	// adding alice's sponsor role is rate limited the first time
+	f.limited["/api/v10/guilds/"+testGuild+"/members/100/roles/r-sponsor"] = 1
+	f.retryAfter = 0.1
+
+	want := map[string]string{
+		"100": "r-attendee,r-cabin,r-other,r-sponsor",
+		"101": "r-other",
+		"102": "r-staff",
+		"103": "r-attendee,r-volunteer",
+		"199": "",
+	}
+	before := map[string]string{}
+	for id := range want {
+		before[id] = strings.Join(f.roles(id), ",")
+	}
+
+	dryRun, err := Sync(bot, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, roles := range before {
+		if got := strings.Join(f.roles(id), ","); got != roles {
+			t.Errorf("dry run changed %s's roles to %s", id, got)
+		}
+	}
+
+	result, err := Sync(bot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Members != 5 || result.Linked != 5 || result.Failed != 0 {
+		t.Errorf("result = %+v", result)
+	}
+	if len(result.Changes) != 8 || len(dryRun.Changes) != len(result.Changes) {
+		t.Errorf("made %d changes, dry run said %d, want 8: %v", len(result.Changes), len(dryRun.Changes), result.Changes)
+	}
+	for id, roles := range want {
+		if got := strings.Join(f.roles(id), ","); got != roles {
+			t.Errorf("%s has %s, want %s", id, got, roles)
+		}
+	}
+
+	// frank joins the server later, and a sync that's already done everything does nothing else
+	f.join("105")
+	result, err = Sync(bot, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 1 || result.Changes[0].String() != "add attendee to @frank (105)" {
+		t.Errorf("second sync made changes %v", result.Changes)
+	}
+}
+
+func TestSyncWithoutAttendees(t *testing.T) {
+	dbtest.New(t)
+	f, bot := newFakeAPI(t)
+	f.join("100", "r-attendee")
+	if _, err := Sync(bot, false); err == nil {
+		t.Error("synced with nobody on the guest list")
+	}
+	if f.requests != 0 {
+		t.Errorf("made %d requests", f.requests)
+	}
+}
@@ -0,0 +1,41 @@
+package email
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dir writes each email to a .eml file in a directory instead of sending it, for dev and testing
+type Dir string
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9@._-]+`)
+
+// Send writes the message to the directory, named by when it was sent and who it's to
+func (d Dir) Send(from string, m *Message) error {
+	msg, err := m.Bytes(from)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(string(d), 0o755)
+	if err != nil {
+		return errors.Wrap(err, "making mail directory")
+	}
+
+	name := fmt.Sprintf("%s-%s-%s.eml", time.Now().Format("20060102-150405"), unsafeChars.ReplaceAllString(m.To, "_"), uuid.NewString()[:8])
+	path := filepath.Join(string(d), name)
+	err = os.WriteFile(path, msg, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "writing email")
+	}
+
+	log.Infof("Wrote %q for %v to %v", m.Subject, m.To, path)
+	return nil
+}
@@ -0,0 +1,206 @@
+// Package email sends transactional email. Messages go into an outbox table first and are delivered by
+// whichever provider is set up, so a failed send gets retried instead of lost.
+package email
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// most times we'll try to send an email before giving up on it
+const maxAttempts = 5
+
+// Message is one email. Key, if set, makes sure the same email is only ever queued once. Attachments are queued
+// with a Source and rendered when the email is sent.
+type Message struct {
+	Key         string
+	To          string
+	Subject     string
+	HTML        []byte
+	Attachments []db.EmailAttachment
+}
+
+// Provider delivers email
+type Provider interface {
+	Send(from string, m *Message) error
+}
+
+// Renderer makes the file for an attachment from the part of its source after the kind
+type Renderer func(ref string) ([]byte, error)
+
+var (
+	renderers = map[string]Renderer{}
+
+	provider    Provider
+	from        string
+	externalURL string
+	templates   *template.Template
+	sendMutex   sync.Mutex
+)
+
+// Init sets the provider email goes out through, who it's from, the site's URL for links, and the templates messages render with.
+// A nil provider keeps email queued in the outbox until one is set up.
+func Init(p Provider, fromAddress, siteURL string, tmpl *template.Template) {
+	provider = p
+	from = fromAddress
+	externalURL = siteURL
+	templates = tmpl
+}
+
+// RegisterAttachment sets how attachments with a source of kind:ref are rendered
+func RegisterAttachment(kind string, r Renderer) {
+	renderers[kind] = r
+}
+
+// renderAttachments makes the files for an email's attachments
+func renderAttachments(refs []db.EmailAttachment) ([]db.EmailAttachment, error) {
+	attachments := make([]db.EmailAttachment, 0, len(refs))
+	for _, a := range refs {
+		if a.Source == "" && len(a.Data) > 0 {
+			attachments = append(attachments, a)
+			continue
+		}
+
+		source := strings.SplitN(a.Source, ":", 2)
+		render := renderers[source[0]]
+		if render == nil || len(source) != 2 {
+			return nil, errors.Newf("nothing renders %s attachments", source[0])
+		}
+
+		data, err := render(source[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "rendering %s", a.Name)
+		}
+		a.Data = data
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// Render executes one of the site's templates for an email body
+func Render(name string, data interface{}) ([]byte, error) {
+	if templates == nil {
+		return nil, errors.New("email templates haven't been loaded")
+	}
+
+	var buf bytes.Buffer
+	err := templates.ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "rendering %s", name)
+	}
+	return buf.Bytes(), nil
+}
+
+// Queue stores the message in the outbox and tries to send it in the background
+func Queue(m *Message) error {
+	if m.To == "" {
+		return errors.Newf("no address to send %q to", m.Subject)
+	}
+
+	e, queued, err := db.QueueEmail(&db.OutboxEmail{
+		Key:         m.Key,
+		To:          m.To,
+		Subject:     m.Subject,
+		Body:        string(m.HTML),
+		Attachments: m.Attachments,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !queued {
+		log.Debugf("Email %v was already queued", m.Key)
+		return nil
+	}
+
+	go deliver(e)
+	return nil
+}
+
+// deliver tries to send an outbox email once, and records how it went
+func deliver(e *db.OutboxEmail) {
+	sendMutex.Lock()
+	defer sendMutex.Unlock()
+
+	if provider == nil {
+		log.Warnf("No email provider set up, %q to %v stays queued", e.Subject, e.To)
+		return
+	}
+
+	e.Attempts++
+	attachments, err := renderAttachments(e.Attachments)
+	if err == nil {
+		err = provider.Send(from, &Message{
+			Key:         e.Key,
+			To:          e.To,
+			Subject:     e.Subject,
+			HTML:        []byte(e.Body),
+			Attachments: attachments,
+		})
+	}
+	if err != nil {
+		log.Errorf("sending %q to %v (attempt %d): %v", e.Subject, e.To, e.Attempts, err)
+		e.LastError = err.Error()
+		if e.Attempts >= maxAttempts {
+			e.Status = fields.EmailFailed
+		}
+	} else {
+		e.Status = fields.EmailSent
+		e.LastError = ""
+		e.SentAt = time.Now()
+	}
+
+	if err := e.Update(); err != nil {
+		log.Errorf("error saving email %v: %v", e.AirtableID, err)
+	}
+}
+
+// RetryOutbox tries again to send everything still queued
+func RetryOutbox() {
+	emails, err := db.GetQueuedEmails()
+	if err != nil {
+		log.Errorf("error getting queued emails: %v", err)
+		return
+	}
+
+	for _, e := range emails {
+		// give the request that queued it a chance to send it first
+		if time.Since(e.QueuedAt) < time.Minute {
+			continue
+		}
+		deliver(e)
+	}
+}
+
+// Requeue gives up-on emails another round of attempts
+func Requeue() (int, error) {
+	emails, err := db.GetOutboxEmails(fields.EmailFailed)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range emails {
+		e.Status = fields.EmailQueued
+		e.Attempts = 0
+		if err := e.Update(); err != nil {
+			return 0, err
+		}
+	}
+	return len(emails), nil
+}
+
+// RunOutbox retries queued email every interval until the process exits
+func RunOutbox(interval time.Duration) {
+	for range time.Tick(interval) {
+		RetryOutbox()
+	}
+}
@@ -0,0 +1,107 @@
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+type fakeProvider struct {
+	sent []*Message
+}
+
+func (p *fakeProvider) Send(from string, m *Message) error {
+	p.sent = append(p.sent, m)
+	return nil
+}
+
+func TestRenderAttachments(t *testing.T) {
+	RegisterAttachment("upper", func(ref string) ([]byte, error) {
+		return []byte(strings.ToUpper(ref)), nil
+	})
+
+	tests := []struct {
+		name  string
+		refs  []db.EmailAttachment
+		wants []string
+		ok    bool
+	}{
+		{"none", nil, nil, true},
+		{"rendered", []db.EmailAttachment{{Name: "a.txt", Source: "upper:abc"}}, []string{"ABC"}, true},
+		{"ref can hold colons", []db.EmailAttachment{{Name: "a.txt", Source: "upper:a:b"}}, []string{"A:B"}, true},
+		{"queued with its file", []db.EmailAttachment{{Name: "a.txt", Data: []byte("old")}}, []string{"old"}, true},
+		{"unknown kind", []db.EmailAttachment{{Name: "a.txt", Source: "lower:abc"}}, nil, false},
+		{"no ref", []db.EmailAttachment{{Name: "a.txt", Source: "upper"}}, nil, false},
+		{"nothing at all", []db.EmailAttachment{{Name: "a.txt"}}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderAttachments(tt.refs)
+			if (err == nil) != tt.ok {
+				t.Fatalf("renderAttachments() error = %v, want ok %v", err, tt.ok)
+			}
+			if len(got) != len(tt.wants) {
+				t.Fatalf("rendered %d attachments, want %d", len(got), len(tt.wants))
+			}
+			for i, want := range tt.wants {
+				if string(got[i].Data) != want {
+					t.Errorf("attachment %d = %q, want %q", i, got[i].Data, want)
+				}
+			}
+		})
+	}
+}
+
+// the outbox keeps where an attachment comes from, not the file, and the file is made when it's sent
+func TestQueueRendersAttachmentsOnSend(t *testing.T) {
+	s := dbtest.New(t)
+	p := &fakeProvider{}
+	Init(p, "vibecamp <tickets@vibe.camp>", "https://my.vibe.camp", nil)
+	renders := 0
+	RegisterAttachment("receipt", func(orderID string) ([]byte, error) {
+		renders++
+		return []byte("%PDF for " + orderID), nil
+	})
+
+	e, _, err := db.QueueEmail(&db.OutboxEmail{
+		Key:         "receipt:order1",
+		To:          "alice@example.com",
+		Subject:     "Your receipt",
+		Attachments: []db.EmailAttachment{{Name: "receipt.pdf", ContentType: "application/pdf", Source: "receipt:order1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := s.Get("Email Outbox", e.AirtableID)[fields.Attachments]
+	if !strings.Contains(stored, "receipt:order1") || strings.Contains(stored, "data") {
+		t.Errorf("outbox attachments = %s, want just the source", stored)
+	}
+
+	queued, err := db.GetQueuedEmails()
+	if err != nil || len(queued) != 1 {
+		t.Fatalf("queued emails = %v, %v", queued, err)
+	}
+	deliver(queued[0])
+
+	if len(p.sent) != 1 || len(p.sent[0].Attachments) != 1 {
+		t.Fatalf("sent %v, want one email with one attachment", p.sent)
+	}
+	if got := string(p.sent[0].Attachments[0].Data); got != "%PDF for order1" || renders != 1 {
+		t.Errorf("attachment = %q after %d renders", got, renders)
+	}
+	if status := s.Get("Email Outbox", e.AirtableID)[fields.Status]; status != fields.EmailSent {
+		t.Errorf("status = %s, want %s", status, fields.EmailSent)
+	}
+
+	if _, _, err := db.QueueEmail(&db.OutboxEmail{
+		To:          "alice@example.com",
+		Attachments: []db.EmailAttachment{{Name: "receipt.pdf", Data: []byte("%PDF")}},
+	}); err == nil {
+		t.Error("queued a file with nothing to render it from")
+	}
+}
@@ -0,0 +1,74 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Bytes renders the message as a MIME email, an html part followed by any attachments
+func (m *Message) Bytes(from string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "writing email body")
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write(m.HTML); err != nil {
+		return nil, errors.Wrap(err, "writing email body")
+	}
+	if err := qp.Close(); err != nil {
+		return nil, errors.Wrap(err, "writing email body")
+	}
+
+	for _, a := range m.Attachments {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "attaching %s", a.Name)
+		}
+		if _, err := part.Write(wrapLines(base64.StdEncoding.EncodeToString(a.Data))); err != nil {
+			return nil, errors.Wrapf(err, "attaching %s", a.Name)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "finishing email")
+	}
+	return buf.Bytes(), nil
+}
+
+// wrapLines breaks base64 into 76 character lines, as mail servers expect
+func wrapLines(s string) []byte {
+	var buf bytes.Buffer
+	for len(s) > 76 {
+		buf.WriteString(s[:76])
+		buf.WriteString("\r\n")
+		s = s[76:]
+	}
+	buf.WriteString(s)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,85 @@
+package email
+
+import (
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// TicketIssued lets the buyer know their tickets are ready and where to find them
+func TicketIssued(order *db.Order) {
+	user, err := db.GetUser(order.UserName)
+	if err != nil {
+		log.Errorf("error getting @%v for their ticket email: %v", order.UserName, err)
+		return
+	}
+
+	notify(user, "ticket-issued:"+order.OrderID, "Your vibecamp ticket", "emailTicketIssued.html.tmpl", map[string]interface{}{
+		"User":    user,
+		"Order":   order,
+		"SiteURL": externalURL,
+	})
+}
+
+// PaymentFailed lets the buyer know their payment didn't go through, so they can try again
+func PaymentFailed(order *db.Order) {
+	user, err := db.GetUser(order.UserName)
+	if err != nil {
+		log.Errorf("error getting @%v for their payment failed email: %v", order.UserName, err)
+		return
+	}
+
+	notify(user, "payment-failed:"+order.StripeID, "Your vibecamp payment didn't go through", "emailPaymentFailed.html.tmpl", map[string]interface{}{
+		"User":    user,
+		"Order":   order,
+		"SiteURL": externalURL,
+	})
+}
+
+// LogisticsReminder asks a ticket holder to fill in their logistics. It goes out at most once a day.
+func LogisticsReminder(user *db.User) {
+	key := "logistics-reminder:" + user.UserName + ":" + time.Now().Format("2006-01-02")
+	notify(user, key, "Fill in your vibecamp logistics", "emailLogisticsReminder.html.tmpl", map[string]interface{}{
+		"User":    user,
+		"SiteURL": externalURL,
+	})
+}
+
+// RemindLogistics queues a logistics reminder for everyone with a ticket, and returns how many it queued
+func RemindLogistics() (int, error) {
+	users, err := db.GetTicketHolders()
+	if err != nil {
+		return 0, errors.Wrap(err, "getting ticket holders")
+	}
+
+	count := 0
+	for _, user := range users {
+		if user.Email == "" {
+			continue
+		}
+		LogisticsReminder(user)
+		count++
+	}
+	return count, nil
+}
+
+func notify(user *db.User, key, subject, template string, data interface{}) {
+	if user.Email == "" {
+		log.Infof("No email for @%v, not sending %q", user.UserName, subject)
+		return
+	}
+
+	body, err := Render(template, data)
+	if err != nil {
+		log.Errorf("error rendering %q for @%v: %v", subject, user.UserName, err)
+		return
+	}
+
+	err = Queue(&Message{Key: key, To: user.Email, Subject: subject, HTML: body})
+	if err != nil {
+		log.Errorf("error queueing %q for @%v: %v", subject, user.UserName, err)
+	}
+}
@@ -0,0 +1,40 @@
+package email
+
+import (
+	"fmt"
+	"net/smtp"
+
+	"github.com/cockroachdb/errors"
+)
+
+// SMTP sends email through a mail server
+type SMTP struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+}
+
+// Send delivers the message through the server, signing in if there's a username
+func (s *SMTP) Send(from string, m *Message) error {
+	msg, err := m.Bytes(from)
+	if err != nil {
+		return err
+	}
+
+	port := s.Port
+	if port == "" {
+		port = "587"
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	err = smtp.SendMail(fmt.Sprintf("%s:%s", s.Host, port), auth, from, []string{m.To}, msg)
+	if err != nil {
+		return errors.Wrap(err, "sending over smtp")
+	}
+	return nil
+}
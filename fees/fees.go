@@ -0,0 +1,148 @@
+// Package fees works out the processing fee buyers pay on top of an order
+package fees
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+// kinds of thing the fee can be charged on
+const (
+	Tickets   = "tickets"
+	Donations = "donations"
+	Transport = "transport"
+	Bedding   = "bedding"
+)
+
+// Policy is how the processing fee is worked out: a percentage plus a fixed amount, charged on some kinds of item.
+// An optional fee is only charged when the buyer chooses to cover it.
+type Policy struct {
+	BasisPoints int
+	FixedCents  int
+	On          map[string]bool
+	Optional    bool
+}
+
+// Default is the 3% on tickets, transport and bedding we've always charged
+var Default = Policy{
+	BasisPoints: 300,
+	On:          map[string]bool{Tickets: true, Transport: true, Bedding: true},
+}
+
+// how long Current keeps a policy before reading the constants again. Unset constants aren't cached by db, so
+// without this every checkout would look each of them up.
+const cacheFor = time.Minute
+
+var (
+	policyMutex sync.Mutex
+	policy      *Policy
+	loaded      time.Time
+)
+
+// Current is the policy from the constants table, falling back to the default for anything that isn't set. It's
+// read at most once every cacheFor.
+func Current() *Policy {
+	policyMutex.Lock()
+	defer policyMutex.Unlock()
+
+	if policy == nil || time.Since(loaded) > cacheFor {
+		policy = load()
+		loaded = time.Now()
+	}
+
+	p := *policy
+	return &p
+}
+
+func load() *Policy {
+	return &Policy{
+		BasisPoints: constantOr(fields.FeeBasisPoints, Default.BasisPoints),
+		FixedCents:  constantOr(fields.FeeFixedCents, Default.FixedCents),
+		On: map[string]bool{
+			Tickets:   constantOr(fields.FeeOnTickets, boolInt(Default.On[Tickets])) == 1,
+			Donations: constantOr(fields.FeeOnDonations, boolInt(Default.On[Donations])) == 1,
+			Transport: constantOr(fields.FeeOnTransport, boolInt(Default.On[Transport])) == 1,
+			Bedding:   constantOr(fields.FeeOnBedding, boolInt(Default.On[Bedding])) == 1,
+		},
+		Optional: constantOr(fields.FeeOptional, boolInt(Default.Optional)) == 1,
+	}
+}
+
+// unlike the caps, 0 is a meaningful setting here, so only a missing constant falls back
+func constantOr(name string, fallback int) int {
+	c, err := db.GetConstant(name)
+	if err != nil || c.Value < 0 {
+		return fallback
+	}
+	return c.Value
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Fraction is the percentage part of the fee as a fraction
+func (p *Policy) Fraction() float64 {
+	return float64(p.BasisPoints) / 10000
+}
+
+// Fixed is the fixed part of the fee in dollars, charged once on any order with something the fee applies to
+func (p *Policy) Fixed() float64 {
+	return float64(p.FixedCents) / 100
+}
+
+// Fee works out the fee on an order from the dollar amount of each kind of item in it. covered is whether the
+// buyer chose to cover an optional fee.
+func (p *Policy) Fee(amounts map[string]float64, covered bool) float64 {
+	if p.Optional && !covered {
+		return 0
+	}
+
+	var percent float64
+	charged := false
+	for kind, amount := range amounts {
+		if amount <= 0 || !p.On[kind] {
+			continue
+		}
+		percent += amount * p.Fraction()
+		charged = true
+	}
+
+	if !charged {
+		return 0
+	}
+	return math.Round((percent+p.Fixed())*100) / 100
+}
+
+// String describes the policy for the order record, like "3% + $0.30 on tickets, transport"
+func (p *Policy) String() string {
+	var on []string
+	for _, kind := range []string{Tickets, Donations, Transport, Bedding} {
+		if p.On[kind] {
+			on = append(on, kind)
+		}
+	}
+
+	desc := fmt.Sprintf("%g%%", float64(p.BasisPoints)/100)
+	if p.FixedCents > 0 {
+		desc += fmt.Sprintf(" + $%.2f", p.Fixed())
+	}
+	if len(on) == 0 {
+		desc += " on nothing"
+	} else {
+		desc += " on " + strings.Join(on, ", ")
+	}
+	if p.Optional {
+		desc += ", optional"
+	}
+	return desc
+}
@@ -0,0 +1,106 @@
+package fees
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+func TestFee(t *testing.T) {
+	stripeLike := Policy{BasisPoints: 290, FixedCents: 30, On: map[string]bool{Tickets: true, Transport: true}}
+	optional := Policy{BasisPoints: 300, On: map[string]bool{Tickets: true}, Optional: true}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		amounts map[string]float64
+		covered bool
+		want    float64
+	}{
+		{"default on a ticket", Default, map[string]float64{Tickets: 420}, false, 12.60},
+		{"default on tickets, transport and bedding", Default, map[string]float64{Tickets: 100, Transport: 60, Bedding: 40}, false, 6},
+		{"default leaves donations alone", Default, map[string]float64{Tickets: 100, Donations: 50}, false, 3},
+		{"default on only a donation", Default, map[string]float64{Donations: 50}, false, 0},
+		{"nothing bought", Default, map[string]float64{}, false, 0},
+		{"negative amounts don't take off", Default, map[string]float64{Tickets: 100, Transport: -60}, false, 3},
+		{"rounds to the cent", Default, map[string]float64{Tickets: 33.33}, false, 1},
+		{"fixed part charged once", stripeLike, map[string]float64{Tickets: 100, Transport: 100}, false, 6.10},
+		{"no fixed part without anything it applies to", stripeLike, map[string]float64{Bedding: 100}, false, 0},
+		{"optional and not covered", optional, map[string]float64{Tickets: 100}, false, 0},
+		{"optional and covered", optional, map[string]float64{Tickets: 100}, true, 3},
+		{"covered when it isn't optional", Default, map[string]float64{Tickets: 100}, true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Fee(tt.amounts, tt.covered); got != tt.want {
+				t.Errorf("Fee() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		want   string
+	}{
+		{Default, "3% on tickets, transport, bedding"},
+		{Policy{BasisPoints: 290, FixedCents: 30, On: map[string]bool{Tickets: true, Donations: true}}, "2.9% + $0.30 on tickets, donations"},
+		{Policy{}, "0% on nothing"},
+		{Policy{BasisPoints: 300, On: map[string]bool{Tickets: true}, Optional: true}, "3% on tickets, optional"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	s := dbtest.New(t)
+	policy = nil
+	if got, want := Current().String(), Default.String(); got != want {
+		t.Errorf("with no constants Current() = %s, want the default %s", got, want)
+	}
+
+	s = dbtest.New(t)
+	for name, value := range map[string]int{
+		fields.FeeBasisPoints: 290,
+		fields.FeeFixedCents:  30,
+		// 0 turns a kind off rather than falling back
+		fields.FeeOnBedding:   0,
+		fields.FeeOnDonations: 1,
+		fields.FeeOptional:    1,
+	} {
+		s.Add(dbtest.Constants, map[string]interface{}{fields.Name: name, fields.Value: value})
+	}
+	// the default is still cached
+	if got, want := Current().String(), Default.String(); got != want {
+		t.Errorf("Current() = %s straight after loading the default", got)
+	}
+
+	policy = nil
+	if got, want := Current().String(), "2.9% + $0.30 on tickets, donations, transport, optional"; got != want {
+		t.Errorf("Current() = %s, want %s", got, want)
+	}
+}
+
+func TestCurrentExpires(t *testing.T) {
+	s := dbtest.New(t)
+	policy = nil
+	Current()
+
+	s.Add(dbtest.Constants, map[string]interface{}{fields.Name: fields.FeeBasisPoints, fields.Value: 290})
+	if got := Current().BasisPoints; got != Default.BasisPoints {
+		t.Errorf("BasisPoints = %d before the cache expired, want the cached %d", got, Default.BasisPoints)
+	}
+
+	loaded = time.Now().Add(-2 * cacheFor)
+	if got := Current().BasisPoints; got != 290 {
+		t.Errorf("BasisPoints = %d once the cache expired, want 290", got)
+	}
+}
@@ -114,6 +114,10 @@ const (
 	// UserName is new ones for 2023. for attendees & soft launch
 	UserName    = "Username"
 	DiscordName = "Discord Name"
+	// stable ids for the attendee's linked sign in accounts, they don't change when the handle does
+	TwitterID = "Twitter ID"
+	DiscordID = "Discord ID"
+	GoogleID  = "Google ID"
 
 	// Ticket Path indicates how an attendee got on the list (prev attendee, FCFS, etc)
 	TicketPath = "Ticket Path"
@@ -188,4 +192,241 @@ const (
 	Sponsorships     = "Sponsorships"
 
 	CheckinCount = "Checkin Count"
+
+	// admission levels
+	CabinAdmission = "Cabin"
+	TentAdmission  = "Tent"
+	SatAdmission   = "Saturday Night"
+
+	// waitlist table
+	WaitlistStatus   = "Waitlist Status"
+	TicketsRequested = "Tickets Requested"
+	OfferToken       = "Offer Token"
+	OfferExpires     = "Offer Expires"
+	// waitlist statuses
+	WaitlistWaiting   = "Waiting"
+	WaitlistOffered   = "Offered"
+	WaitlistPurchased = "Purchased"
+	WaitlistExpired   = "Expired"
+	WaitlistCancelled = "Cancelled"
+	// constants table record for how long an offer is held
+	WaitlistOfferHours = "Waitlist Offer Hours"
+
+	// lottery entries table. Round is the round the entry was committed to, the same field as on the draws table.
+	LotteryStatus = "Lottery Status"
+	Returning     = "Returning"
+	Applied       = "Applied"
+	Weight        = "Weight"
+	DrawPosition  = "Draw Position"
+	// lottery statuses
+	LotteryEntered = "Entered"
+	LotteryWon     = "Won"
+	LotteryLost    = "Lost"
+	// lottery draws table. A round is committed to its entries, winners, weights and a hash of a secret before it's
+	// drawn, then drawn with the secret and a beacon value from the public source named in Seed Source.
+	Round             = "Round"
+	Seed              = "Seed"
+	SeedCommitment    = "Seed Commitment"
+	SeedSource        = "Seed Source"
+	Beacon            = "Beacon"
+	Entries           = "Entries"
+	Winners           = "Winners"
+	EntriesHash       = "Entries Hash"
+	ResultHash        = "Result Hash"
+	DrawStatus        = "Draw Status"
+	ReturningWeight   = "Returning Weight"
+	ApplicationWeight = "Application Weight"
+	// lottery draw statuses
+	DrawCommitted = "Committed"
+	DrawDrawn     = "Drawn"
+	DrawAborted   = "Aborted"
+	// constants table records for lottery weighting
+	LotteryReturningWeight   = "Lottery Returning Weight"
+	LotteryApplicationWeight = "Lottery Application Weight"
+	LotteryTicketLimit       = "Lottery Ticket Limit"
+
+	// sales phases table, one record per ticket path. Opens and Closes are RFC3339 text
+	Opens  = "Opens"
+	Closes = "Closes"
+	Sold   = "Sold"
+	// sales phase log table
+	Event = "Event"
+
+	// promo codes table. SKUs, Ticket Paths and Users are comma separated, blank means any
+	Code           = "Code"
+	DiscountType   = "Discount Type"
+	Amount         = "Amount"
+	SKUs           = "SKUs"
+	MaxRedemptions = "Max Redemptions"
+	Redemptions    = "Redemptions"
+	// redemptions held for checkouts that haven't been paid for yet
+	Reserved    = "Reserved"
+	Expires     = "Expires"
+	TicketPaths = "Ticket Paths"
+	Users       = "Users"
+	// discount types
+	FixedDiscount   = "Fixed"
+	PercentDiscount = "Percent"
+	// orders table, Discount is the amount taken off by the promo code
+	PromoCode = "Promo Code"
+	// aggregations record name
+	PromoDiscounts = "Promo Discounts"
+
+	// sponsorships table. Discount Type is Fixed (uses Discount) or Percent (uses Discount Percent), blank is Fixed
+	DiscountPercent = "Discount Percent"
+	AwardStatus     = "Award Status"
+	// award statuses, blank is Offered
+	AwardOffered   = "Offered"
+	AwardAccepted  = "Accepted"
+	AwardConfirmed = "Confirmed"
+	AwardDeclined  = "Declined"
+	AwardRevoked   = "Revoked"
+
+	// orders table, for payment plans. Installment Plan is the number of payments, 0 for paying in full
+	InstallmentPlan = "Installment Plan"
+	AmountPaid      = "Amount Paid"
+	StripeCustomer  = "Stripe Customer"
+	PaymentMethod   = "Payment Method"
+	// installments table
+	InstallmentNumber = "Installment Number"
+	Due               = "Due"
+	Attempts          = "Attempts"
+	// installment statuses
+	InstallmentScheduled  = "Scheduled"
+	InstallmentProcessing = "Processing"
+	InstallmentPaid       = "Paid"
+	InstallmentFailed     = "Failed"
+	InstallmentCancelled  = "Cancelled"
+	// constants table records for payment plans
+	InstallmentCount        = "Installment Count"
+	InstallmentIntervalDays = "Installment Interval Days"
+	InstallmentMinimum      = "Installment Minimum"
+	InstallmentRetryDays    = "Installment Retry Days"
+	InstallmentMaxAttempts  = "Installment Max Attempts"
+
+	// webhook events table, one record per stripe event id. Steps is a comma separated list of finished steps, and
+	// the orders table has one too for what's been done to an order outside an event, like abandoning it
+	EventID     = "Event ID"
+	EventType   = "Event Type"
+	Payload     = "Payload"
+	Steps       = "Steps"
+	LastError   = "Last Error"
+	ReceivedAt  = "Received At"
+	ProcessedAt = "Processed At"
+	// webhook event statuses
+	EventReceived  = "Received"
+	EventProcessed = "Processed"
+	EventFailed    = "Failed"
+	EventIgnored   = "Ignored"
+
+	// disputes table, one record per stripe dispute
+	DisputeID = "Dispute ID"
+	Reason    = "Reason"
+	Opened    = "Opened"
+	Closed    = "Closed"
+	// orders table, blank unless the payment was disputed
+	DisputeStatus = "Dispute Status"
+	// attendees table, set while a dispute is open so check-in warns about the ticket
+	TicketSuspended = "Ticket Suspended"
+	// dispute statuses
+	DisputeOpen = "Open"
+	DisputeWon  = "Won"
+	DisputeLost = "Lost"
+
+	// constants table record, how long an unpaid checkout lasts before it's cancelled
+	AbandonedCheckoutMinutes = "Abandoned Checkout Minutes"
+
+	// constants table records for the processing fee policy. The "Fee On" ones are 1 to charge the fee on that kind of item
+	FeeBasisPoints = "Fee Basis Points"
+	FeeFixedCents  = "Fee Fixed Cents"
+	FeeOnTickets   = "Fee On Tickets"
+	FeeOnDonations = "Fee On Donations"
+	FeeOnTransport = "Fee On Transport"
+	FeeOnBedding   = "Fee On Bedding"
+	FeeOptional    = "Fee Optional"
+	// orders table, the policy the fee was worked out under and what stripe actually took
+	FeePolicy = "Fee Policy"
+	StripeFee = "Stripe Fee"
+
+	// email outbox table, one record per email. Key stops the same email being queued twice, Attachments is
+	// JSON saying what to render each file from
+	To          = "To"
+	Subject     = "Subject"
+	Body        = "Body"
+	Attachments = "Attachments"
+	EmailKey    = "Key"
+	QueuedAt    = "Queued At"
+	SentAt      = "Sent At"
+	// email statuses
+	EmailQueued = "Queued"
+	EmailSent   = "Sent"
+	EmailFailed = "Failed"
+
+	// attendees table, a multiple select of the staff roles they have
+	Roles = "Roles"
+	// staff roles. Admin can do everything
+	RoleAdmin                = "Admin"
+	RoleFinance              = "Finance"
+	RoleCheckin              = "Check-in"
+	RoleLogistics            = "Logistics"
+	RoleVolunteerCoordinator = "Volunteer Coordinator"
+
+	// staff actions table, one record per thing staff did
+	Actor   = "Actor"
+	Role    = "Role"
+	Action  = "Action"
+	Target  = "Target"
+	Details = "Details"
+
+	// api keys table, one record per key. Key ID is the public part of the key, Key Hash the sha256 of the whole key,
+	// and Scopes is comma separated. Expires and Last Used are blank for never.
+	KeyID     = "Key ID"
+	KeyHash   = "Key Hash"
+	Scopes    = "Scopes"
+	LastUsed  = "Last Used"
+	CreatedBy = "Created By"
+	CreatedAt = "Created At"
+	Revoked   = "Revoked"
+	// api key scopes
+	ScopeAttendeeRead  = "attendee:read"
+	ScopeAttendeesRead = "attendees:read"
+	ScopeCabinsRead    = "cabins:read"
+	ScopeDiscordLookup = "discord:lookup"
+	ScopeOrdersRead    = "orders:read"
+	// replays stored stripe events, for cmd/webhooks
+	ScopeWebhooksReplay = "webhooks:replay"
+
+	// webhook endpoints table, one record per URL we send events to. Events is comma separated, blank for every event,
+	// and Secret signs what's sent so the receiver can check it came from us
+	EndpointID = "Endpoint ID"
+	URL        = "URL"
+	Secret     = "Secret"
+	Events     = "Events"
+	Disabled   = "Disabled"
+	// webhook deliveries table, one record per event per endpoint. Key stops the same event going to an endpoint twice
+	DeliveryID     = "Delivery ID"
+	ResponseStatus = "Response Status"
+	NextAttempt    = "Next Attempt"
+	DeliveredAt    = "Delivered At"
+	// delivery statuses
+	DeliveryPending   = "Pending"
+	DeliveryDelivered = "Delivered"
+	DeliveryFailed    = "Failed"
+	// events we send
+	HookTicketIssued     = "ticket.issued"
+	HookOrderRefunded    = "order.refunded"
+	HookCheckedIn        = "attendee.checked_in"
+	HookLogisticsUpdated = "logistics.updated"
+	HookTest             = "webhook.test"
+
+	// discord roles table, one record per discord role we hand out. Kind says who gets it: every ticket holder, staff,
+	// or ticket holders whose admission level, cabin or ticket path is Value
+	RoleID = "Role ID"
+	Kind   = "Kind"
+	// discord role kinds
+	DiscordRoleAttendee   = "Attendee"
+	DiscordRoleStaff      = "Staff"
+	DiscordRoleAdmission  = "Admission Level"
+	DiscordRoleCabin      = "Cabin"
+	DiscordRoleTicketPath = "Ticket Path"
 )
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/hooks"
+	"github.com/vibecamp/myvibecamp/sales"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+)
+
+// how far back the delivery log goes
+const hookLogDays = 7
+
+// HooksAdminHandler lists webhook endpoints and recent deliveries, and adds, tests, disables and enables endpoints
+// and redelivers failed deliveries. A new endpoint's secret is shown once, on the page that made it.
+func HooksAdminHandler(c *gin.Context) {
+	staff := staffUser(c)
+	var newSecret, newSecretName string
+	var test *db.HookDelivery
+
+	if c.Request.Method == http.MethodPost {
+		switch c.PostForm("action") {
+		case "create":
+			name := strings.TrimSpace(c.PostForm("name"))
+			if name == "" {
+				c.AbortWithError(http.StatusBadRequest, errors.New("Give the endpoint a name saying whose it is"))
+				return
+			}
+
+			u, err := hooks.ValidateURL(strings.TrimSpace(c.PostForm("url")))
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+
+			events := c.PostFormArray("event")
+			for _, ev := range events {
+				if !contains(db.HookEvents, ev) {
+					c.AbortWithError(http.StatusBadRequest, errors.Newf("Unknown event %s", ev))
+					return
+				}
+			}
+
+			secret, err := hooks.NewSecret()
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			endpoint := &db.HookEndpoint{
+				EndpointID: hooks.NewEndpointID(),
+				Name:       name,
+				URL:        u.String(),
+				Secret:     secret,
+				Events:     events,
+				CreatedBy:  staff.UserName,
+			}
+			err = db.CreateHookEndpoint(endpoint)
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			staffDetails(c, "added endpoint %s for %s at %s", endpoint.EndpointID, name, endpoint.URL)
+			newSecret, newSecretName = secret, name
+		case "test", "disable", "enable":
+			endpoint, err := db.GetHookEndpoint(c.PostForm("id"))
+			if err != nil {
+				c.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+
+			if c.PostForm("action") == "test" {
+				test, err = hooks.SendTest(endpoint, staff.UserName)
+				if err != nil {
+					c.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				break
+			}
+
+			err = endpoint.SetDisabled(c.PostForm("action") == "disable")
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			SuccessFlash(c, "Updated "+endpoint.Name)
+			c.Redirect(http.StatusFound, "/admin/hooks")
+			return
+		case "redeliver":
+			d, err := hooks.Redeliver(c.PostForm("id"))
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			if d.Status == fields.DeliveryDelivered {
+				SuccessFlash(c, "Delivered "+d.DeliveryID)
+			} else {
+				WarningFlash(c, "Couldn't deliver "+d.DeliveryID+": "+d.LastError)
+			}
+			c.Redirect(http.StatusFound, "/admin/hooks")
+			return
+		default:
+			c.AbortWithError(http.StatusBadRequest, errors.New("Unknown action"))
+			return
+		}
+	}
+
+	endpoints, err := db.GetHookEndpoints()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	names := map[string]string{}
+	for _, e := range endpoints {
+		names[e.EndpointID] = e.Name
+	}
+
+	deliveries, err := db.GetHookDeliveries(time.Now().AddDate(0, 0, -hookLogDays))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	for _, d := range deliveries {
+		d.QueuedAt = d.QueuedAt.In(sales.Eastern)
+		d.NextAttempt = d.NextAttempt.In(sales.Eastern)
+	}
+
+	c.HTML(http.StatusOK, "hooksAdmin.html.tmpl", gin.H{
+		"flashes":       GetFlashes(c),
+		"Endpoints":     endpoints,
+		"Events":        db.HookEvents,
+		"Deliveries":    deliveries,
+		"Names":         names,
+		"NewSecret":     newSecret,
+		"NewSecretName": newSecretName,
+		"Test":          test,
+		"LogDays":       hookLogDays,
+		"Pending":       fields.DeliveryPending,
+		"Delivered":     fields.DeliveryDelivered,
+		"Failed":        fields.DeliveryFailed,
+	})
+}
@@ -0,0 +1,46 @@
+package hooks
+
+import (
+	"github.com/vibecamp/myvibecamp/api"
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TicketsIssued sends ticket.issued for each ticket on the order, with the attendee it's for
+func TicketsIssued(order *db.Order) {
+	user, err := db.GetUser(order.UserName)
+	if err != nil {
+		log.Errorf("error getting @%v for %s: %v", order.UserName, fields.HookTicketIssued, err)
+		return
+	}
+
+	group, err := user.GetTicketGroup()
+	if err != nil {
+		log.Errorf("error getting @%v's ticket group for %s: %v", user.UserName, fields.HookTicketIssued, err)
+		return
+	}
+
+	for _, u := range group {
+		if u.TicketID == "" {
+			continue
+		}
+		Emit(fields.HookTicketIssued, fields.HookTicketIssued+":"+u.TicketID, api.NewAttendee(u))
+	}
+}
+
+// OrderRefunded sends order.refunded with the order
+func OrderRefunded(order *db.Order) {
+	Emit(fields.HookOrderRefunded, fields.HookOrderRefunded+":"+order.OrderID, api.NewOrder(order))
+}
+
+// CheckedIn sends attendee.checked_in with the attendee
+func CheckedIn(user *db.User) {
+	Emit(fields.HookCheckedIn, fields.HookCheckedIn+":"+user.UserName, api.NewAttendee(user))
+}
+
+// LogisticsUpdated sends logistics.updated with what the attendee has told us now. Every change is sent.
+func LogisticsUpdated(user *db.User) {
+	Emit(fields.HookLogisticsUpdated, "", api.NewLogistics(user))
+}
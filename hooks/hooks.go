@@ -0,0 +1,365 @@
+// Package hooks sends signed webhooks to the endpoints registered at /admin/hooks when something happens to an
+// attendee, so integrations don't have to poll. Like email, each delivery goes into a table first and is retried
+// with backoff until the endpoint takes it or we give up.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader holds t=<unix time>,v1=<hex hmac-sha256 of "<t>.<body>" with the endpoint's secret>
+	SignatureHeader = "Vibecamp-Signature"
+	EventHeader     = "Vibecamp-Event"
+	DeliveryHeader  = "Vibecamp-Delivery"
+)
+
+// how long to wait before each retry. A delivery is given up on once they run out.
+var retryDelays = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+}
+
+// AllowLocal lets endpoints be plain http on this machine or the local network, for trying hooks out in DEV mode
+var AllowLocal bool
+
+var client = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		// never through a proxy, or the dial check below would be checking the proxy's address, not the endpoint's
+		Proxy: nil,
+		// checked again as we connect, in case the name has started pointing somewhere else since the endpoint was added
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				return checkIP(net.ParseIP(host))
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// each endpoint gets one delivery at a time, so a slow one doesn't hold up the rest
+var (
+	endpointMutexesMutex sync.Mutex
+	endpointMutexes      = map[string]*sync.Mutex{}
+)
+
+func endpointMutex(endpointID string) *sync.Mutex {
+	endpointMutexesMutex.Lock()
+	defer endpointMutexesMutex.Unlock()
+
+	m, ok := endpointMutexes[endpointID]
+	if !ok {
+		m = &sync.Mutex{}
+		endpointMutexes[endpointID] = m
+	}
+	return m
+}
+
+// Event is the body of every webhook. ID is the same for every endpoint that gets the event.
+type Event struct {
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Created string      `json:"created"`
+	Data    interface{} `json:"data"`
+}
+
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// NewSecret makes a signing secret for an endpoint
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "generating webhook secret")
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// NewEndpointID makes the id an endpoint's deliveries refer to it by
+func NewEndpointID() string {
+	return newID("ep_")
+}
+
+// ValidateURL checks an endpoint's URL is https and points somewhere on the internet, not at us or our network
+func ValidateURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("The URL isn't valid")
+	}
+	if u.Scheme != "https" && !(AllowLocal && u.Scheme == "http") {
+		return nil, errors.New("The URL must be https")
+	}
+	if u.User != nil {
+		return nil, errors.New("The URL can't have a username or password in it")
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", u.Hostname())
+	if err != nil {
+		return nil, errors.Newf("Couldn't look up %s", u.Hostname())
+	}
+	for _, ip := range ips {
+		if err := checkIP(ip); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// sharedAddressSpace is carrier-grade NAT, which IsPrivate doesn't cover
+var _, sharedAddressSpace, _ = net.ParseCIDR("100.64.0.0/10")
+
+// checkIP refuses addresses that aren't on the public internet, unless AllowLocal is set
+func checkIP(ip net.IP) error {
+	if AllowLocal {
+		return nil
+	}
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || sharedAddressSpace.Contains(ip) {
+		return errors.Newf("The URL points to %v, which isn't a public address", ip)
+	}
+	return nil
+}
+
+// Sign is the signature header for body sent at t
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Emit queues the event for every endpoint that wants it and tries to send it in the background.
+// key, if set, makes sure an endpoint only ever gets one event with it, so a retried stripe webhook doesn't repeat it.
+func Emit(eventType, key string, data interface{}) {
+	endpoints, err := db.GetHookEndpoints()
+	if err != nil {
+		log.Errorf("error getting webhook endpoints for %s: %v", eventType, err)
+		return
+	}
+
+	var body []byte
+	for _, e := range endpoints {
+		if !e.Wants(eventType) {
+			continue
+		}
+
+		if body == nil {
+			body, err = json.Marshal(Event{
+				ID:      newID("evt_"),
+				Type:    eventType,
+				Created: time.Now().UTC().Format(time.RFC3339),
+				Data:    data,
+			})
+			if err != nil {
+				log.Errorf("error encoding %s: %v", eventType, err)
+				return
+			}
+		}
+
+		d, err := queue(e, eventType, key, body)
+		if err != nil {
+			log.Errorf("error queueing %s for %v: %v", eventType, e.Name, err)
+			continue
+		}
+		if d != nil {
+			go deliver(d, e)
+		}
+	}
+}
+
+// queue stores a delivery of body to e, returning nil if one with the same key was already queued
+func queue(e *db.HookEndpoint, eventType, key string, body []byte) (*db.HookDelivery, error) {
+	if key != "" {
+		key = e.EndpointID + ":" + key
+	}
+
+	d, queued, err := db.QueueHookDelivery(&db.HookDelivery{
+		DeliveryID: newID("dlv_"),
+		Key:        key,
+		EndpointID: e.EndpointID,
+		Event:      eventType,
+		Payload:    string(body),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !queued {
+		log.Debugf("Webhook %v was already queued", key)
+		return nil, nil
+	}
+	return d, nil
+}
+
+// send posts the delivery's payload to the endpoint once, returning the response status
+func send(d *db.HookDelivery, e *db.HookEndpoint) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return 0, errors.Wrap(err, "making request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "myvibecamp-webhooks/1")
+	req.Header.Set(EventHeader, d.Event)
+	req.Header.Set(DeliveryHeader, d.DeliveryID)
+	req.Header.Set(SignatureHeader, Sign(e.Secret, time.Now(), []byte(d.Payload)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return resp.StatusCode, errors.Newf("%s: %s", resp.Status, snippet)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliver tries to send a delivery once, and records how it went and when to try again
+func deliver(d *db.HookDelivery, e *db.HookEndpoint) {
+	m := endpointMutex(e.EndpointID)
+	m.Lock()
+	defer m.Unlock()
+
+	d.Attempts++
+	status, err := send(d, e)
+	d.ResponseStatus = status
+	if err != nil {
+		log.Errorf("sending %s to %v (attempt %d): %v", d.Event, e.Name, d.Attempts, err)
+		d.LastError = err.Error()
+		// tests are only tried the once, while someone's watching
+		if d.Event == fields.HookTest || d.Attempts > len(retryDelays) {
+			d.Status = fields.DeliveryFailed
+			d.NextAttempt = time.Time{}
+		} else {
+			d.NextAttempt = time.Now().Add(retryDelays[d.Attempts-1])
+		}
+	} else {
+		d.Status = fields.DeliveryDelivered
+		d.LastError = ""
+		d.DeliveredAt = time.Now()
+		d.NextAttempt = time.Time{}
+	}
+
+	if err := d.Update(); err != nil {
+		log.Errorf("error saving webhook delivery %v: %v", d.DeliveryID, err)
+	}
+}
+
+// RetryDeliveries tries again to send every pending delivery that's due
+func RetryDeliveries() {
+	deliveries, err := db.GetPendingHookDeliveries()
+	if err != nil {
+		log.Errorf("error getting pending webhook deliveries: %v", err)
+		return
+	}
+
+	due := map[string][]*db.HookDelivery{}
+	for _, d := range deliveries {
+		if !time.Now().Before(d.NextAttempt) {
+			due[d.EndpointID] = append(due[d.EndpointID], d)
+		}
+	}
+
+	// endpoints are retried side by side, each one's deliveries in the order they were queued
+	var wg sync.WaitGroup
+	for endpointID, deliveries := range due {
+		e, err := db.GetHookEndpoint(endpointID)
+		if err != nil {
+			log.Errorf("error getting webhook endpoint %v: %v", endpointID, err)
+			continue
+		}
+		if e.Disabled {
+			continue
+		}
+
+		wg.Add(1)
+		go func(e *db.HookEndpoint, deliveries []*db.HookDelivery) {
+			defer wg.Done()
+			for _, d := range deliveries {
+				deliver(d, e)
+			}
+		}(e, deliveries)
+	}
+	wg.Wait()
+}
+
+// RunRetries retries due deliveries every interval until the process exits
+func RunRetries(interval time.Duration) {
+	for range time.Tick(interval) {
+		RetryDeliveries()
+	}
+}
+
+// Redeliver gives a delivery another round of attempts, starting now
+func Redeliver(deliveryID string) (*db.HookDelivery, error) {
+	d, err := db.GetHookDelivery(deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	e, err := db.GetHookEndpoint(d.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Status = fields.DeliveryPending
+	d.Attempts = 0
+	deliver(d, e)
+	return d, nil
+}
+
+// SendTest sends a webhook.test event to the endpoint straight away, whatever it's subscribed to, and returns how it went
+func SendTest(e *db.HookEndpoint, sentBy string) (*db.HookDelivery, error) {
+	body, err := json.Marshal(Event{
+		ID:      newID("evt_"),
+		Type:    fields.HookTest,
+		Created: time.Now().UTC().Format(time.RFC3339),
+		Data:    map[string]string{"message": fmt.Sprintf("Test from @%s", sentBy)},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding test event")
+	}
+
+	d, err := queue(e, fields.HookTest, "", body)
+	if err != nil {
+		return nil, err
+	}
+	deliver(d, e)
+	return d, nil
+}
@@ -0,0 +1,527 @@
+package lottery
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/waitlist"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultTicketLimit = 2
+
+var drawMutex sync.Mutex
+
+// Weights multiply an entry's chance of being drawn. 1 means no boost.
+type Weights struct {
+	Returning   int
+	Application int
+}
+
+// Weight is how many "tickets in the hat" an entry gets
+func (w Weights) Weight(e *db.LotteryEntry) int {
+	weight := 1
+	if e.Returning && w.Returning > 1 {
+		weight *= w.Returning
+	}
+	if e.Applied && w.Application > 1 {
+		weight *= w.Application
+	}
+	return weight
+}
+
+type Pick struct {
+	Entry  *db.LotteryEntry
+	Weight int
+	Key    float64
+}
+
+type Result struct {
+	Seed        string
+	Winners     int
+	EntriesHash string
+	ResultHash  string
+	// Order is every entry in the order drawn, winners first
+	Order []*Pick
+}
+
+// Draw orders the entries by weighted random sampling without replacement (Efraimidis-Spirakis),
+// with the randomness for each entry coming from HMAC-SHA256(seed, username). Anyone with the seed
+// and the entry list gets the same order, so the result can be checked against the published hashes.
+func Draw(seed string, entries []*db.LotteryEntry, weights Weights, winners int) (*Result, error) {
+	if seed == "" {
+		return nil, errors.New("a seed is required")
+	}
+
+	if winners < 0 {
+		return nil, errors.New("winners can't be negative")
+	}
+
+	picks, err := weigh(entries, weights)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range picks {
+		p.Key = math.Log(uniform(seed, strings.ToLower(p.Entry.UserName))) / float64(p.Weight)
+	}
+
+	// highest key wins, ties broken by username so the order is total
+	sort.Slice(picks, func(i, j int) bool {
+		if picks[i].Key != picks[j].Key {
+			return picks[i].Key > picks[j].Key
+		}
+		return picks[i].Entry.UserName < picks[j].Entry.UserName
+	})
+
+	if winners > len(picks) {
+		winners = len(picks)
+	}
+
+	result := &Result{
+		Seed:        seed,
+		Winners:     winners,
+		EntriesHash: EntriesHash(picks),
+		Order:       picks,
+	}
+	result.ResultHash = resultHash(result)
+
+	return result, nil
+}
+
+// weigh gives each entry its weight, in entry order
+func weigh(entries []*db.LotteryEntry, weights Weights) ([]*Pick, error) {
+	picks := make([]*Pick, 0, len(entries))
+	seen := map[string]bool{}
+	for _, e := range entries {
+		name := strings.ToLower(e.UserName)
+		if seen[name] {
+			return nil, errors.Newf("%s entered more than once", name)
+		}
+		seen[name] = true
+
+		picks = append(picks, &Pick{Entry: e, Weight: weights.Weight(e)})
+	}
+	return picks, nil
+}
+
+// Seed is what a round is drawn with: the secret committed to before the draw, and the beacon value published by
+// the round's seed source after it. Neither the admin nor the beacon can pick the result alone.
+func Seed(secret, beacon string) string {
+	return secret + ":" + beacon
+}
+
+// Commitment is the published hash of a round's secret
+func Commitment(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// uniform maps seed and name to a number in (0, 1)
+func uniform(seed, name string) float64 {
+	h := hmac.New(sha256.New, []byte(seed))
+	h.Write([]byte(name))
+	n := binary.BigEndian.Uint64(h.Sum(nil)[:8])
+	return (float64(n>>11) + 0.5) / (1 << 53)
+}
+
+// EntriesHash commits to who entered and at what weight, independent of draw order
+func EntriesHash(picks []*Pick) string {
+	lines := make([]string, 0, len(picks))
+	for _, p := range picks {
+		lines = append(lines, fmt.Sprintf("%s|%d", strings.ToLower(p.Entry.UserName), p.Weight))
+	}
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+func resultHash(r *Result) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n%d\n", r.Seed, r.EntriesHash, r.Winners)
+	for _, p := range r.Order {
+		fmt.Fprintf(&b, "%s\n", strings.ToLower(p.Entry.UserName))
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func constantOr(name string, fallback int) int {
+	c, err := db.GetConstant(name)
+	if err != nil || c.Value < 1 {
+		return fallback
+	}
+	return c.Value
+}
+
+// TicketLimit is how many tickets an entry can ask for, and winners can buy
+func TicketLimit() int {
+	return constantOr(fields.LotteryTicketLimit, defaultTicketLimit)
+}
+
+func currentWeights() Weights {
+	return Weights{
+		Returning:   constantOr(fields.LotteryReturningWeight, 1),
+		Application: constantOr(fields.LotteryApplicationWeight, 1),
+	}
+}
+
+// drawWeights are the weights a round was committed with, so changing the constants after doesn't change its draw
+func drawWeights(d *db.LotteryDraw) Weights {
+	return Weights{Returning: d.ReturningWeight, Application: d.ApplicationWeight}
+}
+
+var (
+	// ErrEntriesClosed is returned by Enter while a round is committed and not drawn yet
+	ErrEntriesClosed = errors.New("entries are closed while a round is drawn")
+	// ErrAlreadyEntered is returned by Enter for someone who's already entered
+	ErrAlreadyEntered = errors.New("already entered the lottery")
+)
+
+// Enter adds an entry. It holds the draw lock, so nobody can enter while a round is being committed or once it's
+// committed and waiting to be drawn, which would change the entries it committed to.
+func Enter(e *db.LotteryEntry) error {
+	drawMutex.Lock()
+	defer drawMutex.Unlock()
+
+	open, err := OpenRound()
+	if err != nil {
+		return err
+	}
+	if open != nil {
+		return errors.Wrapf(ErrEntriesClosed, "round %s", open.Round)
+	}
+
+	_, err = db.GetLotteryEntry(e.UserName)
+	if err == nil {
+		return errors.Wrapf(ErrAlreadyEntered, "%s", e.UserName)
+	} else if !errors.Is(err, db.ErrNoRecords) {
+		return err
+	}
+
+	e.Status = fields.LotteryEntered
+	return e.CreateLotteryEntry()
+}
+
+// OpenRound is the round that's been committed to but not drawn yet, or nil if there isn't one. Nobody can enter
+// while a round is open, because that would change the entries it committed to.
+func OpenRound() (*db.LotteryDraw, error) {
+	draws, err := db.GetLotteryDraws()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range draws {
+		if d.Status == fields.DrawCommitted {
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+// Commit opens a round: it publishes the hash of everyone who's entered and their weights, how many will win,
+// where the beacon for the seed will come from, and the hash of a secret made here. Source should name a value
+// nobody can know yet, like the hash of a bitcoin block that hasn't been mined. The entries are marked with the
+// round and the weights are saved with it, so it's drawn from exactly what it committed to.
+func Commit(round, source string, winners int) (*db.LotteryDraw, error) {
+	drawMutex.Lock()
+	defer drawMutex.Unlock()
+
+	if round == "" || source == "" {
+		return nil, errors.New("a round name and seed source are required")
+	}
+	if winners < 1 {
+		return nil, errors.New("winners must be a positive number")
+	}
+
+	draws, err := db.GetLotteryDraws()
+	if err != nil {
+		return nil, err
+	}
+	drawn := map[string]bool{}
+	for _, d := range draws {
+		if d.Status == fields.DrawCommitted {
+			return nil, errors.Newf("round %s is committed and hasn't been drawn yet", d.Round)
+		}
+		if strings.EqualFold(d.Round, round) {
+			return nil, errors.Newf("there's already a round called %s", round)
+		}
+		if d.Status == fields.DrawDrawn {
+			drawn[d.Round] = true
+		}
+	}
+
+	entries, err := db.GetLotteryEntriesByStatus(fields.LotteryEntered)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no lottery entries to draw from")
+	}
+	for _, e := range entries {
+		if drawn[e.Round] {
+			return nil, errors.Newf("round %s hasn't finished applying, apply it again first", e.Round)
+		}
+	}
+	weights := currentWeights()
+	picks, err := weigh(entries, weights)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating lottery secret")
+	}
+	secret := hex.EncodeToString(b)
+
+	// entries marked for a round that fails to commit are marked again by the next one
+	err = db.SetLotteryRound(entries, round)
+	if err != nil {
+		return nil, err
+	}
+
+	draw := &db.LotteryDraw{
+		Round:             round,
+		Status:            fields.DrawCommitted,
+		Entries:           len(picks),
+		Winners:           winners,
+		EntriesHash:       EntriesHash(picks),
+		SeedCommitment:    Commitment(secret),
+		SeedSource:        source,
+		Secret:            secret,
+		Date:              time.Now().UTC().Format("2006-01-02 15:04"),
+		ReturningWeight:   weights.Returning,
+		ApplicationWeight: weights.Application,
+	}
+	err = draw.CreateLotteryDraw()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("lottery round %s committed: %d entries, entries hash %s", round, draw.Entries, draw.EntriesHash)
+	return draw, nil
+}
+
+// Abort gives up on the open round without drawing it, for when its entries can't be drawn as committed. Its
+// entries can enter the next round.
+func Abort() (*db.LotteryDraw, error) {
+	drawMutex.Lock()
+	defer drawMutex.Unlock()
+
+	draw, err := OpenRound()
+	if err != nil {
+		return nil, err
+	}
+	if draw == nil {
+		return nil, errors.New("there's no committed round to abort")
+	}
+
+	err = draw.SetAborted()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("lottery round %s aborted", draw.Round)
+	return draw, nil
+}
+
+// Run draws the open round with beacon, the value its seed source published, and publishes the seed and result.
+// The round's entries have to be as they were committed. Winners are written into the chaos mode table and everyone
+// else goes on the waitlist in draw order, in the background while the lock's still held, so nothing can be
+// committed or drawn until that's done. A drawn round can't be drawn again, but if writing the results fails for
+// some entries Reapply finishes them.
+func Run(beacon string) (*Result, error) {
+	drawMutex.Lock()
+	applying := false
+	defer func() {
+		if !applying {
+			drawMutex.Unlock()
+		}
+	}()
+
+	if beacon == "" {
+		return nil, errors.New("the beacon value is required")
+	}
+
+	draw, err := OpenRound()
+	if err != nil {
+		return nil, err
+	}
+	if draw == nil {
+		return nil, errors.New("there's no committed round to draw, commit one first")
+	}
+
+	entries, err := roundEntries(draw)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := Draw(Seed(draw.Secret, beacon), entries, drawWeights(draw), draw.Winners)
+	if err != nil {
+		return nil, err
+	}
+	if result.EntriesHash != draw.EntriesHash {
+		return nil, errors.Newf("the entries have changed since round %s was committed, abort it and commit again", draw.Round)
+	}
+
+	err = draw.SetDrawn(beacon, result.Seed, result.ResultHash)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("lottery round %s drawn: %d winners of %d entries, result hash %s", draw.Round, result.Winners, len(result.Order), result.ResultHash)
+
+	applying = true
+	go func() {
+		defer drawMutex.Unlock()
+		apply(result)
+	}()
+	return result, nil
+}
+
+// Reapply writes the results of a drawn round for the entries that didn't get them the first time. The round is
+// drawn again from its published seed, and has to come out the same.
+func Reapply(round string) (*Result, error) {
+	drawMutex.Lock()
+	defer drawMutex.Unlock()
+
+	draws, err := db.GetLotteryDraws()
+	if err != nil {
+		return nil, err
+	}
+	var draw *db.LotteryDraw
+	for _, d := range draws {
+		if d.Round == round && d.Status == fields.DrawDrawn {
+			draw = d
+		}
+	}
+	if draw == nil {
+		return nil, errors.Newf("there's no drawn round called %s", round)
+	}
+
+	entries, err := db.GetLotteryEntriesByRound(draw.Round)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := Draw(draw.Seed, entries, drawWeights(draw), draw.Winners)
+	if err != nil {
+		return nil, err
+	}
+	if result.ResultHash != draw.ResultHash {
+		return nil, errors.Newf("round %s doesn't draw the same as it did, its entries have changed", draw.Round)
+	}
+
+	if failed := apply(result); failed > 0 {
+		return result, errors.Newf("%d entries still couldn't be applied, see the logs", failed)
+	}
+	return result, nil
+}
+
+// roundEntries are the entries committed to the round that haven't been drawn
+func roundEntries(draw *db.LotteryDraw) ([]*db.LotteryEntry, error) {
+	entries, err := db.GetLotteryEntriesByRound(draw.Round)
+	if err != nil {
+		return nil, err
+	}
+
+	waiting := make([]*db.LotteryEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Status == fields.LotteryEntered {
+			waiting = append(waiting, e)
+		}
+	}
+	return waiting, nil
+}
+
+// apply writes winners into the chaos mode table and puts everyone else on the waitlist in draw order. Entries that
+// already have their result are skipped, and an entry's result is saved last, so it can be run again for the ones
+// that failed. It returns how many failed.
+func apply(result *Result) int {
+	failed := 0
+	for i, p := range result.Order {
+		e := p.Entry
+		if e.Status != fields.LotteryEntered {
+			continue
+		}
+
+		status := fields.LotteryLost
+		var err error
+		if i < result.Winners {
+			status = fields.LotteryWon
+			err = addWinner(e)
+		} else {
+			err = addLoser(e)
+		}
+		if err != nil {
+			log.Errorf("applying lottery result for %s: %v", e.UserName, err)
+			failed++
+			continue
+		}
+
+		err = e.SetLotteryResult(status, p.Weight, i+1)
+		if err != nil {
+			log.Errorf("saving lottery result for %s: %v", e.UserName, err)
+			failed++
+		}
+	}
+
+	log.Infof("lottery %s applied, %d failed", result.ResultHash, failed)
+	return failed
+}
+
+// entryQuantity is how many tickets the entry asked for
+func entryQuantity(e *db.LotteryEntry) int {
+	if e.Quantity < 1 {
+		return 1
+	}
+	return e.Quantity
+}
+
+// addWinner lets the entry buy what they entered for in the lottery phase
+func addWinner(e *db.LotteryEntry) error {
+	chaosUser, err := db.GetChaosUser(e.UserName)
+	if err == nil && chaosUser != nil {
+		return chaosUser.UpdatePhase(fields.Lottery, entryQuantity(e), e.AdmissionLevel)
+	}
+
+	chaosUser = &db.ChaosModeUser{
+		UserName:       strings.ToLower(e.UserName),
+		TwitterName:    e.UserName,
+		Name:           e.Name,
+		Email:          e.Email,
+		Phase:          fields.Lottery,
+		TicketLimit:    entryQuantity(e),
+		AdmissionLevel: e.AdmissionLevel,
+	}
+	return chaosUser.CreateChaosUser()
+}
+
+// addLoser puts the entry on the waitlist for what they entered for
+func addLoser(e *db.LotteryEntry) error {
+	err := waitlist.Join(&db.WaitlistEntry{
+		UserName:       e.UserName,
+		Name:           e.Name,
+		Email:          e.Email,
+		AdmissionLevel: e.AdmissionLevel,
+		Quantity:       entryQuantity(e),
+	})
+	if errors.Is(err, waitlist.ErrAlreadyWaiting) {
+		return nil
+	}
+	return err
+}
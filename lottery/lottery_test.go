@@ -0,0 +1,409 @@
+package lottery
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+)
+
+func entries(names ...string) []*db.LotteryEntry {
+	var list []*db.LotteryEntry
+	for _, n := range names {
+		list = append(list, &db.LotteryEntry{UserName: n})
+	}
+	return list
+}
+
+func order(r *Result) []string {
+	var names []string
+	for _, p := range r.Order {
+		names = append(names, p.Entry.UserName)
+	}
+	return names
+}
+
+func TestWeight(t *testing.T) {
+	tests := []struct {
+		name      string
+		weights   Weights
+		returning bool
+		applied   bool
+		want      int
+	}{
+		{"no boosts", Weights{Returning: 3, Application: 2}, false, false, 1},
+		{"returning", Weights{Returning: 3, Application: 2}, true, false, 3},
+		{"applied", Weights{Returning: 3, Application: 2}, false, true, 2},
+		{"both multiply", Weights{Returning: 3, Application: 2}, true, true, 6},
+		{"unset weights don't boost", Weights{}, true, true, 1},
+		{"weight of one doesn't boost", Weights{Returning: 1, Application: 1}, true, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &db.LotteryEntry{Returning: tt.returning, Applied: tt.applied}
+			if got := tt.weights.Weight(e); got != tt.want {
+				t.Errorf("Weight() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrawIsDeterministic(t *testing.T) {
+	names := []string{"alice", "bob", "carol", "dave", "erin", "frank"}
+	first, err := Draw("seed", entries(names...), Weights{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the order entries come in doesn't matter
+	reversed := make([]string, len(names))
+	for i, n := range names {
+		reversed[len(names)-1-i] = n
+	}
+	second, err := Draw("seed", entries(reversed...), Weights{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(order(first), ",") != strings.Join(order(second), ",") {
+		t.Errorf("same seed drew %v then %v", order(first), order(second))
+	}
+	if first.ResultHash != second.ResultHash || first.EntriesHash != second.EntriesHash {
+		t.Errorf("same draw has different hashes")
+	}
+
+	other, err := Draw("another seed", entries(names...), Weights{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ResultHash == first.ResultHash {
+		t.Errorf("different seeds have the same result hash")
+	}
+	if other.EntriesHash != first.EntriesHash {
+		t.Errorf("the entries hash depends on the seed")
+	}
+}
+
+func TestDrawErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		seed    string
+		entries []*db.LotteryEntry
+		winners int
+	}{
+		{"no seed", "", entries("alice"), 1},
+		{"negative winners", "seed", entries("alice"), -1},
+		{"entered twice", "seed", entries("alice", "Alice"), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Draw(tt.seed, tt.entries, Weights{}, tt.winners); err == nil {
+				t.Error("Draw() didn't fail")
+			}
+		})
+	}
+}
+
+func TestDrawCapsWinners(t *testing.T) {
+	r, err := Draw("seed", entries("alice", "bob"), Weights{}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Winners != 2 {
+		t.Errorf("Winners = %d, want 2", r.Winners)
+	}
+}
+
+// a returning entry with weight 3 against one without should win about 3 draws in 4
+func TestDrawWeighting(t *testing.T) {
+	const draws = 4000
+	weighted := 0
+	for i := 0; i < draws; i++ {
+		list := []*db.LotteryEntry{{UserName: "returning", Returning: true}, {UserName: "new"}}
+		r, err := Draw(fmt.Sprintf("seed-%d", i), list, Weights{Returning: 3}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Order[0].Entry.UserName == "returning" {
+			weighted++
+		}
+	}
+
+	share := float64(weighted) / draws
+	if share < 0.72 || share > 0.78 {
+		t.Errorf("weighted entry won %.3f of draws, want about 0.75", share)
+	}
+}
+
+func TestEntriesHash(t *testing.T) {
+	picks := func(weights ...int) []*Pick {
+		var list []*Pick
+		for i, w := range weights {
+			list = append(list, &Pick{Entry: &db.LotteryEntry{UserName: fmt.Sprintf("user%d", i)}, Weight: w})
+		}
+		return list
+	}
+
+	tests := []struct {
+		name string
+		a, b []*Pick
+		same bool
+	}{
+		{"same entries", picks(1, 2), picks(1, 2), true},
+		{"different order", picks(1, 1), []*Pick{picks(1, 1)[1], picks(1, 1)[0]}, true},
+		{"different weight", picks(1, 2), picks(1, 3), false},
+		{"extra entry", picks(1, 2), picks(1, 2, 1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EntriesHash(tt.a) == EntriesHash(tt.b); got != tt.same {
+				t.Errorf("hashes equal = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestCommitment(t *testing.T) {
+	// sha256 of "secret"
+	const want = "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+	if got := Commitment("secret"); got != want {
+		t.Errorf("Commitment() = %s, want %s", got, want)
+	}
+	if Seed("secret", "beacon") != "secret:beacon" {
+		t.Errorf("Seed() = %s", Seed("secret", "beacon"))
+	}
+}
+
+func addEntry(s *dbtest.Server, name string) string {
+	return s.Add("Lottery Entries", map[string]interface{}{
+		fields.UserName:         name,
+		fields.AdmissionLevel:   fields.TentAdmission,
+		fields.TicketsRequested: 1,
+		fields.LotteryStatus:    fields.LotteryEntered,
+	})
+}
+
+func TestCommitAndRun(t *testing.T) {
+	s := dbtest.New(t)
+	s.Add(dbtest.Constants, map[string]interface{}{fields.Name: fields.LotteryReturningWeight, fields.Value: 3})
+	for _, n := range []string{"alice", "bob", "carol"} {
+		addEntry(s, n)
+	}
+
+	if _, err := Run("beacon"); err == nil {
+		t.Fatal("drew without a committed round")
+	}
+
+	draw, err := Commit("round 1", "a future block", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if draw.SeedCommitment != Commitment(draw.Secret) {
+		t.Errorf("commitment doesn't match the secret")
+	}
+	if _, err := Commit("round 2", "a future block", 1); err == nil {
+		t.Error("committed a second round while the first is open")
+	}
+
+	if draw.ReturningWeight != 3 || draw.ApplicationWeight != 1 {
+		t.Errorf("committed with weights %d and %d, want 3 and 1", draw.ReturningWeight, draw.ApplicationWeight)
+	}
+	for _, e := range s.Records("Lottery Entries") {
+		if e[fields.Round] != "round 1" {
+			t.Errorf("%s isn't marked for the round", e[fields.UserName])
+		}
+	}
+
+	// nobody can enter once the round is committed
+	err = Enter(&db.LotteryEntry{UserName: "dave", AdmissionLevel: fields.TentAdmission, Quantity: 1})
+	if !errors.Is(err, ErrEntriesClosed) {
+		t.Errorf("entered a committed round: %v", err)
+	}
+
+	// until it's aborted, and then they're in the next one
+	if _, err := Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Abort(); err == nil {
+		t.Error("aborted with no round committed")
+	}
+	if _, err := Run("beacon"); err == nil {
+		t.Error("drew an aborted round")
+	}
+	err = Enter(&db.LotteryEntry{UserName: "dave", AdmissionLevel: fields.TentAdmission, Quantity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Enter(&db.LotteryEntry{UserName: "Dave", AdmissionLevel: fields.TentAdmission, Quantity: 1}); !errors.Is(err, ErrAlreadyEntered) {
+		t.Errorf("entered twice: %v", err)
+	}
+
+	draw, err = Commit("round 2", "a future block", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if draw.Entries != 4 {
+		t.Errorf("round 2 committed to %d entries, want 4", draw.Entries)
+	}
+	if _, err := Run("beacon"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunRefusesChangedEntries(t *testing.T) {
+	s := dbtest.New(t)
+	for _, n := range []string{"alice", "bob"} {
+		addEntry(s, n)
+	}
+	if _, err := Commit("round 1", "a future block", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// an entry slipped into the round after it was committed changes the entries hash
+	s.Add("Lottery Entries", map[string]interface{}{
+		fields.UserName:      "mallory",
+		fields.LotteryStatus: fields.LotteryEntered,
+		fields.Round:         "round 1",
+	})
+	if _, err := Run("beacon"); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("drew entries that don't match the commitment: %v", err)
+	}
+}
+
+func TestReapply(t *testing.T) {
+	s := dbtest.New(t)
+	s.Add("Lottery Entries", map[string]interface{}{
+		fields.UserName:         "alice",
+		fields.AdmissionLevel:   fields.CabinAdmission,
+		fields.TicketsRequested: 2,
+		fields.LotteryStatus:    fields.LotteryEntered,
+	})
+	for _, n := range []string{"bob", "carol"} {
+		addEntry(s, n)
+	}
+	if _, err := Commit("round 1", "a future block", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// winners win what they entered for
+	if _, err := Run("beacon"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Reapply("round 1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range s.Records("ChaosMode") {
+		if c[fields.UserName] == "alice" && (c[fields.TicketLimit] != "2" || c[fields.AdmissionLevel] != fields.CabinAdmission) {
+			t.Errorf("alice won %s %s tickets, want 2 %s", c[fields.TicketLimit], c[fields.AdmissionLevel], fields.CabinAdmission)
+		}
+	}
+	if got := len(s.Records("ChaosMode")); got != 3 {
+		t.Errorf("%d winners added, want 3", got)
+	}
+}
+
+func TestReapplyAfterAFailure(t *testing.T) {
+	s := dbtest.New(t)
+	for _, n := range []string{"alice", "bob", "carol"} {
+		addEntry(s, n)
+	}
+	if _, err := Commit("round 1", "a future block", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	s.FailWrites("Waitlist", 1)
+	if _, err := Run("beacon"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		run     func() error
+		entered int
+		waiting int
+	}{
+		// the lock is held until the results are written
+		{"next round waits for them", func() error {
+			_, err := Commit("round 2", "a future block", 1)
+			return err
+		}, 1, 1},
+		{"applied again", func() error {
+			_, err := Reapply("round 1")
+			return err
+		}, 0, 2},
+		{"nothing left to apply", func() error {
+			_, err := Reapply("round 1")
+			return err
+		}, 0, 2},
+	}
+
+	for _, tt := range tests {
+		if err := tt.run(); err == nil && tt.entered > 0 {
+			t.Errorf("%s: committed with entries from round 1 unapplied", tt.name)
+		} else if err != nil && tt.entered == 0 {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		statuses := map[string]int{}
+		for _, e := range s.Records("Lottery Entries") {
+			statuses[e[fields.LotteryStatus]]++
+		}
+		if statuses[fields.LotteryEntered] != tt.entered || statuses[fields.LotteryWon] != 1 {
+			t.Errorf("%s: entries ended up %v, want 1 won and %d entered", tt.name, statuses, tt.entered)
+		}
+		if got := len(s.Records("Waitlist")); got != tt.waiting {
+			t.Errorf("%s: %d on the waitlist, want %d", tt.name, got, tt.waiting)
+		}
+	}
+}
+
+func TestRunRejectsSecondDraw(t *testing.T) {
+	s := dbtest.New(t)
+	for _, n := range []string{"alice", "bob", "carol"} {
+		addEntry(s, n)
+	}
+
+	draw, err := Commit("round 1", "a future block", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Run("beacon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Seed != Seed(draw.Secret, "beacon") {
+		t.Errorf("drew with seed %s, want the committed secret and the beacon", result.Seed)
+	}
+	want, err := Draw(result.Seed, entries("alice", "bob", "carol"), Weights{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.ResultHash != result.ResultHash {
+		t.Errorf("the draw can't be recomputed from the published seed")
+	}
+
+	if _, err := Run("another beacon"); err == nil {
+		t.Error("drew the same round twice")
+	}
+
+	// waits for the winners to be written, which holds the lock
+	if _, err := Commit("round 2", "a future block", 1); err == nil {
+		t.Error("committed a round with nobody left to draw")
+	}
+	statuses := map[string]int{}
+	for _, e := range s.Records("Lottery Entries") {
+		statuses[e[fields.LotteryStatus]]++
+	}
+	if statuses[fields.LotteryWon] != 1 || statuses[fields.LotteryLost] != 2 {
+		t.Errorf("entries ended up %v, want 1 won and 2 lost", statuses)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/email"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long a sign-in link works for
+	signInLinkLifetime = 15 * time.Minute
+	// how many sign-in emails one address can be sent per window
+	signInLinksPerAddress = 3
+	signInAddressWindow   = 15 * time.Minute
+	// how many sign-in emails one IP can ask for per window, across addresses
+	signInLinksPerIP = 10
+	signInIPWindow   = time.Hour
+)
+
+var (
+	signInLinkKey []byte
+	// counts for rate limiting
+	signInLinks = cache.New(signInLinkLifetime, 10*time.Minute)
+	spentLinks  *spentSignInLinks
+)
+
+// spentSignInLinks keeps the ids of used sign-in links in a file until they'd have expired anyway, so a restart
+// doesn't make a used link work again
+type spentSignInLinks struct {
+	mutex sync.Mutex
+	path  string
+	ids   map[string]int64
+}
+
+// loadSpentSignInLinks reads the ids spent before the last restart, dropping the ones that have expired
+func loadSpentSignInLinks(path string) (*spentSignInLinks, error) {
+	s := &spentSignInLinks{path: path, ids: map[string]int64{}}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "reading spent sign-in links")
+	}
+
+	now := time.Now().Unix()
+	var kept bytes.Buffer
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+		expires, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || expires < now {
+			continue
+		}
+		s.ids[parts[0]] = expires
+		fmt.Fprintf(&kept, "%s %d\n", parts[0], expires)
+	}
+
+	err = os.WriteFile(path, kept.Bytes(), 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "writing spent sign-in links")
+	}
+	return s, nil
+}
+
+func (s *spentSignInLinks) used(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+// spend marks the link used, and is false if it already was. It's only marked once it's saved.
+func (s *spentSignInLinks) spend(l *signInLink) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.ids[l.ID]; ok {
+		return false, nil
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return false, errors.Wrap(err, "saving spent sign-in link")
+	}
+	_, err = fmt.Fprintf(f, "%s %d\n", l.ID, l.Expires)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "saving spent sign-in link")
+	}
+
+	s.ids[l.ID] = l.Expires
+	return true, nil
+}
+
+// signInLink is what's signed into an emailed sign-in link
+type signInLink struct {
+	ID         string `json:"j"`
+	UserName   string `json:"u"`
+	AirtableID string `json:"i"`
+	Next       string `json:"n"`
+	Expires    int64  `json:"e"`
+}
+
+// initSignInLinks derives the key sign-in links are signed with, and loads the used links kept in dir
+func initSignInLinks(secret, dir string) error {
+	key := sha256.Sum256([]byte(secret + "sign-in link key"))
+	signInLinkKey = key[:]
+
+	var err error
+	spentLinks, err = loadSpentSignInLinks(filepath.Join(dir, "spent-sign-in-links"))
+	return err
+}
+
+func (l *signInLink) token() (string, error) {
+	payload, err := json.Marshal(l)
+	if err != nil {
+		return "", errors.Wrap(err, "encoding sign-in link")
+	}
+
+	h := hmac.New(sha256.New, signInLinkKey)
+	h.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// parseSignInLink checks the token's signature and that it hasn't expired or been used
+func parseSignInLink(token string) (*signInLink, error) {
+	invalid := errors.New("This sign-in link is invalid, has expired, or was already used. Enter your email again for a new one.")
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, invalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, invalid
+	}
+
+	h := hmac.New(sha256.New, signInLinkKey)
+	h.Write(payload)
+	if !hmac.Equal(sig, h.Sum(nil)) {
+		return nil, invalid
+	}
+
+	var l signInLink
+	err = json.Unmarshal(payload, &l)
+	if err != nil {
+		return nil, invalid
+	}
+
+	if time.Now().Unix() > l.Expires {
+		return nil, invalid
+	}
+
+	if spentLinks.used(l.ID) {
+		return nil, invalid
+	}
+
+	return &l, nil
+}
+
+// allowSignInEmail counts a request against the limit for key, and says whether it's still under it
+func allowSignInEmail(key string, limit int, window time.Duration) bool {
+	if signInLinks.Add(key, 1, window) == nil {
+		return true
+	}
+
+	count, err := signInLinks.IncrementInt(key, 1)
+	if err != nil {
+		// expired between the two calls
+		signInLinks.Set(key, 1, window)
+		return true
+	}
+	return count <= limit
+}
+
+// emailSignInUser finds who an email address signs in as, checking the same lists findUser does
+func emailSignInUser(emailAddr string) (userName, airtableID string, ok bool) {
+	if user, err := db.GetUser(emailAddr); err == nil && user != nil {
+		return user.UserName, user.AirtableID, true
+	}
+	if user, err := db.GetSponsorshipUser(emailAddr); err == nil && user != nil {
+		return user.UserName, user.AirtableID, true
+	}
+	if user, err := db.GetSoftLaunchUser(emailAddr); err == nil && user != nil {
+		return user.UserName, user.AirtableID, true
+	}
+	if user, err := db.GetChaosUser(emailAddr); err == nil && user != nil {
+		return user.UserName, user.AirtableID, true
+	}
+	return "", "", false
+}
+
+// sendSignInLink emails a sign-in link to the address if it's on one of our lists, then tells them to check
+// their email either way, so the form can't be used to find out who's coming
+func sendSignInLink(c *gin.Context, next string) {
+	emailAddr := strings.ToLower(strings.TrimSpace(c.PostForm("email-address")))
+	if !localDevMode && !strings.Contains(emailAddr, "@") {
+		// throw an error if it's not a valid email on prod
+		c.AbortWithError(http.StatusBadRequest, errors.New("must enter a valid email address"))
+		return
+	}
+
+	if !allowSignInEmail("ip:"+c.ClientIP(), signInLinksPerIP, signInIPWindow) ||
+		!allowSignInEmail("address:"+emailAddr, signInLinksPerAddress, signInAddressWindow) {
+		c.AbortWithError(http.StatusTooManyRequests, errors.New("We've sent a lot of sign-in links recently, check your email or try again in a little while"))
+		return
+	}
+
+	userName, airtableID, ok := emailSignInUser(emailAddr)
+	if ok {
+		link := &signInLink{
+			ID:         uuid.NewString(),
+			UserName:   userName,
+			AirtableID: airtableID,
+			Next:       next,
+			Expires:    time.Now().Add(signInLinkLifetime).Unix(),
+		}
+
+		err := mailSignInLink(emailAddr, link)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		log.Infof("Sign-in link asked for by %v, who isn't on any list", emailAddr)
+	}
+
+	c.HTML(http.StatusOK, "signInEmailSent.html.tmpl", gin.H{
+		"Email":   emailAddr,
+		"Minutes": int(signInLinkLifetime.Minutes()),
+	})
+}
+
+func mailSignInLink(emailAddr string, link *signInLink) error {
+	token, err := link.token()
+	if err != nil {
+		return err
+	}
+
+	body, err := email.Render("emailSignIn.html.tmpl", gin.H{
+		"Link":    fmt.Sprintf("%s/signin/email?token=%s", externalURL, url.QueryEscape(token)),
+		"Minutes": int(signInLinkLifetime.Minutes()),
+		"SiteURL": externalURL,
+	})
+	if err != nil {
+		return err
+	}
+
+	return email.Queue(&email.Message{
+		Key:     "sign-in:" + link.ID,
+		To:      emailAddr,
+		Subject: "Your vibecamp sign-in link",
+		HTML:    body,
+	})
+}
+
+// EmailSignInHandler shows a button to finish signing in from an emailed link, and signs them in when it's pressed.
+// Following the link alone doesn't use it up, so mail scanners that open links can't spend it first.
+func EmailSignInHandler(c *gin.Context) {
+	token := c.Request.FormValue("token")
+	link, err := parseSignInLink(token)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if c.Request.Method == http.MethodGet {
+		c.HTML(http.StatusOK, "signInEmail.html.tmpl", gin.H{
+			"Token":    token,
+			"UserName": link.UserName,
+		})
+		return
+	}
+
+	spent, err := spentLinks.spend(link)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	} else if !spent {
+		c.AbortWithError(http.StatusBadRequest, errors.New("This sign-in link was already used. Enter your email again for a new one."))
+		return
+	}
+
+	makeEmailSession(c, link.UserName, link.AirtableID)
+
+	next := link.Next
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	c.Redirect(http.StatusFound, next)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSignInLinks(t *testing.T) string {
+	dir := t.TempDir()
+	if err := initSignInLinks("a cookie secret that's long enough to use", dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSignInLinkToken(t *testing.T) {
+	testSignInLinks(t)
+	link := &signInLink{ID: "id1", UserName: "alice", AirtableID: "rec1", Next: "/tickets", Expires: time.Now().Add(time.Minute).Unix()}
+	token, err := link.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := &signInLink{ID: "id2", UserName: "alice", Expires: time.Now().Add(-time.Minute).Unix()}
+	expiredToken, err := expired.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, sig := token[:strings.Index(token, ".")], token[strings.Index(token, ".")+1:]
+	// alice's link with the payload changed to sign in as bob, keeping her signature
+	forged, err := (&signInLink{ID: "id1", UserName: "bob", AirtableID: "rec1", Next: "/tickets", Expires: link.Expires}).token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged = forged[:strings.Index(forged, ".")] + "." + sig
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", token, true},
+		{"expired", expiredToken, false},
+		{"payload swapped", forged, false},
+		{"no signature", payload, false},
+		{"empty", "", false},
+		{"not base64", "!!." + sig, false},
+		{"extra part", token + ".x", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSignInLink(tt.token)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseSignInLink() error = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && (got.UserName != "alice" || got.Next != "/tickets") {
+				t.Errorf("parseSignInLink() = %+v", got)
+			}
+		})
+	}
+
+	// a different secret makes different links
+	if err := initSignInLinks("another cookie secret that's long enough", t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSignInLink(token); err == nil {
+		t.Error("a link signed with the old secret still works")
+	}
+}
+
+func TestSpentSignInLinksSurviveRestart(t *testing.T) {
+	dir := testSignInLinks(t)
+	link := &signInLink{ID: "id1", UserName: "alice", Expires: time.Now().Add(time.Minute).Unix()}
+	token, err := link.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spent, err := spentLinks.spend(link)
+	if err != nil || !spent {
+		t.Fatalf("spend() = %v, %v", spent, err)
+	}
+	if spent, _ := spentLinks.spend(link); spent {
+		t.Error("spent the same link twice")
+	}
+
+	// an old spent link that's expired is dropped when they're loaded again
+	stale := &signInLink{ID: "stale", Expires: time.Now().Add(-time.Minute).Unix()}
+	if _, err := spentLinks.spend(stale); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initSignInLinks("a cookie secret that's long enough to use", dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSignInLink(token); err == nil {
+		t.Error("a used link works again after a restart")
+	}
+	if spentLinks.used("stale") {
+		t.Error("kept an expired link")
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"", nil},
+		{"10.0.0.1", []string{"10.0.0.1"}},
+		{" 10.0.0.1, 10.1.0.0/16 ,", []string{"10.0.0.1", "10.1.0.0/16"}},
+	}
+
+	for _, tt := range tests {
+		got := trustedProxies(tt.list)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || (got == nil) != (tt.want == nil) {
+			t.Errorf("trustedProxies(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
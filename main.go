@@ -11,15 +11,26 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/vibecamp/myvibecamp/api"
 	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/discord"
+	"github.com/vibecamp/myvibecamp/email"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/hooks"
+	"github.com/vibecamp/myvibecamp/receipt"
+	"github.com/vibecamp/myvibecamp/reconcile"
+	"github.com/vibecamp/myvibecamp/sales"
+	"github.com/vibecamp/myvibecamp/sessionstore"
+	"github.com/vibecamp/myvibecamp/signin"
 	"github.com/vibecamp/myvibecamp/stripe"
+	"github.com/vibecamp/myvibecamp/waitlist"
 
 	"github.com/cockroachdb/errors/oserror"
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/kurrik/oauth1a"
@@ -30,10 +41,15 @@ import (
 //go:embed static/*
 var static embed.FS
 
+// shortest COOKIE_SECRET we'll start with
+const minCookieSecretLength = 32
+
 var (
-	localDevMode bool
-	service      *oauth1a.Service
-	externalURL  string
+	localDevMode   bool
+	reconcileSince time.Time
+	// sign in providers that are set up, by name
+	signInProviders = map[string]signin.Provider{}
+	externalURL     string
 )
 
 func main() {
@@ -52,14 +68,25 @@ func main() {
 	var (
 		port                 = os.Getenv("PORT")
 		apiKey               = os.Getenv("TWITTER_API_KEY")
+		twitterClientID      = os.Getenv("TWITTER_CLIENT_ID")
+		twitterClientSecret  = os.Getenv("TWITTER_CLIENT_SECRET")
 		apiSecret            = os.Getenv("TWITTER_API_SECRET")
 		stripeApiKey         = os.Getenv("STRIPE_API_KEY")
 		stripePublishableKey = os.Getenv("STRIPE_PUBLISHABLE_KEY")
 		stripeWebhookSecret  = os.Getenv("STRIPE_WEBHOOK_SECRET")
 		klaviyoKey           = os.Getenv("KLAVIYO_API_KEY")
 		klaviyoListId        = os.Getenv("KLAVIYO_LIST_ID")
+		klaviyoWaitlistId    = os.Getenv("KLAVIYO_WAITLIST_LIST_ID")
+		klaviyoInstallmentId = os.Getenv("KLAVIYO_INSTALLMENT_LIST_ID")
 	)
 
+	if v := os.Getenv("RECONCILE_SINCE"); v != "" {
+		reconcileSince, err = time.ParseInLocation("2006-01-02", v, sales.Eastern)
+		if err != nil {
+			log.Fatalf("RECONCILE_SINCE must look like 2006-01-02: %s", err)
+		}
+	}
+
 	localDevMode = os.Getenv("DEV") == "true"
 	if localDevMode {
 		log.SetLevel(log.DebugLevel) // we have TraceLevel messages as well
@@ -68,8 +95,9 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	if apiKey == "" || apiSecret == "" {
-		log.Errorf("You must specify a consumer key and secret.\n")
+	useOAuth1 := twitterClientID == "" || os.Getenv("TWITTER_OAUTH1") == "true"
+	if useOAuth1 && (apiKey == "" || apiSecret == "") {
+		log.Errorf("You must specify a twitter client id, or a consumer key and secret.\n")
 		os.Exit(1)
 	}
 
@@ -96,41 +124,134 @@ func main() {
 	db.Init(os.Getenv("AIRTABLE_API_KEY"), os.Getenv("AIRTABLE_BASE_ID"), c)
 
 	if localDevMode {
-		stripe.Init("sk_test_4eC39HqLyjWDarjtT1zdp7dc", "", klaviyoKey, klaviyoListId)
+		stripe.Init("sk_test_4eC39HqLyjWDarjtT1zdp7dc", "", klaviyoKey, klaviyoListId, klaviyoWaitlistId)
 	} else {
-		stripe.Init(stripeApiKey, stripeWebhookSecret, klaviyoKey, klaviyoListId)
+		stripe.Init(stripeApiKey, stripeWebhookSecret, klaviyoKey, klaviyoListId, klaviyoWaitlistId)
+	}
+
+	if apiBase := os.Getenv("STRIPE_API_BASE"); apiBase != "" {
+		stripe.UseAPIBase(apiBase)
 	}
 
+	waitlist.Init(externalURL, stripe.NotifyWaitlistOffer)
+	stripe.InitPaymentPlans(externalURL, klaviyoInstallmentId)
+	stripe.InitDisputes(externalURL, os.Getenv("FINANCE_EMAIL"), os.Getenv("KLAVIYO_DISPUTE_LIST_ID"))
+
 	callbackUrl := fmt.Sprintf("%s/callback", externalURL)
 	log.Println("Twitter callback URL: ", callbackUrl)
-	service = &oauth1a.Service{
-		RequestURL:   "https://api.twitter.com/oauth/request_token",
-		AuthorizeURL: "https://api.twitter.com/oauth/authorize",
-		AccessURL:    "https://api.twitter.com/oauth/access_token",
-		ClientConfig: &oauth1a.ClientConfig{
-			ConsumerKey:    apiKey,
-			ConsumerSecret: apiSecret,
-			CallbackURL:    callbackUrl,
-		},
-		Signer: new(oauth1a.HmacSha1Signer),
+	if useOAuth1 {
+		log.Println("Signing in with twitter's OAuth 1.0a")
+		signInProviders["twitter"] = &signin.TwitterOAuth1{Service: &oauth1a.Service{
+			RequestURL:   "https://api.twitter.com/oauth/request_token",
+			AuthorizeURL: "https://api.twitter.com/oauth/authorize",
+			AccessURL:    "https://api.twitter.com/oauth/access_token",
+			ClientConfig: &oauth1a.ClientConfig{
+				ConsumerKey:    apiKey,
+				ConsumerSecret: apiSecret,
+				CallbackURL:    callbackUrl,
+			},
+			Signer: new(oauth1a.HmacSha1Signer),
+		}}
+	} else {
+		signInProviders["twitter"] = signin.Twitter(twitterClientID, twitterClientSecret, callbackUrl, os.Getenv("TWITTER_API_BASE"))
+	}
+	if id := os.Getenv("DISCORD_CLIENT_ID"); id != "" {
+		signInProviders["discord"] = signin.Discord(id, os.Getenv("DISCORD_CLIENT_SECRET"), callbackUrl+"/discord", os.Getenv("DISCORD_API_BASE"))
+	}
+	if id := os.Getenv("GOOGLE_CLIENT_ID"); id != "" {
+		signInProviders["google"] = signin.Google(id, os.Getenv("GOOGLE_CLIENT_SECRET"), callbackUrl+"/google", os.Getenv("GOOGLE_API_BASE"))
+	}
+
+	// sessions and sign-in links are signed with keys derived from it, so a guessable one would let anyone sign in as anyone
+	cookieSecret := os.Getenv("COOKIE_SECRET")
+	if len(cookieSecret) < minCookieSecretLength {
+		log.Fatalf("COOKIE_SECRET needs to be at least %d characters", minCookieSecretLength)
 	}
 
 	r := gin.Default()
 	r.Use(errPrinter)
+	// ClientIP only believes X-Forwarded-For from these, otherwise anyone could dodge the per-IP limits by setting it
+	err = r.SetTrustedProxies(trustedProxies(os.Getenv("TRUSTED_PROXIES")))
+	if err != nil {
+		log.Fatalf("TRUSTED_PROXIES: %v", err)
+	}
 
-	cookieAuthKey := sha256.Sum256([]byte(os.Getenv("COOKIE_SECRET") + "authentication key"))
-	cookieEncKey := sha256.Sum256([]byte(os.Getenv("COOKIE_SECRET") + "encryption key"))
-	store := cookie.NewStore(cookieAuthKey[:], cookieEncKey[:])
-	store.Options(sessions.Options{Path: "/", MaxAge: 60 * 60 * 24 * 7, Secure: !localDevMode, HttpOnly: true})
-	r.Use(sessions.Sessions("session_id", store))
+	cookieAuthKey := sha256.Sum256([]byte(cookieSecret + "authentication key"))
+	cookieEncKey := sha256.Sum256([]byte(cookieSecret + "encryption key"))
+	sessionDir := os.Getenv("SESSION_DIR")
+	if sessionDir == "" {
+		sessionDir = "sessions"
+	}
+	sessionStore, err = sessionstore.New(sessionDir, sessionOwner, cookieAuthKey[:], cookieEncKey[:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionStore.Options(sessions.Options{Path: "/", MaxAge: 60 * 60 * 24 * 7, Secure: !localDevMode, HttpOnly: true})
+	go sessionStore.RunCleanup(time.Hour)
+	r.Use(func(c *gin.Context) {
+		c.Request = sessionstore.WithClientIP(c.Request, c.ClientIP())
+	})
+	r.Use(sessions.Sessions("session_id", sessionStore))
+	err = initSignInLinks(cookieSecret, sessionDir)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	tmpl := template.Must(template.ParseFS(mustSub(static, "static"), "*.tmpl"))
+	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
+		// signInWith says whether a sign in provider is set up
+		"signInWith": func(name string) bool {
+			_, ok := signInProviders[name]
+			return ok
+		},
+	}).ParseFS(mustSub(static, "static"), "*.tmpl"))
 	r.SetHTMLTemplate(tmpl)
 
+	var mailProvider email.Provider
+	if dir := os.Getenv("EMAIL_DIR"); dir != "" || localDevMode {
+		if dir == "" {
+			dir = "dev-mail"
+		}
+		mailProvider = email.Dir(dir)
+		log.Printf("Writing email to %s instead of sending it", dir)
+	} else if host := os.Getenv("SMTP_HOST"); host != "" {
+		mailProvider = &email.SMTP{
+			Host:     host,
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+	} else {
+		log.Warnf("No SMTP_HOST, email will stay queued in the outbox")
+	}
+	email.Init(mailProvider, os.Getenv("EMAIL_FROM"), externalURL, tmpl)
+	stripe.OnOrderPaid(receipt.Send)
+	stripe.OnTicketsIssued(email.TicketIssued)
+	stripe.OnPaymentFailed(email.PaymentFailed)
+	stripe.OnTicketsIssued(hooks.TicketsIssued)
+	stripe.OnOrderRefunded(hooks.OrderRefunded)
+	go email.RunOutbox(5 * time.Minute)
+	hooks.AllowLocal = localDevMode
+	go hooks.RunRetries(time.Minute)
+
+	if token, guild := os.Getenv("DISCORD_BOT_TOKEN"), os.Getenv("DISCORD_GUILD_ID"); token != "" && guild != "" {
+		sync := func(*db.Order) { discord.Trigger() }
+		stripe.OnTicketsIssued(sync)
+		stripe.OnOrderRefunded(sync)
+		go discord.Run(&discord.Bot{Token: token, GuildID: guild, APIBase: os.Getenv("DISCORD_API_BASE")}, 15*time.Minute)
+	} else {
+		log.Warnf("No DISCORD_BOT_TOKEN or DISCORD_GUILD_ID, discord roles won't be synced")
+	}
+
 	r.GET("/signin", SignInHandler)
 	r.GET("/signout", SignOutHandler)
+	r.GET("/sessions", SessionsHandler)
+	r.POST("/sessions", SessionsHandler)
 	r.GET("/callback", CallbackHandler)
 	r.GET("/signin-redirect", SignInRedirect)
+	r.GET("/signin/email", EmailSignInHandler)
+	r.GET("/signin/:provider", SignInHandler)
+	r.GET("/callback/:provider", CallbackHandler)
+	r.POST("/signin/email", EmailSignInHandler)
 	r.GET("/calendar", CalendarHandler)
 
 	r.GET("/ticket", TicketHandler)
@@ -139,18 +260,17 @@ func main() {
 	r.POST("/badge", BadgeHandler)
 	r.GET("/food", FoodHandler)
 	r.POST("/food", FoodHandler)
-	r.GET("/cabinlist", CabinListHandler)
-	r.GET("/checkin/:ticketId", CheckinHandler)
-	r.POST("/checkin/:ticketId", CheckinHandler)
+	r.GET("/cabinlist", requireScope(fields.ScopeCabinsRead), CabinListHandler)
 	r.GET("/checkout", StripeCheckoutHandler)
-	r.POST("/create-payment-intent", stripe.HandleCreatePaymentIntent)
-	r.POST("/create-payment-intent-transport", stripe.HandleTransportCreatePaymentIntent)
+	r.POST("/create-payment-intent", CreatePaymentIntentHandler)
+	r.POST("/create-payment-intent-transport", TransportPaymentIntentHandler)
 	r.GET("/ticket-cart", TicketCartHandler)
 	r.POST("/ticket-cart", TicketCartHandler)
 	r.GET("/vc2-sl", SoftLaunchSignIn)
 	r.POST("/vc2-sl", SoftLaunchSignIn)
 	r.POST("/stripe-webhook", stripe.HandleStripeWebhook)
 	r.GET("/checkout-complete", PurchaseCompleteHandler)
+	r.GET("/receipt/:id", ReceiptHandler)
 	r.GET("/checkout-failed", PurchaseFailedHandler)
 	r.POST("/checkout-failed", PurchaseFailedHandler)
 	r.GET("/2023-logistics", Logistics2023Handler)
@@ -162,15 +282,58 @@ func main() {
 	r.POST("/chaos-mode", ChaosModeSignIn)
 	r.GET("/chaos-cart", ChaosModeCartHandler)
 	r.POST("/chaos-cart", ChaosModeCartHandler)
-	r.GET("/auth-discord", DiscordAuthenticator)
-	r.GET("/app-user", AppEndpoint)
-	r.GET("/user-by-discord", UserByDiscordEndpoint)
-	r.GET("/attendees", GetAttendeesEndpoint)
+	r.GET("/auth-discord", requireScope(fields.ScopeDiscordLookup), DiscordAuthenticator)
+	r.GET("/app-user", requireScope(fields.ScopeAttendeeRead), AppEndpoint)
+	r.GET("/user-by-discord", requireScope(fields.ScopeDiscordLookup), UserByDiscordEndpoint)
+	r.GET("/attendees", requireScope(fields.ScopeAttendeesRead), GetAttendeesEndpoint)
+	r.POST("/webhook-replay", requireScope(fields.ScopeWebhooksReplay), WebhookReplayEndpoint)
+	api.Register(r.Group("/api/v1"), api.Config{ExternalURL: externalURL, Auth: requireAPIScope})
 	r.GET("/sponsorship-cart", SponsorshipCartHandler)
 	r.POST("/sponsorship-cart", SponsorshipCartHandler)
 	r.GET("/vc2", VC2Welcome)
 	r.POST("/vc2", VC2Welcome)
 	r.GET("/vc2-ticket", VC2TicketHandler)
+	r.GET("/payment-plan", PaymentPlanHandler)
+	r.POST("/payment-plan/setup-intent", PaymentPlanSetupHandler)
+	r.GET("/waitlist", WaitlistHandler)
+	r.POST("/waitlist", WaitlistHandler)
+	r.GET("/waitlist/offer/:token", WaitlistOfferHandler)
+	r.GET("/lottery", LotteryHandler)
+	r.POST("/lottery", LotteryHandler)
+
+	// staff pages, each group needs one of its roles
+	checkin := r.Group("/checkin", requireRole(fields.RoleCheckin))
+	checkin.GET("/:ticketId", CheckinHandler)
+	checkin.POST("/:ticketId", CheckinHandler)
+
+	admin := r.Group("/admin", requireRole(fields.RoleAdmin))
+	admin.GET("/lottery", LotteryAdminHandler)
+	admin.POST("/lottery", LotteryAdminHandler)
+	admin.GET("/sessions", SessionsAdminHandler)
+	admin.POST("/sessions", SessionsAdminHandler)
+	admin.GET("/api-keys", APIKeysAdminHandler)
+	admin.POST("/api-keys", APIKeysAdminHandler)
+	admin.GET("/hooks", HooksAdminHandler)
+	admin.POST("/hooks", HooksAdminHandler)
+
+	finance := r.Group("/admin", requireRole(fields.RoleFinance))
+	finance.GET("/sales", SalesAdminHandler)
+	finance.POST("/sales", SalesAdminHandler)
+	finance.GET("/reconcile", ReconcileAdminHandler)
+	finance.GET("/disputes", DisputesAdminHandler)
+	finance.GET("/disputes/:id", DisputeEvidenceHandler)
+	finance.GET("/webhooks", WebhooksAdminHandler)
+	finance.POST("/webhooks", WebhooksAdminHandler)
+	finance.GET("/webhooks/:id", WebhookEventAdminHandler)
+	finance.POST("/webhooks/:id", WebhookEventAdminHandler)
+
+	logistics := r.Group("/admin", requireRole(fields.RoleLogistics))
+	logistics.GET("/email", EmailAdminHandler)
+	logistics.POST("/email", EmailAdminHandler)
+
+	roles := r.Group("/admin", requireRole(fields.RoleVolunteerCoordinator))
+	roles.GET("/roles", RolesAdminHandler)
+	roles.POST("/roles", RolesAdminHandler)
 
 	r.GET("/", IndexHandler)
 	r.StaticFS("/css", http.FS(mustSub(static, "static/css")))
@@ -199,8 +362,26 @@ func main() {
 		}()
 	}
 
+	// open and close sales phases on schedule
+	go sales.Run(1 * time.Minute)
+
+	// expire old waitlist offers and hand out new ones
+	go waitlist.Run(1 * time.Minute)
+
+	// charge payment plan installments as they come due
+	go stripe.RunInstallments(1 * time.Hour)
+
+	// finish any webhook events that failed part way through
+	go stripe.RunWebhookRetries(5 * time.Minute)
+
+	// cancel checkouts nobody paid for and give back what they reserved
+	go stripe.RunCheckoutSweeper(10 * time.Minute)
+
+	// check stripe against the orders table once a day
+	go reconcile.RunEvery(24*time.Hour, reconcileSince)
+
 	// Wait for interrupt signal to gracefully shutdown the server with a timeout of 5 seconds.
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
@@ -212,6 +393,17 @@ func main() {
 	log.Println("Server exiting")
 }
 
+// trustedProxies splits a comma separated list of proxy IPs and CIDRs. None means X-Forwarded-For is never believed.
+func trustedProxies(list string) []string {
+	var proxies []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
 func mustSub(f embed.FS, path string) fs.FS {
 	fsys, err := fs.Sub(f, path)
 	if err != nil {
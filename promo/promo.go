@@ -0,0 +1,69 @@
+package promo
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Validate checks that userName, buying on ticketPath, can use the code right now
+func Validate(code, userName, ticketPath string) (*db.PromoCode, error) {
+	p, err := db.GetPromoCode(code)
+	if errors.Is(err, db.ErrNoRecords) {
+		return nil, errors.Newf("'%s' isn't a valid code", strings.TrimSpace(code))
+	} else if err != nil {
+		return nil, err
+	}
+
+	if p.DiscountType != fields.FixedDiscount && p.DiscountType != fields.PercentDiscount {
+		return nil, errors.Newf("'%s' isn't set up right, let us know", p.Code)
+	}
+
+	if !p.Expires.IsZero() && time.Now().After(p.Expires) {
+		return nil, errors.Newf("'%s' has expired", p.Code)
+	}
+
+	if p.MaxRedemptions > 0 && p.Redemptions >= p.MaxRedemptions {
+		return nil, errors.Newf("'%s' has been used up", p.Code)
+	}
+
+	if len(p.Users) > 0 && !contains(p.Users, strings.ToLower(userName)) {
+		return nil, errors.Newf("'%s' isn't for your account", p.Code)
+	}
+
+	if len(p.TicketPaths) > 0 && !contains(p.TicketPaths, ticketPath) {
+		return nil, errors.Newf("'%s' can't be used for %s tickets", p.Code, ticketPath)
+	}
+
+	return p, nil
+}
+
+// Discount is how much the code takes off quantity of sku at unitPrice. It never takes off more than the price.
+func Discount(p *db.PromoCode, sku string, unitPrice float64, quantity int) float64 {
+	if p == nil || quantity < 1 || (len(p.SKUs) > 0 && !contains(p.SKUs, sku)) {
+		return 0
+	}
+
+	off := p.Amount
+	if p.DiscountType == fields.PercentDiscount {
+		off = unitPrice * p.Amount / 100
+	}
+
+	off = math.Min(math.Max(off, 0), unitPrice)
+	// round to the cent so the order adds up
+	return math.Round(off*100) / 100 * float64(quantity)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package promo
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+)
+
+func TestDiscount(t *testing.T) {
+	fixed := &db.PromoCode{DiscountType: fields.FixedDiscount, Amount: 50}
+	percent := &db.PromoCode{DiscountType: fields.PercentDiscount, Amount: 15}
+
+	tests := []struct {
+		name      string
+		code      *db.PromoCode
+		sku       string
+		unitPrice float64
+		quantity  int
+		want      float64
+	}{
+		{"no code", nil, "adult", 100, 1, 0},
+		{"fixed", fixed, "adult", 100, 1, 50},
+		{"fixed per ticket", fixed, "adult", 100, 3, 150},
+		{"fixed is capped at the price", fixed, "child", 30, 2, 60},
+		{"percent", percent, "adult", 100, 2, 30},
+		{"percent rounds to the cent", percent, "adult", 33.33, 1, 5},
+		{"no tickets", fixed, "adult", 100, 0, 0},
+		{"sku not covered", &db.PromoCode{DiscountType: fields.FixedDiscount, Amount: 10, SKUs: []string{"adult"}}, "child", 50, 1, 0},
+		{"sku covered", &db.PromoCode{DiscountType: fields.FixedDiscount, Amount: 10, SKUs: []string{"adult"}}, "adult", 50, 1, 10},
+		{"negative amount", &db.PromoCode{DiscountType: fields.FixedDiscount, Amount: -10}, "adult", 50, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Discount(tt.code, tt.sku, tt.unitPrice, tt.quantity); got != tt.want {
+				t.Errorf("Discount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := dbtest.New(t)
+	add := func(code string, f map[string]interface{}) {
+		f[fields.Code] = code
+		if f[fields.DiscountType] == nil {
+			f[fields.DiscountType] = fields.FixedDiscount
+		}
+		s.Add("Promo Codes", f)
+	}
+	add("OPEN", map[string]interface{}{fields.Amount: 10})
+	add("EXPIRED", map[string]interface{}{fields.Expires: time.Now().Add(-time.Hour).Format(time.RFC3339)})
+	add("USEDUP", map[string]interface{}{fields.MaxRedemptions: 2, fields.Redemptions: 2})
+	add("HELD", map[string]interface{}{fields.MaxRedemptions: 2, fields.Redemptions: 1, fields.Reserved: 1})
+	add("ALICE", map[string]interface{}{fields.Users: "Alice, bob"})
+	add("FCFSONLY", map[string]interface{}{fields.TicketPaths: fields.FCFS})
+	add("BROKEN", map[string]interface{}{fields.DiscountType: "Free"})
+
+	tests := []struct {
+		code string
+		user string
+		path string
+		ok   bool
+	}{
+		{"open", "carol", fields.Lottery, true},
+		{"nope", "carol", fields.Lottery, false},
+		{"EXPIRED", "carol", fields.Lottery, false},
+		{"USEDUP", "carol", fields.Lottery, false},
+		// held redemptions are checked when the checkout reserves one
+		{"HELD", "carol", fields.Lottery, true},
+		{"ALICE", "alice", fields.Lottery, true},
+		{"ALICE", "carol", fields.Lottery, false},
+		{"FCFSONLY", "carol", fields.FCFS, true},
+		{"FCFSONLY", "carol", fields.Lottery, false},
+		{"BROKEN", "carol", fields.Lottery, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code+" "+tt.user+" "+tt.path, func(t *testing.T) {
+			_, err := Validate(tt.code, tt.user, tt.path)
+			if (err == nil) != tt.ok {
+				t.Errorf("Validate() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// checkouts running at once can't hold more redemptions than the code has
+func TestReserveRedemption(t *testing.T) {
+	s := dbtest.New(t)
+	id := s.Add("Promo Codes", map[string]interface{}{
+		fields.Code:           "LIMITED",
+		fields.DiscountType:   fields.FixedDiscount,
+		fields.MaxRedemptions: 3,
+		fields.Redemptions:    1,
+	})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	reserved, usedUp := 0, 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.ReserveRedemption("LIMITED")
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case err == nil:
+				reserved++
+			case errors.Is(err, db.ErrUsedUp):
+				usedUp++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 2 || usedUp != 3 {
+		t.Fatalf("%d reserved and %d used up, want 2 and 3", reserved, usedUp)
+	}
+
+	// one checkout's paid for and the other's given up on, which frees a redemption
+	if err := db.RedeemReservation("LIMITED"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReleaseRedemption("LIMITED"); err != nil {
+		t.Fatal(err)
+	}
+	got := s.Get("Promo Codes", id)
+	if got[fields.Redemptions] != "2" || got[fields.Reserved] != "0" {
+		t.Errorf("redemptions %q and reserved %q, want 2 and 0", got[fields.Redemptions], got[fields.Reserved])
+	}
+	if err := db.ReserveRedemption("LIMITED"); err != nil {
+		t.Errorf("couldn't reserve the freed redemption: %v", err)
+	}
+	if err := db.ReserveRedemption("LIMITED"); !errors.Is(err, db.ErrUsedUp) {
+		t.Errorf("reserved past the limit: %v", err)
+	}
+}
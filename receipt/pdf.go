@@ -0,0 +1,94 @@
+package receipt
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// PDF renders the receipt as a one page PDF
+func (r *Receipt) PDF() ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetMargins(20, 20, 20)
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.Cell(0, 10, "vibecamp receipt")
+	pdf.Ln(14)
+
+	pdf.SetFont("Helvetica", "", 10)
+	for _, row := range [][2]string{
+		{"Order", r.OrderID},
+		{"Date", r.Date.Format("January 2, 2006 3:04pm MST")},
+		{"Buyer", fmt.Sprintf("%s (@%s)", r.Name, r.UserName)},
+		{"Paid with", r.PaymentMethod},
+	} {
+		pdf.CellFormat(30, 6, row[0], "", 0, "", false, 0, "")
+		pdf.CellFormat(0, 6, tr(row[1]), "", 1, "", false, 0, "")
+	}
+	pdf.Ln(6)
+
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(95, 7, "Item", "B", 0, "", false, 0, "")
+	pdf.CellFormat(20, 7, "Qty", "B", 0, "R", false, 0, "")
+	pdf.CellFormat(30, 7, "Each", "B", 0, "R", false, 0, "")
+	pdf.CellFormat(30, 7, "Amount", "B", 1, "R", false, 0, "")
+
+	pdf.SetFont("Helvetica", "", 10)
+	for _, l := range r.Lines {
+		pdf.CellFormat(95, 7, l.Description, "", 0, "", false, 0, "")
+		pdf.CellFormat(20, 7, fmt.Sprint(l.Quantity), "", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 7, l.Unit.ToString(), "", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 7, l.Amount.ToString(), "", 1, "R", false, 0, "")
+	}
+
+	total := func(label, amount string, bold bool) {
+		style := ""
+		if bold {
+			style = "B"
+		}
+		pdf.SetFont("Helvetica", style, 10)
+		pdf.CellFormat(145, 7, label, "", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 7, amount, "", 1, "R", false, 0, "")
+	}
+
+	pdf.Ln(2)
+	total("Subtotal", r.Subtotal.ToString(), false)
+	if r.Discount.InCents() > 0 {
+		label := "Discount"
+		if r.PromoCode != "" {
+			label += " (" + r.PromoCode + ")"
+		}
+		total(label, "-"+r.Discount.ToString(), false)
+	}
+	if r.Fee.InCents() > 0 {
+		total("Processing fee", r.Fee.ToString(), false)
+	}
+	if r.Donation.InCents() > 0 {
+		total("Donation", r.Donation.ToString(), false)
+	}
+	total("Total", r.Total.ToString(), true)
+	if r.Installments > 1 {
+		total(fmt.Sprintf("Paid so far (%d installment plan)", r.Installments), r.Paid.ToString(), false)
+		total("Remaining", r.Remaining.ToString(), false)
+	}
+
+	if r.Donation.InCents() > 0 {
+		pdf.Ln(8)
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.Cell(0, 6, "Donation")
+		pdf.Ln(6)
+		pdf.SetFont("Helvetica", "", 10)
+		pdf.MultiCell(0, 5, fmt.Sprintf("Your donation of %s is included in the total above. %s", r.Donation.ToString(), donationNote), "", "", false)
+	}
+
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "writing receipt pdf")
+	}
+	return buf.Bytes(), nil
+}
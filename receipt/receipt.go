@@ -0,0 +1,247 @@
+// Package receipt builds itemised receipts for orders, as HTML and PDF, and emails them when an order is paid
+package receipt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/email"
+	"github.com/vibecamp/myvibecamp/sales"
+	"github.com/vibecamp/myvibecamp/stripe"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+	stripeapi "github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/paymentintent"
+)
+
+// Line is one thing bought on an order
+type Line struct {
+	Description string
+	Quantity    int
+	Unit        *db.Currency
+	Amount      *db.Currency
+}
+
+// Receipt is everything that goes on an order's receipt. The donation is kept apart from the lines, since
+// nothing was given in exchange for it.
+type Receipt struct {
+	OrderID       string
+	UserName      string
+	Name          string
+	Email         string
+	Date          time.Time
+	Lines         []Line
+	Subtotal      *db.Currency
+	PromoCode     string
+	Discount      *db.Currency
+	Fee           *db.Currency
+	Donation      *db.Currency
+	Total         *db.Currency
+	Paid          *db.Currency
+	Remaining     *db.Currency
+	Installments  int
+	PaymentMethod string
+	Status        string
+}
+
+// donationNote goes with any donation, so it can be claimed on taxes
+const donationNote = "No goods or services were provided in exchange for this donation."
+
+var skus = []struct {
+	sku         string
+	description string
+	quantity    func(o *db.Order) int
+}{
+	{"adult-cabin", "Adult cabin ticket", func(o *db.Order) int { return o.AdultCabin }},
+	{"adult-tent", "Adult tent ticket", func(o *db.Order) int { return o.AdultTent }},
+	{"adult-sat", "Adult Saturday night ticket", func(o *db.Order) int { return o.AdultSat }},
+	{"child-cabin", "Child cabin ticket", func(o *db.Order) int { return o.ChildCabin }},
+	{"child-tent", "Child tent ticket", func(o *db.Order) int { return o.ChildTent }},
+	{"child-sat", "Child Saturday night ticket", func(o *db.Order) int { return o.ChildSat }},
+	{"toddler-cabin", "Toddler cabin ticket", func(o *db.Order) int { return o.ToddlerCabin }},
+	{"toddler-tent", "Toddler tent ticket", func(o *db.Order) int { return o.ToddlerTent }},
+	{"toddler-sat", "Toddler Saturday night ticket", func(o *db.Order) int { return o.ToddlerSat }},
+	{"bus", "Bus seat", func(o *db.Order) int { return o.BusSpots }},
+	{"sleeping-bag", "Sleeping bag rental", func(o *db.Order) int { return o.SleepingBags }},
+	{"sheet-set", "Sheet set rental", func(o *db.Order) int { return o.SheetSets }},
+	{"pillow", "Pillow rental", func(o *db.Order) int { return o.Pillows }},
+	{"card-pack", "Card packs", func(o *db.Order) int { return o.CardPacks }},
+}
+
+func init() {
+	email.RegisterAttachment("receipt", renderPDF)
+}
+
+// renderPDF makes the receipt PDF for an order when the email it's attached to goes out
+func renderPDF(orderID string) ([]byte, error) {
+	order, err := db.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := Build(order)
+	if err != nil {
+		return nil, err
+	}
+	return r.PDF()
+}
+
+// Build puts together the receipt for an order, looking up the buyer and the card they paid with
+func Build(order *db.Order) (*Receipt, error) {
+	r := &Receipt{
+		OrderID:      order.OrderID,
+		UserName:     order.UserName,
+		PromoCode:    order.PromoCode,
+		Discount:     orZero(order.Discount),
+		Fee:          orZero(order.ProcessingFee),
+		Donation:     db.CurrencyFromCents(int64(order.Donation) * 100),
+		Total:        orZero(order.Total),
+		Installments: order.InstallmentPlan,
+		Status:       order.PaymentStatus,
+	}
+
+	date, err := time.ParseInLocation("2006-01-02 15:04", order.Date, time.UTC)
+	if err == nil {
+		r.Date = date.In(sales.Eastern)
+	}
+
+	var subtotal int64
+	r.Lines = Lines(order)
+	for _, l := range r.Lines {
+		subtotal += l.Amount.InCents()
+	}
+	r.Subtotal = db.CurrencyFromCents(subtotal)
+
+	switch {
+	case order.InstallmentPlan > 1:
+		r.Paid = orZero(order.AmountPaid)
+		r.Remaining = order.Remaining()
+	case order.TicketIssued():
+		r.Paid = r.Total
+		r.Remaining = &db.Currency{}
+	default:
+		r.Paid = &db.Currency{}
+		r.Remaining = r.Total
+	}
+
+	// a receipt without the buyer's name is still a receipt
+	user, err := db.GetUser(order.UserName)
+	if err == nil {
+		r.Name = user.Name
+		r.Email = user.Email
+	} else {
+		log.Warnf("error getting @%v for the receipt for order %v: %v", order.UserName, order.OrderID, err)
+	}
+
+	r.PaymentMethod, err = paymentMethod(order)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Lines are the things bought on an order, at today's prices
+func Lines(order *db.Order) []Line {
+	var lines []Line
+	for _, s := range skus {
+		quantity := s.quantity(order)
+		if quantity == 0 {
+			continue
+		}
+
+		unit := db.CurrencyFromFloat(stripe.UnitPrice(s.sku))
+		lines = append(lines, Line{
+			Description: s.description,
+			Quantity:    quantity,
+			Unit:        unit,
+			Amount:      db.CurrencyFromCents(unit.InCents() * int64(quantity)),
+		})
+	}
+	return lines
+}
+
+func orZero(c *db.Currency) *db.Currency {
+	if c == nil {
+		return &db.Currency{}
+	}
+	return c
+}
+
+// paymentMethod describes what the order was paid with, like "Visa ending 4242"
+func paymentMethod(order *db.Order) (string, error) {
+	if order.StripeID == "" {
+		return "No payment needed", nil
+	}
+
+	params := &stripeapi.PaymentIntentParams{}
+	params.AddExpand("payment_method")
+	pi, err := paymentintent.Get(order.StripeID, params)
+	if err != nil {
+		return "", errors.Wrap(err, "getting payment intent")
+	}
+
+	pm := pi.PaymentMethod
+	switch {
+	case pm == nil:
+		return "Card", nil
+	case pm.Card != nil:
+		return fmt.Sprintf("%s ending %s", strings.Title(string(pm.Card.Brand)), pm.Card.Last4), nil
+	case pm.USBankAccount != nil:
+		return fmt.Sprintf("Bank account ending %s", pm.USBankAccount.Last4), nil
+	}
+	return strings.ReplaceAll(string(pm.Type), "_", " "), nil
+}
+
+// HTML renders the receipt the way it's shown on the site and in the email
+func (r *Receipt) HTML() ([]byte, error) {
+	return email.Render("receipt.html.tmpl", r)
+}
+
+// DonationNote is the line that goes with the donation for tax purposes
+func (r *Receipt) DonationNote() string {
+	return donationNote
+}
+
+// FileName is what a downloaded copy of the receipt is called
+func (r *Receipt) FileName(ext string) string {
+	return fmt.Sprintf("vibecamp-receipt-%s.%s", r.OrderID, ext)
+}
+
+// Send queues the order's confirmation email to the buyer, with the receipt as the body and the PDF attached
+func Send(order *db.Order) {
+	r, err := Build(order)
+	if err != nil {
+		log.Errorf("error building receipt for order %v: %v", order.OrderID, err)
+		return
+	}
+
+	if r.Email == "" {
+		log.Infof("No email for @%v, not sending the receipt for order %v", r.UserName, r.OrderID)
+		return
+	}
+
+	html, err := r.HTML()
+	if err != nil {
+		log.Errorf("error rendering receipt for order %v: %v", r.OrderID, err)
+		return
+	}
+
+	err = email.Queue(&email.Message{
+		Key:     "receipt:" + r.OrderID,
+		To:      r.Email,
+		Subject: "Your vibecamp order confirmation and receipt",
+		HTML:    html,
+		Attachments: []db.EmailAttachment{{
+			Name:        r.FileName("pdf"),
+			ContentType: "application/pdf",
+			Source:      "receipt:" + r.OrderID,
+		}},
+	})
+	if err != nil {
+		log.Errorf("error emailing receipt for order %v: %v", r.OrderID, err)
+	}
+}
@@ -0,0 +1,129 @@
+package receipt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/stripe"
+)
+
+func cents(sku string) int64 {
+	return db.CurrencyFromFloat(stripe.UnitPrice(sku)).InCents()
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		order db.Order
+		// the lines' descriptions, quantities and amounts, in order
+		want []Line
+	}{
+		{"nothing", db.Order{}, nil},
+		{"a tent ticket", db.Order{AdultTent: 1}, []Line{
+			{Description: "Adult tent ticket", Quantity: 1, Amount: db.CurrencyFromCents(cents("adult-tent"))},
+		}},
+		{"a family with a bus and bedding", db.Order{AdultCabin: 2, ChildCabin: 1, BusSpots: 3, SleepingBags: 2}, []Line{
+			{Description: "Adult cabin ticket", Quantity: 2, Amount: db.CurrencyFromCents(2 * cents("adult-cabin"))},
+			{Description: "Child cabin ticket", Quantity: 1, Amount: db.CurrencyFromCents(cents("child-cabin"))},
+			{Description: "Bus seat", Quantity: 3, Amount: db.CurrencyFromCents(3 * cents("bus"))},
+			{Description: "Sleeping bag rental", Quantity: 2, Amount: db.CurrencyFromCents(2 * cents("sleeping-bag"))},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Lines(&tt.order)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d lines, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i, l := range got {
+				w := tt.want[i]
+				if l.Description != w.Description || l.Quantity != w.Quantity || l.Amount.InCents() != w.Amount.InCents() {
+					t.Errorf("line %d = %s x%d %v, want %s x%d %v", i, l.Description, l.Quantity, l.Amount, w.Description, w.Quantity, w.Amount)
+				}
+				if l.Unit.InCents()*int64(l.Quantity) != l.Amount.InCents() {
+					t.Errorf("line %d is %d at %v, but comes to %v", i, l.Quantity, l.Unit, l.Amount)
+				}
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	s := dbtest.New(t)
+	s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "alice", fields.Name: "Alice", fields.Email: "alice@example.com"})
+
+	tests := []struct {
+		name         string
+		status       string
+		installments int
+		paid         *db.Currency
+		wantPaid     int64
+		wantLeft     int64
+	}{
+		{"paid", "success", 0, nil, 50000, 0},
+		{"not paid yet", "", 0, nil, 0, 50000},
+		{"failed", "failed", 0, nil, 0, 50000},
+		{"first of three installments", "partially_paid", 3, db.CurrencyFromCents(16667), 16667, 33333},
+		{"every installment", "success", 3, db.CurrencyFromCents(50000), 50000, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := &db.Order{
+				OrderID:         "order1",
+				UserName:        "alice",
+				Date:            "2023-03-01 17:30",
+				AdultCabin:      1,
+				Donation:        20,
+				ProcessingFee:   db.CurrencyFromCents(1500),
+				Total:           db.CurrencyFromCents(50000),
+				PaymentStatus:   tt.status,
+				InstallmentPlan: tt.installments,
+				AmountPaid:      tt.paid,
+			}
+			r, err := Build(order)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Name != "Alice" || r.Email != "alice@example.com" {
+				t.Errorf("buyer = %s <%s>", r.Name, r.Email)
+			}
+			if r.PaymentMethod != "No payment needed" {
+				t.Errorf("payment method = %s", r.PaymentMethod)
+			}
+			if got := r.Date.Format("2006-01-02 15:04"); got != "2023-03-01 12:30" {
+				t.Errorf("date = %s, want it in eastern time", got)
+			}
+			if r.Subtotal.InCents() != cents("adult-cabin") || r.Donation.InCents() != 2000 || r.Fee.InCents() != 1500 {
+				t.Errorf("subtotal %v, donation %v, fee %v", r.Subtotal, r.Donation, r.Fee)
+			}
+			if r.Discount == nil || r.Discount.InCents() != 0 {
+				t.Errorf("discount = %v, want zero", r.Discount)
+			}
+			if r.Paid.InCents() != tt.wantPaid || r.Remaining.InCents() != tt.wantLeft {
+				t.Errorf("paid %v with %v left, want %d and %d cents", r.Paid, r.Remaining, tt.wantPaid, tt.wantLeft)
+			}
+		})
+	}
+
+	// someone who isn't on the guest list any more still gets a receipt
+	r, err := Build(&db.Order{OrderID: "order2", UserName: "gone", AdultTent: 1, Total: db.CurrencyFromCents(cents("adult-tent"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdf, err := r.PDF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		t.Errorf("PDF() starts %q", pdf[:10])
+	}
+	if r.FileName("pdf") != "vibecamp-receipt-order2.pdf" {
+		t.Errorf("FileName() = %s", r.FileName("pdf"))
+	}
+}
@@ -0,0 +1,240 @@
+// Package reconcile checks stripe's payment intents against the orders table
+package reconcile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/paymentintent"
+)
+
+// kinds of mismatch
+const (
+	PaidNotTicketed = "Paid but not ticketed"
+	AmountDrift     = "Amount drift"
+	OrphanIntent    = "Orphan intent"
+	DuplicateOrders = "Duplicate orders"
+	IntentMismatch  = "Intent mismatch"
+)
+
+// Mismatch is one thing stripe and the orders table disagree about
+type Mismatch struct {
+	Kind      string
+	PaymentID string
+	OrderID   string
+	UserName  string
+	Detail    string
+}
+
+// Report is the outcome of a reconciliation run
+type Report struct {
+	Since      time.Time
+	Intents    int
+	Orders     int
+	Mismatches []Mismatch
+
+	// processing fees buyers paid on the checked orders, what stripe's balance transactions say it took
+	// for them, and how many orders don't have stripe's fee recorded yet
+	FeesCharged    int64
+	StripeFees     int64
+	FeesUnrecorded int
+}
+
+// Run pages through the succeeded payment intents created since (all of them if zero) and checks each has a
+// paid order for the same amount with a ticketed attendee, then looks for people with more than one paid order
+func Run(since time.Time) (*Report, error) {
+	orders, err := db.GetOrders()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting orders")
+	}
+
+	installments, err := db.GetAllInstallments()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting installments")
+	}
+
+	ticketIDs, err := db.GetTicketIDs()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting ticket ids")
+	}
+
+	byPaymentID := make(map[string]*db.Order, len(orders))
+	byOrderID := make(map[string]*db.Order, len(orders))
+	for _, o := range orders {
+		if o.StripeID != "" {
+			byPaymentID[o.StripeID] = o
+		}
+		byOrderID[o.OrderID] = o
+	}
+
+	installmentsByID := make(map[string]*db.Installment, len(installments))
+	deposits := make(map[string]*db.Installment)
+	for _, inst := range installments {
+		installmentsByID[inst.AirtableID] = inst
+		if inst.Number == 1 {
+			deposits[inst.OrderID] = inst
+		}
+	}
+
+	report := &Report{Since: since, Orders: len(orders)}
+
+	params := &stripe.PaymentIntentListParams{}
+	if !since.IsZero() {
+		params.CreatedRange = &stripe.RangeQueryParams{GreaterThanOrEqual: since.Unix()}
+	}
+
+	iter := paymentintent.List(params)
+	for iter.Next() {
+		pi := iter.PaymentIntent()
+		if pi.Status != stripe.PaymentIntentStatusSucceeded {
+			continue
+		}
+
+		report.Intents++
+		report.check(pi, byPaymentID, byOrderID, installmentsByID, deposits, ticketIDs)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errors.Wrap(err, "listing payment intents")
+	}
+
+	report.checkDuplicates(orders)
+
+	sort.SliceStable(report.Mismatches, func(i, j int) bool {
+		return report.Mismatches[i].Kind < report.Mismatches[j].Kind
+	})
+
+	return report, nil
+}
+
+func (r *Report) add(kind string, pi *stripe.PaymentIntent, order *db.Order, detail string, args ...interface{}) {
+	m := Mismatch{Kind: kind, Detail: fmt.Sprintf(detail, args...)}
+	if pi != nil {
+		m.PaymentID = pi.ID
+	}
+	if order != nil {
+		m.OrderID = order.OrderID
+		m.UserName = order.UserName
+	}
+	r.Mismatches = append(r.Mismatches, m)
+}
+
+func (r *Report) check(pi *stripe.PaymentIntent, byPaymentID, byOrderID map[string]*db.Order,
+	installmentsByID, deposits map[string]*db.Installment, ticketIDs map[string]string) {
+	if id := pi.Metadata["installmentId"]; id != "" {
+		inst := installmentsByID[id]
+		if inst == nil {
+			r.add(OrphanIntent, pi, byOrderID[pi.Metadata["orderId"]], "installment %v isn't in the installments table", id)
+			return
+		}
+
+		order := byOrderID[inst.OrderID]
+		if inst.Status != fields.InstallmentPaid {
+			r.add(PaidNotTicketed, pi, order, "installment %d is %v", inst.Number, inst.Status)
+		}
+		if inst.Amount.InCents() != pi.Amount {
+			r.add(AmountDrift, pi, order, "charged %v for installment %d of %v", cents(pi.Amount), inst.Number, inst.Amount.ToString())
+		}
+		return
+	}
+
+	order := byPaymentID[pi.ID]
+	if order == nil {
+		if o := byOrderID[pi.Metadata["orderId"]]; o != nil {
+			r.add(IntentMismatch, pi, o, "order's payment id is %q", o.StripeID)
+		} else {
+			r.add(OrphanIntent, pi, nil, "no order for %v paid %v", pi.Metadata["orderId"], cents(pi.Amount))
+		}
+		return
+	}
+
+	switch {
+	case order.PaymentStatus == "refunded" || order.PaymentStatus == "cancelled":
+		// paid and then undone on purpose, stripe keeps the intent as succeeded
+		return
+	case !order.TicketIssued():
+		r.add(PaidNotTicketed, pi, order, "order is %q", order.PaymentStatus)
+	case order.TotalTickets > 0 && ticketIDs[strings.ToLower(order.UserName)] == "":
+		r.add(PaidNotTicketed, pi, order, "attendee has no ticket id")
+	}
+
+	expected := order.Total.InCents()
+	if order.InstallmentPlan > 1 {
+		deposit := deposits[order.OrderID]
+		if deposit == nil {
+			r.add(PaidNotTicketed, pi, order, "%d installment plan was never scheduled", order.InstallmentPlan)
+			return
+		}
+		expected = deposit.Amount.InCents()
+	}
+
+	if expected != pi.Amount {
+		r.add(AmountDrift, pi, order, "charged %v, order expects %v", cents(pi.Amount), cents(expected))
+	}
+
+	r.FeesCharged += order.ProcessingFee.InCents()
+	if order.StripeFee.InCents() == 0 {
+		r.FeesUnrecorded++
+	} else {
+		r.StripeFees += order.StripeFee.InCents()
+	}
+}
+
+// Fees sums up the processing fees buyers paid against what stripe took
+func (r *Report) Fees() string {
+	summary := fmt.Sprintf("Buyers paid %v in processing fees, stripe took %v", cents(r.FeesCharged), cents(r.StripeFees))
+	if r.FeesUnrecorded > 0 {
+		summary += fmt.Sprintf(" (%d orders don't have stripe's fee recorded)", r.FeesUnrecorded)
+	}
+	return summary
+}
+
+// checkDuplicates finds anyone holding tickets from more than one order
+func (r *Report) checkDuplicates(orders []*db.Order) {
+	byUser := make(map[string][]*db.Order)
+	for _, o := range orders {
+		if o.TotalTickets > 0 && o.TicketIssued() {
+			name := strings.ToLower(o.UserName)
+			byUser[name] = append(byUser[name], o)
+		}
+	}
+
+	for _, userOrders := range byUser {
+		if len(userOrders) < 2 {
+			continue
+		}
+
+		ids := make([]string, 0, len(userOrders))
+		for _, o := range userOrders {
+			ids = append(ids, o.OrderID)
+		}
+		r.add(DuplicateOrders, nil, userOrders[0], "%d paid orders: %s", len(userOrders), strings.Join(ids, ", "))
+	}
+}
+
+func cents(c int64) string {
+	return db.CurrencyFromCents(c).ToString()
+}
+
+// RunEvery reconciles every interval until the process exits, logging anything that doesn't match
+func RunEvery(interval time.Duration, since time.Time) {
+	for range time.Tick(interval) {
+		report, err := Run(since)
+		if err != nil {
+			log.Errorf("reconciling payments: %v", err)
+			continue
+		}
+
+		log.Infof("reconciled %d payment intents against %d orders, %d mismatches", report.Intents, report.Orders, len(report.Mismatches))
+		for _, m := range report.Mismatches {
+			log.Warnf("reconcile: %s: intent %v order %v @%v: %s", m.Kind, m.PaymentID, m.OrderID, m.UserName, m.Detail)
+		}
+	}
+}
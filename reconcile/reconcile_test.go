@@ -0,0 +1,114 @@
+package reconcile
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// stripeMock points stripe at a running stripe-mock (https://github.com/stripe/stripe-mock), skipping the test if
+// there isn't one. stripe-mock's payment intents never succeed, so its responses are passed through a proxy that
+// marks them succeeded, which is all reconciliation looks at.
+func stripeMock(t *testing.T) {
+	base := os.Getenv("STRIPE_MOCK_URL")
+	if base == "" {
+		base = "http://localhost:12111"
+	}
+	target, err := url.Parse(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Timeout: time.Second}
+	if _, err := client.Get(base); err != nil {
+		t.Skipf("stripe-mock isn't running at %s: %v", base, err)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		body = unpaid.ReplaceAll(body, []byte(`"status":"succeeded"`))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	stripe.Key = "sk_test_123"
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL: stripe.String(server.URL),
+	}))
+}
+
+// stripe-mock only pretty prints for clients that aren't stripe's own
+var unpaid = regexp.MustCompile(`"status":\s*"requires_payment_method"`)
+
+func kinds(r *Report) map[string]int {
+	found := map[string]int{}
+	for _, m := range r.Mismatches {
+		found[m.Kind]++
+	}
+	return found
+}
+
+func TestRunAgainstStripeMock(t *testing.T) {
+	stripeMock(t)
+	s := dbtest.New(t)
+
+	// nothing in the orders table, so every intent is an orphan
+	report, err := Run(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Intents == 0 {
+		t.Fatal("no payment intents came back from stripe-mock")
+	}
+	if found := kinds(report); found[OrphanIntent] != report.Intents || len(report.Mismatches) != report.Intents {
+		t.Fatalf("mismatches = %v, want an orphan intent for each of %d intents", report.Mismatches, report.Intents)
+	}
+	pi := report.Mismatches[0]
+
+	// an order for the intent that was never ticketed, for a different amount, and a second paid order
+	s.Add(dbtest.Orders, map[string]interface{}{
+		fields.OrderID:       "order1",
+		fields.UserName:      "alice",
+		fields.PaymentID:     pi.PaymentID,
+		fields.Total:         "$1.00",
+		fields.TotalTickets:  1,
+		fields.PaymentStatus: "",
+	})
+	s.Add(dbtest.Orders, map[string]interface{}{fields.OrderID: "order2", fields.UserName: "bob", fields.TotalTickets: 1, fields.PaymentStatus: "success"})
+	s.Add(dbtest.Orders, map[string]interface{}{fields.OrderID: "order3", fields.UserName: "Bob", fields.TotalTickets: 1, fields.PaymentStatus: "success"})
+
+	report, err = Run(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := kinds(report)
+	if found[PaidNotTicketed] != 1 || found[AmountDrift] != 1 || found[DuplicateOrders] != 1 {
+		t.Errorf("mismatches = %v, want the order for %s not ticketed and short, and bob's duplicate", report.Mismatches, pi.PaymentID)
+	}
+	for _, m := range report.Mismatches {
+		if m.Kind == AmountDrift && m.OrderID != "order1" {
+			t.Errorf("amount drift reported against %s, want order1", m.OrderID)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/sales"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// context keys requireRole leaves for handlers
+	staffKey        = "staff"
+	staffRoleKey    = "staffRole"
+	staffDetailsKey = "staffDetails"
+)
+
+// staffRoleFor is the role that lets user do what one of roles allows. Everyone has every role in dev mode.
+func staffRoleFor(user *db.User, roles ...string) (string, bool) {
+	for _, role := range roles {
+		if r, ok := user.RoleFor(role); ok {
+			return r, true
+		}
+	}
+	if localDevMode {
+		return fields.RoleAdmin, true
+	}
+	return "", false
+}
+
+// hasRole aborts unless the signed in user has one of roles, for pages that only need a role some of the time
+func hasRole(c *gin.Context, roles ...string) (*db.User, string, bool) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.Redirect(http.StatusFound, "/")
+		c.Abort()
+		return nil, "", false
+	}
+
+	user, err := db.GetUser(session.UserName)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return nil, "", false
+	}
+
+	role, ok := staffRoleFor(user, roles...)
+	if !ok {
+		c.AbortWithError(http.StatusForbidden, errors.New("This page is for staff only"))
+		return nil, "", false
+	}
+
+	return user, role, true
+}
+
+// requireRole is middleware for a group of staff routes that need one of roles. Anything other than a GET is
+// recorded in the staff actions table, with the role that allowed it.
+func requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, role, ok := hasRole(c, roles...)
+		if !ok {
+			return
+		}
+		c.Set(staffKey, user)
+		c.Set(staffRoleKey, role)
+
+		c.Next()
+
+		if c.Request.Method != http.MethodGet {
+			logStaffAction(c, user, role)
+		}
+	}
+}
+
+// staffUser is who requireRole let through
+func staffUser(c *gin.Context) *db.User {
+	return c.MustGet(staffKey).(*db.User)
+}
+
+// staffDetails says what a staff action did, for the staff actions table
+func staffDetails(c *gin.Context, format string, args ...interface{}) {
+	c.Set(staffDetailsKey, fmt.Sprintf(format, args...))
+}
+
+func logStaffAction(c *gin.Context, user *db.User, role string) {
+	action := c.Request.URL.Path
+	if a := c.PostForm("action"); a != "" {
+		action += " " + a
+	}
+
+	target := ""
+	for _, t := range []string{c.Param("ticketId"), c.Param("id"), c.PostForm("user"), c.PostForm("id")} {
+		if t != "" {
+			target = t
+			break
+		}
+	}
+
+	details := c.GetString(staffDetailsKey)
+	if status := c.Writer.Status(); status >= http.StatusBadRequest {
+		details = strings.TrimSpace(fmt.Sprintf("failed with %d. %s", status, details))
+	}
+
+	a := &db.StaffAction{
+		Actor:   user.UserName,
+		Role:    role,
+		Action:  action,
+		Target:  target,
+		Details: details,
+	}
+	go func() {
+		if err := db.LogStaffAction(a); err != nil {
+			log.Errorf("error logging staff action %+v: %v", a, err)
+		}
+	}()
+}
+
+// assignableRoles are the roles someone acting as role can give out. Admins can give out any of them, volunteer
+// coordinators can only add gate volunteers, and nobody else can give out anything.
+func assignableRoles(role string) []string {
+	switch role {
+	case fields.RoleAdmin:
+		return db.StaffRoles
+	case fields.RoleVolunteerCoordinator:
+		return []string{fields.RoleCheckin}
+	}
+	return nil
+}
+
+// RolesAdminHandler lists who has staff roles and changes them. Changes take effect on their next page load.
+func RolesAdminHandler(c *gin.Context) {
+	role := c.GetString(staffRoleKey)
+	assignable := assignableRoles(role)
+	userName := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c.Request.FormValue("user")), "@"))
+
+	if c.Request.Method == http.MethodPost {
+		user, err := db.GetUser(userName)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		// keep the roles they have that the actor can't change
+		var roles []string
+		for _, r := range user.Roles {
+			if !contains(assignable, r) {
+				roles = append(roles, r)
+			}
+		}
+		for _, r := range c.PostFormArray("role") {
+			if !contains(assignable, r) {
+				c.AbortWithError(http.StatusForbidden, errors.Newf("You can't give out the %s role", r))
+				return
+			}
+			roles = append(roles, r)
+		}
+
+		err = user.SetRoles(roles)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		staffDetails(c, "roles now %s", strings.Join(roles, ", "))
+		SuccessFlash(c, fmt.Sprintf("Updated @%s's roles", user.UserName))
+		c.Redirect(http.StatusFound, "/admin/roles?user="+url.QueryEscape(user.UserName))
+		return
+	}
+
+	staff, err := db.GetStaff()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var editing *db.User
+	checked := map[string]bool{}
+	if userName != "" {
+		editing, err = db.GetUser(userName)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		for _, r := range editing.Roles {
+			checked[r] = true
+		}
+	}
+
+	// only admins see what everyone's been doing
+	var actions []*db.StaffAction
+	if staffUser(c).HasRole(fields.RoleAdmin) || localDevMode {
+		actions, err = db.GetStaffActions(7)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		for _, a := range actions {
+			a.Date = a.Date.In(sales.Eastern)
+		}
+	}
+
+	c.HTML(http.StatusOK, "rolesAdmin.html.tmpl", gin.H{
+		"flashes":    GetFlashes(c),
+		"Staff":      staff,
+		"Editing":    editing,
+		"Checked":    checked,
+		"Assignable": assignable,
+		"Actions":    actions,
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/sessionstore"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+func TestStaffRoleFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    db.User
+		allowed []string
+		want    string
+		ok      bool
+	}{
+		{"no roles", db.User{}, []string{fields.RoleCheckin}, "", false},
+		{"the role", db.User{Roles: []string{fields.RoleCheckin}}, []string{fields.RoleCheckin}, fields.RoleCheckin, true},
+		{"one of the roles", db.User{Roles: []string{fields.RoleLogistics}}, []string{fields.RoleCheckin, fields.RoleLogistics}, fields.RoleLogistics, true},
+		{"another role", db.User{Roles: []string{fields.RoleFinance}}, []string{fields.RoleCheckin}, "", false},
+		{"admin can do anything", db.User{Roles: []string{fields.RoleAdmin}}, []string{fields.RoleFinance}, fields.RoleAdmin, true},
+		{"their own role before admin", db.User{Roles: []string{fields.RoleAdmin, fields.RoleFinance}}, []string{fields.RoleFinance}, fields.RoleFinance, true},
+		{"staff ticket at check-in", db.User{AdmissionLevel: fields.Staff}, []string{fields.RoleCheckin}, fields.Staff, true},
+		{"staff ticket at admin", db.User{AdmissionLevel: fields.Staff}, []string{fields.RoleAdmin}, "", false},
+		{"staff ticket at finance", db.User{AdmissionLevel: fields.Staff}, []string{fields.RoleFinance}, "", false},
+		{"staff ticket at roles", db.User{AdmissionLevel: fields.Staff}, []string{fields.RoleVolunteerCoordinator}, "", false},
+		{"nothing allowed", db.User{Roles: []string{fields.RoleCheckin}}, nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, ok := staffRoleFor(&tt.user, tt.allowed...)
+			if role != tt.want || ok != tt.ok {
+				t.Errorf("staffRoleFor() = %q, %v, want %q, %v", role, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAssignableRoles(t *testing.T) {
+	tests := []struct {
+		role string
+		want []string
+	}{
+		{fields.RoleAdmin, db.StaffRoles},
+		{fields.RoleVolunteerCoordinator, []string{fields.RoleCheckin}},
+		{fields.RoleFinance, nil},
+		{fields.RoleCheckin, nil},
+		{fields.Staff, nil},
+	}
+
+	for _, tt := range tests {
+		if got := assignableRoles(tt.role); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("assignableRoles(%s) = %v, want %v", tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	s := dbtest.New(t)
+	s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "staff", fields.AdmissionLevel: fields.Staff})
+	s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "coordinator", fields.Roles: fields.RoleVolunteerCoordinator})
+	s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "admin", fields.Roles: fields.RoleAdmin})
+
+	store, err := sessionstore.New(t.TempDir(), sessionOwner, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(sessions.Sessions("session_id", store), func(c *gin.Context) {
+		sessions.Default(c).Set(sessionKey, Session{UserName: c.GetHeader("X-User")})
+	})
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/checkin/t1", requireRole(fields.RoleCheckin), ok)
+	r.GET("/admin/lottery", requireRole(fields.RoleAdmin), ok)
+	r.GET("/admin/sales", requireRole(fields.RoleFinance), ok)
+	r.GET("/admin/roles", requireRole(fields.RoleVolunteerCoordinator), ok)
+
+	tests := []struct {
+		user, path string
+		want       int
+	}{
+		{"staff", "/checkin/t1", http.StatusOK},
+		{"staff", "/admin/lottery", http.StatusForbidden},
+		{"staff", "/admin/sales", http.StatusForbidden},
+		{"staff", "/admin/roles", http.StatusForbidden},
+		{"coordinator", "/admin/roles", http.StatusOK},
+		{"coordinator", "/admin/sales", http.StatusForbidden},
+		{"admin", "/admin/sales", http.StatusOK},
+		{"admin", "/admin/roles", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("X-User", tt.user)
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("@%s at %s = %d, want %d", tt.user, tt.path, w.Code, tt.want)
+		}
+	}
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -13,9 +12,20 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/email"
+	"github.com/vibecamp/myvibecamp/fees"
 	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/hooks"
+	"github.com/vibecamp/myvibecamp/lottery"
+	"github.com/vibecamp/myvibecamp/receipt"
+	"github.com/vibecamp/myvibecamp/reconcile"
+	"github.com/vibecamp/myvibecamp/sales"
+	"github.com/vibecamp/myvibecamp/sessionstore"
+	"github.com/vibecamp/myvibecamp/stripe"
+	"github.com/vibecamp/myvibecamp/waitlist"
 
 	"github.com/cockroachdb/errors"
 	"github.com/gin-gonic/gin"
@@ -30,7 +40,7 @@ func IndexHandler(c *gin.Context) {
 		return
 	}
 
-	findUser(c, session.UserName, false)
+	findUser(c, session.UserName)
 }
 
 func VC2Welcome(c *gin.Context) {
@@ -41,32 +51,16 @@ func VC2Welcome(c *gin.Context) {
 			return
 		}
 
-		findUser(c, session.UserName, false)
+		findUser(c, session.UserName)
 		return
 	}
 
-	// I need to setup session stuff for this - oauth email?
-	// or just get user by email & handle the rest like their
-	// email is their twitter
-	// magic email links? not hard really but need a way to send emails
-
-	emailAddr := c.PostForm("email-address")
-	if !localDevMode && !strings.Contains(emailAddr, "@") {
-		// throw an error if it's not a valid email on prod
-		c.AbortWithError(http.StatusBadRequest, errors.New("must enter a valid email address"))
-		return
-	}
-
-	findUser(c, emailAddr, true)
+	sendSignInLink(c, "/vc2")
 }
 
-func findUser(c *gin.Context, username string, isEmailSignIn bool) {
+func findUser(c *gin.Context, username string) {
 	user, err := db.GetUser(username)
 	if err == nil && user != nil {
-		if isEmailSignIn {
-			makeEmailSession(c, user.UserName, user.AirtableID)
-		}
-
 		// if they have an order ID, check the order
 		if len(user.OrderID) > 0 {
 			order, err := db.GetOrder(user.OrderID)
@@ -76,7 +70,7 @@ func findUser(c *gin.Context, username string, isEmailSignIn bool) {
 				case "failed":
 					c.Redirect(http.StatusFound, "/checkout-failed")
 					return
-				case "success":
+				case "success", "partially_paid":
 					c.Redirect(http.StatusFound, "/vc2-ticket")
 					return
 				case "processing":
@@ -86,13 +80,19 @@ func findUser(c *gin.Context, username string, isEmailSignIn bool) {
 			} else {
 				// otherwise send them based on their ticket path to the cart
 				if user.TicketPath == "Sponsorship" {
-					c.Redirect(http.StatusFound, "/sponsorship-cart")
+					if salesOpen(c, fields.Sponsorship) {
+						c.Redirect(http.StatusFound, "/sponsorship-cart")
+					}
 					return
 				} else if user.TicketPath == "FCFS" || user.TicketPath == "Lottery" || user.TicketPath == "Application" || user.TicketPath == fields.LateApp {
-					c.Redirect(http.StatusFound, "/chaos-cart")
+					if salesOpen(c, user.TicketPath) {
+						c.Redirect(http.StatusFound, "/chaos-cart")
+					}
 					return
 				} else {
-					c.Redirect(http.StatusFound, "/ticket-cart")
+					if salesOpen(c, fields.Attendee2022) {
+						c.Redirect(http.StatusFound, "/ticket-cart")
+					}
 					return
 				}
 			}
@@ -113,30 +113,27 @@ func findUser(c *gin.Context, username string, isEmailSignIn bool) {
 	// check for sponsorship first, in case they're both on sponsorship and e.g. soft launch
 	sponsoredUser, err := db.GetSponsorshipUser(username)
 	if err == nil && sponsoredUser != nil {
-		if isEmailSignIn {
-			makeEmailSession(c, sponsoredUser.UserName, sponsoredUser.AirtableID)
+		if salesOpen(c, fields.Sponsorship) {
+			c.Redirect(http.StatusFound, "/sponsorship-cart")
 		}
-		c.Redirect(http.StatusFound, "/sponsorship-cart")
 		return
 	}
 
 	// check if they're a soft launch
 	softLaunchUser, err := db.GetSoftLaunchUser(username)
 	if err == nil && softLaunchUser != nil {
-		if isEmailSignIn {
-			makeEmailSession(c, softLaunchUser.UserName, softLaunchUser.AirtableID)
+		if salesOpen(c, fields.Attendee2022) {
+			c.Redirect(http.StatusFound, "/vc2-sl")
 		}
-		c.Redirect(http.StatusFound, "/vc2-sl")
 		return
 	}
 
 	// check if they're chaos user
 	chaosUser, err := db.GetChaosUser(username)
 	if err == nil && chaosUser != nil {
-		if isEmailSignIn {
-			makeEmailSession(c, chaosUser.UserName, chaosUser.AirtableID)
+		if salesOpen(c, chaosUser.Phase) {
+			c.Redirect(http.StatusFound, "/chaos-mode")
 		}
-		c.Redirect(http.StatusFound, "/chaos-mode")
 		return
 	}
 
@@ -149,7 +146,8 @@ func makeEmailSession(c *gin.Context, username string, id string) {
 	session.UserName = username
 	session.TwitterName = username
 	session.TwitterID = id
-	session.Oauth = nil
+	session.SignIn = nil
+	rotateSession(c)
 	SaveSession(c, session)
 }
 
@@ -257,19 +255,24 @@ func Transport2023Handler(c *gin.Context) {
 			busFromVibecamp = ""
 		}
 
-		params := url.Values{}
-		params.Set("busQuantity", strconv.Itoa(busQuantity))
-		params.Set("sleepingBags", strconv.Itoa(sleepingBags))
-		params.Set("pillows", strconv.Itoa(pillows))
-		params.Set("sheetSets", strconv.Itoa(sheetSets))
-		params.Set("busToVibecamp", busToVibecamp)
-		params.Set("busFromVibecamp", busFromVibecamp)
+		session.TransportCart = stripe.TransportCart{
+			BusSpots:        busQuantity,
+			BusToVibecamp:   busToVibecamp,
+			BusFromVibecamp: busFromVibecamp,
+			SleepingBags:    sleepingBags,
+			SheetSets:       sheetSets,
+			Pillows:         pillows,
+			CoverFees:       c.PostForm("coverFees") == "on",
+		}
+		SaveSession(c, session)
 
-		c.Redirect(http.StatusFound, "/transport-checkout"+"?"+params.Encode())
+		c.Redirect(http.StatusFound, "/transport-checkout")
 		return
 	}
 
-	c.HTML(http.StatusOK, "transport2023.html.tmpl", gin.H{})
+	c.HTML(http.StatusOK, "transport2023.html.tmpl", gin.H{
+		"Fees": fees.Current(),
+	})
 }
 
 func TransportCheckoutHandler(c *gin.Context) {
@@ -285,26 +288,12 @@ func TransportCheckoutHandler(c *gin.Context) {
 		return
 	}
 
-	busSpots, _ := strconv.Atoi(c.Query("busQuantity"))
-	busToVibecamp := c.Query("busToVibecamp")
-	busFromVibecamp := c.Query("busFromVibecamp")
-	sleepingBags, _ := strconv.Atoi(c.Query("sleepingBags"))
-	pillows, _ := strconv.Atoi(c.Query("pillows"))
-	sheetSets, _ := strconv.Atoi(c.Query("sheetSets"))
-	items := struct {
-		BusSpots        int    `json:"busSpots"`
-		BusToVibecamp   string `json:"busToVibecamp"`
-		BusFromVibecamp string `json:"busFromVibecamp"`
-		SleepingBags    int    `json:"sleepingBags"`
-		SheetSets       int    `json:"sheetSets"`
-		Pillows         int    `json:"pillows"`
-	}{
-		BusSpots:        busSpots,
-		BusToVibecamp:   busToVibecamp,
-		BusFromVibecamp: busFromVibecamp,
-		SleepingBags:    sleepingBags,
-		SheetSets:       sheetSets,
-		Pillows:         pillows,
+	// Transport2023Handler checked the cart and left it in the session, the page only shows it
+	items := session.TransportCart
+	if items == (stripe.TransportCart{}) {
+		ErrorFlash(c, "Your cart is empty")
+		c.Redirect(http.StatusFound, "/2023-transport")
+		return
 	}
 
 	// log.Debugf("%v", itemMap)
@@ -342,11 +331,15 @@ func TicketCartHandler(c *gin.Context) {
 		return
 	}
 
+	if !salesOpen(c, fields.Attendee2022) {
+		return
+	}
+
 	attendee, err := db.GetUser(session.UserName)
 	if err == nil && attendee != nil {
 		if attendee.OrderID != "" {
 			order, err := db.GetOrder(attendee.OrderID)
-			if err == nil && order != nil && order.PaymentStatus == "success" {
+			if err == nil && order != nil && order.TicketIssued() {
 				c.Redirect(http.StatusFound, "/2023-logistics")
 				return
 			}
@@ -357,6 +350,8 @@ func TicketCartHandler(c *gin.Context) {
 		c.HTML(http.StatusOK, "ticketCart.html.tmpl", gin.H{
 			"flashes": GetFlashes(c),
 			"User":    user,
+			"Discord": discordFieldFor(c, session, user.DiscordName),
+			"Fees":    fees.Current(),
 		})
 		return
 	}
@@ -373,6 +368,12 @@ func TicketCartHandler(c *gin.Context) {
 	}
 
 	totalTix := adultTix + childTix + toddlerTix
+	err = sales.Allowed(fields.Attendee2022, totalTix)
+	if err != nil {
+		ErrorFlash(c, err.Error())
+		c.Redirect(http.StatusFound, "/ticket-cart")
+		return
+	}
 	dbTicketType := ""
 
 	if adultTix > 0 {
@@ -399,8 +400,15 @@ func TicketCartHandler(c *gin.Context) {
 			return
 		}
 
-		if totalTix+cabinSold.Quantity > cabinCap.Value {
-			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many cabin tickets exceeds our cap! %d cabin tickets left.", cabinCap.Value-cabinSold.Quantity))
+		heldCabin, err := waitlist.Held(session.UserName, fields.CabinAdmission)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if totalTix+cabinSold.Quantity+heldCabin > cabinCap.Value {
+			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many cabin tickets exceeds our cap! %d cabin tickets left. Join the waitlist and we'll let you know if more open up.", ticketsLeft(cabinCap.Value, cabinSold.Quantity, heldCabin)))
+			c.Redirect(http.StatusFound, "/waitlist?level="+url.QueryEscape(fields.CabinAdmission))
 			return
 		}
 
@@ -423,8 +431,15 @@ func TicketCartHandler(c *gin.Context) {
 			return
 		}
 
-		if totalTix+fullTixSold.Quantity > salesCap.Value {
-			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our cap! %d tickets left.", salesCap.Value-fullTixSold.Quantity))
+		heldFull, err := waitlist.Held(session.UserName, fields.CabinAdmission, fields.TentAdmission)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if totalTix+fullTixSold.Quantity+heldFull > salesCap.Value {
+			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our cap! %d tickets left. Join the waitlist and we'll let you know if more open up.", ticketsLeft(salesCap.Value, fullTixSold.Quantity, heldFull)))
+			c.Redirect(http.StatusFound, "/waitlist?level="+url.QueryEscape(admissionLevel))
 			return
 		}
 	} else {
@@ -440,12 +455,20 @@ func TicketCartHandler(c *gin.Context) {
 			return
 		}
 
-		if totalTix+satSold.Quantity > satCap.Value {
-			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our Saturday night cap! %d Saturday tickets left.", satCap.Value-satSold.Quantity))
+		heldSat, err := waitlist.Held(session.UserName, fields.SatAdmission)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if totalTix+satSold.Quantity+heldSat > satCap.Value {
+			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our Saturday night cap! %d Saturday tickets left. Join the waitlist and we'll let you know if more open up.", ticketsLeft(satCap.Value, satSold.Quantity, heldSat)))
+			c.Redirect(http.StatusFound, "/waitlist?level="+url.QueryEscape(fields.SatAdmission))
 			return
 		}
 	}
 
+	discordID, discordName := discordFromForm(c, session)
 	newUser := &db.User{
 		AirtableID:         "",
 		UserName:           user.UserName,
@@ -465,7 +488,8 @@ func TicketCartHandler(c *gin.Context) {
 		GlutenFree:         c.PostForm("glutenfree") == "on",
 		LactoseIntolerant:  c.PostForm("lactose") == "on",
 		FoodComments:       c.PostForm("comments"),
-		DiscordName:        c.PostForm("discord-name"),
+		DiscordID:          discordID,
+		DiscordName:        discordName,
 		TicketPath:         "2022 Attendee",
 		SponsorshipConfirm: false,
 	}
@@ -486,14 +510,9 @@ func TicketCartHandler(c *gin.Context) {
 		}
 	}
 
-	params := url.Values{}
-	params.Set("ticketType", ticketType)
-	params.Set("adult", strconv.Itoa(adultTix))
-	params.Set("child", strconv.Itoa(childTix))
-	params.Set("toddler", strconv.Itoa(toddlerTix))
-	params.Set("donation", strconv.Itoa(donationAmount))
-
-	c.Redirect(http.StatusFound, "/checkout"+"?"+params.Encode())
+	session.Cart = ticketCart(ticketType, adultTix, childTix, toddlerTix, donationAmount)
+	SaveSession(c, session)
+	c.Redirect(http.StatusFound, "/checkout")
 }
 
 func SponsorshipCartHandler(c *gin.Context) {
@@ -516,11 +535,23 @@ func SponsorshipCartHandler(c *gin.Context) {
 		return
 	}
 
+	if !salesOpen(c, fields.Sponsorship) {
+		return
+	}
+
+	if !user.AwardOpen() {
+		ErrorFlash(c, "This sponsorship is no longer available. If that's a mistake, email us.")
+		c.HTML(http.StatusOK, "ticketSalesClosed.html.tmpl", gin.H{
+			"flashes": GetFlashes(c),
+		})
+		return
+	}
+
 	attendee, err := db.GetUser(session.UserName)
 	if err == nil && attendee != nil {
 		if attendee.OrderID != "" {
 			order, err := db.GetOrder(attendee.OrderID)
-			if err == nil && order != nil && order.PaymentStatus == "success" {
+			if err == nil && order != nil && order.TicketIssued() {
 				c.Redirect(http.StatusFound, "/checkout-complete")
 				return
 			}
@@ -528,70 +559,82 @@ func SponsorshipCartHandler(c *gin.Context) {
 		}
 	}
 
-	adultTix := 1
-	dbTicketType := "Adult"
-	admissionLevel := user.AdmissionLevel
-	var basePrice float64
-	var ticketType string
-	if admissionLevel == "Tent" {
-		basePrice = float64(420.69)
-		ticketType = "tent"
-
-		salesCap, err := db.GetConstant(fields.SalesCap)
+	if c.Request.Method == http.MethodPost && c.PostForm("decline") != "" {
+		err = user.UpdateAwardStatus(fields.AwardDeclined)
 		if err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
-		fullTixSold, err := db.GetAggregation(fields.FullSold)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		}
+		SuccessFlash(c, "Thanks for letting us know. We'll pass your sponsorship on to someone else.")
+		c.HTML(http.StatusOK, "ticketSalesClosed.html.tmpl", gin.H{
+			"flashes": GetFlashes(c),
+		})
+		return
+	}
 
-		if adultTix+fullTixSold.Quantity > salesCap.Value {
-			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our cap! %d tickets left.", salesCap.Value-fullTixSold.Quantity))
-			return
-		}
-	} else {
-		basePrice = float64(140)
-		ticketType = "sat"
+	adultTix, _ := strconv.Atoi(c.Query("quantity"))
+	if c.Request.Method == http.MethodPost {
+		adultTix, _ = strconv.Atoi(c.PostForm("adult-tickets"))
+	}
+	if adultTix < 1 {
+		adultTix = 1
+	} else if adultTix > user.TicketLimit {
+		ErrorFlash(c, fmt.Sprintf("You're limited to %d sponsored tickets", user.TicketLimit))
+		adultTix = user.TicketLimit
+	}
 
-		satCap, err := db.GetConstant(fields.SatCap)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		}
+	err = sales.Allowed(fields.Sponsorship, adultTix)
+	if err != nil {
+		ErrorFlash(c, err.Error())
+		c.HTML(http.StatusOK, "ticketSalesClosed.html.tmpl", gin.H{
+			"flashes": GetFlashes(c),
+		})
+		return
+	}
 
-		satTixSold, err := db.GetAggregation(fields.SatSold)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		}
+	dbTicketType := "Adult"
+	admissionLevel := user.AdmissionLevel
+	var ticketType string
+	switch admissionLevel {
+	case fields.CabinAdmission:
+		ticketType = "cabin"
+	case fields.TentAdmission:
+		ticketType = "tent"
+	default:
+		ticketType = "sat"
+	}
 
-		if adultTix+satTixSold.Quantity > satCap.Value {
-			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our cap! %d tickets left.", satCap.Value-satTixSold.Quantity))
-			return
-		}
+	if !checkCapacity(c, session.UserName, admissionLevel, adultTix) {
+		return
 	}
 
-	subtotalFloat := basePrice - user.Discount.ToFloat()
-	feeFloat := subtotalFloat * float64(0.03)
-	subtotal := db.CurrencyFromFloat(subtotalFloat)
-	total := db.CurrencyFromFloat(subtotalFloat + feeFloat)
-	fee := db.CurrencyFromFloat(feeFloat)
+	order := stripe.SponsoredOrder(*user, adultTix, true)
+	subtotal := db.CurrencyFromFloat(order.Total.ToFloat() - order.ProcessingFee.ToFloat())
 
 	if c.Request.Method == http.MethodGet {
+		quantities := make([]int, 0, user.TicketLimit)
+		for q := 1; q <= user.TicketLimit; q++ {
+			quantities = append(quantities, q)
+		}
+
 		c.HTML(http.StatusOK, "sponsorshipCart.html.tmpl", gin.H{
-			"flashes":  GetFlashes(c),
-			"User":     user,
-			"Total":    total,
-			"Fee":      fee,
-			"Subtotal": subtotal,
+			"flashes":    GetFlashes(c),
+			"User":       user,
+			"Discord":    discordFieldFor(c, session, ""),
+			"Quantity":   adultTix,
+			"Quantities": quantities,
+			"Price":      db.CurrencyFromFloat((subtotal.ToFloat() + order.Discount.ToFloat()) / float64(adultTix)),
+			"Discount":   order.Discount,
+			"Total":      order.Total,
+			"Fee":        order.ProcessingFee,
+			"Subtotal":   subtotal,
+			"Comp":       order.Total.ToCurrencyInt() == 0,
 		})
 		return
 	}
 
+	discordID, discordName := discordFromForm(c, session)
 	newUser := &db.User{
 		AirtableID:         "",
 		UserName:           user.UserName,
@@ -611,7 +654,8 @@ func SponsorshipCartHandler(c *gin.Context) {
 		GlutenFree:         c.PostForm("glutenfree") == "on",
 		LactoseIntolerant:  c.PostForm("lactose") == "on",
 		FoodComments:       c.PostForm("comments"),
-		DiscordName:        c.PostForm("discord-name"),
+		DiscordID:          discordID,
+		DiscordName:        discordName,
 		TicketPath:         "Sponsorship",
 	}
 
@@ -631,14 +675,82 @@ func SponsorshipCartHandler(c *gin.Context) {
 		}
 	}
 
-	params := url.Values{}
-	params.Set("ticketType", ticketType)
-	params.Set("adult", strconv.Itoa(adultTix))
-	params.Set("child", "0")
-	params.Set("toddler", "0")
-	params.Set("donation", "0")
+	if user.AwardStatus == fields.AwardOffered {
+		err = user.UpdateAwardStatus(fields.AwardAccepted)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// full comps don't need to pay, so they skip stripe
+	if order.Total.ToCurrencyInt() == 0 {
+		err = stripe.CompOrder(order, newUser)
+		if errors.Is(err, stripe.ErrAlreadyOrdered) {
+			c.Redirect(http.StatusFound, "/checkout-complete")
+			return
+		} else if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Redirect(http.StatusFound, "/checkout-complete")
+		return
+	}
+
+	session.Cart = ticketCart(ticketType, adultTix, 0, 0, 0)
+	SaveSession(c, session)
+	c.Redirect(http.StatusFound, "/checkout")
+}
+
+// checkCapacity flashes and sends them to the waitlist when quantity more tickets at level would go over a cap
+func checkCapacity(c *gin.Context, userName, level string, quantity int) bool {
+	type capCheck struct {
+		cap, sold string
+		held      []string
+		what      string
+	}
+
+	var checks []capCheck
+	switch level {
+	case fields.CabinAdmission:
+		checks = []capCheck{
+			{fields.CabinCap, fields.CabinSold, []string{fields.CabinAdmission}, "cabin tickets"},
+			{fields.SalesCap, fields.FullSold, []string{fields.CabinAdmission, fields.TentAdmission}, "tickets"},
+		}
+	case fields.TentAdmission:
+		checks = []capCheck{{fields.SalesCap, fields.FullSold, []string{fields.CabinAdmission, fields.TentAdmission}, "tickets"}}
+	default:
+		checks = []capCheck{{fields.SatCap, fields.SatSold, []string{fields.SatAdmission}, "Saturday tickets"}}
+	}
+
+	for _, check := range checks {
+		capConst, err := db.GetConstant(check.cap)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+
+		sold, err := db.GetAggregation(check.sold)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+
+		held, err := waitlist.Held(userName, check.held...)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return false
+		}
+
+		if quantity+sold.Quantity+held > capConst.Value {
+			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our cap! %d %s left. Join the waitlist and we'll let you know if more open up.", ticketsLeft(capConst.Value, sold.Quantity, held), check.what))
+			c.Redirect(http.StatusFound, "/waitlist?level="+url.QueryEscape(level))
+			return false
+		}
+	}
 
-	c.Redirect(http.StatusFound, "/checkout"+"?"+params.Encode())
+	return true
 }
 
 func SoftLaunchSignIn(c *gin.Context) {
@@ -667,33 +779,7 @@ func SoftLaunchSignIn(c *gin.Context) {
 		return
 	}
 
-	// I need to setup session stuff for this - oauth email?
-	// or just get user by email & handle the rest like their
-	// email is their twitter
-	// magic email links? not hard really but need a way to send emails
-
-	emailAddr := c.PostForm("email-address")
-	if !localDevMode && !strings.Contains(emailAddr, "@") {
-		// throw an error if it's not a valid email on prod
-		c.AbortWithError(http.StatusBadRequest, errors.New("must enter a valid email address"))
-		return
-	}
-
-	// get user by email somehow
-	user, err := db.GetSoftLaunchUser(emailAddr)
-	// then return the same page
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
-	}
-
-	session.UserName = user.UserName
-	session.TwitterName = user.UserName
-	session.TwitterID = user.AirtableID
-	session.Oauth = nil
-	SaveSession(c, session)
-
-	c.HTML(http.StatusOK, "softLaunchSignIn.html.tmpl", user)
+	sendSignInLink(c, "/vc2-sl")
 }
 
 func ChaosModeSignIn(c *gin.Context) {
@@ -711,39 +797,18 @@ func ChaosModeSignIn(c *gin.Context) {
 			return
 		}
 
-		c.HTML(http.StatusOK, "chaosSignIn.html.tmpl", user)
-		return
-	}
-
-	emailAddr := c.PostForm("email-address")
-	if !localDevMode && !strings.Contains(emailAddr, "@") {
-		// throw an error if it's not a valid email on prod
-		c.AbortWithError(http.StatusBadRequest, errors.New("must enter a valid email address"))
-		return
-	}
-
-	// get user by email somehow
-	user, err := db.GetChaosUser(emailAddr)
-	// then return the same page
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
-	}
-
-	session.UserName = user.UserName
-	session.TwitterName = user.UserName
-	session.TwitterID = user.AirtableID
-	session.Oauth = nil
-	SaveSession(c, session)
+		if user.TicketLimit < 1 {
+			c.HTML(http.StatusOK, "ticketSalesClosed.html.tmpl", gin.H{
+				"flashes": GetFlashes(c),
+			})
+			return
+		}
 
-	if user.TicketLimit < 1 {
-		c.HTML(http.StatusOK, "ticketSalesClosed.html.tmpl", gin.H{
-			"flashes": GetFlashes(c),
-		})
+		c.HTML(http.StatusOK, "chaosSignIn.html.tmpl", user)
 		return
 	}
 
-	c.HTML(http.StatusOK, "chaosSignIn.html.tmpl", user)
+	sendSignInLink(c, "/chaos-mode")
 }
 
 func ChaosModeCartHandler(c *gin.Context) {
@@ -766,11 +831,15 @@ func ChaosModeCartHandler(c *gin.Context) {
 		return
 	}
 
+	if !salesOpen(c, user.Phase) {
+		return
+	}
+
 	attendee, err := db.GetUser(session.UserName)
 	if err == nil && attendee != nil {
 		if attendee.OrderID != "" {
 			order, err := db.GetOrder(attendee.OrderID)
-			if err == nil && order != nil && order.PaymentStatus == "success" {
+			if err == nil && order != nil && order.TicketIssued() {
 				c.Redirect(http.StatusFound, "/checkout-complete")
 				return
 			}
@@ -781,6 +850,8 @@ func ChaosModeCartHandler(c *gin.Context) {
 		c.HTML(http.StatusOK, "hardLaunchCart.html.tmpl", gin.H{
 			"flashes": GetFlashes(c),
 			"User":    user,
+			"Discord": discordFieldFor(c, session, ""),
+			"Fees":    fees.Current(),
 		})
 		return
 	}
@@ -798,6 +869,12 @@ func ChaosModeCartHandler(c *gin.Context) {
 	}
 
 	totalTix := adultTix + childTix + toddlerTix
+	err = sales.Allowed(user.Phase, totalTix)
+	if err != nil {
+		ErrorFlash(c, err.Error())
+		c.Redirect(http.StatusFound, "/chaos-cart")
+		return
+	}
 	dbTicketType := ""
 
 	if adultTix > 0 {
@@ -824,9 +901,16 @@ func ChaosModeCartHandler(c *gin.Context) {
 			return
 		}
 
-		if totalTix+cabinSold.Quantity > cabinCap.Value {
+		heldCabin, err := waitlist.Held(session.UserName, fields.CabinAdmission)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if totalTix+cabinSold.Quantity+heldCabin > cabinCap.Value {
 			log.Errorf("cabin ticket limit exceeded %d", totalTix+cabinSold.Quantity)
-			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many cabin tickets exceeds our cap! %d cabin tickets left.", cabinCap.Value-cabinSold.Quantity))
+			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many cabin tickets exceeds our cap! %d cabin tickets left. Join the waitlist and we'll let you know if more open up.", ticketsLeft(cabinCap.Value, cabinSold.Quantity, heldCabin)))
+			c.Redirect(http.StatusFound, "/waitlist?level="+url.QueryEscape(fields.CabinAdmission))
 			return
 		}
 
@@ -849,9 +933,16 @@ func ChaosModeCartHandler(c *gin.Context) {
 			return
 		}
 
-		if totalTix+fullTixSold.Quantity > salesCap.Value {
+		heldFull, err := waitlist.Held(session.UserName, fields.CabinAdmission, fields.TentAdmission)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if totalTix+fullTixSold.Quantity+heldFull > salesCap.Value {
 			log.Errorf("total ticket limit exceeded %d", totalTix+fullTixSold.Quantity)
-			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our cap! %d tickets left.", salesCap.Value-fullTixSold.Quantity))
+			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our cap! %d tickets left. Join the waitlist and we'll let you know if more open up.", ticketsLeft(salesCap.Value, fullTixSold.Quantity, heldFull)))
+			c.Redirect(http.StatusFound, "/waitlist?level="+url.QueryEscape(admissionLevel))
 			return
 		}
 	} else {
@@ -867,13 +958,21 @@ func ChaosModeCartHandler(c *gin.Context) {
 			return
 		}
 
-		if totalTix+satSold.Quantity > satCap.Value {
+		heldSat, err := waitlist.Held(session.UserName, fields.SatAdmission)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if totalTix+satSold.Quantity+heldSat > satCap.Value {
 			log.Errorf("saturday ticket limit exceeded %d", totalTix+satSold.Quantity)
-			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our Saturday night cap! %d Saturday tickets left.", satCap.Value-satSold.Quantity))
+			ErrorFlash(c, fmt.Sprintf("Sorry, buying that many tickets exceeds our Saturday night cap! %d Saturday tickets left. Join the waitlist and we'll let you know if more open up.", ticketsLeft(satCap.Value, satSold.Quantity, heldSat)))
+			c.Redirect(http.StatusFound, "/waitlist?level="+url.QueryEscape(fields.SatAdmission))
 			return
 		}
 	}
 
+	discordID, discordName := discordFromForm(c, session)
 	newUser := &db.User{
 		AirtableID:         "",
 		UserName:           user.UserName,
@@ -893,7 +992,8 @@ func ChaosModeCartHandler(c *gin.Context) {
 		GlutenFree:         c.PostForm("glutenfree") == "on",
 		LactoseIntolerant:  c.PostForm("lactose") == "on",
 		FoodComments:       c.PostForm("comments"),
-		DiscordName:        c.PostForm("discord-name"),
+		DiscordID:          discordID,
+		DiscordName:        discordName,
 		TicketPath:         user.Phase,
 	}
 
@@ -913,109 +1013,747 @@ func ChaosModeCartHandler(c *gin.Context) {
 		}
 	}
 
-	params := url.Values{}
-	params.Set("ticketType", ticketType)
-	params.Set("adult", strconv.Itoa(adultTix))
-	params.Set("child", strconv.Itoa(childTix))
-	params.Set("toddler", strconv.Itoa(toddlerTix))
-	params.Set("donation", strconv.Itoa(donationAmount))
-
-	c.Redirect(http.StatusFound, "/checkout"+"?"+params.Encode())
+	session.Cart = ticketCart(ticketType, adultTix, childTix, toddlerTix, donationAmount)
+	SaveSession(c, session)
+	c.Redirect(http.StatusFound, "/checkout")
 }
 
-func SignInRedirect(c *gin.Context) {
-	session := GetSession(c)
-	if !session.SignedIn() {
-		c.Redirect(http.StatusFound, "/")
-		return
+// salesOpen renders the countdown or closed page and returns false when a ticket path isn't selling right now
+func salesOpen(c *gin.Context, ticketPath string) bool {
+	phase, state := sales.Phase(ticketPath)
+	switch state {
+	case sales.Upcoming:
+		c.HTML(http.StatusOK, "salesCountdown.html.tmpl", gin.H{
+			"Phase":   phase,
+			"Opens":   phase.Opens.In(sales.Eastern),
+			"OpensAt": phase.Opens.UnixMilli(),
+		})
+		return false
+	case sales.Closed, sales.SoldOut:
+		c.HTML(http.StatusOK, "ticketSalesClosed.html.tmpl", gin.H{
+			"flashes": GetFlashes(c),
+			"Phase":   phase,
+			"SoldOut": state == sales.SoldOut,
+		})
+		return false
 	}
-
-	findUser(c, session.UserName, false)
+	return true
 }
 
-func StripeCheckoutHandler(c *gin.Context) {
-	session := GetSession(c)
-	if !session.SignedIn() {
-		c.Redirect(http.StatusFound, "/")
-		return
+// ticketsLeft is what's shown to buyers, so it never goes below zero
+func ticketsLeft(capacity, sold, held int) int {
+	left := capacity - sold - held
+	if left < 0 {
+		return 0
 	}
+	return left
+}
 
-	user, err := db.GetUser(session.UserName)
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
+// guestListContact finds a user's name, email and ticket limit in whichever guest list they're on
+func guestListContact(username string) (name string, email string, ticketLimit int, err error) {
+	chaosUser, err := db.GetChaosUser(username)
+	if err == nil && chaosUser != nil {
+		return chaosUser.Name, chaosUser.Email, chaosUser.TicketLimit, nil
 	}
 
-	ticketIds := []string{"adult", "child", "toddler", "donation"}
-	ticketType := c.Query("ticketType")
-	var items []db.Item
-	for ind, element := range ticketIds {
-		amt, _ := strconv.Atoi(c.Query(element))
-		if amt > 0 {
-			if ind < 3 {
-				items = append(items, db.Item{
-					Id:       element + "-" + ticketType,
-					Quantity: amt,
-					Amount:   0,
-				})
-			} else {
-				items = append(items, db.Item{
-					Id:       ticketIds[ind],
-					Quantity: 1,
-					Amount:   amt,
-				})
-			}
-		}
+	softLaunchUser, err := db.GetSoftLaunchUser(username)
+	if err == nil && softLaunchUser != nil {
+		return softLaunchUser.Name, softLaunchUser.Email, softLaunchUser.TicketLimit, nil
 	}
 
-	// log.Debugf("%v", items)
-	itemMap := struct {
-		Items []db.Item `json:"items"`
-	}{
-		Items: items,
+	sponsoredUser, err := db.GetSponsorshipUser(username)
+	if err == nil && sponsoredUser != nil {
+		return sponsoredUser.Name, sponsoredUser.Email, sponsoredUser.TicketLimit, nil
 	}
-	// log.Debugf("%v", itemMap)
-	itemJson, err := json.Marshal(itemMap)
-	if err != nil {
-		log.Errorf("%v", err)
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
+
+	user, err := db.GetUser(username)
+	if err == nil && user != nil {
+		return user.Name, user.Email, 1, nil
 	}
-	// log.Debugf(string(itemJson))
 
-	c.HTML(http.StatusOK, "checkout.html.tmpl", gin.H{
-		"User":      user,
-		"Items":     string(itemJson),
-		"OrderType": "Purchase",
-		"UserType":  user.TicketPath,
-	})
+	return "", "", 0, err
 }
 
-func PurchaseCompleteHandler(c *gin.Context) {
+func WaitlistHandler(c *gin.Context) {
 	session := GetSession(c)
 	if !session.SignedIn() {
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
 
-	user, err := db.GetUser(session.UserName)
+	name, email, ticketLimit, err := guestListContact(session.UserName)
 	if err != nil {
 		c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
 
-	order, err := db.GetOrderByPaymentID(c.Query("payment_id"))
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+	if c.Request.Method == http.MethodGet {
+		entries, err := db.GetWaitlistEntries(session.UserName)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.HTML(http.StatusOK, "waitlist.html.tmpl", gin.H{
+			"flashes":     GetFlashes(c),
+			"UserName":    session.UserName,
+			"Entries":     entries,
+			"Levels":      waitlist.Levels,
+			"Level":       c.Query("level"),
+			"TicketLimit": ticketLimit,
+		})
 		return
 	}
 
-	c.HTML(http.StatusOK, "purchaseComplete.html.tmpl", gin.H{
-		"User":  user,
-		"Order": order,
+	if cancelID := c.PostForm("cancel"); cancelID != "" {
+		err = waitlist.Leave(session.UserName, cancelID)
+		if err != nil {
+			ErrorFlash(c, err.Error())
+		} else {
+			SuccessFlash(c, "You've left the waitlist")
+		}
+		c.Redirect(http.StatusFound, "/waitlist")
+		return
+	}
+
+	quantity, _ := strconv.Atoi(c.PostForm("quantity"))
+	if quantity < 1 || quantity > ticketLimit {
+		ErrorFlash(c, fmt.Sprintf("You can wait for between 1 and %d tickets", ticketLimit))
+		c.Redirect(http.StatusFound, "/waitlist")
+		return
+	}
+
+	entry := &db.WaitlistEntry{
+		UserName:       session.UserName,
+		Name:           name,
+		Email:          email,
+		AdmissionLevel: c.PostForm("admission-level"),
+		Quantity:       quantity,
+	}
+
+	err = waitlist.Join(entry)
+	if err != nil {
+		ErrorFlash(c, err.Error())
+		c.Redirect(http.StatusFound, "/waitlist")
+		return
+	}
+
+	// there may already be room for them
+	go waitlist.Process()
+
+	SuccessFlash(c, "You're on the waitlist! We'll email you if tickets open up.")
+	c.Redirect(http.StatusFound, "/waitlist")
+}
+
+func WaitlistOfferHandler(c *gin.Context) {
+	entry, err := db.GetWaitlistOffer(c.Param("token"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	session := GetSession(c)
+	if !entry.OfferActive() {
+		if session.SignedIn() {
+			ErrorFlash(c, "That waitlist offer has expired.")
+			c.Redirect(http.StatusFound, "/waitlist")
+			return
+		}
+		c.AbortWithError(http.StatusBadRequest, errors.New("That waitlist offer has expired."))
+		return
+	}
+
+	if session.SignedIn() && strings.EqualFold(session.UserName, entry.UserName) {
+		findUser(c, session.UserName)
+		return
+	}
+
+	c.HTML(http.StatusOK, "waitlist.html.tmpl", gin.H{
+		"Offer": entry,
+	})
+}
+
+func LotteryHandler(c *gin.Context) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	entry, err := db.GetLotteryEntry(session.UserName)
+	if err != nil && !errors.Is(err, db.ErrNoRecords) {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if c.Request.Method == http.MethodGet {
+		draws, err := db.GetLotteryDraws()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		open, err := lottery.OpenRound()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		name, email, _, _ := guestListContact(session.UserName)
+		c.HTML(http.StatusOK, "lottery.html.tmpl", gin.H{
+			"flashes":    GetFlashes(c),
+			"UserName":   session.UserName,
+			"Name":       name,
+			"Email":      email,
+			"Entry":      entry,
+			"Draws":      draws,
+			"Open":       open,
+			"Levels":     waitlist.Levels,
+			"MaxTickets": lottery.TicketLimit(),
+		})
+		return
+	}
+
+	if entry != nil {
+		ErrorFlash(c, "You've already entered the lottery")
+		c.Redirect(http.StatusFound, "/lottery")
+		return
+	}
+
+	emailAddr := c.PostForm("email-address")
+	if !strings.Contains(emailAddr, "@") {
+		ErrorFlash(c, "We need a valid email address to tell you if you win")
+		c.Redirect(http.StatusFound, "/lottery")
+		return
+	}
+
+	admissionLevel := c.PostForm("admission-level")
+	if !contains(waitlist.Levels, admissionLevel) {
+		ErrorFlash(c, "Pick a ticket type")
+		c.Redirect(http.StatusFound, "/lottery")
+		return
+	}
+
+	ticketLimit := lottery.TicketLimit()
+	quantity, _ := strconv.Atoi(c.PostForm("quantity"))
+	if quantity < 1 || quantity > ticketLimit {
+		ErrorFlash(c, fmt.Sprintf("You can enter for 1 to %d adult tickets", ticketLimit))
+		c.Redirect(http.StatusFound, "/lottery")
+		return
+	}
+
+	// 2022 attendees are on the soft launch list, and applicants are in the chaos mode table on an application path
+	returning, _ := db.GetSoftLaunchUser(session.UserName)
+	applicant, _ := db.GetChaosUser(session.UserName)
+
+	entry = &db.LotteryEntry{
+		UserName:       session.UserName,
+		Name:           c.PostForm("name"),
+		Email:          emailAddr,
+		AdmissionLevel: admissionLevel,
+		Quantity:       quantity,
+		Returning:      returning != nil,
+		Applied:        applicant != nil && (applicant.Phase == fields.Application || applicant.Phase == fields.LateApp),
+	}
+
+	err = lottery.Enter(entry)
+	if errors.Is(err, lottery.ErrEntriesClosed) {
+		ErrorFlash(c, "Entries are closed while the lottery is drawn")
+		c.Redirect(http.StatusFound, "/lottery")
+		return
+	} else if errors.Is(err, lottery.ErrAlreadyEntered) {
+		ErrorFlash(c, "You've already entered the lottery")
+		c.Redirect(http.StatusFound, "/lottery")
+		return
+	} else if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	SuccessFlash(c, "You're in the lottery! We'll email you when it's drawn.")
+	c.Redirect(http.StatusFound, "/lottery")
+}
+
+func LotteryAdminHandler(c *gin.Context) {
+	user := staffUser(c)
+
+	if c.Request.Method == http.MethodGet {
+		entries, err := db.GetLotteryEntriesByStatus(fields.LotteryEntered)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		draws, err := db.GetLotteryDraws()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		open, err := lottery.OpenRound()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		// drawn rounds with entries still waiting for their result
+		drawn := map[string]bool{}
+		for _, d := range draws {
+			drawn[d.Round] = d.Status == fields.DrawDrawn
+		}
+		unapplied := map[string]bool{}
+		for _, e := range entries {
+			if drawn[e.Round] {
+				unapplied[e.Round] = true
+			}
+		}
+
+		c.HTML(http.StatusOK, "lotteryAdmin.html.tmpl", gin.H{
+			"flashes":   GetFlashes(c),
+			"Entries":   entries,
+			"Draws":     draws,
+			"Open":      open,
+			"Unapplied": unapplied,
+		})
+		return
+	}
+
+	switch c.PostForm("action") {
+	case "abort":
+		draw, err := lottery.Abort()
+		if err != nil {
+			ErrorFlash(c, err.Error())
+			c.Redirect(http.StatusFound, "/admin/lottery")
+			return
+		}
+
+		staffDetails(c, "aborted round %s", draw.Round)
+		SuccessFlash(c, fmt.Sprintf("Aborted round %s. Its entries can be committed to a new round.", draw.Round))
+		c.Redirect(http.StatusFound, "/admin/lottery")
+		return
+	case "reapply":
+		round := c.PostForm("round")
+		result, err := lottery.Reapply(round)
+		if err != nil {
+			ErrorFlash(c, err.Error())
+			c.Redirect(http.StatusFound, "/admin/lottery")
+			return
+		}
+
+		staffDetails(c, "applied round %s again", round)
+		SuccessFlash(c, fmt.Sprintf("Applied round %s again, result hash %s.", round, result.ResultHash))
+		c.Redirect(http.StatusFound, "/admin/lottery")
+		return
+	case "commit":
+		winners, err := strconv.Atoi(c.PostForm("winners"))
+		if err != nil || winners < 1 {
+			ErrorFlash(c, "Number of winners must be a positive number")
+			c.Redirect(http.StatusFound, "/admin/lottery")
+			return
+		}
+
+		draw, err := lottery.Commit(strings.TrimSpace(c.PostForm("round")), strings.TrimSpace(c.PostForm("source")), winners)
+		if err != nil {
+			ErrorFlash(c, err.Error())
+			c.Redirect(http.StatusFound, "/admin/lottery")
+			return
+		}
+
+		staffDetails(c, "committed round %s to %d entries, entries hash %s", draw.Round, draw.Entries, draw.EntriesHash)
+		SuccessFlash(c, fmt.Sprintf("Committed round %s. Publish the entries hash and seed commitment, then draw once %s is out.", draw.Round, draw.SeedSource))
+		c.Redirect(http.StatusFound, "/admin/lottery")
+		return
+	}
+
+	result, err := lottery.Run(strings.TrimSpace(c.PostForm("beacon")))
+	if err != nil {
+		ErrorFlash(c, err.Error())
+		c.Redirect(http.StatusFound, "/admin/lottery")
+		return
+	}
+
+	log.Infof("lottery run by %s", user.UserName)
+	SuccessFlash(c, fmt.Sprintf("Drew %d winners from %d entries. Result hash %s. Winners are being added now.", result.Winners, len(result.Order), result.ResultHash))
+	c.Redirect(http.StatusFound, "/admin/lottery")
+}
+
+type salesPhaseRow struct {
+	Name   string
+	Phase  *db.SalesPhase
+	State  string
+	Opens  string
+	Closes string
+}
+
+// datetime-local inputs are in eastern time
+const phaseInputFormat = "2006-01-02T15:04"
+
+func SalesAdminHandler(c *gin.Context) {
+	user := staffUser(c)
+
+	if c.Request.Method == http.MethodGet {
+		err := sales.Refresh()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		rows := make([]salesPhaseRow, 0, len(sales.Paths))
+		for _, path := range sales.Paths {
+			phase, state := sales.Phase(path)
+			row := salesPhaseRow{Name: path, Phase: phase, State: state}
+			if phase != nil {
+				if !phase.Opens.IsZero() {
+					row.Opens = phase.Opens.In(sales.Eastern).Format(phaseInputFormat)
+				}
+				if !phase.Closes.IsZero() {
+					row.Closes = phase.Closes.In(sales.Eastern).Format(phaseInputFormat)
+				}
+			}
+			rows = append(rows, row)
+		}
+
+		events, err := db.GetSalesPhaseEvents()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.HTML(http.StatusOK, "salesAdmin.html.tmpl", gin.H{
+			"flashes": GetFlashes(c),
+			"Phases":  rows,
+			"Events":  events,
+		})
+		return
+	}
+
+	var opens, closes time.Time
+	var err error
+	if v := c.PostForm("opens"); v != "" {
+		opens, err = time.ParseInLocation(phaseInputFormat, v, sales.Eastern)
+		if err != nil {
+			ErrorFlash(c, "Couldn't read the open time")
+			c.Redirect(http.StatusFound, "/admin/sales")
+			return
+		}
+	}
+	if v := c.PostForm("closes"); v != "" {
+		closes, err = time.ParseInLocation(phaseInputFormat, v, sales.Eastern)
+		if err != nil {
+			ErrorFlash(c, "Couldn't read the close time")
+			c.Redirect(http.StatusFound, "/admin/sales")
+			return
+		}
+	}
+
+	capacity, _ := strconv.Atoi(c.PostForm("cap"))
+	if capacity < 0 {
+		capacity = 0
+	}
+
+	err = sales.Reschedule(c.PostForm("phase"), opens, closes, capacity, user.UserName)
+	if err != nil {
+		ErrorFlash(c, err.Error())
+		c.Redirect(http.StatusFound, "/admin/sales")
+		return
+	}
+
+	SuccessFlash(c, fmt.Sprintf("%s rescheduled", c.PostForm("phase")))
+	c.Redirect(http.StatusFound, "/admin/sales")
+}
+
+// discordField is what the discord part of the logistics form shows
+type discordField struct {
+	Name     string
+	Verified bool
+	Next     string
+}
+
+// verifiedDiscord is the discord account they've linked, this session or before
+func verifiedDiscord(session *Session) (id, name string) {
+	if session.DiscordID != "" {
+		return session.DiscordID, session.DiscordName
+	}
+
+	user, err := db.GetUser(session.UserName)
+	if err == nil && user.DiscordID != "" {
+		return user.DiscordID, user.DiscordName
+	}
+	return "", ""
+}
+
+// discordFieldFor shows their verified discord account if they have one, otherwise what they typed before
+func discordFieldFor(c *gin.Context, session *Session, typed string) discordField {
+	id, name := verifiedDiscord(session)
+	if id == "" {
+		return discordField{Name: typed, Next: c.Request.URL.Path}
+	}
+	return discordField{Name: name, Verified: true, Next: c.Request.URL.Path}
+}
+
+// discordFromForm is their verified discord account if they have one, otherwise the name they typed
+func discordFromForm(c *gin.Context, session *Session) (id, name string) {
+	id, name = verifiedDiscord(session)
+	if id == "" {
+		name = c.PostForm("discord-name")
+	}
+	return id, name
+}
+
+func SignInRedirect(c *gin.Context) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	findUser(c, session.UserName)
+}
+
+func StripeCheckoutHandler(c *gin.Context) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	user, err := db.GetUser(session.UserName)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	// the cart handlers checked the cart and left it in the session, the page only shows it
+	items := session.Cart
+	if len(items) == 0 {
+		ErrorFlash(c, "Your cart is empty")
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	// log.Debugf("%v", items)
+	itemMap := struct {
+		Items []db.Item `json:"items"`
+	}{
+		Items: items,
+	}
+	// log.Debugf("%v", itemMap)
+	itemJson, err := json.Marshal(itemMap)
+	if err != nil {
+		log.Errorf("%v", err)
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	// log.Debugf(string(itemJson))
+
+	c.HTML(http.StatusOK, "checkout.html.tmpl", gin.H{
+		"User":      user,
+		"Items":     string(itemJson),
+		"OrderType": "Purchase",
+		"UserType":  user.TicketPath,
+		"Fees":      fees.Current(),
+	})
+}
+
+// ticketCart is the items for a ticket order of one admission level, ticketType being cabin, tent or sat
+func ticketCart(ticketType string, adult, child, toddler, donation int) []db.Item {
+	var items []db.Item
+	for _, t := range []struct {
+		age      string
+		quantity int
+	}{{"adult", adult}, {"child", child}, {"toddler", toddler}} {
+		if t.quantity > 0 {
+			items = append(items, db.Item{Id: t.age + "-" + ticketType, Quantity: t.quantity})
+		}
+	}
+	if donation > 0 {
+		items = append(items, db.Item{Id: "donation", Quantity: 1, Amount: donation})
+	}
+	return items
+}
+
+// CreatePaymentIntentHandler opens a payment for the signed in user's checkout
+func CreatePaymentIntentHandler(c *gin.Context) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in to check out"})
+		return
+	}
+
+	stripe.HandleCreatePaymentIntent(c, session.UserName, session.Cart)
+}
+
+// TransportPaymentIntentHandler opens a payment for the signed in user's transport checkout
+func TransportPaymentIntentHandler(c *gin.Context) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in to check out"})
+		return
+	}
+
+	stripe.HandleTransportCreatePaymentIntent(c, session.UserName, session.TransportCart)
+}
+
+func PurchaseCompleteHandler(c *gin.Context) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	user, err := db.GetUser(session.UserName)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	var order *db.Order
+	if c.Query("payment_id") != "" {
+		order, err = db.GetOrderByPaymentID(c.Query("payment_id"))
+	} else {
+		// comped orders never had a payment
+		order, err = db.GetOrder(user.OrderID)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	c.HTML(http.StatusOK, "purchaseComplete.html.tmpl", gin.H{
+		"User":  user,
+		"Order": order,
+	})
+}
+
+// ReceiptHandler shows an order's receipt to the person who bought it, or to staff. ?format=pdf downloads it.
+func ReceiptHandler(c *gin.Context) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	order, err := db.GetOrder(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	if !strings.EqualFold(order.UserName, session.UserName) {
+		if _, _, ok := hasRole(c, fields.RoleFinance); !ok {
+			return
+		}
+	}
+
+	r, err := receipt.Build(order)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if c.Query("format") == "pdf" {
+		pdf, err := r.PDF()
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, r.FileName("pdf")))
+		c.Data(http.StatusOK, "application/pdf", pdf)
+		return
+	}
+
+	c.HTML(http.StatusOK, "receipt.html.tmpl", r)
+}
+
+// planOrder gets the signed in user's order if it's on a payment plan
+func planOrder(c *gin.Context) (*db.Order, bool) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.Redirect(http.StatusFound, "/")
+		return nil, false
+	}
+
+	user, err := db.GetUser(session.UserName)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	if user.OrderID == "" {
+		c.Redirect(http.StatusFound, "/signin-redirect")
+		return nil, false
+	}
+
+	order, err := db.GetOrder(user.OrderID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if order.InstallmentPlan < 2 {
+		c.Redirect(http.StatusFound, "/signin-redirect")
+		return nil, false
+	}
+
+	return order, true
+}
+
+func PaymentPlanHandler(c *gin.Context) {
+	order, ok := planOrder(c)
+	if !ok {
+		return
+	}
+
+	if setupIntent := c.Query("setup_intent"); setupIntent != "" {
+		err := stripe.ApplyNewCard(order, setupIntent)
+		if err != nil {
+			ErrorFlash(c, err.Error())
+		} else {
+			SuccessFlash(c, "Card updated! We'll retry any missed payments now.")
+		}
+		c.Redirect(http.StatusFound, "/payment-plan")
+		return
+	}
+
+	installments, err := db.GetInstallments(order.OrderID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	canUpdateCard := false
+	for _, inst := range installments {
+		if inst.Status == fields.InstallmentScheduled || inst.Status == fields.InstallmentFailed {
+			canUpdateCard = order.PaymentStatus == "partially_paid"
+		}
+	}
+
+	c.HTML(http.StatusOK, "paymentPlan.html.tmpl", gin.H{
+		"flashes":       GetFlashes(c),
+		"Order":         order,
+		"Remaining":     order.Remaining(),
+		"Installments":  installments,
+		"CanUpdateCard": canUpdateCard,
 	})
 }
 
+// PaymentPlanSetupHandler starts saving a replacement card for a payment plan
+func PaymentPlanSetupHandler(c *gin.Context) {
+	order, ok := planOrder(c)
+	if !ok {
+		return
+	}
+
+	clientSecret, err := stripe.NewCardSetup(order)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"clientSecret": clientSecret})
+}
+
 func PurchaseFailedHandler(c *gin.Context) {
 	session := GetSession(c)
 	if !session.SignedIn() {
@@ -1090,6 +1828,7 @@ func Logistics2023Handler(c *gin.Context) {
 		c.HTML(http.StatusOK, "logistics2023.html.tmpl", gin.H{
 			"flashes": GetFlashes(c),
 			"User":    user,
+			"Discord": discordFieldFor(c, session, user.DiscordName),
 			"Order":   order,
 		})
 		return
@@ -1100,7 +1839,7 @@ func Logistics2023Handler(c *gin.Context) {
 	glutenFree := c.PostForm("glutenfree") == "on"
 	lactoseIntolerant := c.PostForm("lactose") == "on"
 	foodComments := c.PostForm("comments")
-	discordName := c.PostForm("discord-name")
+	_, discordName := discordFromForm(c, session)
 
 	/*
 		assistanceToCamp := c.PostForm("travel-from-airport")
@@ -1124,6 +1863,7 @@ func Logistics2023Handler(c *gin.Context) {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
+	go hooks.LogisticsUpdated(user)
 
 	SuccessFlash(c, "Saved!")
 
@@ -1196,21 +1936,6 @@ func LogisticsHandler(c *gin.Context) {
 }
 
 func CheckinHandler(c *gin.Context) {
-	session := GetSession(c)
-	if !session.SignedIn() {
-		c.Redirect(http.StatusFound, "/")
-		return
-	}
-
-	user, err := db.GetUser(session.TwitterName)
-	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
-		return
-	} else if !localDevMode && !user.HasCheckinPermission() {
-		c.AbortWithError(http.StatusForbidden, errors.New("This page is for staff only"))
-		return
-	}
-
 	ticketId := c.Param("ticketId")
 	// fmt.Printf("ticketId: %s\n", ticketId)
 	ticketUser, err := db.GetUserFromTicketId(ticketId)
@@ -1226,10 +1951,13 @@ func CheckinHandler(c *gin.Context) {
 	}
 
 	anyUnchecked := false
+	anySuspended := false
 	for _, u := range ticketGroup {
 		if !u.CheckedIn {
 			anyUnchecked = true
-			break
+		}
+		if u.TicketSuspended {
+			anySuspended = true
 		}
 	}
 
@@ -1238,6 +1966,7 @@ func CheckinHandler(c *gin.Context) {
 			"flashes":      GetFlashes(c),
 			"group":        ticketGroup,
 			"anyUnchecked": anyUnchecked,
+			"anySuspended": anySuspended,
 		})
 		return
 	}
@@ -1250,7 +1979,12 @@ func CheckinHandler(c *gin.Context) {
 				c.AbortWithError(http.StatusInternalServerError, err)
 				return
 			}
-			u.SetCheckedIn()
+			err = u.SetCheckedIn()
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			go hooks.CheckedIn(u)
 			checkinCount++
 		}
 	}
@@ -1259,6 +1993,7 @@ func CheckinHandler(c *gin.Context) {
 		WarningFlash(c, "Select at least one person to check in")
 	} else {
 		// update aggregations?
+		staffDetails(c, "checked in %d", checkinCount)
 		if checkinCount == 1 {
 			SuccessFlash(c, "Checked in 1 person")
 		} else {
@@ -1303,6 +2038,7 @@ func BadgeHandler(c *gin.Context) {
 			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
+		go hooks.LogisticsUpdated(user)
 	}
 
 	params := url.Values{}
@@ -1366,6 +2102,7 @@ func FoodHandler(c *gin.Context) {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
+	go hooks.LogisticsUpdated(user)
 
 	SuccessFlash(c, "Saved!")
 
@@ -1373,25 +2110,6 @@ func FoodHandler(c *gin.Context) {
 }
 
 func CabinListHandler(c *gin.Context) {
-	authToken := c.Query("auth_token")
-
-	if authToken == "" {
-		c.AbortWithError(http.StatusUnauthorized, errors.New("auth_token required"))
-		return
-	}
-
-	hmacSecret := os.Getenv("HMAC_SECRET")
-	if hmacSecret == "" {
-		c.AbortWithError(http.StatusForbidden, errors.New("route disabled"))
-		return
-	}
-
-	h := sha256.Sum256([]byte(hmacSecret))
-	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(authToken)) != 1 {
-		c.AbortWithError(http.StatusForbidden, errors.New("invalid auth_token"))
-		return
-	}
-
 	cabins, err := db.GetCabinsForBadgeGenerator()
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
@@ -1406,26 +2124,8 @@ type DiscordResponse struct {
 }
 
 func DiscordAuthenticator(c *gin.Context) {
-	authToken := c.Request.Header[http.CanonicalHeaderKey("auth_token")]
 	discordName := c.Query("discord_name")
 
-	if authToken == nil {
-		c.AbortWithError(http.StatusUnauthorized, errors.New("auth_token required"))
-		return
-	}
-
-	hmacSecret := os.Getenv("HMAC_SECRET")
-	if hmacSecret == "" {
-		c.AbortWithError(http.StatusForbidden, errors.New("route disabled"))
-		return
-	}
-
-	h := sha256.Sum256([]byte(hmacSecret))
-	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(authToken[0])) != 1 {
-		c.AbortWithError(http.StatusForbidden, errors.New("invalid auth_token"))
-		return
-	}
-
 	user, err := db.GetUserByDiscord(discordName)
 	if err != nil {
 		// c.AbortWithError(http.StatusInternalServerError, err)
@@ -1453,39 +2153,21 @@ type AppEndpointResponse struct {
 }
 
 func AppEndpoint(c *gin.Context) {
-	authToken := c.Request.Header[http.CanonicalHeaderKey("auth_token")]
 	twitterName := c.Query("twitter_name")
 
-	if authToken == nil {
-		c.AbortWithError(http.StatusUnauthorized, errors.New("auth_token required"))
-		return
-	}
-
-	hmacSecret := os.Getenv("HMAC_SECRET")
-	if hmacSecret == "" {
-		c.AbortWithError(http.StatusForbidden, errors.New("route disabled"))
-		return
-	}
-
-	h := sha256.Sum256([]byte(hmacSecret))
-	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(authToken[0])) != 1 {
-		c.AbortWithError(http.StatusForbidden, errors.New("invalid auth_token"))
-		return
-	}
-
 	user, _ := db.GetUser(twitterName)
 	if user != nil {
-		c.JSON(http.StatusOK, AppEndpointResponse{TwitterName: user.TwitterName, UserName: user.UserName, DiscordName: user.DiscordName, TicketStatus: "Active", TicketType: user.TicketType, TicketID: fmt.Sprintf(`%s/checkin/%s`, externalURL, user.TicketID), AccomodationType: user.AdmissionLevel, Cabin2022: user.Cabin2022, CreatedAt: user.Created, Cabin2023: user.Cabin2023, CabinNickname2023: user.CabinNickname2023, TentVillage2023: user.TentVillage})
+		c.JSON(http.StatusOK, AppEndpointResponse{TwitterName: user.TwitterName, UserName: user.UserName, DiscordName: user.DiscordName, TicketStatus: user.TicketStatus(), TicketType: user.TicketType, TicketID: fmt.Sprintf(`%s/checkin/%s`, externalURL, user.TicketID), AccomodationType: user.AdmissionLevel, Cabin2022: user.Cabin2022, CreatedAt: user.Created, Cabin2023: user.Cabin2023, CabinNickname2023: user.CabinNickname2023, TentVillage2023: user.TentVillage})
 	} else {
 		user, err := db.GetUserByField(fields.TwitterName, twitterName)
 		if user != nil {
-			c.JSON(http.StatusOK, AppEndpointResponse{TwitterName: user.TwitterName, UserName: user.UserName, DiscordName: user.DiscordName, TicketStatus: "Active", TicketType: user.TicketType, TicketID: fmt.Sprintf(`%s/checkin/%s`, externalURL, user.TicketID), AccomodationType: user.AdmissionLevel, Cabin2022: user.Cabin2022, CreatedAt: user.Created, Cabin2023: user.Cabin2023, CabinNickname2023: user.CabinNickname2023, TentVillage2023: user.TentVillage})
+			c.JSON(http.StatusOK, AppEndpointResponse{TwitterName: user.TwitterName, UserName: user.UserName, DiscordName: user.DiscordName, TicketStatus: user.TicketStatus(), TicketType: user.TicketType, TicketID: fmt.Sprintf(`%s/checkin/%s`, externalURL, user.TicketID), AccomodationType: user.AdmissionLevel, Cabin2022: user.Cabin2022, CreatedAt: user.Created, Cabin2023: user.Cabin2023, CabinNickname2023: user.CabinNickname2023, TentVillage2023: user.TentVillage})
 			return
 		}
 
 		if err != nil {
 			// c.AbortWithError(http.StatusInternalServerError, err)
-			if err == errors.New("You're not on the guest list! Most likely we spelled your Twitter handle wrong.") {
+			if errors.Is(err, db.ErrNoRecords) {
 				c.JSON(http.StatusNotFound, nil)
 			} else {
 				c.AbortWithError(http.StatusInternalServerError, err)
@@ -1497,26 +2179,8 @@ func AppEndpoint(c *gin.Context) {
 }
 
 func UserByDiscordEndpoint(c *gin.Context) {
-	authToken := c.Request.Header[http.CanonicalHeaderKey("auth_token")]
 	discordName := c.Query("discord_name")
 
-	if authToken == nil {
-		c.AbortWithError(http.StatusUnauthorized, errors.New("auth_token required"))
-		return
-	}
-
-	hmacSecret := os.Getenv("HMAC_SECRET")
-	if hmacSecret == "" {
-		c.AbortWithError(http.StatusForbidden, errors.New("route disabled"))
-		return
-	}
-
-	h := sha256.Sum256([]byte(hmacSecret))
-	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(authToken[0])) != 1 {
-		c.AbortWithError(http.StatusForbidden, errors.New("invalid auth_token"))
-		return
-	}
-
 	user, err := db.GetUserByDiscord(discordName)
 	if err != nil {
 		// c.AbortWithError(http.StatusInternalServerError, err)
@@ -1526,7 +2190,7 @@ func UserByDiscordEndpoint(c *gin.Context) {
 			c.AbortWithError(http.StatusInternalServerError, err)
 		}
 	} else if user != nil {
-		c.JSON(http.StatusOK, AppEndpointResponse{TwitterName: user.TwitterName, UserName: user.UserName, DiscordName: user.DiscordName, TicketStatus: "Active", TicketType: user.TicketType, TicketID: user.TicketID, AccomodationType: user.AdmissionLevel, Cabin2022: user.Cabin2022, CreatedAt: user.Created, Cabin2023: user.Cabin2023, CabinNickname2023: user.CabinNickname2023, TentVillage2023: user.TentVillage})
+		c.JSON(http.StatusOK, AppEndpointResponse{TwitterName: user.TwitterName, UserName: user.UserName, DiscordName: user.DiscordName, TicketStatus: user.TicketStatus(), TicketType: user.TicketType, TicketID: user.TicketID, AccomodationType: user.AdmissionLevel, Cabin2022: user.Cabin2022, CreatedAt: user.Created, Cabin2023: user.Cabin2023, CabinNickname2023: user.CabinNickname2023, TentVillage2023: user.TentVillage})
 	} else {
 		c.AbortWithError(http.StatusInternalServerError, errors.New("Unknown server error"))
 	}
@@ -1534,30 +2198,306 @@ func UserByDiscordEndpoint(c *gin.Context) {
 
 // gets all attendees and returns them in an array
 func GetAttendeesEndpoint(c *gin.Context) {
-	authToken := c.Request.Header[http.CanonicalHeaderKey("auth_token")]
+	attendees, err := db.GetAttendees()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, attendees)
+}
+
+// webhookReplay is what replaying one event did, or would do on a dry run
+type webhookReplay struct {
+	EventID string   `json:"event_id"`
+	Changes []string `json:"changes"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func replayWebhookEvents(ids []string, dryRun bool) []webhookReplay {
+	results := make([]webhookReplay, 0, len(ids))
+	for _, id := range ids {
+		changes, err := stripe.ReplayEvent(id, dryRun)
+		result := webhookReplay{EventID: id, Changes: changes}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
 
-	if authToken == nil {
-		c.AbortWithError(http.StatusUnauthorized, errors.New("auth_token required"))
+// WebhookReplayEndpoint replays the stored stripe events named by id, for cmd/webhooks. Replays run here rather than
+// in the command so the site's listeners send what the events' steps promise, and so they can't race the site
+// handling the same event.
+func WebhookReplayEndpoint(c *gin.Context) {
+	key, ok := c.Get(apiKeyContextKey)
+	if !ok {
+		c.AbortWithError(http.StatusForbidden, errors.New("the legacy token can't replay events, use an API key"))
 		return
 	}
 
-	hmacSecret := os.Getenv("HMAC_SECRET")
-	if hmacSecret == "" {
-		c.AbortWithError(http.StatusForbidden, errors.New("route disabled"))
+	ids := c.PostFormArray("id")
+	if len(ids) == 0 {
+		c.AbortWithError(http.StatusBadRequest, errors.New("no events to replay"))
+		return
+	}
+	dryRun := c.PostForm("dry-run") == "on"
+
+	log.Infof("API key %s replaying events %s, dry run %v", key.(*db.APIKey).KeyID, strings.Join(ids, ", "), dryRun)
+	c.JSON(http.StatusOK, replayWebhookEvents(ids, dryRun))
+}
+
+func WebhooksAdminHandler(c *gin.Context) {
+	var since, until time.Time
+	var err error
+	status := c.Request.FormValue("status")
+	if v := c.Request.FormValue("since"); v != "" {
+		since, err = time.ParseInLocation(phaseInputFormat, v, sales.Eastern)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, errors.New("Couldn't read the since time"))
+			return
+		}
+	}
+	if v := c.Request.FormValue("until"); v != "" {
+		until, err = time.ParseInLocation(phaseInputFormat, v, sales.Eastern)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, errors.New("Couldn't read the until time"))
+			return
+		}
+	}
+
+	events, err := db.GetWebhookEvents(status, since, until)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	h := sha256.Sum256([]byte(hmacSecret))
-	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(authToken[0])) != 1 {
-		c.AbortWithError(http.StatusForbidden, errors.New("invalid auth_token"))
+	var results []webhookReplay
+	dryRun := c.PostForm("dry-run") == "on"
+	if c.Request.Method == http.MethodPost {
+		if since.IsZero() {
+			c.AbortWithError(http.StatusBadRequest, errors.New("Pick a since time to replay a range"))
+			return
+		}
+
+		ids := make([]string, 0, len(events))
+		for _, e := range events {
+			ids = append(ids, e.EventID)
+		}
+		results = replayWebhookEvents(ids, dryRun)
+
+		// show where the replay left them
+		events, err = db.GetWebhookEvents(status, since, until)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// newest first
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	c.HTML(http.StatusOK, "webhooksAdmin.html.tmpl", gin.H{
+		"Events":   events,
+		"Statuses": []string{fields.EventReceived, fields.EventProcessed, fields.EventFailed, fields.EventIgnored},
+		"Status":   status,
+		"Since":    c.Request.FormValue("since"),
+		"Until":    c.Request.FormValue("until"),
+		"Results":  results,
+		"DryRun":   dryRun,
+		"Eastern":  sales.Eastern,
+	})
+}
+
+func WebhookEventAdminHandler(c *gin.Context) {
+	var results []webhookReplay
+	dryRun := c.PostForm("dry-run") == "on"
+	if c.Request.Method == http.MethodPost {
+		results = replayWebhookEvents([]string{c.Param("id")}, dryRun)
+	}
+
+	event, err := db.GetWebhookEvent(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
 		return
 	}
 
-	attendees, err := db.GetAttendees()
+	var payload bytes.Buffer
+	if json.Indent(&payload, []byte(event.Payload), "", "  ") != nil {
+		payload.WriteString(event.Payload)
+	}
+
+	c.HTML(http.StatusOK, "webhookEvent.html.tmpl", gin.H{
+		"Event":   event,
+		"Payload": payload.String(),
+		"Results": results,
+		"DryRun":  dryRun,
+		"Eastern": sales.Eastern,
+	})
+}
+
+func ReconcileAdminHandler(c *gin.Context) {
+	since := reconcileSince
+	if v := c.Query("since"); v != "" {
+		var err error
+		since, err = time.ParseInLocation("2006-01-02", v, sales.Eastern)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, errors.New("Couldn't read the since date"))
+			return
+		}
+	}
+
+	report, err := reconcile.Run(since)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, attendees)
+	sinceInput := ""
+	if !since.IsZero() {
+		sinceInput = since.In(sales.Eastern).Format("2006-01-02")
+	}
+
+	c.HTML(http.StatusOK, "reconcileAdmin.html.tmpl", gin.H{
+		"Report": report,
+		"Since":  sinceInput,
+	})
+}
+
+func DisputesAdminHandler(c *gin.Context) {
+	disputes, err := db.GetDisputes()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.HTML(http.StatusOK, "disputesAdmin.html.tmpl", gin.H{
+		"Disputes": disputes,
+		"Eastern":  sales.Eastern,
+	})
+}
+
+// DisputeEvidenceHandler shows a dispute's evidence packet, or downloads it with ?format=txt or ?format=json
+func DisputeEvidenceHandler(c *gin.Context) {
+	evidence, err := stripe.GatherEvidence(c.Param("id"))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	filename := "dispute-" + evidence.Dispute.DisputeID
+	switch c.Query("format") {
+	case "txt":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.txt"`, filename))
+		c.String(http.StatusOK, evidence.Text())
+	case "json":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, filename))
+		c.IndentedJSON(http.StatusOK, evidence)
+	default:
+		c.HTML(http.StatusOK, "disputeEvidence.html.tmpl", gin.H{
+			"Evidence": evidence,
+			"Packet":   evidence.Text(),
+		})
+	}
+}
+
+func EmailAdminHandler(c *gin.Context) {
+	if c.Request.Method == http.MethodPost {
+		switch c.PostForm("action") {
+		case "retry":
+			requeued, err := email.Requeue()
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			go email.RetryOutbox()
+			SuccessFlash(c, fmt.Sprintf("Retrying queued email, and %d that had failed", requeued))
+		case "remind-logistics":
+			// one airtable lookup per ticket holder, so this takes a while
+			go func() {
+				count, err := email.RemindLogistics()
+				if err != nil {
+					log.Errorf("error sending logistics reminders: %v", err)
+					return
+				}
+				log.Infof("Queued logistics reminders for %d ticket holders", count)
+			}()
+			SuccessFlash(c, "Queueing logistics reminders for everyone with a ticket. They show up below as they go out.")
+		default:
+			c.AbortWithError(http.StatusBadRequest, errors.New("Unknown action"))
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/email")
+		return
+	}
+
+	queued, err := db.GetOutboxEmails(fields.EmailQueued)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	failed, err := db.GetOutboxEmails(fields.EmailFailed)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, e := range append(queued, failed...) {
+		e.QueuedAt = e.QueuedAt.In(sales.Eastern)
+	}
+
+	c.HTML(http.StatusOK, "emailAdmin.html.tmpl", gin.H{
+		"flashes": GetFlashes(c),
+		"Queued":  queued,
+		"Failed":  failed,
+	})
+}
+
+// SessionsAdminHandler looks up where someone's signed in, and signs them out of one session or all of them
+func SessionsAdminHandler(c *gin.Context) {
+	staff := staffUser(c)
+
+	userName := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c.Request.FormValue("user")), "@"))
+
+	if c.Request.Method == http.MethodPost {
+		switch c.PostForm("action") {
+		case "revoke":
+			rec, ok := sessionStore.Session(c.PostForm("id"))
+			if !ok {
+				c.AbortWithError(http.StatusNotFound, errors.New("That session has already ended"))
+				return
+			}
+			sessionStore.Revoke(rec.ID)
+			log.Infof("@%v revoked a session of @%v's", staff.UserName, rec.UserName)
+			SuccessFlash(c, fmt.Sprintf("Signed @%s out of that session", rec.UserName))
+		case "revoke-all":
+			if userName == "" {
+				c.AbortWithError(http.StatusBadRequest, errors.New("No username given"))
+				return
+			}
+			count := sessionStore.RevokeUser(userName, "")
+			log.Infof("@%v revoked all %d of @%v's sessions", staff.UserName, count, userName)
+			SuccessFlash(c, fmt.Sprintf("Signed @%s out of %d sessions", userName, count))
+		default:
+			c.AbortWithError(http.StatusBadRequest, errors.New("Unknown action"))
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/sessions?user="+url.QueryEscape(userName))
+		return
+	}
+
+	var list []sessionstore.Record
+	if userName != "" {
+		list = easternSessions(sessionStore.Sessions(userName))
+	}
+
+	c.HTML(http.StatusOK, "sessionsAdmin.html.tmpl", gin.H{
+		"flashes":  GetFlashes(c),
+		"UserName": userName,
+		"Sessions": list,
+	})
 }
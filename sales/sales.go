@@ -0,0 +1,196 @@
+package sales
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// phase states
+const (
+	// Unscheduled paths have no sales phase record and fall back to ticket limits alone
+	Unscheduled = "Unscheduled"
+	Upcoming    = "Upcoming"
+	Open        = "Open"
+	Closed      = "Closed"
+	SoldOut     = "Sold Out"
+)
+
+// Paths are the ticket paths that get a sales window
+var Paths = []string{fields.Attendee2022, fields.Sponsorship, fields.FCFS, fields.Lottery, fields.Application, fields.LateApp}
+
+// Eastern is the time zone sales windows are announced in
+var Eastern = loadEastern()
+
+var (
+	phaseMutex sync.RWMutex
+	phases     = map[string]*db.SalesPhase{}
+	states     = map[string]string{}
+)
+
+func loadEastern() *time.Location {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// StateAt is the state of a phase at the given time
+func StateAt(p *db.SalesPhase, now time.Time) string {
+	if p == nil {
+		return Unscheduled
+	}
+
+	if !p.Opens.IsZero() && now.Before(p.Opens) {
+		return Upcoming
+	} else if !p.Closes.IsZero() && !now.Before(p.Closes) {
+		return Closed
+	} else if p.Cap > 0 && p.Sold >= p.Cap {
+		return SoldOut
+	}
+	return Open
+}
+
+// Phase returns the last loaded phase for a ticket path and its state right now
+func Phase(ticketPath string) (*db.SalesPhase, string) {
+	phaseMutex.RLock()
+	p := phases[ticketPath]
+	phaseMutex.RUnlock()
+
+	return p, StateAt(p, time.Now())
+}
+
+// Refresh reloads the phases and logs any that changed state since the last load
+func Refresh() error {
+	loaded, err := db.GetSalesPhases()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	newPhases := map[string]*db.SalesPhase{}
+	newStates := map[string]string{}
+	for _, p := range loaded {
+		newPhases[p.Name] = p
+		newStates[p.Name] = StateAt(p, now)
+	}
+
+	phaseMutex.Lock()
+	oldStates := states
+	phases = newPhases
+	states = newStates
+	phaseMutex.Unlock()
+
+	// nothing to compare against on the first load
+	if len(oldStates) == 0 {
+		return nil
+	}
+
+	for name, state := range newStates {
+		old, ok := oldStates[name]
+		if !ok {
+			old = Unscheduled
+		}
+
+		if old != state {
+			err = db.LogSalesPhaseEvent(name, fmt.Sprintf("%s → %s", old, state))
+			if err != nil {
+				log.Errorf("logging sales phase change: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run refreshes the phases every interval until the process exits
+func Run(interval time.Duration) {
+	err := Refresh()
+	if err != nil {
+		log.Errorf("loading sales phases: %v", err)
+	}
+
+	for range time.Tick(interval) {
+		err = Refresh()
+		if err != nil {
+			log.Errorf("refreshing sales phases: %v", err)
+		}
+	}
+}
+
+// Allowed checks, against the live phase record, that quantity more tickets can be sold on a ticket path now
+func Allowed(ticketPath string, quantity int) error {
+	p, err := db.GetSalesPhase(ticketPath)
+	if errors.Is(err, db.ErrNoRecords) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch StateAt(p, time.Now()) {
+	case Upcoming:
+		return errors.Newf("Sales for %s open %s", p.Name, p.Opens.In(Eastern).Format("Monday Jan 2 at 3:04pm MST"))
+	case Closed:
+		return errors.Newf("Sales for %s are closed", p.Name)
+	case SoldOut:
+		return errors.Newf("%s tickets are sold out", p.Name)
+	}
+
+	if p.Cap > 0 && p.Sold+quantity > p.Cap {
+		return errors.Newf("Sorry, there are only %d %s tickets left", p.Cap-p.Sold, p.Name)
+	}
+
+	return nil
+}
+
+// Reschedule sets a ticket path's window and cap, creating its phase if needed
+func Reschedule(ticketPath string, opens, closes time.Time, capacity int, changedBy string) error {
+	if !isPath(ticketPath) {
+		return errors.Newf("Unknown ticket path %q", ticketPath)
+	}
+	if !opens.IsZero() && !closes.IsZero() && !closes.After(opens) {
+		return errors.New("A phase has to close after it opens")
+	}
+
+	p, err := db.GetSalesPhase(ticketPath)
+	if errors.Is(err, db.ErrNoRecords) {
+		p = &db.SalesPhase{Name: ticketPath, Opens: opens, Closes: closes, Cap: capacity}
+		err = p.CreateSalesPhase()
+	} else if err == nil {
+		err = p.UpdateSchedule(opens, closes, capacity)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = db.LogSalesPhaseEvent(ticketPath, fmt.Sprintf("rescheduled by %s: opens %s, closes %s, cap %d",
+		changedBy, describe(opens), describe(closes), capacity))
+	if err != nil {
+		log.Errorf("logging sales phase change: %v", err)
+	}
+
+	return Refresh()
+}
+
+func isPath(ticketPath string) bool {
+	for _, p := range Paths {
+		if p == ticketPath {
+			return true
+		}
+	}
+	return false
+}
+
+func describe(t time.Time) string {
+	if t.IsZero() {
+		return "any time"
+	}
+	return t.In(Eastern).Format("Jan 2 3:04pm MST")
+}
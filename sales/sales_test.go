@@ -0,0 +1,73 @@
+package sales
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+func TestStateAt(t *testing.T) {
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	hour := time.Hour
+
+	tests := []struct {
+		name  string
+		phase *db.SalesPhase
+		want  string
+	}{
+		{"no phase", nil, Unscheduled},
+		{"no window", &db.SalesPhase{}, Open},
+		{"before it opens", &db.SalesPhase{Opens: now.Add(hour)}, Upcoming},
+		{"as it opens", &db.SalesPhase{Opens: now}, Open},
+		{"inside the window", &db.SalesPhase{Opens: now.Add(-hour), Closes: now.Add(hour)}, Open},
+		{"as it closes", &db.SalesPhase{Closes: now}, Closed},
+		{"after it closes", &db.SalesPhase{Closes: now.Add(-hour)}, Closed},
+		{"sold out", &db.SalesPhase{Cap: 10, Sold: 10}, SoldOut},
+		{"tickets left", &db.SalesPhase{Cap: 10, Sold: 9}, Open},
+		{"no cap", &db.SalesPhase{Sold: 1000}, Open},
+		{"closed beats sold out", &db.SalesPhase{Closes: now.Add(-hour), Cap: 10, Sold: 10}, Closed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StateAt(tt.phase, now); got != tt.want {
+				t.Errorf("StateAt() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	s := dbtest.New(t)
+	opens := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name   string
+		path   string
+		opens  time.Time
+		closes time.Time
+		ok     bool
+	}{
+		{"known path", fields.FCFS, opens, opens.Add(time.Hour), true},
+		{"typo", "FCSF", opens, opens.Add(time.Hour), false},
+		{"blank", "", opens, opens.Add(time.Hour), false},
+		{"closes before it opens", fields.Lottery, opens, opens.Add(-time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Reschedule(tt.path, tt.opens, tt.closes, 0, "staff")
+			if (err == nil) != tt.ok {
+				t.Errorf("Reschedule() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	records := s.Records("Sales Phases")
+	if len(records) != 1 || records[0][fields.Name] != fields.FCFS {
+		t.Errorf("phases saved = %v, want only %s", records, fields.FCFS)
+	}
+}
@@ -3,20 +3,35 @@ package main
 import (
 	"context"
 	"encoding/gob"
+	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/cockroachdb/errors"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
-	"github.com/kurrik/oauth1a"
 	log "github.com/sirupsen/logrus"
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/discord"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/sales"
+	"github.com/vibecamp/myvibecamp/sessionstore"
+	"github.com/vibecamp/myvibecamp/signin"
+	"github.com/vibecamp/myvibecamp/stripe"
 )
 
 type Session struct {
 	UserName    string
 	TwitterName string
 	TwitterID   string
-	Oauth       *oauth1a.UserConfig
+	SignIn      *signin.State
+	// a discord account they've verified this session
+	DiscordID   string
+	DiscordName string
+
+	// the carts the checkout pages were last rendered with, payments have to match them
+	Cart          []db.Item
+	TransportCart stripe.TransportCart
 }
 
 func init() {
@@ -25,6 +40,17 @@ func init() {
 
 const sessionKey = "s"
 
+var sessionStore *sessionstore.Store
+
+// sessionOwner is who a stored session belongs to, so their sessions can be listed and revoked
+func sessionOwner(values map[interface{}]interface{}) string {
+	s, ok := values[sessionKey].(Session)
+	if !ok {
+		return ""
+	}
+	return s.UserName
+}
+
 func GetSession(c *gin.Context) *Session {
 	defaultSession := sessions.Default(c)
 	s := defaultSession.Get(sessionKey)
@@ -38,10 +64,16 @@ func GetSession(c *gin.Context) *Session {
 
 func SaveSession(c *gin.Context, s *Session) {
 	defaultSession := sessions.Default(c)
-	defaultSession.Set(sessionKey, &s)
+	defaultSession.Set(sessionKey, *s)
 	defaultSession.Save()
 }
 
+// rotateSession gives the session a new id when it's next saved, so an id someone got hold of before they signed in
+// is no use after
+func rotateSession(c *gin.Context) {
+	sessionstore.Rotate(sessions.Default(c))
+}
+
 func ClearSession(c *gin.Context) {
 	session := sessions.Default(c)
 	session.Clear()
@@ -90,32 +122,49 @@ func (s *Session) SignedIn() bool {
 	return s != nil && (s.TwitterName != "" || s.UserName != "")
 }
 
+// SignInHandler sends them off to sign in with a provider, twitter unless the url names another.
+// Signed in people go through it to link another account, and come back to next.
 func SignInHandler(c *gin.Context) {
 	session := GetSession(c)
 
-	session.Oauth = &oauth1a.UserConfig{}
-	err := session.Oauth.GetRequestToken(context.Background(), service, http.DefaultClient)
-	if err != nil {
-		log.Debugf("Could not get request token: %v", err)
-		c.String(http.StatusInternalServerError, "Problem getting the request token")
-		c.Abort()
+	provider, ok := signInProvider(c)
+	if !ok {
 		return
 	}
 
-	url, err := session.Oauth.GetAuthorizeURL(service)
+	url, state, err := provider.Begin(context.Background())
 	if err != nil {
-		log.Debugf("Could not get authorization URL: %v", err)
-		c.String(http.StatusInternalServerError, "Problem getting the authorization URL")
+		log.Debugf("Could not start sign in with %v: %v", provider.Name(), err)
+		c.String(http.StatusInternalServerError, "Problem starting sign in")
 		c.Abort()
 		return
 	}
+	if next := c.Query("next"); strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") {
+		state.Next = next
+	}
 
+	session.SignIn = state
 	SaveSession(c, session)
 
 	log.Debugf("Redirecting user to %v\n", url)
 	c.Redirect(http.StatusFound, url)
 }
 
+// signInProvider is the provider named in the url, aborting if it isn't set up
+func signInProvider(c *gin.Context) (signin.Provider, bool) {
+	name := c.Param("provider")
+	if name == "" {
+		name = "twitter"
+	}
+
+	provider, ok := signInProviders[name]
+	if !ok {
+		c.AbortWithError(http.StatusNotFound, errors.Newf("Signing in with %s isn't set up", name))
+		return nil, false
+	}
+	return provider, true
+}
+
 func SignOutHandler(c *gin.Context) {
 	ClearSession(c)
 	c.Redirect(http.StatusFound, "/")
@@ -124,40 +173,217 @@ func SignOutHandler(c *gin.Context) {
 func CallbackHandler(c *gin.Context) {
 	log.Debugf("Callback hit") //. %v current sessions.\n", len(sessions))
 
+	provider, ok := signInProvider(c)
+	if !ok {
+		return
+	}
+
 	session := GetSession(c)
-	if session.Oauth == nil || session.Oauth.RequestTokenKey == "" {
-		log.Tracef("No user config in session")
+	if session.SignIn == nil || session.SignIn.Provider != provider.Name() {
+		log.Tracef("No sign in state in session")
 		c.String(http.StatusBadRequest, "error: no session found")
 		c.Abort()
 		return
 	}
+	next := session.SignIn.Next
 
-	token, verifier, err := session.Oauth.ParseAuthorize(c.Request, service)
+	identity, err := provider.Finish(context.Background(), c.Request, session.SignIn)
 	if err != nil {
-		log.Tracef("Could not parse authorization: %v", err)
-		c.String(http.StatusInternalServerError, "error: could not parse authorization")
+		log.Tracef("Could not finish sign in with %v: %v", provider.Name(), err)
+		c.String(http.StatusBadRequest, "error: could not sign in")
 		c.Abort()
 		return
 	}
+	session.SignIn = nil
 
-	err = session.Oauth.GetAccessToken(context.Background(), token, verifier, service, http.DefaultClient)
-	if err != nil {
-		log.Tracef("Error getting access token: %v", err)
-		c.String(http.StatusInternalServerError, "error: could not get access token")
-		c.Abort()
+	if session.SignedIn() && identity.Provider != "twitter" {
+		err = linkAccount(session, identity)
+		if err != nil {
+			SaveSession(c, session)
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		SaveSession(c, session)
+		SuccessFlash(c, fmt.Sprintf("Linked your %s account", strings.Title(identity.Provider)))
+		if next == "" {
+			next = "/signin-redirect"
+		}
+		c.Redirect(http.StatusFound, next)
 		return
 	}
 
-	session.TwitterName = session.Oauth.AccessValues.Get("screen_name")
-	session.TwitterID = session.Oauth.AccessValues.Get("user_id")
-	session.UserName = strings.ToLower(session.TwitterName)
-	session.Oauth = nil
+	userName, err := signInUserName(identity)
+	if err != nil {
+		SaveSession(c, session)
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
 
-	if localDevMode {
-		// session.TwitterName = "GRINTESTING" // login as this user, for dev
-		session.UserName = strings.ToLower(session.TwitterName)
+	session.TwitterName = userName
+	session.UserName = userName
+	session.TwitterID = ""
+	session.DiscordID = ""
+	session.DiscordName = ""
+	switch identity.Provider {
+	case "twitter":
+		session.TwitterID = identity.ID
+	case "discord":
+		session.DiscordID = identity.ID
+		session.DiscordName = identity.UserName
 	}
 
+	rotateSession(c)
 	SaveSession(c, session)
 	c.Redirect(http.StatusFound, "/signin-redirect")
 }
+
+// providerIDFields are the attendee fields each provider's stable ids are kept in
+var providerIDFields = map[string]string{
+	"twitter": fields.TwitterID,
+	"discord": fields.DiscordID,
+	"google":  fields.GoogleID,
+}
+
+// signInUserName finds who an account signs in as. An account linked to an attendee always signs in as them.
+// Otherwise twitter accounts sign in by handle, and the rest by their verified email, the same as email sign in.
+// Either way the account gets linked to the attendee for next time.
+func signInUserName(identity *signin.Identity) (string, error) {
+	user, err := db.GetUserByField(providerIDFields[identity.Provider], identity.ID)
+	if err == nil {
+		if identity.Provider == "discord" && user.DiscordName != identity.UserName {
+			// they've renamed themselves on discord
+			if err := user.SetDiscord(identity.ID, identity.UserName); err != nil {
+				log.Errorf("error updating @%v's discord name: %v", user.UserName, err)
+			}
+		}
+		return user.UserName, nil
+	}
+
+	var userName string
+	switch {
+	case identity.Provider == "twitter":
+		userName = strings.ToLower(identity.UserName)
+	case identity.Email != "":
+		var found bool
+		userName, _, found = emailSignInUser(strings.ToLower(identity.Email))
+		if !found {
+			return "", errors.Newf("We couldn't find %s on the guest list. Try signing in with Twitter or your email, and link your %s account from your logistics page.", identity.Email, strings.Title(identity.Provider))
+		}
+	default:
+		return "", errors.Newf("Your %s account doesn't have a verified email, so we can't tell who you are. Try signing in with Twitter or your email.", strings.Title(identity.Provider))
+	}
+
+	user, err = db.GetUser(userName)
+	if err == nil {
+		if err := linkIdentity(user, identity); err != nil {
+			log.Errorf("error linking %v account to @%v: %v", identity.Provider, userName, err)
+		}
+	}
+
+	return userName, nil
+}
+
+// linkAccount links another provider's account to whoever's signed in
+func linkAccount(session *Session, identity *signin.Identity) error {
+	owner, err := db.GetUserByField(providerIDFields[identity.Provider], identity.ID)
+	if err == nil && owner.UserName != session.UserName {
+		return errors.Newf("That %s account is already linked to someone else. If it's yours, let us know.", strings.Title(identity.Provider))
+	}
+
+	if identity.Provider == "discord" {
+		session.DiscordID = identity.ID
+		session.DiscordName = identity.UserName
+	}
+
+	// they may not be an attendee yet, carts pick the discord account up from the session
+	user, err := db.GetUser(session.UserName)
+	if err != nil {
+		return nil
+	}
+
+	// linking on purpose replaces an account linked before
+	switch identity.Provider {
+	case "discord":
+		err = user.SetDiscord(identity.ID, identity.UserName)
+		if err == nil {
+			// give them their roles now rather than at the next sync
+			discord.Trigger()
+		}
+		return err
+	case "google":
+		return user.SetGoogleID(identity.ID)
+	}
+	return nil
+}
+
+// linkIdentity records the account on an attendee signing in with it, unless they already have one from that provider
+func linkIdentity(user *db.User, identity *signin.Identity) error {
+	switch identity.Provider {
+	case "twitter":
+		if user.TwitterID == "" {
+			return user.SetTwitterID(identity.ID)
+		}
+	case "discord":
+		if user.DiscordID == "" || user.DiscordID == identity.ID {
+			return user.SetDiscord(identity.ID, identity.UserName)
+		}
+	case "google":
+		if user.GoogleID == "" {
+			return user.SetGoogleID(identity.ID)
+		}
+	}
+	return nil
+}
+
+// SessionsHandler lists where they're signed in, and signs them out of one session or all of them
+func SessionsHandler(c *gin.Context) {
+	session := GetSession(c)
+	if !session.SignedIn() {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	current := sessions.Default(c).ID()
+
+	if c.Request.Method == http.MethodPost {
+		switch c.PostForm("action") {
+		case "revoke":
+			id := c.PostForm("id")
+			if rec, ok := sessionStore.Session(id); !ok || rec.UserName != session.UserName {
+				c.AbortWithError(http.StatusNotFound, errors.New("That session has already ended"))
+				return
+			}
+			if id == current {
+				SignOutHandler(c)
+				return
+			}
+			sessionStore.Revoke(id)
+			SuccessFlash(c, "Signed out of that session")
+		case "revoke-all":
+			count := sessionStore.RevokeUser(session.UserName, current)
+			log.Infof("@%v signed out everywhere, ending %d other sessions", session.UserName, count)
+			SignOutHandler(c)
+			return
+		default:
+			c.AbortWithError(http.StatusBadRequest, errors.New("Unknown action"))
+			return
+		}
+		c.Redirect(http.StatusFound, "/sessions")
+		return
+	}
+
+	c.HTML(http.StatusOK, "sessions.html.tmpl", gin.H{
+		"flashes":  GetFlashes(c),
+		"Sessions": easternSessions(sessionStore.Sessions(session.UserName)),
+		"Current":  current,
+	})
+}
+
+// easternSessions puts session times in Eastern for showing
+func easternSessions(list []sessionstore.Record) []sessionstore.Record {
+	for i := range list {
+		list[i].Created = list[i].Created.In(sales.Eastern)
+		list[i].LastSeen = list[i].LastSeen.In(sales.Eastern)
+	}
+	return list
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/signin"
+	"github.com/vibecamp/myvibecamp/signin/fakeoauth"
+)
+
+// signInThrough signs account in through a fake of the provider, and returns who the provider says it is
+func signInThrough(t *testing.T, provider string, account fakeoauth.Account) *signin.Identity {
+	fake, err := fakeoauth.New(provider, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(fake.Handler())
+	defer server.Close()
+
+	const callback = "https://my.vibe.camp/callback"
+	p := map[string]*signin.OAuth2{
+		"twitter": signin.Twitter("client", "", callback, server.URL),
+		"discord": signin.Discord("client", "", callback, server.URL),
+		"google":  signin.Google("client", "", callback, server.URL),
+	}[provider]
+
+	authURL, state, err := p.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	identity, err := p.Finish(context.Background(), httptest.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil), state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestSignInUserName(t *testing.T) {
+	s := dbtest.New(t)
+	alice := s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "alice", fields.TwitterID: "100", fields.DiscordID: "200", fields.DiscordName: "alice"})
+	bob := s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "bob"})
+	carol := s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "carol@example.com", fields.Email: "carol@example.com"})
+
+	tests := []struct {
+		name     string
+		provider string
+		account  fakeoauth.Account
+		want     string
+		// the attendee record and field the account should end up linked in, and what it should hold
+		record, field, value string
+	}{
+		{"linked twitter account that changed its handle", "twitter", fakeoauth.Account{ID: "100", UserName: "alice_renamed"}, "alice", alice, fields.TwitterID, "100"},
+		{"twitter handle", "twitter", fakeoauth.Account{ID: "101", UserName: "Bob"}, "bob", bob, fields.TwitterID, "101"},
+		{"twitter handle that isn't an attendee yet", "twitter", fakeoauth.Account{ID: "102", UserName: "Dave"}, "dave", "", "", ""},
+		{"linked discord account that changed its name", "discord", fakeoauth.Account{ID: "200", UserName: "alice2"}, "alice", alice, fields.DiscordName, "alice2"},
+		{"discord email", "discord", fakeoauth.Account{ID: "201", UserName: "carol", Email: "Carol@example.com"}, "carol@example.com", carol, fields.DiscordID, "201"},
+		{"google email", "google", fakeoauth.Account{ID: "g1", Name: "Carol", Email: "carol@example.com"}, "carol@example.com", carol, fields.GoogleID, "g1"},
+		{"google email that's not on the list", "google", fakeoauth.Account{ID: "g2", Email: "erin@example.com"}, "", "", "", ""},
+		{"discord without a verified email", "discord", fakeoauth.Account{ID: "202", UserName: "frank"}, "", "", "", ""},
+		{"google without a verified email", "google", fakeoauth.Account{ID: "g3", Name: "Frank"}, "", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userName, err := signInUserName(signInThrough(t, tt.provider, tt.account))
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("signed in as %s", userName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userName != tt.want {
+				t.Errorf("signed in as %s, want %s", userName, tt.want)
+			}
+			if tt.record != "" {
+				if got := s.Get(dbtest.Attendees, tt.record)[tt.field]; got != tt.value {
+					t.Errorf("%s = %q, want %q", tt.field, got, tt.value)
+				}
+			}
+		})
+	}
+}
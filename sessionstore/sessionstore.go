@@ -0,0 +1,373 @@
+// Package sessionstore keeps sessions on the server, one file each in a directory, so they can be listed and
+// revoked. The cookie only carries a signed session id, and a revoked session's id stops working straight away.
+package sessionstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/gob"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/gin-contrib/sessions"
+	"github.com/gorilla/securecookie"
+	gsessions "github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// Record is one session as it's stored. Values are the session's gob encoded values.
+type Record struct {
+	ID        string
+	UserName  string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+	IP        string
+	UserAgent string
+	Values    []byte
+}
+
+// Store is a gin session store backed by a directory of session files
+type Store struct {
+	dir     string
+	codecs  []securecookie.Codec
+	options *gsessions.Options
+	// owner says who a session's values belong to, so sessions can be listed by attendee
+	owner func(values map[interface{}]interface{}) string
+
+	mutex   sync.Mutex
+	records map[string]*Record
+}
+
+// rotateKey marks a session to get a new id when it's next saved
+type rotateKey struct{}
+
+// clientIPKey is where the request's context keeps the client IP the router worked out
+type clientIPKey struct{}
+
+// ErrRevoked is returned by Save for a session that was revoked while its request was being handled
+var ErrRevoked = errors.New("session was revoked")
+
+const fileExt = ".session"
+
+// New loads the sessions in dir, making it if it's missing. The key pairs sign the session id cookie, the same way
+// the cookie store's do.
+func New(dir string, owner func(values map[interface{}]interface{}) string, keyPairs ...[]byte) (*Store, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, errors.Wrap(err, "making session directory")
+	}
+
+	s := &Store{
+		dir:     dir,
+		codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		options: &gsessions.Options{Path: "/", MaxAge: 86400 * 30},
+		owner:   owner,
+		records: map[string]*Record{},
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+fileExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "listing sessions")
+	}
+
+	now := time.Now()
+	for _, f := range files {
+		rec, err := readRecord(f)
+		if err != nil {
+			log.Errorf("skipping session file %v: %v", f, err)
+			continue
+		}
+		if now.After(rec.Expires) {
+			os.Remove(f)
+			continue
+		}
+		s.records[rec.ID] = rec
+	}
+	log.Debugf("Loaded %d sessions from %v", len(s.records), dir)
+
+	return s, nil
+}
+
+func readRecord(path string) (*Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rec Record
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&rec)
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// Options sets the cookie options, and MaxAge is how long a session lasts since it was last saved
+func (s *Store) Options(options sessions.Options) {
+	s.options = options.ToGorillaOptions()
+}
+
+// Get returns the request's session, the same one each time it's asked for during a request
+func (s *Store) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session the request's cookie points to, or starts a new one if there isn't a live one
+func (s *Store) New(r *http.Request, name string) (*gsessions.Session, error) {
+	session := gsessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	err = securecookie.DecodeMulti(name, c.Value, &id, s.codecs...)
+	if err != nil {
+		// an old cookie store cookie, or tampered with
+		return session, nil
+	}
+
+	s.mutex.Lock()
+	rec, ok := s.records[id]
+	if ok && time.Now().After(rec.Expires) {
+		ok = false
+	}
+	if ok {
+		rec.LastSeen = time.Now()
+	}
+	s.mutex.Unlock()
+	if !ok {
+		return session, nil
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(rec.Values)).Decode(&session.Values)
+	if err != nil {
+		return session, errors.Wrap(err, "decoding session")
+	}
+
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the session and sets its cookie. A session with nothing in it isn't kept, so visitors who never sign
+// in don't leave files behind, and clearing a session on sign out removes it. A session that's been revoked since
+// it was loaded isn't brought back: it's refused with ErrRevoked.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	_, rotate := session.Values[rotateKey{}]
+	delete(session.Values, rotateKey{})
+
+	if session.Options.MaxAge < 0 || len(session.Values) == 0 {
+		if session.ID != "" {
+			s.Revoke(session.ID)
+			session.ID = ""
+		}
+		if !session.IsNew {
+			expired := *session.Options
+			expired.MaxAge = -1
+			http.SetCookie(w, gsessions.NewCookie(session.Name(), "", &expired))
+		}
+		return nil
+	}
+
+	var values bytes.Buffer
+	err := gob.NewEncoder(&values).Encode(session.Values)
+	if err != nil {
+		return errors.Wrap(err, "encoding session")
+	}
+
+	now := time.Now()
+	rec := &Record{Created: now}
+
+	s.mutex.Lock()
+	if session.ID != "" {
+		old, ok := s.records[session.ID]
+		if !ok {
+			s.mutex.Unlock()
+			return errors.Wrapf(ErrRevoked, "saving session for %s", s.owner(session.Values))
+		}
+		*rec = *old
+		if rotate {
+			s.removeLocked(session.ID)
+			rec.Created = now
+			session.ID = ""
+		}
+	}
+	if session.ID == "" {
+		session.ID = newID()
+	}
+	rec.ID = session.ID
+	rec.UserName = s.owner(session.Values)
+	rec.LastSeen = now
+	rec.Expires = now.Add(time.Duration(session.Options.MaxAge) * time.Second)
+	rec.IP = clientIP(r)
+	rec.UserAgent = r.UserAgent()
+	rec.Values = values.Bytes()
+	s.records[rec.ID] = rec
+	s.mutex.Unlock()
+
+	err = s.write(rec)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return errors.Wrap(err, "encoding session cookie")
+	}
+	http.SetCookie(w, gsessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func newID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
+
+// WithClientIP gives r the client IP to record on its session. The router knows which proxies to believe, so it
+// works it out and passes it on rather than the store reading X-Forwarded-For, which anyone can set.
+func WithClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// clientIP is where the request came from: what WithClientIP said, or the connection's address
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok && ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+fileExt)
+}
+
+// write saves the record to its file, by way of a temp file so a crash can't leave half of one
+func (s *Store) write(rec *Record) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(rec)
+	if err != nil {
+		return errors.Wrap(err, "encoding session record")
+	}
+
+	tmp := s.path(rec.ID) + ".tmp"
+	err = os.WriteFile(tmp, buf.Bytes(), 0o600)
+	if err != nil {
+		return errors.Wrap(err, "writing session")
+	}
+	err = os.Rename(tmp, s.path(rec.ID))
+	if err != nil {
+		return errors.Wrap(err, "writing session")
+	}
+	return nil
+}
+
+func (s *Store) removeLocked(id string) {
+	delete(s.records, id)
+	err := os.Remove(s.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("error removing session file %v: %v", id, err)
+	}
+}
+
+// Rotate gives the session a new id when it's next saved, so an id someone had before signing in stops working
+func Rotate(session sessions.Session) {
+	session.Set(rotateKey{}, true)
+}
+
+// Sessions returns the live sessions belonging to userName, most recently used first, without their values
+func (s *Store) Sessions(userName string) []Record {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	var list []Record
+	for _, rec := range s.records {
+		if rec.UserName != userName || now.After(rec.Expires) {
+			continue
+		}
+		r := *rec
+		r.Values = nil
+		list = append(list, r)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	return list
+}
+
+// Session returns one live session by id, without its values
+func (s *Store) Session(id string) (Record, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rec, ok := s.records[id]
+	if !ok || time.Now().After(rec.Expires) {
+		return Record{}, false
+	}
+	r := *rec
+	r.Values = nil
+	return r, true
+}
+
+// Revoke ends a session, whoever's it is
+func (s *Store) Revoke(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.records[id]; ok {
+		s.removeLocked(id)
+	}
+}
+
+// RevokeUser ends every one of userName's sessions except the one with id except, and returns how many it ended
+func (s *Store) RevokeUser(userName, except string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := 0
+	for id, rec := range s.records {
+		if rec.UserName == userName && id != except {
+			s.removeLocked(id)
+			count++
+		}
+	}
+	return count
+}
+
+// Cleanup removes expired sessions
+func (s *Store) Cleanup() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for id, rec := range s.records {
+		if now.After(rec.Expires) {
+			s.removeLocked(id)
+		}
+	}
+}
+
+// RunCleanup removes expired sessions every interval until the process exits
+func (s *Store) RunCleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.Cleanup()
+	}
+}
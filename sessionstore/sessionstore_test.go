@@ -0,0 +1,250 @@
+package sessionstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	gsessions "github.com/gorilla/sessions"
+)
+
+const cookieName = "vibecamp"
+
+var hashKey = []byte("a hash key for signing session ids")
+
+func owner(values map[interface{}]interface{}) string {
+	userName, _ := values["user"].(string)
+	return userName
+}
+
+func testStore(t *testing.T, dir string) *Store {
+	s, err := New(dir, owner, hashKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// load is the session a request with cookie gets
+func load(t *testing.T, s *Store, cookie *http.Cookie) *gsessions.Session {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	session, err := s.New(r, cookieName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// save saves the session and returns the cookie it was given, if any
+func save(t *testing.T, s *Store, session *gsessions.Session) *http.Cookie {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("User-Agent", "test browser")
+	w := httptest.NewRecorder()
+	if err := s.Save(r, w, session); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieName {
+			return c
+		}
+	}
+	return nil
+}
+
+// signIn starts a session for userName and returns its cookie
+func signIn(t *testing.T, s *Store, userName string) *http.Cookie {
+	session := load(t, s, nil)
+	session.Values["user"] = userName
+	return save(t, s, session)
+}
+
+func TestSessionCookies(t *testing.T) {
+	s := testStore(t, t.TempDir())
+	alice := signIn(t, s, "alice")
+	other, err := New(t.TempDir(), owner, []byte("somebody else's hash key, for another site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := signIn(t, other, "alice")
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		user   string
+	}{
+		{"no cookie", nil, ""},
+		{"signed in", alice, "alice"},
+		{"tampered with", &http.Cookie{Name: cookieName, Value: alice.Value[:len(alice.Value)-4] + "AAAA"}, ""},
+		{"signed with another key", forged, ""},
+		{"not a session id", &http.Cookie{Name: cookieName, Value: "garbage"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := load(t, s, tt.cookie)
+			if got := owner(session.Values); got != tt.user {
+				t.Errorf("session belongs to %q, want %q", got, tt.user)
+			}
+			if session.IsNew != (tt.user == "") {
+				t.Errorf("IsNew = %v", session.IsNew)
+			}
+		})
+	}
+}
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := testStore(t, dir)
+	cookie := signIn(t, s, "alice")
+
+	s = testStore(t, dir)
+	if got := owner(load(t, s, cookie).Values); got != "alice" {
+		t.Errorf("after a restart the session belongs to %q", got)
+	}
+	list := s.Sessions("alice")
+	if len(list) != 1 || list[0].UserAgent != "test browser" || list[0].Values != nil {
+		t.Errorf("Sessions() = %+v", list)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	dir := t.TempDir()
+	s := testStore(t, dir)
+	phone := signIn(t, s, "alice")
+	laptop := signIn(t, s, "alice")
+	bob := signIn(t, s, "bob")
+
+	laptopID := load(t, s, laptop).ID
+	if n := s.RevokeUser("alice", laptopID); n != 1 {
+		t.Errorf("RevokeUser() ended %d sessions, want 1", n)
+	}
+	if !load(t, s, phone).IsNew {
+		t.Error("alice's phone is still signed in")
+	}
+	if load(t, s, laptop).IsNew || load(t, s, bob).IsNew {
+		t.Error("RevokeUser() ended the wrong sessions")
+	}
+
+	s.Revoke(laptopID)
+	if !load(t, s, laptop).IsNew {
+		t.Error("a revoked session still works")
+	}
+	if _, ok := s.Session(laptopID); ok {
+		t.Error("Session() still has the revoked session")
+	}
+	if _, err := os.Stat(filepath.Join(dir, laptopID+fileExt)); !os.IsNotExist(err) {
+		t.Errorf("the revoked session's file is still there: %v", err)
+	}
+
+	// and it stays revoked after a restart
+	if !load(t, testStore(t, dir), laptop).IsNew {
+		t.Error("a revoked session works again after a restart")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	s := testStore(t, t.TempDir())
+	before := signIn(t, s, "alice")
+
+	session := load(t, s, before)
+	oldID := session.ID
+	session.Values[rotateKey{}] = true
+	after := save(t, s, session)
+
+	if session.ID == oldID {
+		t.Fatal("the id didn't change")
+	}
+	if !load(t, s, before).IsNew {
+		t.Error("the old id still works")
+	}
+	if got := load(t, s, after); got.ID != session.ID || owner(got.Values) != "alice" {
+		t.Errorf("the new id loads %q's session %s", owner(got.Values), got.ID)
+	}
+	if _, ok := load(t, s, after).Values[rotateKey{}]; ok {
+		t.Error("the rotate mark was saved")
+	}
+}
+
+func TestEmptySessionsArentKept(t *testing.T) {
+	dir := t.TempDir()
+	s := testStore(t, dir)
+
+	// a visitor who never signs in
+	if cookie := save(t, s, load(t, s, nil)); cookie != nil {
+		t.Errorf("an empty session got a cookie: %v", cookie)
+	}
+
+	// signing out clears the session
+	cookie := signIn(t, s, "alice")
+	session := load(t, s, cookie)
+	delete(session.Values, "user")
+	cleared := save(t, s, session)
+	if cleared == nil || cleared.MaxAge >= 0 {
+		t.Errorf("signing out set cookie %v, want it expired", cleared)
+	}
+	if !load(t, s, cookie).IsNew {
+		t.Error("the signed out session still works")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 0 {
+		t.Errorf("left files %v", files)
+	}
+}
+
+func TestSaveAfterRevoke(t *testing.T) {
+	dir := t.TempDir()
+	s := testStore(t, dir)
+	cookie := signIn(t, s, "alice")
+
+	// the session's revoked while a request that loaded it is still going
+	session := load(t, s, cookie)
+	s.Revoke(session.ID)
+	session.Values["seen"] = true
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := s.Save(r, httptest.NewRecorder(), session); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Save() = %v, want ErrRevoked", err)
+	}
+	if !load(t, s, cookie).IsNew {
+		t.Error("saving brought the revoked session back")
+	}
+	if _, err := os.Stat(filepath.Join(dir, session.ID+fileExt)); !os.IsNotExist(err) {
+		t.Errorf("the revoked session's file is back: %v", err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		forwarded string
+		routerIP  string
+		want      string
+	}{
+		{"straight from the client", "", "", "192.0.2.1"},
+		{"forwarded header isn't believed", "203.0.113.9", "", "192.0.2.1"},
+		{"what the router worked out", "203.0.113.9", "203.0.113.9", "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.routerIP != "" {
+				r = WithClientIP(r, tt.routerIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package signin
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Discord signs in with discord's OAuth 2.0. apiBase points it somewhere other than discord, and is blank for the
+// real thing.
+func Discord(clientID, clientSecret, redirectURL, apiBase string) *OAuth2 {
+	base := "https://discord.com"
+	if apiBase != "" {
+		base = strings.TrimRight(apiBase, "/")
+	}
+
+	return &OAuth2{
+		ProviderName: "discord",
+		AuthURL:      base + "/oauth2/authorize",
+		TokenURL:     base + "/api/oauth2/token",
+		UserURL:      base + "/api/users/@me",
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"identify", "email"},
+		UserInfo:     discordUser,
+	}
+}
+
+func discordUser(body []byte) (*Identity, error) {
+	var resp struct {
+		ID            string `json:"id"`
+		UserName      string `json:"username"`
+		Discriminator string `json:"discriminator"`
+		GlobalName    string `json:"global_name"`
+		Email         string `json:"email"`
+		Verified      bool   `json:"verified"`
+	}
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		ID:       resp.ID,
+		UserName: DiscordName(resp.UserName, resp.Discriminator),
+		Name:     resp.GlobalName,
+	}
+	if resp.Verified {
+		identity.Email = resp.Email
+	}
+	return identity, nil
+}
+
+// DiscordName is how a discord account's name is written, with the #1234 on the end for accounts that haven't
+// moved to unique usernames yet
+func DiscordName(userName, discriminator string) string {
+	if discriminator == "" || discriminator == "0" {
+		return userName
+	}
+	return userName + "#" + discriminator
+}
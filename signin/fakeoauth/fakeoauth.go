@@ -0,0 +1,187 @@
+// Package fakeoauth is a stand in for twitter's, discord's or google's OAuth 2.0 endpoints, for trying sign in
+// without setting up an app with them. It approves every authorization as one made up account, and checks the
+// PKCE verifier like the real ones do.
+package fakeoauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// endpoints are where each provider's authorize, token and user endpoints live under their base url
+var endpoints = map[string][3]string{
+	"twitter": {"/i/oauth2/authorize", "/2/oauth2/token", "/2/users/me"},
+	"discord": {"/oauth2/authorize", "/api/oauth2/token", "/api/users/@me"},
+	"google":  {"/o/oauth2/v2/auth", "/token", "/v1/userinfo"},
+}
+
+// Account is who every authorization signs in as. Email is only given out as verified when it's set.
+type Account struct {
+	ID       string
+	UserName string
+	Name     string
+	Email    string
+}
+
+type grant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+}
+
+// Server fakes one provider. Deny turns down every authorization instead.
+type Server struct {
+	Provider string
+	Account  Account
+	Deny     bool
+
+	mutex  sync.Mutex
+	codes  map[string]grant
+	tokens map[string]bool
+}
+
+// New makes a fake of the provider, twitter, discord or google
+func New(provider string, account Account) (*Server, error) {
+	if _, ok := endpoints[provider]; !ok {
+		return nil, errors.Newf("No provider called %s", provider)
+	}
+	return &Server{Provider: provider, Account: account, codes: map[string]grant{}, tokens: map[string]bool{}}, nil
+}
+
+// Handler serves the provider's authorize, token and user endpoints
+func (s *Server) Handler() http.Handler {
+	paths := endpoints[s.Provider]
+	mux := http.NewServeMux()
+	mux.HandleFunc(paths[0], s.authorize)
+	mux.HandleFunc(paths[1], s.token)
+	mux.HandleFunc(paths[2], s.me)
+	return mux
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("client_id") == "" {
+		http.Error(w, "need response_type=code and a client_id", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "need an S256 code_challenge", http.StatusBadRequest)
+		return
+	}
+
+	params := redirect.Query()
+	params.Set("state", q.Get("state"))
+	if s.Deny {
+		params.Set("error", "access_denied")
+	} else {
+		code := random()
+		s.mutex.Lock()
+		s.codes[code] = grant{clientID: q.Get("client_id"), redirectURI: q.Get("redirect_uri"), challenge: q.Get("code_challenge")}
+		s.mutex.Unlock()
+		params.Set("code", code)
+	}
+	redirect.RawQuery = params.Encode()
+
+	log.Printf("Authorized %s, back to %s", q.Get("client_id"), redirect)
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" {
+		oauthError(w, "unsupported_grant_type")
+		return
+	}
+
+	s.mutex.Lock()
+	g, ok := s.codes[r.FormValue("code")]
+	delete(s.codes, r.FormValue("code"))
+	s.mutex.Unlock()
+	if !ok {
+		oauthError(w, "invalid_grant")
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		log.Printf("PKCE verifier doesn't match the challenge")
+		oauthError(w, "invalid_grant")
+		return
+	}
+	if r.FormValue("redirect_uri") != g.redirectURI || r.FormValue("client_id") != g.clientID {
+		oauthError(w, "invalid_grant")
+		return
+	}
+
+	accessToken := random()
+	s.mutex.Lock()
+	s.tokens[accessToken] = true
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token_type":   "bearer",
+		"access_token": accessToken,
+		"expires_in":   7200,
+	})
+}
+
+func (s *Server) me(w http.ResponseWriter, r *http.Request) {
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mutex.Lock()
+	ok := s.tokens[accessToken]
+	s.mutex.Unlock()
+	if !ok {
+		http.Error(w, `{"title":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	a := s.Account
+	var user interface{}
+	switch s.Provider {
+	case "twitter":
+		user = map[string]interface{}{
+			"data": map[string]string{"id": a.ID, "username": a.UserName, "name": a.Name},
+		}
+	case "discord":
+		user = map[string]interface{}{
+			"id": a.ID, "username": a.UserName, "discriminator": "0", "global_name": a.Name, "email": a.Email, "verified": a.Email != "",
+		}
+	case "google":
+		user = map[string]interface{}{
+			"sub": a.ID, "name": a.Name, "email": a.Email, "email_verified": a.Email != "",
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+func oauthError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func random() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
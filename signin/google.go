@@ -0,0 +1,55 @@
+package signin
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Google signs in with google's OpenID Connect. apiBase points it somewhere other than google, and is blank for
+// the real thing.
+func Google(clientID, clientSecret, redirectURL, apiBase string) *OAuth2 {
+	authURL := "https://accounts.google.com/o/oauth2/v2/auth"
+	tokenURL := "https://oauth2.googleapis.com/token"
+	userURL := "https://openidconnect.googleapis.com/v1/userinfo"
+	if apiBase != "" {
+		apiBase = strings.TrimRight(apiBase, "/")
+		authURL = apiBase + "/o/oauth2/v2/auth"
+		tokenURL = apiBase + "/token"
+		userURL = apiBase + "/v1/userinfo"
+	}
+
+	return &OAuth2{
+		ProviderName: "google",
+		AuthURL:      authURL,
+		TokenURL:     tokenURL,
+		UserURL:      userURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		UserInfo:     googleUser,
+	}
+}
+
+func googleUser(body []byte) (*Identity, error) {
+	var resp struct {
+		Subject       string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		ID:   resp.Subject,
+		Name: resp.Name,
+	}
+	if resp.EmailVerified {
+		identity.Email = resp.Email
+		identity.UserName = resp.Email
+	}
+	return identity, nil
+}
@@ -0,0 +1,169 @@
+package signin
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// OAuth2 is an OAuth 2.0 authorization code flow with PKCE. UserInfo turns the body of a GET to UserURL into
+// who signed in.
+type OAuth2 struct {
+	ProviderName string
+	AuthURL      string
+	TokenURL     string
+	UserURL      string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	UserInfo     func(body []byte) (*Identity, error)
+	Client       *http.Client
+}
+
+// Name is the provider's name, like "twitter"
+func (p *OAuth2) Name() string {
+	return p.ProviderName
+}
+
+// Begin makes a fresh state and PKCE verifier, and returns the authorize URL with the verifier's challenge
+func (p *OAuth2) Begin(ctx context.Context) (string, *State, error) {
+	value, err := randomString(24)
+	if err != nil {
+		return "", nil, err
+	}
+	verifier, err := randomString(48)
+	if err != nil {
+		return "", nil, err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURL)
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", value)
+	params.Set("code_challenge", challenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	state := &State{Provider: p.ProviderName, Value: value, Verifier: verifier}
+	return p.AuthURL + "?" + params.Encode(), state, nil
+}
+
+// challenge is the S256 PKCE challenge for a verifier
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Finish checks the state, trades the code for an access token, and looks up who it belongs to
+func (p *OAuth2) Finish(ctx context.Context, r *http.Request, state *State) (*Identity, error) {
+	q := r.URL.Query()
+	if q.Get("error") != "" {
+		return nil, errors.Wrapf(ErrDenied, "%s: %s", p.ProviderName, q.Get("error"))
+	}
+
+	if state == nil || state.Provider != p.ProviderName || state.Value == "" ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state.Value)) != 1 {
+		return nil, errors.New("sign in state doesn't match, try signing in again")
+	}
+
+	code := q.Get("code")
+	if code == "" {
+		return nil, errors.New("no authorization code in callback")
+	}
+
+	token, err := p.exchange(ctx, code, state.Verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.UserURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "making user request")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	body, err := p.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting user")
+	}
+
+	identity, err := p.UserInfo(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading user")
+	}
+	if identity.ID == "" {
+		return nil, errors.Newf("%s didn't say who signed in", p.ProviderName)
+	}
+
+	identity.Provider = p.ProviderName
+	return identity, nil
+}
+
+// exchange trades an authorization code for an access token
+func (p *OAuth2) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "making token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	body, err := p.do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "getting access token")
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return "", errors.Wrap(err, "reading access token")
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no access token in response")
+	}
+	return token.AccessToken, nil
+}
+
+func (p *OAuth2) do(req *http.Request) ([]byte, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Newf("%s returned %d: %s", req.URL.Host, resp.StatusCode, body)
+	}
+	return body, nil
+}
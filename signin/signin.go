@@ -0,0 +1,58 @@
+// Package signin signs people in through third party providers. Each provider starts by sending them off to
+// authorize us, and finishes when they come back to the callback with who they are.
+package signin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/cockroachdb/errors"
+)
+
+// Identity is who a provider says signed in. ID is the provider's stable id for them, which doesn't change
+// when they change their handle. Email is only set when the provider has verified it.
+type Identity struct {
+	Provider string
+	ID       string
+	UserName string
+	Name     string
+	Email    string
+}
+
+// State is what a provider needs to remember between sending someone off and them coming back. It's kept in
+// the session.
+type State struct {
+	Provider string
+	Value    string
+	Verifier string
+	// where to send them once they're back, for linking an account from a page other than sign in
+	Next string
+
+	// oauth 1.0a request token
+	RequestKey    string
+	RequestSecret string
+}
+
+// Provider is somewhere people can sign in through
+type Provider interface {
+	Name() string
+	// Begin returns where to send them to authorize us, and the state to keep until they come back
+	Begin(ctx context.Context) (string, *State, error)
+	// Finish checks the callback request against the kept state and returns who signed in
+	Finish(ctx context.Context, r *http.Request, state *State) (*Identity, error)
+}
+
+// ErrDenied is returned when they came back without authorizing us
+var ErrDenied = errors.New("sign in was cancelled")
+
+// randomString returns n random bytes, url safe base64 encoded
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "generating random string")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,206 @@
+package signin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/signin/fakeoauth"
+
+	"github.com/cockroachdb/errors"
+)
+
+const callback = "https://my.vibe.camp/callback"
+
+var providers = []struct {
+	name        string
+	newProvider func(apiBase string) *OAuth2
+	account     fakeoauth.Account
+	want        Identity
+}{
+	{
+		"twitter",
+		func(apiBase string) *OAuth2 { return Twitter("client", "secret", callback, apiBase) },
+		fakeoauth.Account{ID: "1234", UserName: "grintesting", Name: "Grin Testing"},
+		Identity{Provider: "twitter", ID: "1234", UserName: "grintesting", Name: "Grin Testing"},
+	},
+	{
+		"discord",
+		func(apiBase string) *OAuth2 { return Discord("client", "secret", callback, apiBase) },
+		fakeoauth.Account{ID: "5678", UserName: "grin", Name: "Grin", Email: "grin@example.com"},
+		Identity{Provider: "discord", ID: "5678", UserName: "grin", Name: "Grin", Email: "grin@example.com"},
+	},
+	{
+		"discord without a verified email",
+		func(apiBase string) *OAuth2 { return Discord("client", "", callback, apiBase) },
+		fakeoauth.Account{ID: "5678", UserName: "grin", Name: "Grin"},
+		Identity{Provider: "discord", ID: "5678", UserName: "grin", Name: "Grin"},
+	},
+	{
+		"google",
+		func(apiBase string) *OAuth2 { return Google("client", "secret", callback, apiBase) },
+		fakeoauth.Account{ID: "sub-1", Name: "Grin Testing", Email: "grin@example.com"},
+		Identity{Provider: "google", ID: "sub-1", UserName: "grin@example.com", Name: "Grin Testing", Email: "grin@example.com"},
+	},
+	{
+		"google without a verified email",
+		func(apiBase string) *OAuth2 { return Google("client", "secret", callback, apiBase) },
+		fakeoauth.Account{ID: "sub-1", Name: "Grin Testing"},
+		Identity{Provider: "google", ID: "sub-1", Name: "Grin Testing"},
+	},
+}
+
+// fakeProvider starts a fake of the named provider, and returns one made by newProvider pointed at it
+func fakeProvider(t *testing.T, provider string, account fakeoauth.Account, newProvider func(apiBase string) *OAuth2) (*OAuth2, *fakeoauth.Server) {
+	fake, err := fakeoauth.New(provider, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(fake.Handler())
+	t.Cleanup(server.Close)
+	return newProvider(server.URL), fake
+}
+
+// authorize follows the authorize URL and returns the request the provider sends back to the callback
+func authorize(t *testing.T, authURL string) *http.Request {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d", resp.StatusCode)
+	}
+	return httptest.NewRequest(http.MethodGet, resp.Header.Get("Location"), nil)
+}
+
+func TestSignIn(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range providers {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := fakeProvider(t, tt.want.Provider, tt.account, tt.newProvider)
+			authURL, state, err := p.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			identity, err := p.Finish(ctx, authorize(t, authURL), state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *identity != tt.want {
+				t.Errorf("signed in as %+v, want %+v", *identity, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignInFails(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// change breaks the sign in between authorizing and coming back
+		change func(r *http.Request, state *State) (*http.Request, *State)
+		denied bool
+	}{
+		{"state doesn't match", func(r *http.Request, state *State) (*http.Request, *State) {
+			q := r.URL.Query()
+			q.Set("state", "someone else's")
+			r.URL.RawQuery = q.Encode()
+			return r, state
+		}, false},
+		{"no state kept", func(r *http.Request, state *State) (*http.Request, *State) {
+			return r, nil
+		}, false},
+		{"state from another provider", func(r *http.Request, state *State) (*http.Request, *State) {
+			state.Provider = "somewhere else"
+			return r, state
+		}, false},
+		{"no code", func(r *http.Request, state *State) (*http.Request, *State) {
+			q := r.URL.Query()
+			q.Del("code")
+			r.URL.RawQuery = q.Encode()
+			return r, state
+		}, false},
+		{"wrong code", func(r *http.Request, state *State) (*http.Request, *State) {
+			q := r.URL.Query()
+			q.Set("code", "made up")
+			r.URL.RawQuery = q.Encode()
+			return r, state
+		}, false},
+		{"wrong verifier", func(r *http.Request, state *State) (*http.Request, *State) {
+			state.Verifier = "not the one the challenge was made from"
+			return r, state
+		}, false},
+		{"cancelled", func(r *http.Request, state *State) (*http.Request, *State) {
+			q := url.Values{"state": {state.Value}, "error": {"access_denied"}}
+			r.URL.RawQuery = q.Encode()
+			return r, state
+		}, true},
+	}
+
+	for _, provider := range providers {
+		for _, tt := range tests {
+			t.Run(provider.name+" "+tt.name, func(t *testing.T) {
+				p, _ := fakeProvider(t, provider.want.Provider, provider.account, provider.newProvider)
+				authURL, state, err := p.Begin(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				r, state := tt.change(authorize(t, authURL), state)
+				identity, err := p.Finish(ctx, r, state)
+				if err == nil {
+					t.Fatalf("signed in as %+v", identity)
+				}
+				if errors.Is(err, ErrDenied) != tt.denied {
+					t.Errorf("Finish() error = %v, want denied %v", err, tt.denied)
+				}
+			})
+		}
+	}
+}
+
+func TestSignInCodeOnlyWorksOnce(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range providers {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := fakeProvider(t, tt.want.Provider, tt.account, tt.newProvider)
+			authURL, state, err := p.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := authorize(t, authURL)
+			if _, err := p.Finish(ctx, r, state); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.Finish(ctx, r, state); err == nil {
+				t.Error("the same callback signed in twice")
+			}
+		})
+	}
+}
+
+func TestSignInDenied(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range providers {
+		t.Run(tt.name, func(t *testing.T) {
+			p, fake := fakeProvider(t, tt.want.Provider, tt.account, tt.newProvider)
+			fake.Deny = true
+			authURL, state, err := p.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := p.Finish(ctx, authorize(t, authURL), state); !errors.Is(err, ErrDenied) {
+				t.Errorf("Finish() error = %v, want ErrDenied", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package signin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+	"github.com/kurrik/oauth1a"
+)
+
+// Twitter signs in with twitter's OAuth 2.0. apiBase points it somewhere other than twitter, like a local fake
+// authorization server, and is blank for the real thing.
+func Twitter(clientID, clientSecret, redirectURL, apiBase string) *OAuth2 {
+	authURL := "https://twitter.com/i/oauth2/authorize"
+	tokenURL := "https://api.twitter.com/2/oauth2/token"
+	userURL := "https://api.twitter.com/2/users/me"
+	if apiBase != "" {
+		apiBase = strings.TrimRight(apiBase, "/")
+		authURL = apiBase + "/i/oauth2/authorize"
+		tokenURL = apiBase + "/2/oauth2/token"
+		userURL = apiBase + "/2/users/me"
+	}
+
+	return &OAuth2{
+		ProviderName: "twitter",
+		AuthURL:      authURL,
+		TokenURL:     tokenURL,
+		UserURL:      userURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"users.read", "tweet.read"},
+		UserInfo:     twitterUser,
+	}
+}
+
+func twitterUser(body []byte) (*Identity, error) {
+	var resp struct {
+		Data struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			UserName string `json:"username"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		ID:       resp.Data.ID,
+		UserName: resp.Data.UserName,
+		Name:     resp.Data.Name,
+	}, nil
+}
+
+// TwitterOAuth1 signs in with twitter's legacy OAuth 1.0a endpoints
+type TwitterOAuth1 struct {
+	Service *oauth1a.Service
+}
+
+// Name is "twitter", it's the same accounts as the OAuth 2.0 flow
+func (p *TwitterOAuth1) Name() string {
+	return "twitter"
+}
+
+// Begin gets a request token and returns the URL to authorize it
+func (p *TwitterOAuth1) Begin(ctx context.Context) (string, *State, error) {
+	config := &oauth1a.UserConfig{}
+	err := config.GetRequestToken(ctx, p.Service, http.DefaultClient)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "getting request token")
+	}
+
+	url, err := config.GetAuthorizeURL(p.Service)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "getting authorization url")
+	}
+
+	return url, &State{Provider: p.Name(), RequestKey: config.RequestTokenKey, RequestSecret: config.RequestTokenSecret}, nil
+}
+
+// Finish trades the authorized request token for an access token, which comes with who signed in
+func (p *TwitterOAuth1) Finish(ctx context.Context, r *http.Request, state *State) (*Identity, error) {
+	if r.URL.Query().Get("denied") != "" {
+		return nil, errors.Wrap(ErrDenied, "twitter")
+	}
+
+	if state == nil || state.Provider != p.Name() || state.RequestKey == "" {
+		return nil, errors.New("no sign in found in session, try signing in again")
+	}
+
+	config := &oauth1a.UserConfig{RequestTokenKey: state.RequestKey, RequestTokenSecret: state.RequestSecret}
+	token, verifier, err := config.ParseAuthorize(r, p.Service)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing authorization")
+	}
+
+	err = config.GetAccessToken(ctx, token, verifier, p.Service, http.DefaultClient)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting access token")
+	}
+
+	return &Identity{
+		Provider: p.Name(),
+		ID:       config.AccessValues.Get("user_id"),
+		UserName: config.AccessValues.Get("screen_name"),
+	}, nil
+}
@@ -10,15 +10,14 @@ const stripe = Stripe(pk);
 let elements;
 
 let items = [];
-let username = "";
-let usertype = "";
 let paymentIntentId = "";
+let promoCode = "";
+let installments = false;
+let coverFees = true;
+let paymentElement;
 const ticketCart = document.querySelector("#ticket-cart");
 if (ticketCart.hasAttribute("cartData")) {
   items = JSON.parse(ticketCart.getAttribute("cartData")).items;
-  username = ticketCart.getAttribute("username");
-  usertype = ticketCart.getAttribute("usertype");
-  ordertype = ticketCart.getAttribute("ordertype");
 }
 
 initialize();
@@ -28,6 +27,20 @@ document
   .querySelector("#payment-form")
   .addEventListener("submit", handleSubmit);
 
+const promoForm = document.querySelector("#promo-form");
+if (promoForm) {
+  promoForm.addEventListener("submit", handlePromo);
+}
+
+document
+  .querySelector("#installments")
+  .addEventListener("change", handleInstallments);
+
+const coverFeesBox = document.querySelector("#cover-fees");
+if (coverFeesBox) {
+  coverFeesBox.addEventListener("change", handleCoverFees);
+}
+
 // how do i get items
 // pass into template from go & call func in html js script tag
 // get from query params within this js script
@@ -46,23 +59,114 @@ async function initialize() {
   }
 
   setLoading(true);
+  const error = await createPaymentIntent();
+  if (error) {
+    showMessage(error);
+  }
+  setLoading(false);
+}
+
+// Creates or updates the payment intent for the cart and promo code, and mounts the payment form.
+// Returns an error message if the server turned the cart down.
+async function createPaymentIntent() {
   const response = await fetch("/create-payment-intent", {
     method: "POST",
     headers: { "Content-Type": "application/json" },
-    body: JSON.stringify({ items, username, usertype, ordertype }),
+    body: JSON.stringify({
+      items,
+      promoCode,
+      installments,
+      coverFees,
+    }),
   });
-  const { clientSecret, total, intentId } = await response.json();
+  const body = await response.json();
+  if (!response.ok) {
+    return body.error || "Something went wrong.";
+  }
+
+  const { clientSecret, total, intentId, discount, planOffered, dueNow, fee } =
+    body;
   paymentIntentId = intentId;
 
   const appearance = {
     theme: "stripe",
   };
+  if (paymentElement) {
+    paymentElement.destroy();
+  }
   elements = stripe.elements({ appearance, clientSecret });
 
-  document.querySelector("#order-total").value = `$${total.toFixed(2)}`;
+  let totalText = `$${total.toFixed(2)}`;
+  if (discount > 0) {
+    totalText += ` ($${discount.toFixed(2)} off)`;
+  }
+  if (fee > 0) {
+    totalText += `, incl. $${fee.toFixed(2)} fee`;
+  }
+  if (installments) {
+    totalText += `, $${dueNow.toFixed(2)} due today`;
+  }
+  document.querySelector("#order-total").value = totalText;
+
+  const installmentsDiv = document.querySelector("#installments-div");
+  if (planOffered > 1) {
+    document.querySelector(
+      "#installments-label"
+    ).textContent = `Pay in ${planOffered} installments`;
+    installmentsDiv.classList.remove("hidden");
+  } else {
+    installmentsDiv.classList.add("hidden");
+  }
   document.querySelector("#total-div").classList.remove("hidden");
-  const paymentElement = elements.create("payment");
+  paymentElement = elements.create("payment");
   paymentElement.mount("#payment-element");
+  return "";
+}
+
+async function handlePromo(e) {
+  e.preventDefault();
+  const previous = promoCode;
+  promoCode = document.querySelector("#promo-code").value.trim();
+  const message = document.querySelector("#promo-message");
+
+  setLoading(true);
+  const error = await createPaymentIntent();
+  if (error) {
+    promoCode = previous;
+    message.textContent = error;
+    message.className = "col-12 small text-danger";
+  } else if (promoCode) {
+    message.textContent = "Code applied!";
+    message.className = "col-12 small text-success";
+  } else {
+    message.textContent = "";
+  }
+  setLoading(false);
+}
+
+async function handleInstallments(e) {
+  installments = e.target.checked;
+
+  setLoading(true);
+  const error = await createPaymentIntent();
+  if (error) {
+    installments = !installments;
+    e.target.checked = installments;
+    showMessage(error);
+  }
+  setLoading(false);
+}
+
+async function handleCoverFees(e) {
+  coverFees = e.target.checked;
+
+  setLoading(true);
+  const error = await createPaymentIntent();
+  if (error) {
+    coverFees = !coverFees;
+    e.target.checked = coverFees;
+    showMessage(error);
+  }
   setLoading(false);
 }
 
@@ -10,12 +10,10 @@ const stripe = Stripe(pk);
 let elements;
 
 let items = {};
-let username = "";
 let paymentIntentId = "";
 const ticketCart = document.querySelector("#ticket-cart");
 if (ticketCart.hasAttribute("cartData")) {
   items = JSON.parse(ticketCart.getAttribute("cartData"));
-  username = ticketCart.getAttribute("username");
 }
 
 initialize();
@@ -46,9 +44,15 @@ async function initialize() {
   const response = await fetch("/create-payment-intent-transport", {
     method: "POST",
     headers: { "Content-Type": "application/json" },
-    body: JSON.stringify({ ...items, username }),
+    body: JSON.stringify(items),
   });
-  const { clientSecret, total, intentId } = await response.json();
+  const body = await response.json();
+  if (!response.ok) {
+    showMessage(body.error || "Something went wrong.");
+    setLoading(false);
+    return;
+  }
+  const { clientSecret, total, intentId } = body;
   paymentIntentId = intentId;
 
   const appearance = {
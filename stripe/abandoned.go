@@ -0,0 +1,137 @@
+package stripe
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/paymentintent"
+)
+
+const defaultAbandonedCheckoutMinutes = 180
+
+// order status once an unpaid checkout is cancelled
+const abandoned = "abandoned"
+
+var sweepMutex sync.Mutex
+
+// SweepAbandonedCheckouts cancels payment intents that have sat unpaid past the timeout, gives back the
+// promo code holds and bus seats their orders reserved, and clears the attendee's order so they can start over.
+// Ticket orders don't hold capacity until they're paid, and waitlist offers expire on their own.
+func SweepAbandonedCheckouts() {
+	sweepMutex.Lock()
+	defer sweepMutex.Unlock()
+
+	timeout := time.Duration(constantOr(fields.AbandonedCheckoutMinutes, defaultAbandonedCheckoutMinutes)) * time.Minute
+
+	orders, err := db.GetUnpaidOrders()
+	if err != nil {
+		log.Errorf("error getting unpaid orders: %v", err)
+		return
+	}
+
+	for _, order := range orders {
+		created, err := time.Parse("2006-01-02 15:04", order.Date)
+		if err != nil || time.Since(created) < timeout {
+			continue
+		}
+
+		err = abandonOrder(order)
+		if err != nil {
+			log.Errorf("error abandoning order %v: %v", order.OrderID, err)
+		}
+	}
+}
+
+func abandonOrder(order *db.Order) error {
+	pi, err := paymentintent.Get(order.StripeID, nil)
+	if err != nil {
+		return errors.Wrap(err, "getting payment intent")
+	}
+
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded, stripe.PaymentIntentStatusProcessing:
+		// paid after all, the webhook will catch up
+		log.Debugf("Order %v is %s, not abandoning", order.OrderID, pi.Status)
+		return nil
+	case stripe.PaymentIntentStatusCanceled:
+	default:
+		_, err = paymentintent.Cancel(pi.ID, &stripe.PaymentIntentCancelParams{
+			CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonAbandoned)),
+		})
+		if err != nil {
+			return errors.Wrap(err, "cancelling payment intent")
+		}
+	}
+
+	// the order stays unpaid until the last step, so the next sweep finishes the job if one fails, skipping what's done
+	j := orderJournal(order, "abandon")
+
+	if order.BusToVibecamp != "" {
+		err = j.step("bus-to-released", fmt.Sprintf("free %d seats on bus %v", order.BusSpots, order.BusToVibecamp), func() error {
+			return db.UpdateSlot(order.BusToVibecamp, -order.BusSpots)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if order.BusFromVibecamp != "" {
+		err = j.step("bus-from-released", fmt.Sprintf("free %d seats on bus %v", order.BusSpots, order.BusFromVibecamp), func() error {
+			return db.UpdateSlot(order.BusFromVibecamp, -order.BusSpots)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// failed orders keep their hold in case the payment's retried, so it goes back here too
+	if order.PromoCode != "" {
+		err = j.step("promo-released", fmt.Sprintf("release the hold on promo code %v", order.PromoCode), func() error {
+			return db.ReleaseRedemption(order.PromoCode)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if order.TotalTickets > 0 {
+		err = j.step("order-cleared", fmt.Sprintf("clear @%v's order", order.UserName), func() error {
+			user, err := db.GetUser(order.UserName)
+			if err != nil {
+				return err
+			}
+			if !strings.EqualFold(user.OrderID, order.OrderID) {
+				return nil
+			}
+			return user.UpdateOrderID("")
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = j.step("status", fmt.Sprintf("set order %v status to %v", order.OrderID, abandoned), func() error {
+		return order.UpdateOrderStatus(abandoned)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Abandoned order %v for @%v after its checkout went unpaid", order.OrderID, order.UserName)
+	return nil
+}
+
+// RunCheckoutSweeper sweeps abandoned checkouts every interval until the process exits
+func RunCheckoutSweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		SweepAbandonedCheckouts()
+	}
+}
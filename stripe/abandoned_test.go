@@ -0,0 +1,198 @@
+package stripe
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+var unpaidIntent = regexp.MustCompile(`"status":\s*"requires_payment_method"`)
+
+// stripeMock points stripe at a running stripe-mock (https://github.com/stripe/stripe-mock), skipping the test if
+// there isn't one. Intents with "paid" in their id come back succeeded, and it returns the paths that were posted to.
+func stripeMock(t *testing.T) func() []string {
+	base := os.Getenv("STRIPE_MOCK_URL")
+	if base == "" {
+		base = "http://localhost:12111"
+	}
+	target, err := url.Parse(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Timeout: time.Second}
+	if _, err := client.Get(base); err != nil {
+		t.Skipf("stripe-mock isn't running at %s: %v", base, err)
+	}
+
+	var mutex sync.Mutex
+	var posted []string
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.Request.Method == http.MethodPost {
+			mutex.Lock()
+			posted = append(posted, resp.Request.URL.Path)
+			mutex.Unlock()
+		}
+		if !strings.Contains(resp.Request.URL.Path, "paid") {
+			return nil
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		body = unpaidIntent.ReplaceAll(body, []byte(`"status":"succeeded"`))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	stripe.Key = "sk_test_123"
+	UseAPIBase(server.URL)
+	return func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, posted...)
+	}
+}
+
+func TestSweepAbandonedCheckouts(t *testing.T) {
+	posted := stripeMock(t)
+	s := dbtest.New(t)
+
+	longAgo := time.Now().UTC().Add(-4 * time.Hour).Format("2006-01-02 15:04")
+	justNow := time.Now().UTC().Format("2006-01-02 15:04")
+	order := func(orderID, paymentID, status, date string, more map[string]interface{}) string {
+		f := map[string]interface{}{
+			fields.OrderID:       orderID,
+			fields.UserName:      "alice",
+			fields.PaymentID:     paymentID,
+			fields.PaymentStatus: status,
+			fields.Date:          date,
+		}
+		for k, v := range more {
+			f[k] = v
+		}
+		return s.Add(dbtest.Orders, f)
+	}
+
+	alice := s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "alice", fields.OrderID: "order-abandoned"})
+	to := s.Add("Bus 2023", map[string]interface{}{fields.BusSlot: "Friday 10am", fields.Purchased: 5, fields.Cap: 50})
+	from := s.Add("Bus 2023", map[string]interface{}{fields.BusSlot: "Monday 10am", fields.Purchased: 4, fields.Cap: 50})
+	promo := s.Add("Promo Codes", map[string]interface{}{fields.Code: "FRIEND", fields.DiscountType: fields.FixedDiscount, fields.Reserved: 2})
+
+	abandonedOrder := order("order-abandoned", "pi_abandoned", "", longAgo, map[string]interface{}{
+		fields.TotalTickets:    1,
+		fields.BusSpots:        2,
+		fields.BusToVibecamp:   "Friday 10am",
+		fields.BusFromVibecamp: "Monday 10am",
+		fields.PromoCode:       "FRIEND",
+	})
+	failedOrder := order("order-failed", "pi_failed", "failed", longAgo, map[string]interface{}{fields.PromoCode: "FRIEND"})
+	paidOrder := order("order-paid", "pi_paid", "", longAgo, nil)
+	recentOrder := order("order-recent", "pi_recent", "", justNow, nil)
+	successOrder := order("order-success", "pi_success", "success", longAgo, nil)
+
+	SweepAbandonedCheckouts()
+
+	tests := []struct {
+		name  string
+		table string
+		id    string
+		field string
+		want  string
+	}{
+		{"unpaid order", dbtest.Orders, abandonedOrder, fields.PaymentStatus, abandoned},
+		{"failed order", dbtest.Orders, failedOrder, fields.PaymentStatus, abandoned},
+		{"paid but the webhook hasn't come", dbtest.Orders, paidOrder, fields.PaymentStatus, ""},
+		{"still checking out", dbtest.Orders, recentOrder, fields.PaymentStatus, ""},
+		{"already paid", dbtest.Orders, successOrder, fields.PaymentStatus, "success"},
+		{"bus there", "Bus 2023", to, fields.Purchased, "3"},
+		{"bus back", "Bus 2023", from, fields.Purchased, "2"},
+		{"promo code", "Promo Codes", promo, fields.Reserved, "0"},
+		{"alice can start over", dbtest.Attendees, alice, fields.OrderID, ""},
+	}
+	for _, tt := range tests {
+		if got := s.Get(tt.table, tt.id)[tt.field]; got != tt.want {
+			t.Errorf("%s: %s = %q, want %q", tt.name, tt.field, got, tt.want)
+		}
+	}
+
+	cancelled := strings.Join(posted(), ",")
+	if want := "/v1/payment_intents/pi_abandoned/cancel,/v1/payment_intents/pi_failed/cancel"; cancelled != want {
+		t.Errorf("cancelled %s, want %s", cancelled, want)
+	}
+}
+
+func TestSweepFinishesAfterAFailure(t *testing.T) {
+	stripeMock(t)
+	s := dbtest.New(t)
+
+	alice := s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "alice", fields.OrderID: "order1"})
+	bus := s.Add("Bus 2023", map[string]interface{}{fields.BusSlot: "Friday 10am", fields.Purchased: 5, fields.Cap: 50})
+	promo := s.Add("Promo Codes", map[string]interface{}{fields.Code: "FRIEND", fields.DiscountType: fields.FixedDiscount, fields.Reserved: 2})
+	order := s.Add(dbtest.Orders, map[string]interface{}{
+		fields.OrderID:       "order1",
+		fields.UserName:      "alice",
+		fields.PaymentID:     "pi_abandoned",
+		fields.Date:          time.Now().UTC().Add(-4 * time.Hour).Format("2006-01-02 15:04"),
+		fields.TotalTickets:  1,
+		fields.BusSpots:      2,
+		fields.BusToVibecamp: "Friday 10am",
+		fields.PromoCode:     "FRIEND",
+	})
+
+	tests := []struct {
+		name string
+		// the table whose next write fails
+		failing  string
+		seats    string
+		reserved string
+		orderID  string
+		status   string
+	}{
+		{"promo code write fails", "Promo Codes", "3", "2", "order1", ""},
+		{"attendee write fails", dbtest.Attendees, "3", "1", "order1", ""},
+		{"swept again", "", "3", "1", "", abandoned},
+		{"nothing left to sweep", "", "3", "1", "", abandoned},
+	}
+
+	for _, tt := range tests {
+		if tt.failing != "" {
+			s.FailWrites(tt.failing, 1)
+		}
+		SweepAbandonedCheckouts()
+
+		if got := s.Get("Bus 2023", bus)[fields.Purchased]; got != tt.seats {
+			t.Errorf("%s: bus seats = %s, want %s", tt.name, got, tt.seats)
+		}
+		if got := s.Get("Promo Codes", promo)[fields.Reserved]; got != tt.reserved {
+			t.Errorf("%s: promo held = %s, want %s", tt.name, got, tt.reserved)
+		}
+		if got := s.Get(dbtest.Attendees, alice)[fields.OrderID]; got != tt.orderID {
+			t.Errorf("%s: order id = %q, want %q", tt.name, got, tt.orderID)
+		}
+		if got := s.Get(dbtest.Orders, order)[fields.PaymentStatus]; got != tt.status {
+			t.Errorf("%s: status = %q, want %q", tt.name, got, tt.status)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package stripe
+
+import (
+	"strings"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/sales"
+	"github.com/vibecamp/myvibecamp/waitlist"
+
+	"github.com/cockroachdb/errors"
+)
+
+// most of any one thing a single checkout can buy
+const maxItemQuantity = 10
+
+const maxDonation = 10000
+
+// TransportCart is the bus seats and bedding on a transport checkout, and whether the buyer covers an optional fee
+type TransportCart struct {
+	BusSpots        int    `json:"busSpots"`
+	BusToVibecamp   string `json:"busToVibecamp"`
+	BusFromVibecamp string `json:"busFromVibecamp"`
+	SleepingBags    int    `json:"sleepingBags"`
+	SheetSets       int    `json:"sheetSets"`
+	Pillows         int    `json:"pillows"`
+	CoverFees       bool   `json:"coverFees"`
+}
+
+// ErrCartMismatch means the cart sent with a payment doesn't match the checkout page we rendered
+var ErrCartMismatch = errors.New("Your cart changed since checkout opened, please go back to your cart and try again")
+
+// validateItems checks every item is something we sell, in a sensible quantity, and that all tickets are one admission level
+func validateItems(items []db.Item) error {
+	if len(items) == 0 {
+		return errors.New("Your cart is empty")
+	}
+
+	seen := map[string]bool{}
+	level := ""
+	for _, item := range items {
+		if seen[item.Id] {
+			return errors.Newf("'%s' is in your cart twice", item.Id)
+		}
+		seen[item.Id] = true
+
+		if item.Id == "donation" {
+			if item.Quantity != 1 || item.Amount < 1 || item.Amount > maxDonation {
+				return errors.Newf("Donations must be between $1 and $%d", maxDonation)
+			}
+			continue
+		}
+
+		if _, ok := ticketPrices[item.Id]; !ok {
+			return errors.Newf("'%s' isn't something we sell", item.Id)
+		}
+
+		if item.Quantity < 1 || item.Quantity > maxItemQuantity {
+			return errors.Newf("Ticket quantities must be between 1 and %d", maxItemQuantity)
+		}
+
+		if item.Amount != 0 {
+			return errors.Newf("'%s' can't carry its own amount", item.Id)
+		}
+
+		itemLevel := item.Id[strings.Index(item.Id, "-")+1:]
+		if level != "" && itemLevel != level {
+			return errors.New("All tickets in an order must be the same admission level")
+		}
+		level = itemLevel
+	}
+
+	return nil
+}
+
+// sameItems is whether two carts hold the same items in the same quantities, in any order
+func sameItems(a, b []db.Item) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[db.Item]int, len(a))
+	for _, item := range a {
+		counts[item]++
+	}
+	for _, item := range b {
+		if counts[item] == 0 {
+			return false
+		}
+		counts[item]--
+	}
+
+	return true
+}
+
+// ticketCounts returns how many adult tickets and how many tickets of any age are in the cart
+func ticketCounts(items []db.Item) (adults, total int) {
+	for _, item := range items {
+		if _, ok := ticketPrices[item.Id]; !ok {
+			continue
+		}
+		if strings.HasPrefix(item.Id, "adult") {
+			adults += item.Quantity
+		}
+		total += item.Quantity
+	}
+	return adults, total
+}
+
+// admissionLevels maps the level in a ticket sku to the admission level it buys
+var admissionLevels = map[string]string{"cabin": fields.CabinAdmission, "tent": fields.TentAdmission, "sat": fields.SatAdmission}
+
+// cartLevel is the admission level of the tickets in a cart that's been through validateItems, "" if it has none
+func cartLevel(items []db.Item) string {
+	for _, item := range items {
+		if _, ok := ticketPrices[item.Id]; ok {
+			return admissionLevels[item.Id[strings.Index(item.Id, "-")+1:]]
+		}
+	}
+	return ""
+}
+
+// guestListEntry is what the guest list for a user's ticket path allows them: how many adult tickets, which sales
+// phase they buy in, and the admission level they're held to, if any
+type guestListEntry struct {
+	limit int
+	phase string
+	level string
+}
+
+// ticketLimit looks up the user on the guest list for their ticket path
+func ticketLimit(user *db.User) (*guestListEntry, error) {
+	switch user.TicketPath {
+	case fields.Attendee2022:
+		softLaunchUser, err := db.GetSoftLaunchUser(user.UserName)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting soft launch user")
+		}
+		return &guestListEntry{limit: softLaunchUser.TicketLimit, phase: fields.Attendee2022}, nil
+	case fields.Sponsorship:
+		sponsoredUser, err := db.GetSponsorshipUser(user.UserName)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting sponsorship user")
+		}
+		return &guestListEntry{limit: sponsoredUser.TicketLimit, phase: fields.Sponsorship, level: sponsoredUser.AdmissionLevel}, nil
+	default:
+		chaosUser, err := db.GetChaosUser(user.UserName)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting chaos user")
+		}
+		return &guestListEntry{limit: chaosUser.TicketLimit, phase: chaosUser.Phase, level: chaosUser.AdmissionLevel}, nil
+	}
+}
+
+// checkEligible re-checks the cart against the user's ticket limit and admission level, whether their sales phase
+// is selling, and that there's still room under the caps once tickets held for waitlist offers are counted
+func checkEligible(user *db.User, items []db.Item) error {
+	entry, err := ticketLimit(user)
+	if err != nil {
+		return err
+	}
+
+	adults, total := ticketCounts(items)
+	if adults > entry.limit {
+		return errors.Newf("You're limited to %d adult tickets", entry.limit)
+	}
+
+	err = sales.Allowed(entry.phase, total)
+	if err != nil {
+		return err
+	}
+
+	level := cartLevel(items)
+	if level == "" {
+		return nil
+	}
+	if level != user.AdmissionLevel || (entry.level != "" && level != entry.level) {
+		return errors.Newf("Your tickets can't be %s admission, please go back to your cart and try again", level)
+	}
+
+	remaining, err := waitlist.RemainingFor(user.UserName, level)
+	if err != nil {
+		return err
+	}
+	// the soft launch had a smaller cabin cap of its own
+	if entry.phase == fields.Attendee2022 && level == fields.CabinAdmission {
+		softRemaining, err := waitlist.RemainingUnder(user.UserName, fields.SoftCabinCap, fields.CabinSold, fields.CabinAdmission)
+		if err != nil {
+			return err
+		}
+		if softRemaining < remaining {
+			remaining = softRemaining
+		}
+	}
+	if total > remaining {
+		if remaining < 0 {
+			remaining = 0
+		}
+		return errors.Newf("Sorry, there are only %d %s tickets left. Join the waitlist and we'll let you know if more open up.", remaining, level)
+	}
+
+	return nil
+}
+
+// validateTransport checks the quantities are sensible and the bus slots exist and have room
+func validateTransport(cart TransportCart) error {
+	quantities := []int{cart.BusSpots, cart.SleepingBags, cart.SheetSets, cart.Pillows}
+	total := 0
+	for _, q := range quantities {
+		if q < 0 || q > maxItemQuantity {
+			return errors.Newf("Quantities must be between 0 and %d", maxItemQuantity)
+		}
+		total += q
+	}
+
+	if total == 0 {
+		return errors.New("Your cart is empty")
+	}
+
+	if cart.BusSpots == 0 {
+		if cart.BusToVibecamp != "" || cart.BusFromVibecamp != "" {
+			return errors.New("Pick how many bus seats you need")
+		}
+		return nil
+	}
+
+	if cart.BusToVibecamp == "" && cart.BusFromVibecamp == "" {
+		return errors.New("Pick a bus to or from vibecamp")
+	}
+
+	for _, name := range []string{cart.BusToVibecamp, cart.BusFromVibecamp} {
+		if name == "" {
+			continue
+		}
+
+		slot, err := db.GetSlot(name)
+		if errors.Is(err, db.ErrNoRecords) {
+			return errors.Newf("'%s' isn't one of our buses", name)
+		} else if err != nil {
+			return err
+		}
+
+		if slot.Purchased+cart.BusSpots > slot.Cap {
+			return errors.Newf("Sorry, the %s bus only has %d seats left", name, slot.Cap-slot.Purchased)
+		}
+	}
+
+	return nil
+}
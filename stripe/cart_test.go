@@ -0,0 +1,86 @@
+package stripe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+func TestValidateItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []db.Item
+		ok    bool
+	}{
+		{"tickets and a donation", []db.Item{{Id: "adult-tent", Quantity: 2}, {Id: "child-tent", Quantity: 1}, {Id: "donation", Quantity: 1, Amount: 20}}, true},
+		{"empty", nil, false},
+		{"not for sale", []db.Item{{Id: "adult-yacht", Quantity: 1}}, false},
+		{"twice", []db.Item{{Id: "adult-tent", Quantity: 1}, {Id: "adult-tent", Quantity: 1}}, false},
+		{"too many", []db.Item{{Id: "adult-tent", Quantity: maxItemQuantity + 1}}, false},
+		{"none", []db.Item{{Id: "adult-tent", Quantity: 0}}, false},
+		{"priced by the buyer", []db.Item{{Id: "adult-cabin", Quantity: 1, Amount: 1}}, false},
+		{"mixed levels", []db.Item{{Id: "adult-cabin", Quantity: 1}, {Id: "child-tent", Quantity: 1}}, false},
+		{"huge donation", []db.Item{{Id: "donation", Quantity: 1, Amount: maxDonation + 1}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateItems(tt.items); (err == nil) != tt.ok {
+				t.Errorf("validateItems() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCheckEligible(t *testing.T) {
+	s := dbtest.New(t)
+	for name, value := range map[string]int{fields.SalesCap: 10, fields.CabinCap: 4, fields.SatCap: 5} {
+		s.Add(dbtest.Constants, map[string]interface{}{fields.Name: name, fields.Value: value})
+	}
+	for name, sold := range map[string]int{fields.FullSold: 6, fields.CabinSold: 2, fields.SatSold: 0} {
+		s.Add(dbtest.Aggregations, map[string]interface{}{fields.Name: name, fields.Quantity: sold, fields.Revenue: "$0.00"})
+	}
+	for _, name := range []string{"alice", "bob"} {
+		s.Add("ChaosMode", map[string]interface{}{fields.UserName: name, fields.TicketLimit: 2, fields.Phase: fields.FCFS})
+	}
+	// bob's been offered one of the cabin tickets that's left
+	s.Add("Waitlist", map[string]interface{}{
+		fields.UserName:         "bob",
+		fields.AdmissionLevel:   fields.CabinAdmission,
+		fields.TicketsRequested: 1,
+		fields.WaitlistStatus:   fields.WaitlistOffered,
+		fields.OfferExpires:     time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+
+	user := func(name, level string) *db.User {
+		return &db.User{UserName: name, TicketPath: fields.FCFS, AdmissionLevel: level}
+	}
+
+	tests := []struct {
+		name  string
+		user  *db.User
+		items []db.Item
+		ok    bool
+	}{
+		{"last unheld cabin ticket", user("alice", fields.CabinAdmission), []db.Item{{Id: "adult-cabin", Quantity: 1}}, true},
+		{"cabin ticket held for an offer", user("alice", fields.CabinAdmission), []db.Item{{Id: "adult-cabin", Quantity: 2}}, false},
+		{"taking up their own offer", user("bob", fields.CabinAdmission), []db.Item{{Id: "adult-cabin", Quantity: 2}}, true},
+		{"up to the sales cap", user("alice", fields.TentAdmission), []db.Item{{Id: "adult-tent", Quantity: 1}, {Id: "child-tent", Quantity: 2}}, true},
+		{"over the sales cap", user("alice", fields.TentAdmission), []db.Item{{Id: "adult-tent", Quantity: 1}, {Id: "child-tent", Quantity: 3}}, false},
+		{"over their ticket limit", user("alice", fields.SatAdmission), []db.Item{{Id: "adult-sat", Quantity: 3}}, false},
+		{"not their admission level", user("alice", fields.CabinAdmission), []db.Item{{Id: "adult-tent", Quantity: 1}}, false},
+		{"just a donation", user("alice", ""), []db.Item{{Id: "donation", Quantity: 1, Amount: 5}}, true},
+		{"not on the guest list", user("carol", fields.TentAdmission), []db.Item{{Id: "adult-tent", Quantity: 1}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkEligible(tt.user, tt.items); (err == nil) != tt.ok {
+				t.Errorf("checkEligible() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
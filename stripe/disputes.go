@@ -0,0 +1,381 @@
+package stripe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/charge"
+	"github.com/stripe/stripe-go/v74/paymentintent"
+)
+
+// order status once a dispute is lost
+const chargedBack = "charged_back"
+
+var financeEmail = ""
+var klaviyoDisputeId = ""
+var disputesURL = ""
+
+// InitDisputes sets who hears about disputes and the klaviyo list whose flow tells them
+func InitDisputes(externalURL, finance, klaviyoDisputeList string) {
+	disputesURL = externalURL + "/admin/disputes"
+	financeEmail = finance
+	klaviyoDisputeId = klaviyoDisputeList
+}
+
+// disputedOrder finds the order a dispute is about, by payment intent or, for installments, the intent's order id
+func disputedOrder(d *stripe.Dispute) (*db.Order, string, error) {
+	paymentID := ""
+	if d.PaymentIntent != nil {
+		paymentID = d.PaymentIntent.ID
+	} else if d.Charge != nil {
+		ch, err := charge.Get(d.Charge.ID, nil)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "getting disputed charge")
+		} else if ch.PaymentIntent == nil {
+			return nil, "", errors.Newf("charge %v has no payment intent", d.Charge.ID)
+		}
+		paymentID = ch.PaymentIntent.ID
+	}
+
+	order, err := db.GetOrderByPaymentID(paymentID)
+	if err == nil {
+		return order, paymentID, nil
+	}
+
+	pi, piErr := paymentintent.Get(paymentID, nil)
+	if piErr != nil || pi.Metadata["orderId"] == "" {
+		return nil, paymentID, errors.Wrapf(err, "no order for disputed payment %v", paymentID)
+	}
+
+	order, err = db.GetOrder(pi.Metadata["orderId"])
+	return order, paymentID, err
+}
+
+// ticketHolders is everyone whose ticket came from the order
+func ticketHolders(order *db.Order) ([]*db.User, error) {
+	user, err := db.GetUser(order.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := user.GetTicketGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range group {
+		if u.UserName == user.UserName {
+			return group, nil
+		}
+	}
+	return append(group, user), nil
+}
+
+func suspendTickets(order *db.Order, suspended bool) error {
+	holders, err := ticketHolders(order)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range holders {
+		if u.TicketSuspended != suspended {
+			err = u.SetTicketSuspended(suspended)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func disputeCreated(event *stripe.Event, j *journal) error {
+	var dispute stripe.Dispute
+	err := json.Unmarshal(event.Data.Raw, &dispute)
+	if err != nil {
+		return errors.Wrap(err, "parsing dispute")
+	}
+	log.Printf("Dispute %v opened for %d (%s)", dispute.ID, dispute.Amount, dispute.Reason)
+
+	order, paymentID, err := disputedOrder(&dispute)
+	if err != nil {
+		return err
+	}
+
+	err = j.step("dispute-recorded", fmt.Sprintf("record dispute %v on order %v", dispute.ID, order.OrderID), func() error {
+		_, err := db.GetDispute(dispute.ID)
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, db.ErrNoRecords) {
+			return err
+		}
+
+		d := &db.Dispute{
+			DisputeID: dispute.ID,
+			OrderID:   order.OrderID,
+			PaymentID: paymentID,
+			UserName:  order.UserName,
+			Amount:    db.CurrencyFromCents(dispute.Amount),
+			Reason:    string(dispute.Reason),
+			Status:    fields.DisputeOpen,
+			Opened:    time.Unix(dispute.Created, 0),
+		}
+		return d.CreateDispute()
+	})
+	if err != nil {
+		return err
+	}
+
+	err = j.step("order-flagged", fmt.Sprintf("flag order %v as disputed", order.OrderID), func() error {
+		return order.UpdateDisputeStatus(fields.DisputeOpen)
+	})
+	if err != nil {
+		return err
+	}
+
+	if order.TotalTickets > 0 {
+		err = j.step("tickets-suspended", fmt.Sprintf("suspend @%v's tickets", order.UserName), func() error {
+			return suspendTickets(order, true)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return j.step("finance-notified", fmt.Sprintf("tell finance about dispute %v", dispute.ID), func() error {
+		return notifyDispute(order, &dispute, fields.DisputeOpen)
+	})
+}
+
+func disputeClosed(event *stripe.Event, j *journal) error {
+	var dispute stripe.Dispute
+	err := json.Unmarshal(event.Data.Raw, &dispute)
+	if err != nil {
+		return errors.Wrap(err, "parsing dispute")
+	}
+	log.Printf("Dispute %v closed as %s", dispute.ID, dispute.Status)
+
+	order, _, err := disputedOrder(&dispute)
+	if err != nil {
+		return err
+	}
+
+	// a refund during the dispute already released the order, anything else but losing means they keep it
+	outcome := fields.DisputeWon
+	if dispute.Status == stripe.DisputeStatusLost {
+		outcome = fields.DisputeLost
+	}
+
+	err = j.step("dispute-closed", fmt.Sprintf("mark dispute %v %v", dispute.ID, outcome), func() error {
+		d, err := db.GetDispute(dispute.ID)
+		if errors.Is(err, db.ErrNoRecords) {
+			// opened before we handled disputes
+			d = &db.Dispute{
+				DisputeID: dispute.ID,
+				OrderID:   order.OrderID,
+				PaymentID: order.StripeID,
+				UserName:  order.UserName,
+				Amount:    db.CurrencyFromCents(dispute.Amount),
+				Reason:    string(dispute.Reason),
+				Status:    fields.DisputeOpen,
+				Opened:    time.Unix(dispute.Created, 0),
+			}
+			err = d.CreateDispute()
+		}
+		if err != nil {
+			return err
+		}
+		return d.Close(outcome, time.Now())
+	})
+	if err != nil {
+		return err
+	}
+
+	err = j.step("order-dispute-status", fmt.Sprintf("mark order %v's dispute %v", order.OrderID, outcome), func() error {
+		return order.UpdateDisputeStatus(outcome)
+	})
+	if err != nil {
+		return err
+	}
+
+	if outcome == fields.DisputeLost {
+		// the money's gone, so is the ticket. Tickets stay suspended so check-in still warns
+		err = revokeOrder(order, chargedBack, j)
+	} else if order.TotalTickets > 0 {
+		err = j.step("tickets-restored", fmt.Sprintf("restore @%v's tickets", order.UserName), func() error {
+			return suspendTickets(order, false)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return j.step("finance-notified", fmt.Sprintf("tell finance dispute %v was %v", dispute.ID, outcome), func() error {
+		return notifyDispute(order, &dispute, outcome)
+	})
+}
+
+// notifyDispute adds finance to the dispute list with the details, the list's klaviyo flow emails them
+func notifyDispute(order *db.Order, dispute *stripe.Dispute, status string) error {
+	if klaviyoDisputeId == "" || financeEmail == "" {
+		log.Warnf("No finance contact for disputes, dispute %v on order %v is %s", dispute.ID, order.OrderID, status)
+		return nil
+	}
+
+	klaviyoUrl := "https://a.klaviyo.com/api/v2/list/" + klaviyoDisputeId + "/members?api_key=" + klaviyoKey
+
+	profile := map[string]interface{}{
+		"email":          financeEmail,
+		"Dispute ID":     dispute.ID,
+		"Dispute Status": status,
+		"Dispute Amount": db.CurrencyFromCents(dispute.Amount).ToString(),
+		"Dispute Reason": string(dispute.Reason),
+		"Dispute Order":  order.OrderID,
+		"Dispute User":   order.UserName,
+		"Dispute Link":   disputesURL + "/" + dispute.ID,
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{"profiles": []interface{}{profile}})
+	if err != nil {
+		return err
+	}
+
+	req, _ := http.NewRequest("POST", klaviyoUrl, bytes.NewReader(payload))
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return errors.Newf("klaviyo returned %s", res.Status)
+	}
+
+	return nil
+}
+
+// Evidence is what we know about a disputed order, to send to the card network
+type Evidence struct {
+	Dispute       *db.Dispute
+	OrderID       string
+	OrderDate     string
+	PaymentID     string
+	Total         string
+	Items         []string
+	UserName      string
+	TwitterName   string
+	Name          string
+	Email         string
+	DiscordName   string
+	AccountSince  string
+	TicketID      string
+	CheckedIn     bool
+	TicketHolders []string
+	CheckedInAll  []string
+}
+
+// GatherEvidence pulls together the order, who signed in to buy it and whether the tickets were used
+func GatherEvidence(disputeID string) (*Evidence, error) {
+	d, err := db.GetDispute(disputeID)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := db.GetOrder(d.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := db.GetUser(order.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Evidence{
+		Dispute:      d,
+		OrderID:      order.OrderID,
+		OrderDate:    order.Date,
+		PaymentID:    order.StripeID,
+		Total:        order.Total.ToString(),
+		UserName:     user.UserName,
+		TwitterName:  user.TwitterName,
+		Name:         user.Name,
+		Email:        user.Email,
+		DiscordName:  user.DiscordName,
+		AccountSince: user.Created,
+		TicketID:     user.TicketID,
+		CheckedIn:    user.CheckedIn,
+	}
+
+	for _, item := range []struct {
+		name string
+		qty  int
+	}{
+		{"Adult Cabin", order.AdultCabin}, {"Adult Tent", order.AdultTent}, {"Adult Saturday", order.AdultSat},
+		{"Child Cabin", order.ChildCabin}, {"Child Tent", order.ChildTent}, {"Child Saturday", order.ChildSat},
+		{"Toddler Cabin", order.ToddlerCabin}, {"Toddler Tent", order.ToddlerTent}, {"Toddler Saturday", order.ToddlerSat},
+		{"Bus Spots", order.BusSpots}, {"Sleeping Bags", order.SleepingBags}, {"Sheet Sets", order.SheetSets}, {"Pillows", order.Pillows},
+	} {
+		if item.qty > 0 {
+			e.Items = append(e.Items, fmt.Sprintf("%d %s", item.qty, item.name))
+		}
+	}
+	if order.Donation > 0 {
+		e.Items = append(e.Items, fmt.Sprintf("$%d donation", order.Donation))
+	}
+	if order.PromoCode != "" {
+		e.Items = append(e.Items, fmt.Sprintf("promo code %s (%s off)", order.PromoCode, order.Discount.ToString()))
+	}
+
+	holders, err := ticketHolders(order)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range holders {
+		e.TicketHolders = append(e.TicketHolders, u.UserName)
+		if u.CheckedIn {
+			e.CheckedInAll = append(e.CheckedInAll, u.UserName)
+		}
+	}
+
+	return e, nil
+}
+
+// Text lays the evidence out as a plain text packet
+func (e *Evidence) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Dispute %s (%s, %s)\n", e.Dispute.DisputeID, e.Dispute.Reason, e.Dispute.Status)
+	fmt.Fprintf(&b, "Amount disputed: %s\n", e.Dispute.Amount.ToString())
+	fmt.Fprintf(&b, "Opened: %s\n\n", e.Dispute.Opened.In(eastern()).Format(time.RFC1123))
+
+	fmt.Fprintf(&b, "Order %s\n", e.OrderID)
+	fmt.Fprintf(&b, "Ordered: %s\n", e.OrderDate)
+	fmt.Fprintf(&b, "Payment: %s\n", e.PaymentID)
+	fmt.Fprintf(&b, "Total: %s\n", e.Total)
+	fmt.Fprintf(&b, "Items: %s\n\n", strings.Join(e.Items, ", "))
+
+	fmt.Fprintf(&b, "Purchaser signed in as %s\n", e.UserName)
+	fmt.Fprintf(&b, "Twitter: @%s\n", e.TwitterName)
+	fmt.Fprintf(&b, "Name: %s\n", e.Name)
+	fmt.Fprintf(&b, "Email: %s\n", e.Email)
+	fmt.Fprintf(&b, "Discord: %s\n", e.DiscordName)
+	fmt.Fprintf(&b, "On the guest list since: %s\n\n", e.AccountSince)
+
+	fmt.Fprintf(&b, "Ticket: %s\n", e.TicketID)
+	fmt.Fprintf(&b, "Purchaser checked in: %t\n", e.CheckedIn)
+	fmt.Fprintf(&b, "Ticket holders: %s\n", strings.Join(e.TicketHolders, ", "))
+	fmt.Fprintf(&b, "Checked in: %s\n", strings.Join(e.CheckedInAll, ", "))
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package stripe
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+func disputeEvent(eventType, status string) *stripe.Event {
+	raw := fmt.Sprintf(`{"id": "dp_1", "object": "dispute", "amount": 42069, "reason": "fraudulent", "status": %q, "payment_intent": "pi_1", "created": 1680000000}`, status)
+	return &stripe.Event{ID: "evt_dispute", Type: eventType, Data: &stripe.EventData{Raw: []byte(raw)}}
+}
+
+func TestDisputes(t *testing.T) {
+	tests := []struct {
+		name string
+		// how the dispute closes, and what the order's status is by then
+		closed        string
+		paymentStatus string
+		outcome       string
+		suspended     bool
+	}{
+		{"won", "won", "success", fields.DisputeWon, false},
+		{"warning closed", "warning_closed", "success", fields.DisputeWon, false},
+		// refunded while it was open, so there's nothing left to take back
+		{"lost after a refund", "lost", "refunded", fields.DisputeLost, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := dbtest.New(t)
+			alice := s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "alice", fields.TicketID: "t1", fields.AdmissionLevel: "Basic"})
+			orderID := s.Add(dbtest.Orders, map[string]interface{}{
+				fields.OrderID:       "order1",
+				fields.UserName:      "alice",
+				fields.PaymentID:     "pi_1",
+				fields.PaymentStatus: "success",
+				fields.TotalTickets:  1,
+				fields.Total:         420.69,
+			})
+
+			j := &journal{}
+			if err := disputeCreated(disputeEvent("charge.dispute.created", "needs_response"), j); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Get(dbtest.Attendees, alice)[fields.TicketSuspended]; got != "checked" {
+				t.Errorf("ticket suspended = %q while the dispute's open", got)
+			}
+			if got := s.Get(dbtest.Orders, orderID)[fields.DisputeStatus]; got != fields.DisputeOpen {
+				t.Errorf("order dispute status = %q", got)
+			}
+			d, err := db.GetDispute("dp_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.OrderID != "order1" || d.PaymentID != "pi_1" || d.UserName != "alice" || d.Status != fields.DisputeOpen {
+				t.Errorf("dispute = %+v", d)
+			}
+
+			if tt.paymentStatus != "success" {
+				order, err := db.GetOrder("order1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := order.UpdateOrderStatus(tt.paymentStatus); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := disputeClosed(disputeEvent("charge.dispute.closed", tt.closed), &journal{}); err != nil {
+				t.Fatal(err)
+			}
+			suspended := s.Get(dbtest.Attendees, alice)[fields.TicketSuspended] == "checked"
+			if suspended != tt.suspended {
+				t.Errorf("ticket suspended = %v once the dispute's %s", suspended, tt.closed)
+			}
+			if got := s.Get(dbtest.Orders, orderID)[fields.DisputeStatus]; got != tt.outcome {
+				t.Errorf("order dispute status = %q, want %q", got, tt.outcome)
+			}
+			if d, _ := db.GetDispute("dp_1"); d == nil || d.Status != tt.outcome {
+				t.Errorf("dispute = %+v, want %s", d, tt.outcome)
+			}
+		})
+	}
+}
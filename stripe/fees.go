@@ -0,0 +1,38 @@
+package stripe
+
+import (
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fees"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/paymentintent"
+)
+
+// applyFee sets the order's processing fee under the current policy, and notes the policy on the order
+func applyFee(order *db.Order, amounts map[string]float64, coverFees bool) {
+	policy := fees.Current()
+	order.ProcessingFee = db.CurrencyFromFloat(policy.Fee(amounts, coverFees))
+	order.FeePolicy = policy.String()
+	if policy.Optional && !coverFees {
+		order.FeePolicy += ", not covered"
+	}
+}
+
+// recordStripeFee saves the fee stripe's balance transaction says it took for the order's payment, for reconciliation
+func recordStripeFee(order *db.Order, paymentID string) error {
+	params := &stripe.PaymentIntentParams{}
+	params.AddExpand("latest_charge.balance_transaction")
+	pi, err := paymentintent.Get(paymentID, params)
+	if err != nil {
+		return errors.Wrap(err, "getting payment intent")
+	}
+
+	if pi.LatestCharge == nil || pi.LatestCharge.BalanceTransaction == nil {
+		log.Debugf("No balance transaction yet for %v", paymentID)
+		return nil
+	}
+
+	return order.UpdateStripeFee(db.CurrencyFromCents(pi.LatestCharge.BalanceTransaction.Fee))
+}
@@ -0,0 +1,499 @@
+package stripe
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/customer"
+	"github.com/stripe/stripe-go/v74/paymentintent"
+	"github.com/stripe/stripe-go/v74/setupintent"
+)
+
+const (
+	defaultInstallmentCount        = 3
+	defaultInstallmentIntervalDays = 30
+	defaultInstallmentMinimum      = 300
+	defaultInstallmentRetryDays    = 3
+	defaultInstallmentMaxAttempts  = 3
+)
+
+// payment plan order statuses, alongside "success", "failed" etc
+const (
+	partiallyPaid = "partially_paid"
+	cancelled     = "cancelled"
+)
+
+var installmentMutex sync.Mutex
+var paymentPlanURL = ""
+var klaviyoInstallmentId = ""
+
+// InitPaymentPlans sets where reminders link to and the klaviyo list whose flow sends them
+func InitPaymentPlans(externalURL string, klaviyoInstallmentList string) {
+	paymentPlanURL = externalURL + "/payment-plan"
+	klaviyoInstallmentId = klaviyoInstallmentList
+}
+
+func constantOr(name string, fallback int) int {
+	c, err := db.GetConstant(name)
+	if err != nil || c.Value < 1 {
+		return fallback
+	}
+	return c.Value
+}
+
+// PlanAvailable is how many payments an order can be split into, or 0 if it has to be paid in full
+func PlanAvailable(order *db.Order) int {
+	if order.TotalTickets == 0 {
+		return 0
+	}
+
+	if order.Total.ToFloat() < float64(constantOr(fields.InstallmentMinimum, defaultInstallmentMinimum)) {
+		return 0
+	}
+
+	n := constantOr(fields.InstallmentCount, defaultInstallmentCount)
+	if n < 2 {
+		return 0
+	}
+	return n
+}
+
+// splitCents splits total into n payments, with any odd cents going on the deposit
+func splitCents(total int64, n int) []int64 {
+	if n < 1 {
+		return []int64{total}
+	}
+
+	each := total / int64(n)
+	amounts := make([]int64, n)
+	for i := range amounts {
+		amounts[i] = each
+	}
+	amounts[0] += total - each*int64(n)
+	return amounts
+}
+
+// dueNow is what gets charged at checkout - the deposit on a payment plan, otherwise everything
+func dueNow(order *db.Order) int64 {
+	if order.InstallmentPlan > 1 {
+		return splitCents(order.Total.InCents(), order.InstallmentPlan)[0]
+	}
+	return order.Total.InCents()
+}
+
+func newCustomer(user *db.User) (string, error) {
+	params := &stripe.CustomerParams{
+		Name: stripe.String(user.Name),
+	}
+	if user.Email != "" {
+		params.Email = stripe.String(user.Email)
+	}
+	params.AddMetadata("username", user.UserName)
+
+	cus, err := customer.New(params)
+	if err != nil {
+		return "", errors.Wrap(err, "creating stripe customer")
+	}
+	return cus.ID, nil
+}
+
+// startPlan schedules the rest of the payments once the deposit has gone through
+func startPlan(order *db.Order, deposit *stripe.PaymentIntent) error {
+	existing, err := db.GetInstallments(order.OrderID)
+	if err != nil {
+		return err
+	} else if len(existing) > 0 {
+		log.Debugf("Order %v already has a payment plan", order.OrderID)
+		return nil
+	}
+
+	interval := constantOr(fields.InstallmentIntervalDays, defaultInstallmentIntervalDays)
+	amounts := splitCents(order.Total.InCents(), order.InstallmentPlan)
+	now := time.Now()
+
+	for i, amount := range amounts {
+		inst := &db.Installment{
+			OrderID: order.OrderID,
+			Number:  i + 1,
+			Amount:  db.CurrencyFromCents(amount),
+			Due:     now.AddDate(0, 0, i*interval),
+			Status:  fields.InstallmentScheduled,
+		}
+		if i == 0 {
+			inst.Status = fields.InstallmentPaid
+			inst.PaymentID = deposit.ID
+			inst.Attempts = 1
+		}
+
+		err = inst.CreateInstallment()
+		if err != nil {
+			return err
+		}
+	}
+
+	paymentMethod := ""
+	if deposit.PaymentMethod != nil {
+		paymentMethod = deposit.PaymentMethod.ID
+	}
+
+	return order.UpdatePayments(db.CurrencyFromCents(amounts[0]), paymentMethod)
+}
+
+// ProcessInstallments charges installments that are due, retries failed ones and cancels plans that keep failing
+func ProcessInstallments() {
+	installmentMutex.Lock()
+	defer installmentMutex.Unlock()
+
+	now := time.Now()
+	maxAttempts := constantOr(fields.InstallmentMaxAttempts, defaultInstallmentMaxAttempts)
+
+	for _, status := range []string{fields.InstallmentScheduled, fields.InstallmentFailed} {
+		installments, err := db.GetInstallmentsByStatus(status)
+		if err != nil {
+			log.Errorf("getting %s installments: %v", status, err)
+			continue
+		}
+
+		for _, inst := range installments {
+			if inst.Due.After(now) {
+				// sorted by due date, so nothing after this is due either
+				break
+			}
+
+			order, err := db.GetOrder(inst.OrderID)
+			if err != nil {
+				log.Errorf("getting order for installment %v: %v", inst.AirtableID, err)
+				continue
+			}
+
+			if order.PaymentStatus != partiallyPaid {
+				inst.Status = fields.InstallmentCancelled
+				err = inst.Update()
+				if err != nil {
+					log.Errorf("cancelling installment %v: %v", inst.AirtableID, err)
+				}
+				continue
+			}
+
+			if inst.Attempts >= maxAttempts {
+				err = cancelPlan(order)
+				if err != nil {
+					log.Errorf("cancelling payment plan for %v: %v", order.OrderID, err)
+				}
+				continue
+			}
+
+			chargeInstallment(order, inst, maxAttempts)
+		}
+	}
+}
+
+func chargeInstallment(order *db.Order, inst *db.Installment, maxAttempts int) {
+	inst.Attempts++
+
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(inst.Amount.InCents()),
+		Currency:      stripe.String(string(stripe.CurrencyUSD)),
+		Customer:      stripe.String(order.StripeCustomer),
+		PaymentMethod: stripe.String(order.PaymentMethod),
+		OffSession:    stripe.Bool(true),
+		Confirm:       stripe.Bool(true),
+		Description:   stripe.String("vibecamp payment plan " + strconv.Itoa(inst.Number) + " of " + strconv.Itoa(order.InstallmentPlan)),
+	}
+	params.AddMetadata("orderId", order.OrderID)
+	params.AddMetadata("installmentId", inst.AirtableID)
+	params.SetIdempotencyKey(inst.AirtableID + "-" + strconv.Itoa(inst.Attempts))
+
+	pi, err := paymentintent.New(params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.PaymentIntent != nil {
+			inst.PaymentID = stripeErr.PaymentIntent.ID
+		}
+		installmentFailed(order, inst, maxAttempts, err.Error())
+		return
+	}
+
+	inst.PaymentID = pi.ID
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		err = installmentPaid(order, inst)
+		if err != nil {
+			log.Errorf("recording installment %v: %v", inst.AirtableID, err)
+		}
+	case stripe.PaymentIntentStatusProcessing:
+		inst.Status = fields.InstallmentProcessing
+		err = inst.Update()
+		if err != nil {
+			log.Errorf("updating installment %v: %v", inst.AirtableID, err)
+		}
+	default:
+		installmentFailed(order, inst, maxAttempts, string(pi.Status))
+	}
+}
+
+func installmentPaid(order *db.Order, inst *db.Installment) error {
+	if inst.Status == fields.InstallmentPaid {
+		return nil
+	}
+
+	inst.Status = fields.InstallmentPaid
+	err := inst.Update()
+	if err != nil {
+		return err
+	}
+
+	paid := inst.Amount.InCents()
+	if order.AmountPaid != nil {
+		paid += order.AmountPaid.InCents()
+	}
+
+	err = order.UpdatePayments(db.CurrencyFromCents(paid), order.PaymentMethod)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("installment %d of %d paid on order %v", inst.Number, order.InstallmentPlan, order.OrderID)
+
+	if order.Remaining().InCents() <= 0 {
+		return order.UpdateOrderStatus("success")
+	}
+	return nil
+}
+
+func installmentFailed(order *db.Order, inst *db.Installment, maxAttempts int, reason string) {
+	log.Errorf("installment %d on order %v failed, attempt %d: %s", inst.Number, order.OrderID, inst.Attempts, reason)
+
+	inst.Status = fields.InstallmentFailed
+	inst.Due = time.Now().AddDate(0, 0, constantOr(fields.InstallmentRetryDays, defaultInstallmentRetryDays))
+	err := inst.Update()
+	if err != nil {
+		log.Errorf("updating installment %v: %v", inst.AirtableID, err)
+	}
+
+	if inst.Attempts >= maxAttempts {
+		err = cancelPlan(order)
+		if err != nil {
+			log.Errorf("cancelling payment plan for %v: %v", order.OrderID, err)
+		}
+		return
+	}
+
+	err = notifyInstallment(order, inst, "failed", maxAttempts-inst.Attempts)
+	if err != nil {
+		log.Errorf("sending installment reminder for %v: %v", order.OrderID, err)
+	}
+}
+
+// cancelPlan gives up on an order whose installments keep failing. What was paid isn't refunded automatically.
+// The order's released before its installments are cancelled, with the steps saved on the order, so if it fails
+// part way the installments are still there to bring the next run back and it picks up where it stopped.
+func cancelPlan(order *db.Order) error {
+	installments, err := db.GetInstallments(order.OrderID)
+	if err != nil {
+		return err
+	}
+
+	var open []*db.Installment
+	for _, inst := range installments {
+		if inst.Status == fields.InstallmentScheduled || inst.Status == fields.InstallmentFailed {
+			open = append(open, inst)
+		}
+	}
+
+	err = releaseOrder(order, cancelled, orderJournal(order, "cancel-plan"))
+	if err != nil {
+		return err
+	}
+
+	var last *db.Installment
+	for _, inst := range open {
+		last = inst
+		inst.Status = fields.InstallmentCancelled
+		err = inst.Update()
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infof("payment plan for order %v cancelled with %s paid", order.OrderID, order.AmountPaid.ToString())
+
+	if last != nil {
+		err = notifyInstallment(order, last, "cancelled", 0)
+		if err != nil {
+			log.Errorf("sending cancellation notice for %v: %v", order.OrderID, err)
+		}
+	}
+
+	return nil
+}
+
+// handleInstallmentEvent records the result of a payment intent made by ProcessInstallments
+func handleInstallmentEvent(pi *stripe.PaymentIntent, succeeded bool) error {
+	installmentMutex.Lock()
+	defer installmentMutex.Unlock()
+
+	order, err := db.GetOrder(pi.Metadata["orderId"])
+	if err != nil {
+		return err
+	}
+
+	installments, err := db.GetInstallments(order.OrderID)
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range installments {
+		if inst.AirtableID != pi.Metadata["installmentId"] {
+			continue
+		}
+
+		if succeeded {
+			inst.PaymentID = pi.ID
+			return installmentPaid(order, inst)
+		}
+
+		// already recorded when the charge was made
+		if inst.Status == fields.InstallmentFailed && inst.PaymentID == pi.ID {
+			return nil
+		}
+
+		inst.PaymentID = pi.ID
+		installmentFailed(order, inst, constantOr(fields.InstallmentMaxAttempts, defaultInstallmentMaxAttempts), "payment failed")
+		return nil
+	}
+
+	return errors.Newf("no installment %v on order %v", pi.Metadata["installmentId"], order.OrderID)
+}
+
+// NewCardSetup starts saving a new card for a payment plan, returning the client secret for stripe elements
+func NewCardSetup(order *db.Order) (string, error) {
+	if order.StripeCustomer == "" || order.PaymentStatus != partiallyPaid {
+		return "", errors.New("This order isn't on a payment plan")
+	}
+
+	params := &stripe.SetupIntentParams{
+		Customer: stripe.String(order.StripeCustomer),
+		Usage:    stripe.String(string(stripe.SetupIntentUsageOffSession)),
+		AutomaticPaymentMethods: &stripe.SetupIntentAutomaticPaymentMethodsParams{
+			Enabled: stripe.Bool(true),
+		},
+	}
+	params.AddMetadata("orderId", order.OrderID)
+
+	si, err := setupintent.New(params)
+	if err != nil {
+		return "", errors.Wrap(err, "creating setup intent")
+	}
+
+	return si.ClientSecret, nil
+}
+
+// ApplyNewCard switches the plan to the card saved by a setup intent and retries anything that failed
+func ApplyNewCard(order *db.Order, setupIntentID string) error {
+	si, err := setupintent.Get(setupIntentID, nil)
+	if err != nil {
+		return errors.Wrap(err, "getting setup intent")
+	}
+
+	if si.Customer == nil || si.Customer.ID != order.StripeCustomer {
+		return errors.New("That card wasn't saved for this order")
+	} else if si.Status != stripe.SetupIntentStatusSucceeded || si.PaymentMethod == nil {
+		return errors.Newf("Your card couldn't be saved (%s)", si.Status)
+	}
+
+	installmentMutex.Lock()
+	defer installmentMutex.Unlock()
+
+	err = order.UpdatePayments(order.AmountPaid, si.PaymentMethod.ID)
+	if err != nil {
+		return err
+	}
+
+	installments, err := db.GetInstallments(order.OrderID)
+	if err != nil {
+		return err
+	}
+
+	for _, inst := range installments {
+		if inst.Status == fields.InstallmentFailed {
+			inst.Status = fields.InstallmentScheduled
+			inst.Due = time.Now()
+			err = inst.Update()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	go ProcessInstallments()
+	return nil
+}
+
+// RunInstallments processes installments every interval until the process exits
+func RunInstallments(interval time.Duration) {
+	for range time.Tick(interval) {
+		ProcessInstallments()
+	}
+}
+
+// notifyInstallment adds the buyer to the klaviyo installment list, which has a flow that emails them
+func notifyInstallment(order *db.Order, inst *db.Installment, status string, attemptsLeft int) error {
+	if klaviyoInstallmentId == "" {
+		log.Debugf("No klaviyo installment list, not notifying %s of %s installment", order.UserName, status)
+		return nil
+	}
+
+	user, err := db.GetUser(order.UserName)
+	if err != nil {
+		return err
+	}
+
+	if user.Email == "" {
+		return errors.Newf("no email for %s", order.UserName)
+	}
+
+	klaviyoUrl := "https://a.klaviyo.com/api/v2/list/" + klaviyoInstallmentId + "/members?api_key=" + klaviyoKey
+
+	profile := map[string]interface{}{
+		"email":                     user.Email,
+		"Installment Status":        status,
+		"Installment Amount":        inst.Amount.ToString(),
+		"Installment Number":        inst.Number,
+		"Installment Plan":          order.InstallmentPlan,
+		"Installment Retry":         inst.Due.In(eastern()).Format("Monday Jan 2"),
+		"Installment Attempts Left": attemptsLeft,
+		"Payment Plan Link":         paymentPlanURL,
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{"profiles": []interface{}{profile}})
+	if err != nil {
+		return err
+	}
+
+	req, _ := http.NewRequest("POST", klaviyoUrl, bytes.NewReader(payload))
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return errors.Newf("klaviyo returned %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package stripe
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+func TestSplitCents(t *testing.T) {
+	tests := []struct {
+		total int64
+		n     int
+		want  []int64
+	}{
+		{90000, 3, []int64{30000, 30000, 30000}},
+		{100000, 3, []int64{33334, 33333, 33333}},
+		{42069, 2, []int64{21035, 21034}},
+		{2, 3, []int64{2, 0, 0}},
+		{500, 1, []int64{500}},
+		{500, 0, []int64{500}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d in %d", tt.total, tt.n), func(t *testing.T) {
+			got := splitCents(tt.total, tt.n)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("splitCents() = %v, want %v", got, tt.want)
+			}
+			var sum int64
+			for _, c := range got {
+				sum += c
+			}
+			if sum != tt.total {
+				t.Errorf("payments add up to %d, want %d", sum, tt.total)
+			}
+		})
+	}
+}
+
+func TestDueNow(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int64
+		plan  int
+		want  int64
+	}{
+		{"paid in full", 42069, 0, 42069},
+		// cents a float would lose
+		{"paid in full, awkward cents", 57, 0, 57},
+		{"paid in full, more awkward cents", 100113, 1, 100113},
+		{"deposit on three payments", 100000, 3, 33334},
+		{"deposit on two payments", 42069, 2, 21035},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := &db.Order{Total: db.CurrencyFromCents(tt.total), InstallmentPlan: tt.plan}
+			if got := dueNow(order); got != tt.want {
+				t.Errorf("dueNow() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanAvailable(t *testing.T) {
+	tests := []struct {
+		name      string
+		constants map[string]int
+		tickets   int
+		total     int64
+		want      int
+	}{
+		{"default", nil, 1, 42069, defaultInstallmentCount},
+		{"under the default minimum", nil, 1, 29999, 0},
+		{"no tickets", nil, 0, 100000, 0},
+		{"more payments", map[string]int{fields.InstallmentCount: 4}, 1, 42069, 4},
+		{"one payment is no plan", map[string]int{fields.InstallmentCount: 1}, 1, 42069, 0},
+		{"higher minimum", map[string]int{fields.InstallmentMinimum: 500}, 2, 42069, 0},
+		{"lower minimum", map[string]int{fields.InstallmentMinimum: 100}, 1, 15000, defaultInstallmentCount},
+		{"0 falls back to the default", map[string]int{fields.InstallmentCount: 0, fields.InstallmentMinimum: 0}, 1, 29999, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := dbtest.New(t)
+			for name, value := range tt.constants {
+				s.Add(dbtest.Constants, map[string]interface{}{fields.Name: name, fields.Value: value})
+			}
+
+			order := &db.Order{TotalTickets: tt.tickets, Total: db.CurrencyFromCents(tt.total)}
+			if got := PlanAvailable(order); got != tt.want {
+				t.Errorf("PlanAvailable() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelPlanAfterAFailure(t *testing.T) {
+	s := dbtest.New(t)
+	s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "alice", fields.TicketID: "t1", fields.OrderID: "order1"})
+	sold := s.Add(dbtest.Aggregations, map[string]interface{}{fields.Name: fields.TotalTicketsSold, fields.Quantity: 10, fields.Revenue: "$0.00"})
+	bus := s.Add("Bus 2023", map[string]interface{}{fields.BusSlot: "Friday 10am", fields.Purchased: 5, fields.Cap: 50})
+	order := s.Add(dbtest.Orders, map[string]interface{}{
+		fields.OrderID:         "order1",
+		fields.UserName:        "alice",
+		fields.PaymentStatus:   partiallyPaid,
+		fields.InstallmentPlan: 3,
+		fields.TotalTickets:    1,
+		fields.BusSpots:        2,
+		fields.BusToVibecamp:   "Friday 10am",
+	})
+	inst := s.Add("Installments", map[string]interface{}{fields.OrderID: "order1", fields.InstallmentNumber: 2, fields.Status: fields.InstallmentFailed})
+
+	tests := []struct {
+		name string
+		// the table whose next write fails
+		failing     string
+		ok          bool
+		sold, seats string
+		status      string
+		installment string
+	}{
+		{"bus write fails", "Bus 2023", false, "9", "5", partiallyPaid, fields.InstallmentFailed},
+		{"cancelled again", "", true, "9", "3", cancelled, fields.InstallmentCancelled},
+	}
+
+	for _, tt := range tests {
+		if tt.failing != "" {
+			s.FailWrites(tt.failing, 1)
+		}
+		o, err := db.GetOrder("order1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cancelPlan(o); (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+
+		if got := s.Get(dbtest.Aggregations, sold)[fields.Quantity]; got != tt.sold {
+			t.Errorf("%s: tickets sold = %s, want %s", tt.name, got, tt.sold)
+		}
+		if got := s.Get("Bus 2023", bus)[fields.Purchased]; got != tt.seats {
+			t.Errorf("%s: bus seats = %s, want %s", tt.name, got, tt.seats)
+		}
+		if got := s.Get(dbtest.Orders, order)[fields.PaymentStatus]; got != tt.status {
+			t.Errorf("%s: status = %q, want %q", tt.name, got, tt.status)
+		}
+		if got := s.Get("Installments", inst)[fields.Status]; got != tt.installment {
+			t.Errorf("%s: installment = %q, want %q", tt.name, got, tt.installment)
+		}
+	}
+}
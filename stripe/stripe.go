@@ -8,9 +8,14 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fees"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/promo"
+	"github.com/vibecamp/myvibecamp/waitlist"
 
 	"github.com/cockroachdb/errors"
 	"github.com/gin-gonic/gin"
@@ -23,19 +28,48 @@ import (
 
 // this could be put in the DB but should it be? hmm
 var ticketPrices = map[string]int{"adult-cabin": 590, "adult-tent": 420, "adult-sat": 140, "child-cabin": 380, "child-tent": 210, "child-sat": 70, "toddler-cabin": 0, "toddler-tent": 0, "toddler-sat": 0}
-var stripeFeePercent float64 = 0.03
+var transportPrices = map[string]int{"bus": 5, "sleeping-bag": 35, "sheet-set": 60, "pillow": 20}
+
+const cardPackPrice = 25.44
+
 var webhookSecret = ""
 var klaviyoKey = ""
 var klaviyoListId = ""
+var klaviyoWaitlistId = ""
 
-func Init(key string, secret string, klaviyo string, klaviyoList string) {
+func Init(key string, secret string, klaviyo string, klaviyoList string, klaviyoWaitlist string) {
 	stripe.Key = key
 	webhookSecret = secret
 	klaviyoKey = klaviyo
 	klaviyoListId = klaviyoList
+	klaviyoWaitlistId = klaviyoWaitlist
+}
+
+// UseAPIBase sends stripe API calls somewhere other than stripe, like a local stripe-mock
+func UseAPIBase(url string) {
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL: stripe.String(url),
+	}))
+}
+
+// UnitPrice is the list price of one of something we sell, before any discount or fee
+func UnitPrice(sku string) float64 {
+	switch {
+	case sku == "adult-tent":
+		return 420.69
+	case sku == "card-pack":
+		return cardPackPrice
+	}
+
+	if price, ok := transportPrices[sku]; ok {
+		return float64(price)
+	}
+	return float64(ticketPrices[sku])
 }
 
-func calculateCartInfo(items []db.Item, ticketLimit int) (*db.Order, error) {
+// calculateCartInfo prices a cart that's already been through validateItems. coverFees is whether the buyer
+// chose to cover an optional processing fee.
+func calculateCartInfo(items []db.Item, code *db.PromoCode, coverFees bool) (*db.Order, error) {
 	order := &db.Order{}
 	order.TotalTickets = 0
 	order.OrderID = ""
@@ -44,21 +78,19 @@ func calculateCartInfo(items []db.Item, ticketLimit int) (*db.Order, error) {
 	order.PaymentStatus = ""
 	order.AirtableID = ""
 	var ticketTotal float64 = 0
+	var discount float64 = 0
 	for _, element := range items {
 		if element.Id == "donation" && element.Quantity > 0 && element.Amount > 0 {
 			order.Donation = element.Amount
 		} else if element.Quantity > 0 {
-			if element.Quantity > ticketLimit && strings.HasPrefix(element.Id, "adult") {
-				return nil, errors.New("Exceeded soft launch ticket limit")
-			}
-
 			price, ok1 := ticketPrices[element.Id]
 			if ok1 {
+				unitPrice := float64(price)
 				if element.Id == "adult-tent" {
-					ticketTotal += (float64(element.Quantity) * float64(420.69))
-				} else {
-					ticketTotal += float64(price * element.Quantity)
+					unitPrice = float64(420.69)
 				}
+				ticketTotal += unitPrice * float64(element.Quantity)
+				discount += promo.Discount(code, element.Id, unitPrice, element.Quantity)
 				order.TotalTickets += element.Quantity
 
 				if element.Id == "adult-cabin" {
@@ -84,14 +116,24 @@ func calculateCartInfo(items []db.Item, ticketLimit int) (*db.Order, error) {
 		}
 	}
 
-	var stripeFee float64 = ticketTotal * stripeFeePercent
-	order.ProcessingFee = db.CurrencyFromFloat(stripeFee)
+	if code != nil {
+		if discount == 0 {
+			return nil, errors.Newf("'%s' doesn't apply to anything in your cart", code.Code)
+		}
+		order.PromoCode = code.Code
+		order.Discount = db.CurrencyFromFloat(discount)
+		ticketTotal -= discount
+	}
+
+	applyFee(order, map[string]float64{fees.Tickets: ticketTotal, fees.Donations: float64(order.Donation)}, coverFees)
 	order.Total = db.CurrencyFromFloat(float64(ticketTotal) + order.ProcessingFee.ToFloat() + float64(order.Donation))
 	order.Date = time.Now().UTC().Format("2006-01-02 15:04")
 	return order, nil
 }
 
-func HandleTransportCreatePaymentIntent(c *gin.Context) {
+// HandleTransportCreatePaymentIntent opens a payment for the signed in user's bus seats and bedding. The cart has to
+// match the one their checkout page was rendered with.
+func HandleTransportCreatePaymentIntent(c *gin.Context, userName string, rendered TransportCart) {
 	var w http.ResponseWriter = c.Writer
 	var r *http.Request = c.Request
 	if r.Method != "POST" {
@@ -99,27 +141,30 @@ func HandleTransportCreatePaymentIntent(c *gin.Context) {
 		return
 	}
 
-	var req struct {
-		BusSpots        int    `json:"busSpots"`
-		BusToVibecamp   string `json:"busToVibecamp"`
-		BusFromVibecamp string `json:"busFromVibecamp"`
-		SleepingBags    int    `json:"sleepingBags"`
-		SheetSets       int    `json:"sheetSets"`
-		Pillows         int    `json:"pillows"`
-		UserName        string `json:"username"`
-	}
-
+	var req TransportCart
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusBadRequest, "Couldn't read your cart")
 		log.Errorf("json.NewDecoder.Decode: %v", err)
 		return
 	}
 
-	total := req.BusSpots*5 + req.SleepingBags*35 + req.SheetSets*60 + req.Pillows*20
-	processingFee := float64(total) * stripeFeePercent
+	if req != rendered {
+		log.Warnf("@%v sent a transport cart that doesn't match their checkout: %+v vs %+v", userName, req, rendered)
+		writeJSONError(w, http.StatusBadRequest, ErrCartMismatch.Error())
+		return
+	}
+
+	err := validateTransport(req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	bus := float64(req.BusSpots * transportPrices["bus"])
+	bedding := float64(req.SleepingBags*transportPrices["sleeping-bag"] + req.SheetSets*transportPrices["sheet-set"] + req.Pillows*transportPrices["pillow"])
 
 	order := &db.Order{
-		UserName:        req.UserName,
+		UserName:        userName,
 		OrderID:         uuid.NewString(),
 		StripeID:        "",
 		PaymentStatus:   "",
@@ -134,8 +179,6 @@ func HandleTransportCreatePaymentIntent(c *gin.Context) {
 		ToddlerCabin:    0,
 		ToddlerTent:     0,
 		ToddlerSat:      0,
-		ProcessingFee:   db.CurrencyFromFloat(processingFee),
-		Total:           db.CurrencyFromFloat(float64(total) + processingFee),
 		CardPacks:       0,
 		Donation:        0,
 		Date:            time.Now().UTC().Format("2006-01-02 15:04"),
@@ -146,6 +189,8 @@ func HandleTransportCreatePaymentIntent(c *gin.Context) {
 		SheetSets:       req.SheetSets,
 		Pillows:         req.Pillows,
 	}
+	applyFee(order, map[string]float64{fees.Transport: bus, fees.Bedding: bedding}, req.CoverFees)
+	order.Total = db.CurrencyFromFloat(bus + bedding + order.ProcessingFee.ToFloat())
 
 	if order.BusToVibecamp != "" {
 		err := db.UpdateSlot(order.BusToVibecamp, order.BusSpots)
@@ -208,7 +253,9 @@ func HandleTransportCreatePaymentIntent(c *gin.Context) {
 	})
 }
 
-func HandleCreatePaymentIntent(c *gin.Context) {
+// HandleCreatePaymentIntent prices and opens a payment for the signed in user's ticket cart. The cart has to match
+// the one their checkout page was rendered with, and is re-checked against the guest list and catalog.
+func HandleCreatePaymentIntent(c *gin.Context, userName string, rendered []db.Item) {
 	var w http.ResponseWriter = c.Writer
 	var r *http.Request = c.Request
 	if r.Method != "POST" {
@@ -217,57 +264,88 @@ func HandleCreatePaymentIntent(c *gin.Context) {
 	}
 
 	var req struct {
-		Items     []db.Item `json:"items"`
-		UserName  string    `json:"username"`
-		UserType  string    `json:"usertype"`
-		OrderType string    `json:"ordertype"`
+		Items        []db.Item `json:"items"`
+		PromoCode    string    `json:"promoCode"`
+		Installments bool      `json:"installments"`
+		CoverFees    bool      `json:"coverFees"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusBadRequest, "Couldn't read your cart")
 		log.Errorf("json.NewDecoder.Decode: %v", err)
 		return
 	}
 
-	var ticketLimit int = 1
+	if !sameItems(req.Items, rendered) {
+		log.Warnf("@%v sent a cart that doesn't match their checkout: %v vs %v", userName, req.Items, rendered)
+		writeJSONError(w, http.StatusBadRequest, ErrCartMismatch.Error())
+		return
+	}
+
+	err := validateItems(req.Items)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	newUser, err := db.GetUser(userName)
+	if err != nil {
+		log.Errorf("db.GetUser: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = checkEligible(newUser, req.Items)
+	if errors.Is(err, db.ErrNoRecords) {
+		writeJSONError(w, http.StatusForbidden, "You're not on the guest list for tickets")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	var order *db.Order
-	if req.UserType == "chaos" {
-		chaosUser, err := db.GetChaosUser(req.UserName)
+	if newUser.TicketPath == fields.Sponsorship {
+		sponsoredUser, err := db.GetSponsorshipUser(newUser.UserName)
 		if err != nil {
-			log.Errorf("db.GetChaosUser: %v", err)
+			log.Errorf("db.GetSponsoredUser: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		ticketLimit = chaosUser.TicketLimit
-	} else if req.UserType == "2022" {
-		user, err := db.GetSoftLaunchUser(req.UserName)
-		if err != nil {
-			log.Errorf("db.GetSoftLaunchUser: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !sponsoredUser.AwardOpen() {
+			writeJSONError(w, http.StatusBadRequest, "This sponsorship is no longer available")
 			return
 		}
-		ticketLimit = user.TicketLimit
-	} else {
-		sponsoredUser, err := db.GetSponsorshipUser(req.UserName)
-		if err != nil {
-			log.Errorf("db.GetSponsoredUser: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+
+		quantity, _ := ticketCounts(req.Items)
+		if quantity == 0 {
+			quantity = 1
 		}
-		order = makeSponsoredOrder(*sponsoredUser)
+		order = SponsoredOrder(*sponsoredUser, quantity, req.CoverFees)
 	}
 
-	newUser, err := db.GetUser(req.UserName)
-	if err != nil {
-		log.Errorf("db.GetUser: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var code *db.PromoCode
+	if strings.TrimSpace(req.PromoCode) != "" {
+		if order != nil {
+			writeJSONError(w, http.StatusBadRequest, "Promo codes can't be combined with a sponsorship discount")
+			return
+		}
+
+		code, err = promo.Validate(req.PromoCode, newUser.UserName, newUser.TicketPath)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 	}
 
 	if order == nil {
-		order, err = calculateCartInfo(req.Items, ticketLimit)
+		order, err = calculateCartInfo(req.Items, code, req.CoverFees)
 		if err != nil {
 			log.Errorf("stripe.calculateCartInfo: %v", err)
+			if code != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -275,55 +353,106 @@ func HandleCreatePaymentIntent(c *gin.Context) {
 
 	order.UserName = newUser.UserName
 
-	var pi *stripe.PaymentIntent
-	if newUser.OrderID != "" {
-		dbOrder, err := db.GetOrder(newUser.OrderID)
+	if req.Installments {
+		order.InstallmentPlan = PlanAvailable(order)
+		if order.InstallmentPlan == 0 {
+			writeJSONError(w, http.StatusBadRequest, "Payment plans aren't available for this order")
+			return
+		}
+	}
 
+	var dbOrder *db.Order
+	if newUser.OrderID != "" {
+		dbOrder, err = db.GetOrder(newUser.OrderID)
 		if err != nil {
+			dbOrder = nil
 			order.OrderID = newUser.OrderID
-			pi, err = handleNewOrder(order, newUser)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
 		}
+	}
 
-		if dbOrder != nil {
-			// if it's successful redirect
-			if dbOrder.PaymentStatus == "success" || dbOrder.PaymentStatus == "processing" {
-				c.Redirect(http.StatusFound, "/checkout-complete")
-				return
-			} else if dbOrder.PaymentStatus == "failed" {
-				c.Redirect(http.StatusFound, "/checkout-failed")
-				return
-			}
-
-			pi, err = handleDbOrder(dbOrder, order, newUser)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	if dbOrder != nil {
+		// if it's successful redirect
+		if dbOrder.PaymentStatus == "success" || dbOrder.PaymentStatus == "processing" {
+			c.Redirect(http.StatusFound, "/checkout-complete")
+			return
+		} else if dbOrder.PaymentStatus == "failed" {
+			c.Redirect(http.StatusFound, "/checkout-failed")
+			return
 		}
-	} else {
-		pi, err = handleNewOrder(order, newUser)
+	}
 
-		if err != nil {
+	// a checkout holds a redemption of its code from here until it's paid for or given up on, so checkouts
+	// running at once can't take a code past its limit
+	var held, reserved string
+	if dbOrder != nil && dbOrder.PaymentStatus == "" {
+		held = dbOrder.PromoCode
+	}
+	if order.PromoCode != "" && !strings.EqualFold(order.PromoCode, held) {
+		err = db.ReserveRedemption(order.PromoCode)
+		if errors.Is(err, db.ErrUsedUp) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("'%s' has been used up", order.PromoCode))
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		reserved = order.PromoCode
+	}
+
+	var pi *stripe.PaymentIntent
+	if dbOrder == nil || dbOrder.PaymentStatus == abandoned {
+		// the sweeper cancels an abandoned order's payment intent, so it starts again
+		pi, err = handleNewOrder(order, newUser)
+	} else {
+		pi, err = handleDbOrder(dbOrder, order, newUser)
+	}
+	if err != nil {
+		if reserved != "" {
+			releasePromo(reserved)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if held != "" && !strings.EqualFold(order.PromoCode, held) {
+		releasePromo(held)
+	}
+
+	var discount float64
+	if order.Discount != nil {
+		discount = order.Discount.ToFloat()
 	}
 
 	writeJSON(w, struct {
 		ClientSecret string  `json:"clientSecret"`
 		Total        float64 `json:"total"`
 		IntentId     string  `json:"intentId"`
+		PromoCode    string  `json:"promoCode"`
+		Discount     float64 `json:"discount"`
+		Installments int     `json:"installments"`
+		PlanOffered  int     `json:"planOffered"`
+		DueNow       float64 `json:"dueNow"`
+		Fee          float64 `json:"fee"`
 	}{
 		ClientSecret: pi.ClientSecret,
 		Total:        order.Total.ToFloat(),
 		IntentId:     pi.ID,
+		PromoCode:    order.PromoCode,
+		Discount:     discount,
+		Installments: order.InstallmentPlan,
+		PlanOffered:  PlanAvailable(order),
+		DueNow:       db.CurrencyFromCents(dueNow(order)).ToFloat(),
+		Fee:          order.ProcessingFee.ToFloat(),
 	})
 }
 
+// releasePromo gives back a redemption a checkout held, logging instead of failing since the checkout's moved on
+func releasePromo(code string) {
+	err := db.ReleaseRedemption(code)
+	if err != nil {
+		log.Errorf("error releasing a redemption of promo code %v: %v", code, err)
+	}
+}
+
 func handleDbOrder(dbOrder *db.Order, order *db.Order, newUser *db.User) (*stripe.PaymentIntent, error) {
 	pi, err := paymentintent.Get(dbOrder.StripeID, nil)
 	if err != nil {
@@ -340,6 +469,14 @@ func handleDbOrder(dbOrder *db.Order, order *db.Order, newUser *db.User) (*strip
 		return pi, nil
 	}
 
+	order.StripeCustomer = dbOrder.StripeCustomer
+	if order.InstallmentPlan > 1 && order.StripeCustomer == "" {
+		order.StripeCustomer, err = newCustomer(newUser)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err = dbOrder.ReplaceCart(order)
 	if err != nil {
 		log.Errorf("Error updating cart %v", err)
@@ -349,9 +486,16 @@ func handleDbOrder(dbOrder *db.Order, order *db.Order, newUser *db.User) (*strip
 	log.Debugf("old order %+v", dbOrder)
 	log.Debugf("new order %+v", order)
 	params := &stripe.PaymentIntentParams{
-		Amount:      stripe.Int64(order.Total.ToCurrencyInt()),
+		Amount:      stripe.Int64(dueNow(order)),
 		Description: stripe.String(fmt.Sprintf("%d tickets to vibecamp", order.TotalTickets)),
 	}
+	if order.InstallmentPlan > 1 {
+		// the deposit saves the card for the rest of the installments
+		params.Customer = stripe.String(order.StripeCustomer)
+		params.SetupFutureUsage = stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession))
+	} else if pi.SetupFutureUsage != "" {
+		params.SetupFutureUsage = stripe.String("")
+	}
 	pi, err = paymentintent.Update(order.StripeID, params)
 	if err != nil {
 		log.Errorf("pi.Update %v", err)
@@ -367,7 +511,7 @@ func handleNewOrder(order *db.Order, newUser *db.User) (*stripe.PaymentIntent, e
 	}
 	// Create a PaymentIntent with amount and currency
 	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(order.Total.ToCurrencyInt()),
+		Amount:   stripe.Int64(dueNow(order)),
 		Currency: stripe.String(string(stripe.CurrencyUSD)),
 		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
 			Enabled: stripe.Bool(true),
@@ -377,6 +521,17 @@ func handleNewOrder(order *db.Order, newUser *db.User) (*stripe.PaymentIntent, e
 		Description:         stripe.String(fmt.Sprintf("%d tickets to vibecamp", order.TotalTickets)),
 	}
 
+	if order.InstallmentPlan > 1 {
+		// the deposit saves the card for the rest of the installments
+		customerID, err := newCustomer(newUser)
+		if err != nil {
+			return nil, err
+		}
+		order.StripeCustomer = customerID
+		params.Customer = stripe.String(customerID)
+		params.SetupFutureUsage = stripe.String(string(stripe.PaymentIntentSetupFutureUsageOffSession))
+	}
+
 	params.AddMetadata("orderId", order.OrderID)
 	// use order id as idempotency key
 	params.SetIdempotencyKey(order.OrderID)
@@ -419,6 +574,17 @@ func writeJSON(w http.ResponseWriter, v interface{}) {
 	}
 }
 
+// writeJSONError sends an error the checkout page shows to the buyer
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{
+		Error: message,
+	})
+}
+
 func AddToKlaviyo(email string, admissionLevel string, donation string) error {
 	klaviyoUrl := "https://a.klaviyo.com/api/v2/list/" + klaviyoListId + "/members?api_key=" + klaviyoKey
 
@@ -455,7 +621,58 @@ func AddToKlaviyo(email string, admissionLevel string, donation string) error {
 	return nil
 }
 
-func CreateCardOrder(c *gin.Context, handle string, quantity int, session *stripe.CheckoutSession) error {
+// NotifyWaitlistOffer adds the person to the klaviyo waitlist list, which has a flow that emails them the offer link
+func NotifyWaitlistOffer(entry *db.WaitlistEntry, offerLink string) error {
+	if klaviyoWaitlistId == "" {
+		log.Debugf("No klaviyo waitlist list, not notifying %s of %s", entry.UserName, offerLink)
+		return nil
+	}
+
+	if entry.Email == "" {
+		return errors.Newf("no email for %s", entry.UserName)
+	}
+
+	klaviyoUrl := "https://a.klaviyo.com/api/v2/list/" + klaviyoWaitlistId + "/members?api_key=" + klaviyoKey
+
+	profile := map[string]interface{}{
+		"email":                  entry.Email,
+		"Waitlist Level":         entry.AdmissionLevel,
+		"Waitlist Tickets":       entry.Quantity,
+		"Waitlist Offer Link":    offerLink,
+		"Waitlist Offer Expires": entry.OfferExpires.In(eastern()).Format("Monday Jan 2 3:04pm MST"),
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{"profiles": []interface{}{profile}})
+	if err != nil {
+		return err
+	}
+
+	req, _ := http.NewRequest("POST", klaviyoUrl, bytes.NewReader(payload))
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return errors.Newf("klaviyo returned %s", res.Status)
+	}
+
+	return nil
+}
+
+func eastern() *time.Location {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func CreateCardOrder(handle string, quantity int, session *stripe.CheckoutSession) error {
 	// fill order in with 0s except for amount, username, & card packs
 	order := &db.Order{
 		TotalTickets:  0,
@@ -463,7 +680,7 @@ func CreateCardOrder(c *gin.Context, handle string, quantity int, session *strip
 		AdultTent:     0,
 		ChildCabin:    0,
 		ChildTent:     0,
-		Total:         db.CurrencyFromFloat(float64(25.44) * float64(quantity)),
+		Total:         db.CurrencyFromFloat(cardPackPrice * float64(quantity)),
 		CardPacks:     quantity,
 		UserName:      handle,
 		ChildSat:      0,
@@ -520,208 +737,157 @@ func HandleStripeWebhook(c *gin.Context) {
 		w.WriteHeader(http.StatusBadRequest) // Return a 400 error on a bad signature
 		return
 	}
-	// Unmarshal the event data into an appropriate struct depending on its Type
-	switch event.Type {
-	case "payment_intent.succeeded":
-		var paymentIntent stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
-		if err != nil {
-			log.Errorf("Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		log.Printf("Successful payment for %d.", paymentIntent.Amount)
 
-		// update order in db to mark as successful payment
-		order, err := db.GetOrderByPaymentID(paymentIntent.ID)
-		if err != nil {
-			log.Errorf("error getting order by payment id: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	record, err := db.RecordWebhookEvent(event.ID, string(event.Type), string(payload))
+	if err != nil {
+		log.Errorf("error recording webhook event %v: %v\n", event.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-		if order.PaymentStatus != "success" {
-			err = order.UpdateOrderStatus("success")
-			if err != nil {
-				log.Errorf("error updating order payment status: %v\n", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+	err = processEvent(record.EventID)
+	if err != nil {
+		log.Errorf("error processing webhook event %v: %v\n", event.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-			if order.TotalTickets > 0 {
+	w.WriteHeader(http.StatusOK)
+}
 
-				user, err := db.GetUser(order.UserName)
-				if err != nil {
-					log.Errorf("error getting user %v\n", err)
-					w.WriteHeader((http.StatusInternalServerError))
-					return
-				}
+// refundOrder gives back whatever a successful order took - tickets, aggregations and bus seats - and offers it to the waitlist
+func refundOrder(order *db.Order, j *journal) error {
+	err := revokeOrder(order, "refunded", j)
+	if err != nil || order.PaymentStatus != "refunded" {
+		return err
+	}
 
-				// update aggregations
-				err = db.UpdateAggregations(order, user.TicketPath)
-				if err != nil {
-					log.Errorf("error updating aggregations %v\n", err)
-					w.WriteHeader((http.StatusInternalServerError))
-					return
-				}
+	return j.step("order-refunded", fmt.Sprintf("run order refunded hooks for order %v", order.OrderID), func() error {
+		return notify(orderRefundedListeners, order)
+	})
+}
 
-				err = user.UpdateTicketId(uuid.NewString())
-				if err != nil {
-					log.Errorf("error updating user ticket id %v\n", err)
-					w.WriteHeader((http.StatusInternalServerError))
-					return
-				}
+// revokeOrder stops a paid order's payment plan and releases it, leaving it with status
+func revokeOrder(order *db.Order, status string, j *journal) error {
+	if order.PaymentStatus != "success" && order.PaymentStatus != partiallyPaid {
+		log.Debugf("Order %v is %v, nothing to revoke", order.OrderID, order.PaymentStatus)
+		return nil
+	}
 
-				if user.Email != "" {
-					err = AddToKlaviyo(user.Email, user.AdmissionLevel, "$"+strconv.Itoa(order.Donation))
-					if err != nil {
-						log.Errorf("Error adding user to klaviyo %v\n", err)
-					}
-				} else {
-					log.Debugf("User does not have an associated email")
-				}
-			} else {
-				if order.BusSpots > 0 || order.SheetSets > 0 || order.Pillows > 0 || order.SleepingBags > 0 {
-					user, err := db.GetUser(order.UserName)
-					if err != nil {
-						log.Errorf("error getting user %v\n", err)
-						w.WriteHeader((http.StatusInternalServerError))
-						return
-					}
+	if order.InstallmentPlan > 1 {
+		err := j.step("installments-cancelled", fmt.Sprintf("cancel the remaining installments on order %v", order.OrderID), func() error {
+			installments, err := db.GetInstallments(order.OrderID)
+			if err != nil {
+				return err
+			}
 
-					err = user.AddTransportAndBeddingOrder(order.BusSpots, order.SleepingBags, order.SheetSets, order.Pillows, order.BusToVibecamp, order.BusFromVibecamp)
+			for _, inst := range installments {
+				if inst.Status == fields.InstallmentScheduled || inst.Status == fields.InstallmentFailed {
+					inst.Status = fields.InstallmentCancelled
+					err = inst.Update()
 					if err != nil {
-						w.WriteHeader((http.StatusInternalServerError))
-						log.Errorf("user.AddTransportAndBeddingOrder: %v", err)
-						return
+						return err
 					}
 				}
 			}
-		} else {
-			log.Debugf("Order %v already marked successful", order.OrderID)
-		}
-		w.WriteHeader(http.StatusOK)
-		return
-	case "payment_intent.processing":
-		var paymentIntent stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+			return nil
+		})
 		if err != nil {
-			log.Errorf("Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return err
 		}
-		log.Printf("Processing payment for %d.", paymentIntent.Amount)
+	}
 
-		// idk do nothing here?
-		order, err := db.GetOrderByPaymentID(paymentIntent.ID)
-		if err != nil {
-			log.Errorf("error getting order by payment id: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	return releaseOrder(order, status, j)
+}
 
-		if order.PaymentStatus == "success" || order.PaymentStatus == "failed" {
-			log.Info("Payment already updated to %v", order.PaymentStatus)
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+// releaseOrder undoes a successful order and leaves it with status
+func releaseOrder(order *db.Order, status string, j *journal) error {
+	user, err := db.GetUser(order.UserName)
+	if err != nil {
+		return err
+	}
 
-		err = order.UpdateOrderStatus("processing")
+	if order.TotalTickets > 0 {
+		err = j.step("aggregations-reversed", fmt.Sprintf("take order %v's %d tickets off the aggregations", order.OrderID, order.TotalTickets), func() error {
+			return db.ReverseAggregations(order, user.TicketPath)
+		})
 		if err != nil {
-			log.Errorf("error updating order payment status: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return err
 		}
 
-		w.WriteHeader(http.StatusOK)
-		return
-	case "payment_intent.payment_failed":
-		var paymentIntent stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+		err = j.step("ticket-id-cleared", fmt.Sprintf("clear @%v's ticket id", user.UserName), func() error {
+			return user.UpdateTicketId("")
+		})
 		if err != nil {
-			log.Errorf("Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return err
 		}
-		log.Printf("Failed payment for %d.", paymentIntent.Amount)
 
-		// update db with failed order
-		// update user to have 0 tickets in table? or just rm from table?
-		order, err := db.GetOrderByPaymentID(paymentIntent.ID)
-		if err != nil {
-			log.Errorf("error getting order by payment id: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		if order.PromoCode != "" {
+			err = j.step("promo-returned", fmt.Sprintf("give back a redemption of promo code %v", order.PromoCode), func() error {
+				return db.AddRedemptions(order.PromoCode, -1)
+			})
+			if err != nil {
+				return err
+			}
 		}
 
-		err = order.UpdateOrderStatus("failed")
-		if err != nil {
-			log.Errorf("error updating order payment status: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		if user.TicketPath == fields.Sponsorship {
+			err = j.step("sponsorship-declined", fmt.Sprintf("mark @%v's sponsorship %v", user.UserName, fields.AwardDeclined), func() error {
+				return setAward(user, fields.AwardDeclined)
+			})
+			if err != nil {
+				return err
+			}
 		}
+	}
 
-		w.WriteHeader(http.StatusOK)
-		return
-	case "payment_intent.created":
-		var paymentIntent stripe.PaymentIntent
-		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+	if order.BusToVibecamp != "" {
+		err = j.step("bus-to-released", fmt.Sprintf("free %d seats on bus %v", order.BusSpots, order.BusToVibecamp), func() error {
+			return db.UpdateSlot(order.BusToVibecamp, -order.BusSpots)
+		})
 		if err != nil {
-			log.Errorf("Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return err
 		}
-		log.Printf("Payment intent created %v", paymentIntent.ID)
-		w.WriteHeader(http.StatusOK)
-		return
-	case "checkout.session.completed":
-		var session stripe.CheckoutSession
-		err := json.Unmarshal(event.Data.Raw, &session)
+	}
+
+	if order.BusFromVibecamp != "" {
+		err = j.step("bus-from-released", fmt.Sprintf("free %d seats on bus %v", order.BusSpots, order.BusFromVibecamp), func() error {
+			return db.UpdateSlot(order.BusFromVibecamp, -order.BusSpots)
+		})
 		if err != nil {
-			log.Errorf("Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return err
 		}
-		log.Printf("Checkout session completed %v", session.ID)
-
-		// check the custom fields to see if Twitter handle is in it
-		// if so, create a card order for them
-
-		if session.CustomFields != nil && len(session.CustomFields) > 0 && session.CustomFields[0].Label.Custom == "Twitter handle" {
-			twitterHandle := session.CustomFields[0].Text.Value
-			quantity := int(session.AmountSubtotal / 2544)
-			err = CreateCardOrder(c, twitterHandle, quantity, &session)
+	}
 
-			if err != nil {
-				log.Errorf("Error creating card order %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}
+	err = j.step("status", fmt.Sprintf("set order %v status to %v", order.OrderID, status), func() error {
+		return order.UpdateOrderStatus(status)
+	})
+	if err != nil {
+		return err
+	}
 
-		w.WriteHeader(http.StatusOK)
-		return
-	default:
-		log.Errorf("Unhandled event type: %s\n", event.Type)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if order.TotalTickets > 0 {
+		j.later(waitlist.Process)
 	}
+
+	return nil
 }
 
-func makeSponsoredOrder(user db.SponsorshipUser) *db.Order {
-	price := float64(420.69)
-	if user.AdmissionLevel != "Tent" {
-		price = float64(140)
+// SponsoredOrder prices quantity adult tickets at the sponsorship's admission level, less its discount
+func SponsoredOrder(user db.SponsorshipUser, quantity int, coverFees bool) *db.Order {
+	price := float64(140)
+	if user.AdmissionLevel == "Tent" {
+		price = float64(420.69)
+	} else if user.AdmissionLevel == "Cabin" {
+		price = float64(ticketPrices["adult-cabin"])
 	}
-	subtotal := price - user.Discount.ToFloat()
-	fee := subtotal * stripeFeePercent
-	total := subtotal + fee
+	discount := user.TicketDiscount(price) * float64(quantity)
+	subtotal := price*float64(quantity) - discount
 	order := &db.Order{
 		OrderID:       "",
 		UserName:      user.UserName,
-		Total:         db.CurrencyFromFloat(total),
-		ProcessingFee: db.CurrencyFromFloat(fee),
-		TotalTickets:  1,
+		Discount:      db.CurrencyFromFloat(discount),
+		TotalTickets:  quantity,
 		AdultCabin:    0,
 		AdultTent:     0,
 		AdultSat:      0,
@@ -739,10 +905,134 @@ func makeSponsoredOrder(user db.SponsorshipUser) *db.Order {
 	}
 
 	if user.AdmissionLevel == "Tent" {
-		order.AdultTent = 1
+		order.AdultTent = quantity
+	} else if user.AdmissionLevel == "Cabin" {
+		order.AdultCabin = quantity
 	} else {
-		order.AdultSat = 1
+		order.AdultSat = quantity
 	}
 
+	applyFee(order, map[string]float64{fees.Tickets: subtotal}, coverFees)
+	order.Total = db.CurrencyFromFloat(subtotal + order.ProcessingFee.ToFloat())
 	return order
 }
+
+// ErrAlreadyOrdered is returned by CompOrder for someone who already has their tickets
+var ErrAlreadyOrdered = errors.New("already has tickets")
+
+// compMutex stops a double submitted comp from issuing tickets twice
+var compMutex sync.Mutex
+
+// CompOrder records a fully sponsored order and issues the ticket without going through stripe. It's refused with
+// ErrAlreadyOrdered if they already have a comped or paid ticket order.
+func CompOrder(order *db.Order, user *db.User) error {
+	if order.Total.ToCurrencyInt() != 0 {
+		return errors.New("only free orders can skip checkout")
+	}
+
+	compMutex.Lock()
+	defer compMutex.Unlock()
+
+	orders, err := db.GetOrdersByUser(user.UserName)
+	if err != nil {
+		return err
+	}
+	for _, o := range orders {
+		if o.TotalTickets > 0 && o.TicketIssued() {
+			return errors.Wrapf(ErrAlreadyOrdered, "@%v has order %v", user.UserName, o.OrderID)
+		}
+	}
+
+	order.OrderID = uuid.NewString()
+	order.UserName = user.UserName
+	order.PaymentStatus = "success"
+	err = order.CreateOrder()
+	if err != nil {
+		return err
+	}
+
+	err = user.UpdateOrderID(order.OrderID)
+	if err != nil {
+		return err
+	}
+
+	return fulfillTickets(order, &journal{})
+}
+
+// fulfillTickets does everything that follows a paid (or comped) ticket order
+func fulfillTickets(order *db.Order, j *journal) error {
+	user, err := db.GetUser(order.UserName)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	err = j.step("aggregations", fmt.Sprintf("add order %v's %d tickets to the aggregations", order.OrderID, order.TotalTickets), func() error {
+		return db.UpdateAggregations(order, user.TicketPath)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = j.step("ticket-id", fmt.Sprintf("give @%v a ticket id", user.UserName), func() error {
+		return user.UpdateTicketId(uuid.NewString())
+	})
+	if err != nil {
+		return err
+	}
+
+	err = j.step("waitlist-claim", fmt.Sprintf("claim @%v's waitlist offer", order.UserName), func() error {
+		return waitlist.Claim(order.UserName)
+	})
+	if err != nil {
+		return err
+	}
+
+	if order.PromoCode != "" {
+		err = j.step("promo-redemption", fmt.Sprintf("redeem promo code %v", order.PromoCode), func() error {
+			return db.RedeemReservation(order.PromoCode)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if user.TicketPath == fields.Sponsorship {
+		err = j.step("sponsorship-confirm", fmt.Sprintf("mark @%v's sponsorship %v", user.UserName, fields.AwardConfirmed), func() error {
+			return setAward(user, fields.AwardConfirmed)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if user.Email != "" {
+		// best effort, a missed mailing list signup isn't worth retrying the order over
+		err = j.step("klaviyo", fmt.Sprintf("add %v to klaviyo", user.Email), func() error {
+			return AddToKlaviyo(user.Email, user.AdmissionLevel, "$"+strconv.Itoa(order.Donation))
+		})
+		if err != nil {
+			log.Errorf("Error adding user to klaviyo %v\n", err)
+		}
+	} else {
+		log.Debugf("User does not have an associated email")
+	}
+
+	return j.step("tickets-issued", fmt.Sprintf("run tickets issued hooks for order %v", order.OrderID), func() error {
+		return notify(ticketsIssuedListeners, order)
+	})
+}
+
+// setAward moves a sponsorship along its lifecycle and keeps the attendee's confirmation checkbox in step
+func setAward(user *db.User, status string) error {
+	sponsoredUser, err := db.GetSponsorshipUser(user.UserName)
+	if err != nil {
+		return err
+	}
+
+	err = sponsoredUser.UpdateAwardStatus(status)
+	if err != nil {
+		return err
+	}
+
+	return user.SetSponsorshipConfirm(status == fields.AwardConfirmed)
+}
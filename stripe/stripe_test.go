@@ -0,0 +1,99 @@
+package stripe
+
+import (
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+)
+
+func TestSponsoredOrder(t *testing.T) {
+	dbtest.New(t)
+
+	tests := []struct {
+		name     string
+		user     db.SponsorshipUser
+		quantity int
+		// in cents
+		discount, fee, total int64
+		cabin, tent, sat     int
+	}{
+		{"fixed discount on tent", db.SponsorshipUser{AdmissionLevel: fields.TentAdmission, Discount: db.CurrencyFromFloat(120.69)}, 2,
+			24138, 1800, 61800, 0, 2, 0},
+		{"fully comped cabin", db.SponsorshipUser{AdmissionLevel: fields.CabinAdmission, Discount: &db.Currency{}, DiscountType: fields.PercentDiscount, DiscountPercent: 100}, 1,
+			59000, 0, 0, 1, 0, 0},
+		{"fixed discount on saturday", db.SponsorshipUser{AdmissionLevel: fields.SatAdmission, Discount: db.CurrencyFromFloat(40)}, 1,
+			4000, 300, 10300, 0, 0, 1},
+		{"discount can't go past the price", db.SponsorshipUser{AdmissionLevel: fields.SatAdmission, Discount: db.CurrencyFromFloat(500)}, 1,
+			14000, 0, 0, 0, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := SponsoredOrder(tt.user, tt.quantity, true)
+			if got := order.Discount.ToCurrencyInt(); got != tt.discount {
+				t.Errorf("discount = %d, want %d", got, tt.discount)
+			}
+			if got := order.ProcessingFee.ToCurrencyInt(); got != tt.fee {
+				t.Errorf("fee = %d, want %d", got, tt.fee)
+			}
+			if got := order.Total.ToCurrencyInt(); got != tt.total {
+				t.Errorf("total = %d, want %d", got, tt.total)
+			}
+			if order.AdultCabin != tt.cabin || order.AdultTent != tt.tent || order.AdultSat != tt.sat || order.TotalTickets != tt.quantity {
+				t.Errorf("tickets = %d cabin, %d tent, %d sat of %d", order.AdultCabin, order.AdultTent, order.AdultSat, order.TotalTickets)
+			}
+		})
+	}
+}
+
+func TestCompOrder(t *testing.T) {
+	s := dbtest.New(t)
+	s.Currency(fields.Total, fields.ProcessingFee, fields.StripeFee, fields.Donation, fields.Discount, fields.Revenue)
+	alice := s.Add(dbtest.Attendees, map[string]interface{}{fields.UserName: "alice", fields.AdmissionLevel: fields.CabinAdmission})
+	sold := s.Add(dbtest.Aggregations, map[string]interface{}{fields.Name: fields.TotalTicketsSold, fields.Quantity: 10, fields.Revenue: "$0.00"})
+	var issued []string
+	defer func(saved []func(*db.Order)) { ticketsIssuedListeners = saved }(ticketsIssuedListeners)
+	OnTicketsIssued(func(order *db.Order) { issued = append(issued, order.UserName) })
+	comp := db.SponsorshipUser{UserName: "alice", AdmissionLevel: fields.CabinAdmission, Discount: &db.Currency{}, DiscountType: fields.PercentDiscount, DiscountPercent: 100}
+
+	user, err := db.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CompOrder(SponsoredOrder(db.SponsorshipUser{UserName: "alice", AdmissionLevel: fields.CabinAdmission, Discount: &db.Currency{}}, 1, true), user); err == nil {
+		t.Error("comped an order that costs something")
+	}
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"comped", nil},
+		// the form submitted twice
+		{"comped again", ErrAlreadyOrdered},
+	}
+
+	for _, tt := range tests {
+		if err := CompOrder(SponsoredOrder(comp, 1, true), user); !errors.Is(err, tt.err) {
+			t.Errorf("%s: CompOrder() = %v, want %v", tt.name, err, tt.err)
+		}
+
+		orders := s.Records(dbtest.Orders)
+		if len(orders) != 1 || orders[0][fields.PaymentStatus] != "success" {
+			t.Fatalf("%s: orders = %v, want one successful order", tt.name, orders)
+		}
+		if got := s.Get(dbtest.Attendees, alice); got[fields.OrderID] != orders[0][fields.OrderID] || got[fields.TicketID] == "" {
+			t.Errorf("%s: alice has order %q and ticket %q", tt.name, got[fields.OrderID], got[fields.TicketID])
+		}
+		if got := s.Get(dbtest.Aggregations, sold)[fields.Quantity]; got != "11" {
+			t.Errorf("%s: tickets sold = %s, want 11", tt.name, got)
+		}
+		if len(issued) != 1 {
+			t.Errorf("%s: tickets issued listeners ran for %v, want alice once", tt.name, issued)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package stripe
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+	"github.com/vibecamp/myvibecamp/waitlist"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/paymentintent"
+)
+
+// eventHandler processes one type of stripe event, running side effects through the journal
+type eventHandler func(event *stripe.Event, j *journal) error
+
+var eventHandlers = map[string]eventHandler{
+	"payment_intent.succeeded":      paymentSucceeded,
+	"payment_intent.processing":     paymentProcessing,
+	"payment_intent.payment_failed": paymentFailed,
+	"payment_intent.created":        paymentCreated,
+	"charge.refunded":               chargeRefunded,
+	"checkout.session.completed":    checkoutSessionCompleted,
+	"charge.dispute.created":        disputeCreated,
+	"charge.dispute.closed":         disputeClosed,
+}
+
+var webhookMutex sync.Mutex
+
+// orderPaidListeners are called once an order's payment goes through
+var orderPaidListeners []func(order *db.Order)
+
+// OnOrderPaid registers fn to run once an order's payment goes through, like sending its receipt
+func OnOrderPaid(fn func(order *db.Order)) {
+	orderPaidListeners = append(orderPaidListeners, fn)
+}
+
+// ticketsIssuedListeners are called once an order's tickets have been given out
+var ticketsIssuedListeners []func(order *db.Order)
+
+// OnTicketsIssued registers fn to run once an order's tickets have been given out
+func OnTicketsIssued(fn func(order *db.Order)) {
+	ticketsIssuedListeners = append(ticketsIssuedListeners, fn)
+}
+
+// orderRefundedListeners are called once a refunded order's been undone
+var orderRefundedListeners []func(order *db.Order)
+
+// OnOrderRefunded registers fn to run once a refunded order's been undone
+func OnOrderRefunded(fn func(order *db.Order)) {
+	orderRefundedListeners = append(orderRefundedListeners, fn)
+}
+
+// paymentFailedListeners are called when an order's payment fails
+var paymentFailedListeners []func(order *db.Order)
+
+// OnPaymentFailed registers fn to run when an order's payment fails
+func OnPaymentFailed(fn func(order *db.Order)) {
+	paymentFailedListeners = append(paymentFailedListeners, fn)
+}
+
+// notify runs the listeners one after another, so the step that calls them isn't finished until they all have. They
+// should be quick, queueing anything slow like email, since the event waits on them.
+func notify(listeners []func(order *db.Order), order *db.Order) error {
+	for _, fn := range listeners {
+		fn(order)
+	}
+	return nil
+}
+
+// journal runs an event's steps, skipping any an earlier attempt already finished, and notes the changes it makes.
+// A journal without an event runs everything, and a dry run only notes what it would change.
+type journal struct {
+	event   stepRecord
+	dryRun  bool
+	changes []string
+}
+
+// stepRecord is where a journal keeps the steps it's finished, a webhook event or an order
+type stepRecord interface {
+	StepDone(step string) bool
+	FinishStep(step string) error
+	// what the steps are for, in the logs
+	String() string
+}
+
+// orderSteps keeps a journal's steps on the order, for work done to it outside a webhook event. Steps are named
+// after the job so one job's steps don't skip another's.
+type orderSteps struct {
+	order *db.Order
+	job   string
+}
+
+func (s orderSteps) StepDone(step string) bool    { return s.order.StepDone(s.job + "/" + step) }
+func (s orderSteps) FinishStep(step string) error { return s.order.FinishStep(s.job + "/" + step) }
+func (s orderSteps) String() string               { return fmt.Sprintf("Order %v's %v", s.order.OrderID, s.job) }
+
+// orderJournal is a journal that saves its steps on order, so doing job again after a failure picks up where it stopped
+func orderJournal(order *db.Order, job string) *journal {
+	return &journal{event: orderSteps{order: order, job: job}}
+}
+
+func (j *journal) done(name string) bool {
+	return j.event != nil && j.event.StepDone(name)
+}
+
+func (j *journal) step(name, change string, fn func() error) error {
+	if j.done(name) {
+		log.Debugf("%v already finished %v", j.event, name)
+		return nil
+	}
+
+	j.changes = append(j.changes, change)
+	if j.dryRun {
+		return nil
+	}
+
+	err := fn()
+	if err != nil {
+		return errors.Wrap(err, name)
+	}
+
+	if j.event == nil {
+		return nil
+	}
+	return j.event.FinishStep(name)
+}
+
+// later runs fn in the background once the event's changes are made, unless it's a dry run
+func (j *journal) later(fn func()) {
+	if !j.dryRun {
+		go fn()
+	}
+}
+
+// processEvent runs a newly stored event through its handler
+func processEvent(eventID string) error {
+	_, err := runEvent(eventID, false, false)
+	return err
+}
+
+// ReplayEvent processes a stored event again against the current code, skipping steps it already finished.
+// It returns the changes made, or for a dry run the changes it would make.
+func ReplayEvent(eventID string, dryRun bool) ([]string, error) {
+	return runEvent(eventID, true, dryRun)
+}
+
+// runEvent runs a stored event through its handler and records how it went. Unknown event types are kept but ignored.
+func runEvent(eventID string, replay, dryRun bool) ([]string, error) {
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+
+	// reload, another delivery of the same event may have got here first
+	record, err := db.GetWebhookEvent(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !replay && (record.Status == fields.EventProcessed || record.Status == fields.EventIgnored) {
+		log.Debugf("Event %v already %v", record.EventID, record.Status)
+		return nil, nil
+	}
+
+	var event stripe.Event
+	err = json.Unmarshal([]byte(record.Payload), &event)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing stored event")
+	}
+
+	handler, ok := eventHandlers[event.Type]
+	if !ok {
+		log.Infof("Ignoring unhandled event type: %s\n", event.Type)
+		if dryRun || record.Status == fields.EventIgnored {
+			return nil, nil
+		}
+		record.Status = fields.EventIgnored
+		return nil, record.Update()
+	}
+
+	j := &journal{event: record, dryRun: dryRun}
+	if dryRun {
+		// steps aren't saved on a dry run, so don't let the journal touch the record
+		j.event = &db.WebhookEvent{EventID: record.EventID, Steps: record.Steps}
+		err = handler(&event, j)
+		return j.changes, err
+	}
+
+	record.Attempts++
+	err = handler(&event, j)
+	if err != nil {
+		record.Status = fields.EventFailed
+		record.LastError = err.Error()
+		if updateErr := record.Update(); updateErr != nil {
+			log.Errorf("error saving failed event %v: %v", record.EventID, updateErr)
+		}
+		return j.changes, err
+	}
+
+	record.Status = fields.EventProcessed
+	record.LastError = ""
+	record.ProcessedAt = time.Now()
+	return j.changes, record.Update()
+}
+
+// RetryWebhookEvents runs every stored event that hasn't finished processing again
+func RetryWebhookEvents() {
+	events, err := db.GetUnfinishedWebhookEvents()
+	if err != nil {
+		log.Errorf("error getting unfinished webhook events: %v", err)
+		return
+	}
+
+	for _, e := range events {
+		// give the request that stored it a chance to finish first
+		if time.Since(e.ReceivedAt) < time.Minute {
+			continue
+		}
+
+		err = processEvent(e.EventID)
+		if err != nil {
+			log.Errorf("retrying webhook event %v (attempt %d): %v", e.EventID, e.Attempts+1, err)
+		}
+	}
+}
+
+// RunWebhookRetries retries unfinished webhook events every interval until the process exits
+func RunWebhookRetries(interval time.Duration) {
+	for range time.Tick(interval) {
+		RetryWebhookEvents()
+	}
+}
+
+func paymentSucceeded(event *stripe.Event, j *journal) error {
+	var paymentIntent stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+	if err != nil {
+		return errors.Wrap(err, "parsing payment intent")
+	}
+	log.Printf("Successful payment for %d.", paymentIntent.Amount)
+
+	if paymentIntent.Metadata["installmentId"] != "" {
+		return j.step("installment-paid", fmt.Sprintf("mark installment %v on order %v paid", paymentIntent.Metadata["installmentId"], paymentIntent.Metadata["orderId"]), func() error {
+			return handleInstallmentEvent(&paymentIntent, true)
+		})
+	}
+
+	// update order in db to mark as successful payment
+	order, err := db.GetOrderByPaymentID(paymentIntent.ID)
+	if err != nil {
+		return errors.Wrap(err, "getting order by payment id")
+	}
+
+	if !j.done("status") && order.TicketIssued() {
+		log.Debugf("Order %v already marked successful", order.OrderID)
+		return nil
+	}
+
+	if order.InstallmentPlan > 1 {
+		err = j.step("payment-plan", fmt.Sprintf("schedule %d installments for order %v", order.InstallmentPlan, order.OrderID), func() error {
+			return startPlan(order, &paymentIntent)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	status := "success"
+	if order.InstallmentPlan > 1 {
+		status = partiallyPaid
+	}
+	err = j.step("status", fmt.Sprintf("set order %v status to %v", order.OrderID, status), func() error {
+		return order.UpdateOrderStatus(status)
+	})
+	if err != nil {
+		return err
+	}
+
+	j.later(func() {
+		if err := recordStripeFee(order, paymentIntent.ID); err != nil {
+			log.Errorf("error recording stripe fee for order %v: %v", order.OrderID, err)
+		}
+	})
+
+	err = j.step("order-paid", fmt.Sprintf("run order paid hooks for order %v, like sending its receipt", order.OrderID), func() error {
+		return notify(orderPaidListeners, order)
+	})
+	if err != nil {
+		return err
+	}
+
+	if order.TotalTickets > 0 {
+		return fulfillTickets(order, j)
+	}
+
+	if order.BusSpots > 0 || order.SheetSets > 0 || order.Pillows > 0 || order.SleepingBags > 0 {
+		return j.step("transport", fmt.Sprintf("add order %v's transport and bedding to @%v", order.OrderID, order.UserName), func() error {
+			user, err := db.GetUser(order.UserName)
+			if err != nil {
+				return err
+			}
+
+			return user.AddTransportAndBeddingOrder(order.BusSpots, order.SleepingBags, order.SheetSets, order.Pillows, order.BusToVibecamp, order.BusFromVibecamp)
+		})
+	}
+
+	return nil
+}
+
+func paymentProcessing(event *stripe.Event, j *journal) error {
+	var paymentIntent stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+	if err != nil {
+		return errors.Wrap(err, "parsing payment intent")
+	}
+	log.Printf("Processing payment for %d.", paymentIntent.Amount)
+
+	if paymentIntent.Metadata["installmentId"] != "" {
+		return nil
+	}
+
+	order, err := db.GetOrderByPaymentID(paymentIntent.ID)
+	if err != nil {
+		return errors.Wrap(err, "getting order by payment id")
+	}
+
+	if order.PaymentStatus == "success" || order.PaymentStatus == "failed" || order.PaymentStatus == partiallyPaid {
+		log.Infof("Payment already updated to %v", order.PaymentStatus)
+		return nil
+	}
+
+	return j.step("status", fmt.Sprintf("set order %v status to processing", order.OrderID), func() error {
+		return order.UpdateOrderStatus("processing")
+	})
+}
+
+func paymentFailed(event *stripe.Event, j *journal) error {
+	var paymentIntent stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+	if err != nil {
+		return errors.Wrap(err, "parsing payment intent")
+	}
+	log.Printf("Failed payment for %d.", paymentIntent.Amount)
+
+	if paymentIntent.Metadata["installmentId"] != "" {
+		return j.step("installment-failed", fmt.Sprintf("mark installment %v on order %v failed", paymentIntent.Metadata["installmentId"], paymentIntent.Metadata["orderId"]), func() error {
+			return handleInstallmentEvent(&paymentIntent, false)
+		})
+	}
+
+	order, err := db.GetOrderByPaymentID(paymentIntent.ID)
+	if err != nil {
+		return errors.Wrap(err, "getting order by payment id")
+	}
+
+	// the order keeps its promo code hold, the same payment intent can be retried and go through. The hold's given
+	// back if the order's abandoned.
+	err = j.step("status", fmt.Sprintf("set order %v status to failed", order.OrderID), func() error {
+		return order.UpdateOrderStatus("failed")
+	})
+	if err != nil {
+		return err
+	}
+
+	err = j.step("payment-failed", fmt.Sprintf("run payment failed hooks for order %v", order.OrderID), func() error {
+		return notify(paymentFailedListeners, order)
+	})
+	if err != nil {
+		return err
+	}
+
+	// anything they were holding goes to the next person
+	j.later(waitlist.Process)
+	return nil
+}
+
+func paymentCreated(event *stripe.Event, j *journal) error {
+	var paymentIntent stripe.PaymentIntent
+	err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+	if err != nil {
+		return errors.Wrap(err, "parsing payment intent")
+	}
+	log.Printf("Payment intent created %v", paymentIntent.ID)
+	return nil
+}
+
+func chargeRefunded(event *stripe.Event, j *journal) error {
+	var charge stripe.Charge
+	err := json.Unmarshal(event.Data.Raw, &charge)
+	if err != nil {
+		return errors.Wrap(err, "parsing charge")
+	}
+
+	if !charge.Refunded || charge.PaymentIntent == nil {
+		log.Printf("Partial refund of %d on %v, leaving order alone", charge.AmountRefunded, charge.ID)
+		return nil
+	}
+	log.Printf("Refunded charge %v", charge.ID)
+
+	order, err := db.GetOrderByPaymentID(charge.PaymentIntent.ID)
+	if err != nil {
+		pi, piErr := paymentintent.Get(charge.PaymentIntent.ID, nil)
+		if piErr == nil && pi.Metadata["installmentId"] != "" {
+			// only the deposit is on the order, refunding one installment doesn't undo it
+			log.Printf("Refunded installment %v on order %v, leaving order alone", pi.Metadata["installmentId"], pi.Metadata["orderId"])
+			return nil
+		}
+
+		return errors.Wrap(err, "getting order by payment id")
+	}
+
+	return refundOrder(order, j)
+}
+
+func checkoutSessionCompleted(event *stripe.Event, j *journal) error {
+	var session stripe.CheckoutSession
+	err := json.Unmarshal(event.Data.Raw, &session)
+	if err != nil {
+		return errors.Wrap(err, "parsing checkout session")
+	}
+	log.Printf("Checkout session completed %v", session.ID)
+
+	// check the custom fields to see if Twitter handle is in it
+	// if so, create a card order for them
+	if len(session.CustomFields) > 0 && session.CustomFields[0].Label.Custom == "Twitter handle" {
+		twitterHandle := session.CustomFields[0].Text.Value
+		quantity := int(session.AmountSubtotal / 2544)
+		return j.step("card-order", fmt.Sprintf("create a card order of %d packs for @%v", quantity, twitterHandle), func() error {
+			return CreateCardOrder(twitterHandle, quantity, &session)
+		})
+	}
+
+	return nil
+}
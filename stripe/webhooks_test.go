@@ -0,0 +1,188 @@
+package stripe
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stripe/stripe-go/v74"
+)
+
+// testSteps is an event handler with two steps, counting how often each runs. The second fails while failing is set.
+type testSteps struct {
+	ran     map[string]int
+	failing bool
+}
+
+func (h *testSteps) handle(event *stripe.Event, j *journal) error {
+	for _, step := range []string{"first", "second"} {
+		step := step
+		err := j.step(step, "did the "+step+" step", func() error {
+			h.ran[step]++
+			if step == "second" && h.failing {
+				return errors.New("stripe is down")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testEvent(t *testing.T, eventID, eventType string) {
+	_, err := db.RecordWebhookEvent(eventID, eventType, `{"id": "`+eventID+`", "object": "event", "type": "`+eventType+`"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventStatus(t *testing.T, eventID string) *db.WebhookEvent {
+	e, err := db.GetWebhookEvent(eventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestRunEventSkipsFinishedSteps(t *testing.T) {
+	dbtest.New(t)
+	h := &testSteps{ran: map[string]int{}, failing: true}
+	eventHandlers["test.steps"] = h.handle
+	defer delete(eventHandlers, "test.steps")
+	testEvent(t, "evt_1", "test.steps")
+
+	tests := []struct {
+		name    string
+		run     func() ([]string, error)
+		failing bool
+		ok      bool
+		status  string
+		changes string
+		// how many times each step has run by the end
+		first, second int
+	}{
+		{"second step fails", func() ([]string, error) { return runEvent("evt_1", false, false) }, true, false, fields.EventFailed, "did the first step,did the second step", 1, 1},
+		{"dry run of what's left", func() ([]string, error) { return ReplayEvent("evt_1", true) }, false, true, fields.EventFailed, "did the second step", 1, 1},
+		{"retried", func() ([]string, error) { return runEvent("evt_1", false, false) }, false, true, fields.EventProcessed, "did the second step", 1, 2},
+		{"delivered again", func() ([]string, error) { return runEvent("evt_1", false, false) }, false, true, fields.EventProcessed, "", 1, 2},
+		{"replayed", func() ([]string, error) { return ReplayEvent("evt_1", false) }, false, true, fields.EventProcessed, "", 1, 2},
+	}
+
+	for _, tt := range tests {
+		h.failing = tt.failing
+		changes, err := tt.run()
+		if (err == nil) != tt.ok {
+			t.Fatalf("%s: error = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if got := strings.Join(changes, ","); got != tt.changes {
+			t.Errorf("%s: changes = %q, want %q", tt.name, got, tt.changes)
+		}
+		if e := eventStatus(t, "evt_1"); e.Status != tt.status {
+			t.Errorf("%s: status = %s, want %s", tt.name, e.Status, tt.status)
+		}
+		if h.ran["first"] != tt.first || h.ran["second"] != tt.second {
+			t.Errorf("%s: steps ran %v, want first %d and second %d", tt.name, h.ran, tt.first, tt.second)
+		}
+	}
+
+	// the dry run doesn't count as an attempt, the replay does
+	e := eventStatus(t, "evt_1")
+	if e.Attempts != 3 || e.LastError != "" || e.ProcessedAt.IsZero() {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+func TestRunEventIgnoresUnknownTypes(t *testing.T) {
+	dbtest.New(t)
+	testEvent(t, "evt_2", "customer.created")
+
+	if err := processEvent("evt_2"); err != nil {
+		t.Fatal(err)
+	}
+	if e := eventStatus(t, "evt_2"); e.Status != fields.EventIgnored {
+		t.Errorf("status = %s, want %s", e.Status, fields.EventIgnored)
+	}
+}
+
+// steps outside a stored event, like a refund made from the admin pages, always run
+func TestJournalWithoutEvent(t *testing.T) {
+	ran := 0
+	j := &journal{}
+	for i := 0; i < 2; i++ {
+		if err := j.step("refund", "refunded", func() error { ran++; return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ran != 2 || len(j.changes) != 2 {
+		t.Errorf("ran %d times with changes %v", ran, j.changes)
+	}
+
+	dryRun := &journal{dryRun: true}
+	if err := dryRun.step("refund", "refunded", func() error { ran++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 2 || len(dryRun.changes) != 1 {
+		t.Errorf("dry run ran the step, or didn't note it: %v", dryRun.changes)
+	}
+}
+
+// the same payment intent can be retried after it fails, so the order keeps its promo code hold until it's abandoned
+func TestPaymentFailedKeepsPromoHold(t *testing.T) {
+	s := dbtest.New(t)
+	promo := s.Add("Promo Codes", map[string]interface{}{fields.Code: "FRIEND", fields.DiscountType: fields.FixedDiscount, fields.Reserved: 1})
+	order := s.Add(dbtest.Orders, map[string]interface{}{fields.OrderID: "order1", fields.UserName: "alice", fields.PaymentID: "pi_1", fields.PromoCode: "FRIEND"})
+
+	event := &stripe.Event{ID: "evt_failed", Type: "payment_intent.payment_failed", Data: &stripe.EventData{Raw: []byte(`{"id": "pi_1", "object": "payment_intent", "amount": 42069}`)}}
+	if err := paymentFailed(event, &journal{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get(dbtest.Orders, order)[fields.PaymentStatus]; got != "failed" {
+		t.Errorf("status = %q, want failed", got)
+	}
+	if got := s.Get("Promo Codes", promo)[fields.Reserved]; got != "1" {
+		t.Errorf("promo held = %s, want 1", got)
+	}
+}
+
+// listeners run inside their step, so the step's only marked finished once they have
+func TestListenersRunInTheirStep(t *testing.T) {
+	s := dbtest.New(t)
+	s.Add(dbtest.Orders, map[string]interface{}{fields.OrderID: "order1", fields.UserName: "alice", fields.PaymentID: "pi_1"})
+	_, err := db.RecordWebhookEvent("evt_failed", "payment_intent.payment_failed",
+		`{"id": "evt_failed", "object": "event", "type": "payment_intent.payment_failed", "data": {"object": {"id": "pi_1", "object": "payment_intent", "amount": 42069}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ran []string
+	defer func(saved []func(*db.Order)) { paymentFailedListeners = saved }(paymentFailedListeners)
+	OnPaymentFailed(func(order *db.Order) {
+		if e := eventStatus(t, "evt_failed"); e.StepDone("payment-failed") {
+			t.Error("the step was finished before the listener ran")
+		}
+		ran = append(ran, order.OrderID)
+	})
+
+	if err := processEvent("evt_failed"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ran, ",") != "order1" {
+		t.Errorf("listener ran for %v, want order1", ran)
+	}
+	if e := eventStatus(t, "evt_failed"); !e.StepDone("payment-failed") {
+		t.Error("the step wasn't finished after the listener ran")
+	}
+
+	if _, err := ReplayEvent("evt_failed", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 1 {
+		t.Errorf("a replay ran the listener again: %v", ran)
+	}
+}
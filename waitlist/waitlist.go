@@ -0,0 +1,295 @@
+package waitlist
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/fields"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Levels are the admission levels people can wait for
+var Levels = []string{fields.CabinAdmission, fields.TentAdmission, fields.SatAdmission}
+
+const defaultOfferHours = 24
+
+var offerURL = ""
+var notify func(entry *db.WaitlistEntry, offerLink string) error
+var processMutex sync.Mutex
+
+// ErrAlreadyWaiting is marked on Join's error when they're already waiting for that admission level
+var ErrAlreadyWaiting = errors.New("already on the waitlist")
+
+// Init sets where offer links point and how offers get sent. notifier is called once per new offer.
+func Init(externalURL string, notifier func(entry *db.WaitlistEntry, offerLink string) error) {
+	offerURL = externalURL + "/waitlist/offer/"
+	notify = notifier
+	db.OnCapacityIncrease(func() { go Process() })
+}
+
+func validLevel(level string) bool {
+	for _, l := range Levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// Join puts an entry at the back of the line for its admission level
+func Join(entry *db.WaitlistEntry) error {
+	if !validLevel(entry.AdmissionLevel) {
+		return errors.Newf("unknown admission level: '%s'", entry.AdmissionLevel)
+	}
+
+	if entry.Quantity < 1 {
+		return errors.New("must wait for at least one ticket")
+	}
+
+	entry.UserName = strings.ToLower(entry.UserName)
+	existing, err := db.GetWaitlistEntries(entry.UserName)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range existing {
+		if e.AdmissionLevel == entry.AdmissionLevel && (e.Status == fields.WaitlistWaiting || e.OfferActive()) {
+			return errors.Mark(errors.Newf("You're already on the %s waitlist", entry.AdmissionLevel), ErrAlreadyWaiting)
+		}
+	}
+
+	entry.Status = fields.WaitlistWaiting
+	return entry.CreateWaitlistEntry()
+}
+
+// Leave takes a user off the waitlist, giving up any offer they hold
+func Leave(userName, airtableID string) error {
+	entries, err := db.GetWaitlistEntries(userName)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.AirtableID != airtableID {
+			continue
+		}
+
+		if e.Status != fields.WaitlistWaiting && e.Status != fields.WaitlistOffered {
+			return errors.New("You're not on that waitlist anymore")
+		}
+
+		released := e.Status == fields.WaitlistOffered
+		err = e.UpdateWaitlistStatus(fields.WaitlistCancelled)
+		if err != nil {
+			return err
+		}
+
+		if released {
+			go Process()
+		}
+		return nil
+	}
+
+	return errors.New("No waitlist entry found")
+}
+
+// Held counts the tickets reserved by live offers at the given levels, not counting exceptUser's own offers
+func Held(exceptUser string, levels ...string) (int, error) {
+	offers, err := db.GetWaitlistEntriesByStatus(fields.WaitlistOffered)
+	if err != nil {
+		return 0, err
+	}
+
+	held := 0
+	for _, e := range offers {
+		if !e.OfferActive() || strings.EqualFold(e.UserName, exceptUser) {
+			continue
+		}
+
+		for _, l := range levels {
+			if e.AdmissionLevel == l {
+				held += e.Quantity
+			}
+		}
+	}
+
+	return held, nil
+}
+
+// Remaining is the number of tickets at a level that are neither sold nor held for an offer
+func Remaining(level string) (int, error) {
+	return RemainingFor("", level)
+}
+
+// RemainingFor is Remaining for a buyer, counting the tickets held by their own offer as theirs to buy
+func RemainingFor(userName, level string) (int, error) {
+	var remaining int
+	var err error
+
+	switch level {
+	case fields.CabinAdmission:
+		full, err := RemainingUnder(userName, fields.SalesCap, fields.FullSold, fields.CabinAdmission, fields.TentAdmission)
+		if err != nil {
+			return 0, err
+		}
+
+		cabin, err := RemainingUnder(userName, fields.CabinCap, fields.CabinSold, fields.CabinAdmission)
+		if err != nil {
+			return 0, err
+		}
+
+		remaining = full
+		if cabin < full {
+			remaining = cabin
+		}
+	case fields.TentAdmission:
+		remaining, err = RemainingUnder(userName, fields.SalesCap, fields.FullSold, fields.CabinAdmission, fields.TentAdmission)
+	case fields.SatAdmission:
+		remaining, err = RemainingUnder(userName, fields.SatCap, fields.SatSold, fields.SatAdmission)
+	default:
+		return 0, errors.Newf("unknown admission level: '%s'", level)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, nil
+}
+
+// RemainingUnder is what's left under one cap after what's sold and what live offers hold, other than userName's
+func RemainingUnder(userName, capName, soldName string, heldLevels ...string) (int, error) {
+	capConst, err := db.GetConstant(capName)
+	if err != nil {
+		return 0, err
+	}
+
+	sold, err := db.GetAggregation(soldName)
+	if err != nil {
+		return 0, err
+	}
+
+	held, err := Held(userName, heldLevels...)
+	if err != nil {
+		return 0, err
+	}
+
+	return capConst.Value - sold.Quantity - held, nil
+}
+
+// Process expires stale offers and makes new ones, in order, while there's room
+func Process() {
+	processMutex.Lock()
+	defer processMutex.Unlock()
+
+	offers, err := db.GetWaitlistEntriesByStatus(fields.WaitlistOffered)
+	if err != nil {
+		log.Errorf("getting waitlist offers: %v", err)
+		return
+	}
+
+	for _, e := range offers {
+		if !e.OfferActive() {
+			log.Infof("waitlist offer for %s expired", e.UserName)
+			err = e.UpdateWaitlistStatus(fields.WaitlistExpired)
+			if err != nil {
+				log.Errorf("expiring waitlist offer: %v", err)
+			}
+		}
+	}
+
+	waiting, err := db.GetWaitlistEntriesByStatus(fields.WaitlistWaiting)
+	if err != nil {
+		log.Errorf("getting waitlist: %v", err)
+		return
+	}
+
+	if len(waiting) == 0 {
+		return
+	}
+
+	for _, level := range Levels {
+		remaining, err := Remaining(level)
+		if err != nil {
+			log.Errorf("getting remaining %s tickets: %v", level, err)
+			continue
+		}
+
+		for _, e := range waiting {
+			if e.AdmissionLevel != level {
+				continue
+			}
+
+			// first come first served, so nobody skips ahead of a bigger request
+			if e.Quantity > remaining {
+				break
+			}
+
+			err = makeOffer(e)
+			if err != nil {
+				log.Errorf("making waitlist offer to %s: %v", e.UserName, err)
+				break
+			}
+			remaining -= e.Quantity
+		}
+	}
+}
+
+func makeOffer(e *db.WaitlistEntry) error {
+	hours := defaultOfferHours
+	c, err := db.GetConstant(fields.WaitlistOfferHours)
+	if err == nil && c.Value > 0 {
+		hours = c.Value
+	}
+
+	err = e.MakeOffer(uuid.NewString(), time.Now().Add(time.Duration(hours)*time.Hour))
+	if err != nil {
+		return err
+	}
+
+	log.Infof("waitlist offer made to %s for %d %s tickets", e.UserName, e.Quantity, e.AdmissionLevel)
+
+	if notify != nil {
+		err = notify(e, offerURL+e.OfferToken)
+		if err != nil {
+			// the offer stands, they can still see it on the waitlist page
+			log.Errorf("notifying %s of waitlist offer: %v", e.UserName, err)
+		}
+	}
+
+	return nil
+}
+
+// Claim marks a user's live offers as used once they've paid
+func Claim(userName string) error {
+	entries, err := db.GetWaitlistEntries(userName)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.Status == fields.WaitlistOffered {
+			err = e.UpdateWaitlistStatus(fields.WaitlistPurchased)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run processes the waitlist every interval until the process exits
+func Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		Process()
+	}
+}
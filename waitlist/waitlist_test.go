@@ -0,0 +1,173 @@
+package waitlist
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vibecamp/myvibecamp/db"
+	"github.com/vibecamp/myvibecamp/db/dbtest"
+	"github.com/vibecamp/myvibecamp/fields"
+)
+
+const waitlistTable = "Waitlist"
+
+// testCaps fills in the caps and what's sold against them
+func testCaps(s *dbtest.Server, caps, sold map[string]int) {
+	for name, value := range caps {
+		s.Add(dbtest.Constants, map[string]interface{}{fields.Name: name, fields.Value: value})
+	}
+	for name, quantity := range sold {
+		s.Add(dbtest.Aggregations, map[string]interface{}{fields.Name: name, fields.Quantity: quantity, fields.Revenue: "$0.00"})
+	}
+}
+
+func addEntry(s *dbtest.Server, userName, level string, quantity int, status string, expires time.Time) string {
+	f := map[string]interface{}{
+		fields.UserName:         userName,
+		fields.AdmissionLevel:   level,
+		fields.TicketsRequested: quantity,
+		fields.WaitlistStatus:   status,
+	}
+	if !expires.IsZero() {
+		f[fields.OfferExpires] = expires.Format(time.RFC3339)
+	}
+	return s.Add(waitlistTable, f)
+}
+
+func TestRemainingFor(t *testing.T) {
+	s := dbtest.New(t)
+	testCaps(s,
+		map[string]int{fields.SalesCap: 10, fields.CabinCap: 4, fields.SatCap: 5},
+		map[string]int{fields.FullSold: 6, fields.CabinSold: 1, fields.SatSold: 5})
+	hour := time.Now().Add(time.Hour)
+	addEntry(s, "bob", fields.CabinAdmission, 2, fields.WaitlistOffered, hour)
+	addEntry(s, "carol", fields.TentAdmission, 1, fields.WaitlistOffered, time.Now().Add(-time.Hour))
+	addEntry(s, "dave", fields.SatAdmission, 1, fields.WaitlistOffered, hour)
+	addEntry(s, "erin", fields.TentAdmission, 3, fields.WaitlistWaiting, time.Time{})
+
+	tests := []struct {
+		name     string
+		userName string
+		level    string
+		want     int
+		ok       bool
+	}{
+		// the cabin cap is the tighter one: 4 - 1 sold - 2 held for bob
+		{"cabin", "", fields.CabinAdmission, 1, true},
+		{"cabin for bob", "Bob", fields.CabinAdmission, 3, true},
+		// bob's cabin offer comes out of the full cap too, carol's has expired and erin's only waiting
+		{"tent", "", fields.TentAdmission, 2, true},
+		{"tent for bob", "bob", fields.TentAdmission, 4, true},
+		{"tent for carol", "carol", fields.TentAdmission, 2, true},
+		{"saturday, oversold by dave's offer", "", fields.SatAdmission, 0, true},
+		{"saturday for dave", "dave", fields.SatAdmission, 0, true},
+		{"unknown level", "", "Backstage", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RemainingFor(tt.userName, tt.level)
+			if (err == nil) != tt.ok {
+				t.Fatalf("RemainingFor() error = %v, want ok %v", err, tt.ok)
+			}
+			if got != tt.want {
+				t.Errorf("RemainingFor(%q, %q) = %d, want %d", tt.userName, tt.level, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoin(t *testing.T) {
+	s := dbtest.New(t)
+	addEntry(s, "alice", fields.TentAdmission, 1, fields.WaitlistWaiting, time.Time{})
+	addEntry(s, "bob", fields.TentAdmission, 1, fields.WaitlistOffered, time.Now().Add(time.Hour))
+	addEntry(s, "carol", fields.TentAdmission, 1, fields.WaitlistExpired, time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name  string
+		entry db.WaitlistEntry
+		ok    bool
+	}{
+		{"new", db.WaitlistEntry{UserName: "Dave", AdmissionLevel: fields.TentAdmission, Quantity: 2}, true},
+		{"unknown level", db.WaitlistEntry{UserName: "erin", AdmissionLevel: "Backstage", Quantity: 1}, false},
+		{"no tickets", db.WaitlistEntry{UserName: "erin", AdmissionLevel: fields.TentAdmission}, false},
+		{"already waiting", db.WaitlistEntry{UserName: "Alice", AdmissionLevel: fields.TentAdmission, Quantity: 1}, false},
+		{"already waiting for another level", db.WaitlistEntry{UserName: "alice", AdmissionLevel: fields.CabinAdmission, Quantity: 1}, true},
+		{"holding an offer", db.WaitlistEntry{UserName: "bob", AdmissionLevel: fields.TentAdmission, Quantity: 1}, false},
+		{"offer expired", db.WaitlistEntry{UserName: "carol", AdmissionLevel: fields.TentAdmission, Quantity: 1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Join(&tt.entry)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Join() error = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && (tt.entry.UserName != strings.ToLower(tt.entry.UserName) || tt.entry.Status != fields.WaitlistWaiting) {
+				t.Errorf("joined as %s, %s", tt.entry.UserName, tt.entry.Status)
+			}
+		})
+	}
+}
+
+func TestProcess(t *testing.T) {
+	s := dbtest.New(t)
+	testCaps(s,
+		map[string]int{fields.SalesCap: 10, fields.CabinCap: 4, fields.SatCap: 5, fields.WaitlistOfferHours: 48},
+		map[string]int{fields.FullSold: 7, fields.CabinSold: 4, fields.SatSold: 4})
+
+	stale := addEntry(s, "old", fields.TentAdmission, 1, fields.WaitlistOffered, time.Now().Add(-time.Minute))
+	alice := addEntry(s, "alice", fields.TentAdmission, 2, fields.WaitlistWaiting, time.Time{})
+	// only one tent ticket is left after alice's, bob asked for two and carol behind him has to wait her turn
+	bob := addEntry(s, "bob", fields.TentAdmission, 2, fields.WaitlistWaiting, time.Time{})
+	carol := addEntry(s, "carol", fields.TentAdmission, 1, fields.WaitlistWaiting, time.Time{})
+	dave := addEntry(s, "dave", fields.CabinAdmission, 1, fields.WaitlistWaiting, time.Time{})
+	erin := addEntry(s, "erin", fields.SatAdmission, 1, fields.WaitlistWaiting, time.Time{})
+
+	notified := map[string]string{}
+	Init("https://my.vibe.camp", func(e *db.WaitlistEntry, offerLink string) error {
+		notified[e.UserName] = offerLink
+		return nil
+	})
+	defer Init("", nil)
+	Process()
+
+	want := map[string]string{
+		stale: fields.WaitlistExpired,
+		alice: fields.WaitlistOffered,
+		bob:   fields.WaitlistWaiting,
+		carol: fields.WaitlistWaiting,
+		dave:  fields.WaitlistWaiting,
+		erin:  fields.WaitlistOffered,
+	}
+	for id, status := range want {
+		rec := s.Get(waitlistTable, id)
+		if rec[fields.WaitlistStatus] != status {
+			t.Errorf("%s is %s, want %s", rec[fields.UserName], rec[fields.WaitlistStatus], status)
+		}
+		if status != fields.WaitlistOffered {
+			continue
+		}
+
+		link := notified[rec[fields.UserName]]
+		if rec[fields.OfferToken] == "" || link != "https://my.vibe.camp/waitlist/offer/"+rec[fields.OfferToken] {
+			t.Errorf("%s was sent %q for offer %q", rec[fields.UserName], link, rec[fields.OfferToken])
+		}
+		expires, _ := time.Parse(time.RFC3339, rec[fields.OfferExpires])
+		if until := time.Until(expires); until < 47*time.Hour || until > 48*time.Hour {
+			t.Errorf("%s's offer expires in %v, want 48 hours", rec[fields.UserName], until)
+		}
+	}
+	if len(notified) != 2 {
+		t.Errorf("notified %v", notified)
+	}
+
+	// alice pays, and her offer is used up rather than going back to the pool
+	if err := Claim("Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get(waitlistTable, alice)[fields.WaitlistStatus]; got != fields.WaitlistPurchased {
+		t.Errorf("alice's offer is %s after paying", got)
+	}
+}